@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"ikedadada/go-ptor/cmd/client/usecase"
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// mappedAddressTTL is the TTL, in seconds, of answers for hidden services.
+// Their virtual addresses do not change while the client runs.
+const mappedAddressTTL = 300
+
+// maxUDPDNSSize is the largest reply sent over UDP (RFC 1035 section
+// 4.2.1). Larger replies are truncated so the application retries over TCP.
+const maxUDPDNSSize = 512
+
+// HostResolver looks host names up through the network.
+type HostResolver interface {
+	// Resolve returns the addresses an exit found for host, asked on a
+	// circuit chosen for isolationKey.
+	Resolve(host, isolationKey string) ([]vo.ResolvedAnswer, error)
+}
+
+var _ HostResolver = (*SOCKS5Controller)(nil)
+
+// DNSController answers the DNS queries of applications that resolve names
+// themselves, so that their lookups do not leak outside the network. A and
+// AAAA queries are resolved at an exit. Hidden service names get virtual
+// addresses, which the SOCKS port maps back to the service.
+type DNSController struct {
+	resolver HostResolver
+	mapUC    usecase.MapAddressUseCase
+}
+
+// NewDNSController creates a new DNSController
+func NewDNSController(resolver HostResolver, mapUC usecase.MapAddressUseCase) *DNSController {
+	return &DNSController{resolver: resolver, mapUC: mapUC}
+}
+
+// ServePacket answers the queries arriving on pc until it is closed.
+func (c *DNSController) ServePacket(pc net.PacketConn) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Printf("read DNS query: %v", err)
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if reply, ok := c.answer(query, maxUDPDNSSize); ok {
+				pc.WriteTo(reply, addr)
+			}
+		}()
+	}
+}
+
+// HandleConnection answers the queries of a DNS over TCP connection, each
+// framed by a two byte length, until the application closes it.
+func (c *DNSController) HandleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	var size [2]byte
+	for {
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			log.Printf("read DNS query: %v", err)
+			return
+		}
+		reply, ok := c.answer(query, 0)
+		if !ok {
+			return
+		}
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(reply)))); err != nil {
+			return
+		}
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+// answer returns the reply to query, truncated to maxSize bytes unless
+// maxSize is zero. Messages that cannot be parsed, or are not queries, get
+// no reply.
+func (c *DNSController) answer(query []byte, maxSize int) ([]byte, bool) {
+	q, err := vo.DNSMessageFrom(query)
+	if err != nil || q.Response {
+		log.Printf("drop DNS message: %v", err)
+		return nil, false
+	}
+	reply := &vo.DNSMessage{
+		ID:                 q.ID,
+		Response:           true,
+		Opcode:             q.Opcode,
+		RecursionDesired:   q.RecursionDesired,
+		RecursionAvailable: true,
+		Questions:          q.Questions,
+	}
+	switch {
+	case q.Opcode != 0: // only standard queries
+		reply.RCode = vo.DNSRCodeNotImplemented
+	case len(q.Questions) != 1:
+		reply.RCode = vo.DNSRCodeFormatError
+	default:
+		reply.RCode, reply.Answers = c.lookup(q.Questions[0])
+	}
+
+	b, err := reply.Bytes()
+	for err == nil && maxSize > 0 && len(b) > maxSize && len(reply.Answers) > 0 {
+		reply.Answers = reply.Answers[:len(reply.Answers)-1]
+		reply.Truncated = true
+		b, err = reply.Bytes()
+	}
+	if err != nil {
+		log.Printf("encode DNS reply: %v", err)
+		return nil, false
+	}
+	return b, true
+}
+
+// lookup answers a single question.
+func (c *DNSController) lookup(q vo.DNSQuestion) (uint8, []vo.DNSRecord) {
+	if q.Class != vo.DNSClassINET || (q.Type != vo.DNSTypeA && q.Type != vo.DNSTypeAAAA) {
+		return vo.DNSRCodeNotImplemented, nil
+	}
+	ipv6 := q.Type == vo.DNSTypeAAAA
+
+	if strings.HasSuffix(strings.ToLower(q.Name), ".ptor") {
+		out, err := c.mapUC.Handle(usecase.MapAddressInput{Host: q.Name, IPv6: ipv6})
+		if err != nil {
+			log.Printf("map %s: %v", q.Name, err)
+			return vo.DNSRCodeNameError, nil
+		}
+		return vo.DNSRCodeSuccess, []vo.DNSRecord{dnsAddressRecord(q, out.IP, mappedAddressTTL)}
+	}
+
+	// DNS queries carry no credentials, so they share the circuits of
+	// streams without any
+	answers, err := c.resolver.Resolve(q.Name, "")
+	if err != nil {
+		log.Printf("resolve %s: %v", q.Name, err)
+		var refused *entity.StreamRefusedError
+		if errors.Is(err, errUnresolvable) || (errors.As(err, &refused) && refused.Reason == vo.EndReasonResolveFailed) {
+			return vo.DNSRCodeNameError, nil
+		}
+		return vo.DNSRCodeServerFailure, nil
+	}
+	// the exit answers with both families; a name without addresses of
+	// the asked one gets an empty answer
+	var records []vo.DNSRecord
+	for _, a := range answers {
+		if (a.IP.To4() == nil) == ipv6 {
+			records = append(records, dnsAddressRecord(q, a.IP, uint32(a.TTL/time.Second)))
+		}
+	}
+	return vo.DNSRCodeSuccess, records
+}
+
+// dnsAddressRecord returns the A or AAAA record answering q with ip.
+func dnsAddressRecord(q vo.DNSQuestion, ip net.IP, ttl uint32) vo.DNSRecord {
+	data := ip.To16()
+	if q.Type == vo.DNSTypeA {
+		data = ip.To4()
+	}
+	return vo.DNSRecord{Name: q.Name, Type: q.Type, Class: vo.DNSClassINET, TTL: ttl, Data: data}
+}
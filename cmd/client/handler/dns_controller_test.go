@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"ikedadada/go-ptor/cmd/client/usecase"
+	"ikedadada/go-ptor/shared/domain/entity"
+	"ikedadada/go-ptor/shared/domain/repository"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+type mockHostResolver struct {
+	answers []vo.ResolvedAnswer
+	err     error
+	hosts   []string
+}
+
+func (m *mockHostResolver) Resolve(host, isolationKey string) ([]vo.ResolvedAnswer, error) {
+	m.hosts = append(m.hosts, host)
+	return m.answers, m.err
+}
+
+type mockMapAddressUseCase struct{}
+
+func (m *mockMapAddressUseCase) Handle(in usecase.MapAddressInput) (usecase.MapAddressOutput, error) {
+	if !strings.EqualFold(in.Host, "known.ptor") {
+		return usecase.MapAddressOutput{}, repository.ErrNotFound
+	}
+	if in.IPv6 {
+		return usecase.MapAddressOutput{IP: net.ParseIP("fe80::1")}, nil
+	}
+	return usecase.MapAddressOutput{IP: net.IPv4(127, 192, 0, 1)}, nil
+}
+
+func dnsQuery(t *testing.T, name string, qtype uint16) []byte {
+	t.Helper()
+	b, err := (&vo.DNSMessage{
+		ID:               0x1234,
+		RecursionDesired: true,
+		Questions:        []vo.DNSQuestion{{Name: name, Type: qtype, Class: vo.DNSClassINET}},
+	}).Bytes()
+	if err != nil {
+		t.Fatalf("encode query: %v", err)
+	}
+	return b
+}
+
+func TestDNSController_Answer(t *testing.T) {
+	exitAnswers := []vo.ResolvedAnswer{
+		{IP: net.IPv4(192, 0, 2, 1), TTL: 90 * time.Second},
+		{IP: net.ParseIP("2001:db8::1"), TTL: 30 * time.Second},
+	}
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		resolver  *mockHostResolver
+		wantRCode uint8
+		wantData  []byte
+		wantTTL   uint32
+	}{
+		{"A at the exit", "example.com", vo.DNSTypeA, &mockHostResolver{answers: exitAnswers}, vo.DNSRCodeSuccess, []byte{192, 0, 2, 1}, 90},
+		{"AAAA at the exit", "example.com", vo.DNSTypeAAAA, &mockHostResolver{answers: exitAnswers}, vo.DNSRCodeSuccess, net.ParseIP("2001:db8::1"), 30},
+		{"no address of the family", "example.com", vo.DNSTypeAAAA, &mockHostResolver{answers: exitAnswers[:1]}, vo.DNSRCodeSuccess, nil, 0},
+		{"resolve failed", "nowhere.example", vo.DNSTypeA, &mockHostResolver{err: &entity.StreamRefusedError{Reason: vo.EndReasonResolveFailed}}, vo.DNSRCodeNameError, nil, 0},
+		{"circuit failed", "example.com", vo.DNSTypeA, &mockHostResolver{err: errors.New("acquire circuit: no relays")}, vo.DNSRCodeServerFailure, nil, 0},
+		{"hidden service", "Known.ptor", vo.DNSTypeA, &mockHostResolver{}, vo.DNSRCodeSuccess, []byte{127, 192, 0, 1}, mappedAddressTTL},
+		{"unknown hidden service", "unknown.ptor", vo.DNSTypeA, &mockHostResolver{}, vo.DNSRCodeNameError, nil, 0},
+		{"other type", "example.com", 15, &mockHostResolver{}, vo.DNSRCodeNotImplemented, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewDNSController(tt.resolver, &mockMapAddressUseCase{})
+			b, ok := c.answer(dnsQuery(t, tt.qname, tt.qtype), maxUDPDNSSize)
+			if !ok {
+				t.Fatal("no reply")
+			}
+			reply, err := vo.DNSMessageFrom(b)
+			if err != nil {
+				t.Fatalf("decode reply: %v", err)
+			}
+			if reply.ID != 0x1234 || !reply.Response || !reply.RecursionDesired || len(reply.Questions) != 1 {
+				t.Errorf("reply header %+v does not match the query", reply)
+			}
+			if reply.RCode != tt.wantRCode {
+				t.Errorf("rcode = %d, want %d", reply.RCode, tt.wantRCode)
+			}
+			if tt.wantData == nil {
+				if len(reply.Answers) != 0 {
+					t.Errorf("answers = %+v, want none", reply.Answers)
+				}
+				return
+			}
+			if len(reply.Answers) != 1 {
+				t.Fatalf("answers = %+v, want one", reply.Answers)
+			}
+			a := reply.Answers[0]
+			if a.Type != tt.qtype || !net.IP(a.Data).Equal(net.IP(tt.wantData)) || a.TTL != tt.wantTTL {
+				t.Errorf("answer type=%d data=%v ttl=%d, want type=%d data=%v ttl=%d", a.Type, net.IP(a.Data), a.TTL, tt.qtype, net.IP(tt.wantData), tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestDNSController_TruncatesUDPReplies(t *testing.T) {
+	var answers []vo.ResolvedAnswer
+	for i := 0; i < 64; i++ {
+		answers = append(answers, vo.ResolvedAnswer{IP: net.IPv4(192, 0, 2, byte(i)), TTL: time.Minute})
+	}
+	c := NewDNSController(&mockHostResolver{answers: answers}, &mockMapAddressUseCase{})
+	query := dnsQuery(t, "many.example", vo.DNSTypeA)
+
+	b, _ := c.answer(query, maxUDPDNSSize)
+	reply, err := vo.DNSMessageFrom(b)
+	if err != nil {
+		t.Fatalf("decode reply: %v", err)
+	}
+	if len(b) > maxUDPDNSSize || !reply.Truncated || len(reply.Answers) == 0 {
+		t.Errorf("udp reply of %d bytes with %d answers, truncated=%v", len(b), len(reply.Answers), reply.Truncated)
+	}
+
+	b, _ = c.answer(query, 0)
+	if reply, _ = vo.DNSMessageFrom(b); reply.Truncated || len(reply.Answers) != len(answers) {
+		t.Errorf("tcp reply with %d answers, truncated=%v", len(reply.Answers), reply.Truncated)
+	}
+}
+
+func TestDNSController_HandleConnection(t *testing.T) {
+	c := NewDNSController(&mockHostResolver{}, &mockMapAddressUseCase{})
+	client, server := net.Pipe()
+	go c.HandleConnection(server)
+	defer client.Close()
+
+	// two queries on one connection, each framed by its length
+	for _, qtype := range []uint16{vo.DNSTypeA, vo.DNSTypeAAAA} {
+		query := dnsQuery(t, "known.ptor", qtype)
+		go client.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...))
+
+		var size [2]byte
+		if _, err := io.ReadFull(client, size[:]); err != nil {
+			t.Fatalf("read length: %v", err)
+		}
+		b := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(client, b); err != nil {
+			t.Fatalf("read reply: %v", err)
+		}
+		reply, err := vo.DNSMessageFrom(b)
+		if err != nil {
+			t.Fatalf("decode reply: %v", err)
+		}
+		if len(reply.Answers) != 1 || reply.Answers[0].Type != qtype {
+			t.Errorf("answers = %+v, want one of type %d", reply.Answers, qtype)
+		}
+	}
+}
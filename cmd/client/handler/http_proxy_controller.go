@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// hopByHopHeaders are the headers that concern only the connection to the
+// proxy and are not passed on to the target.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// HTTPProxyController handles HTTP proxy connections. CONNECT requests
+// become tunnels; plain requests in absolute form, which most HTTP clients
+// send for http:// URLs, are passed to the target in origin form over a
+// stream of their own. It only parses requests; the streams go through the
+// connector's pipeline.
+type HTTPProxyController struct {
+	connector StreamConnector
+}
+
+// NewHTTPProxyController creates a new HTTPProxyController
+func NewHTTPProxyController(connector StreamConnector) *HTTPProxyController {
+	return &HTTPProxyController{connector: connector}
+}
+
+// bufferedConn reads what a frontend read ahead of the stream data before
+// reading more from the connection.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// HandleConnection handles an HTTP proxy connection
+func (c *HTTPProxyController) HandleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		log.Printf("read HTTP proxy request: %v", err)
+		writeHTTPStatus(conn, http.StatusBadRequest)
+		return
+	}
+	user, pass := proxyCredentials(req)
+
+	if req.Method == http.MethodConnect {
+		host, port, err := splitTarget(req.Host, 0)
+		if err != nil {
+			log.Printf("HTTP CONNECT target %q: %v", req.Host, err)
+			writeHTTPStatus(conn, http.StatusBadRequest)
+			return
+		}
+		log.Printf("HTTP CONNECT completed, target: %s:%d", host, port)
+		c.connector.Connect(&bufferedConn{Conn: conn, r: br}, ConnectRequest{Host: host, Port: port, Username: user, Password: pass}, func(bound *net.TCPAddr, err error) {
+			if err != nil {
+				writeHTTPStatus(conn, httpFailureStatus(err))
+				return
+			}
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		})
+		return
+	}
+
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+		log.Printf("HTTP proxy request for %q is not an absolute http URL", req.RequestURI)
+		writeHTTPStatus(conn, http.StatusBadRequest)
+		return
+	}
+	host, port, err := splitTarget(req.URL.Host, 80)
+	if err != nil {
+		log.Printf("HTTP proxy target %q: %v", req.URL.Host, err)
+		writeHTTPStatus(conn, http.StatusBadRequest)
+		return
+	}
+	log.Printf("HTTP proxy request completed, target: %s:%d", host, port)
+
+	// The stream carries this one request: the target closes it after the
+	// response, which tells the application not to reuse the connection.
+	// The body follows unchanged from the buffered reader.
+	head := originFormHead(req)
+	c.connector.Connect(&bufferedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(head), br)}, ConnectRequest{Host: host, Port: port, Username: user, Password: pass}, func(_ *net.TCPAddr, err error) {
+		if err != nil {
+			writeHTTPStatus(conn, httpFailureStatus(err))
+		}
+	})
+}
+
+// originFormHead returns the request line and headers of req as the target
+// should see them: in origin form, without hop-by-hop headers, asking the
+// target to close the connection after the response.
+func originFormHead(req *http.Request) []byte {
+	header := req.Header.Clone()
+	for _, h := range hopByHopHeaders {
+		header.Del(h)
+	}
+	header.Set("Connection", "close")
+	if len(req.TransferEncoding) > 0 {
+		// ReadRequest moves Transfer-Encoding out of the header
+		header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	header.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// splitTarget splits a host[:port] authority, using defaultPort if it has
+// no port. A zero defaultPort makes the port mandatory.
+func splitTarget(authority string, defaultPort int) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(authority)
+	if err != nil {
+		if defaultPort == 0 {
+			return "", 0, err
+		}
+		// no port: strip the brackets of an IPv6 literal
+		return strings.TrimSuffix(strings.TrimPrefix(authority, "["), "]"), defaultPort, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 0xFFFF {
+		return "", 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	return host, port, nil
+}
+
+// proxyCredentials returns the Basic credentials of the
+// Proxy-Authorization header. Like SOCKS credentials they only serve as an
+// isolation key.
+func proxyCredentials(req *http.Request) (user, pass string) {
+	auth, ok := strings.CutPrefix(req.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return "", ""
+	}
+	raw, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return "", ""
+	}
+	user, pass, _ = strings.Cut(string(raw), ":")
+	return user, pass
+}
+
+// httpFailureStatus maps a failed stream to the status for the
+// application: forbidden if the exit's policy refused the target, gateway
+// timeout if the exit never answered, bad gateway otherwise.
+func httpFailureStatus(err error) int {
+	var refused *entity.StreamRefusedError
+	switch {
+	case errors.As(err, &refused) && refused.Reason == vo.EndReasonExitPolicy:
+		return http.StatusForbidden
+	case errors.Is(err, entity.ErrBeginTimeout):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// writeHTTPStatus answers with an empty response carrying code.
+func writeHTTPStatus(w io.Writer, code int) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+}
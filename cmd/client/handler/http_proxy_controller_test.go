@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+func TestHTTPProxyController_HandleConnection_Connect(t *testing.T) {
+	conn := &mockConnection{readData: []byte("CONNECT example.ptor:443 HTTP/1.1\r\n" +
+		"Host: example.ptor:443\r\n" +
+		"Proxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n\r\n" +
+		"tls bytes")}
+	connector := &mockStreamConnector{}
+	NewHTTPProxyController(connector).HandleConnection(conn)
+
+	if len(connector.calls) != 1 {
+		t.Fatalf("connect calls = %d, want 1", len(connector.calls))
+	}
+	want := ConnectRequest{Host: "example.ptor", Port: 443, Username: "alice", Password: "secret"}
+	if connector.calls[0] != want {
+		t.Errorf("request = %+v, want %+v", connector.calls[0], want)
+	}
+	if string(connector.data) != "tls bytes" {
+		t.Errorf("stream data = %q, want %q", connector.data, "tls bytes")
+	}
+	if got := conn.writeData.String(); got != "HTTP/1.1 200 Connection established\r\n\r\n" {
+		t.Errorf("reply = %q", got)
+	}
+}
+
+func TestHTTPProxyController_HandleConnection_AbsoluteForm(t *testing.T) {
+	conn := &mockConnection{readData: []byte("POST http://example.ptor/upload?x=1 HTTP/1.1\r\n" +
+		"Host: example.ptor\r\n" +
+		"Proxy-Connection: keep-alive\r\n" +
+		"Content-Length: 4\r\n\r\n" +
+		"body")}
+	connector := &mockStreamConnector{}
+	NewHTTPProxyController(connector).HandleConnection(conn)
+
+	if len(connector.calls) != 1 {
+		t.Fatalf("connect calls = %d, want 1", len(connector.calls))
+	}
+	if got := connector.calls[0]; got.Host != "example.ptor" || got.Port != 80 {
+		t.Errorf("target = %s:%d, want example.ptor:80", got.Host, got.Port)
+	}
+	if conn.writeData.Len() != 0 {
+		t.Errorf("proxy answered itself: %q", conn.writeData.String())
+	}
+
+	// the target sees an origin form request with the body
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(connector.data)))
+	if err != nil {
+		t.Fatalf("forwarded request: %v\n%s", err, connector.data)
+	}
+	if req.Method != http.MethodPost || req.RequestURI != "/upload?x=1" || req.Host != "example.ptor" {
+		t.Errorf("forwarded %s %s for %s", req.Method, req.RequestURI, req.Host)
+	}
+	if req.Header.Get("Proxy-Connection") != "" || !req.Close {
+		t.Errorf("forwarded header = %v", req.Header)
+	}
+	if body, err := io.ReadAll(req.Body); err != nil || string(body) != "body" {
+		t.Errorf("forwarded body = %q (%v)", body, err)
+	}
+}
+
+func TestHTTPProxyController_HandleConnection_Failure(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		err     error
+		want    int
+	}{
+		{"exit policy", "CONNECT example.com:25 HTTP/1.1\r\nHost: example.com:25\r\n\r\n", &entity.StreamRefusedError{Reason: vo.EndReasonExitPolicy}, http.StatusForbidden},
+		{"timeout", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", entity.ErrBeginTimeout, http.StatusGatewayTimeout},
+		{"unresolvable", "GET http://nowhere.ptor/ HTTP/1.1\r\nHost: nowhere.ptor\r\n\r\n", errUnresolvable, http.StatusBadGateway},
+		{"origin form", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", nil, http.StatusBadRequest},
+		{"CONNECT without port", "CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &mockConnection{readData: []byte(tt.request)}
+			NewHTTPProxyController(&mockStreamConnector{err: tt.err}).HandleConnection(conn)
+
+			resp, err := http.ReadResponse(bufio.NewReader(&conn.writeData), nil)
+			if err != nil {
+				t.Fatalf("read response: %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
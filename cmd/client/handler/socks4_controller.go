@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// maxSOCKS4FieldLen bounds the user ID and host name of a SOCKS4 request.
+const maxSOCKS4FieldLen = 255
+
+// SOCKS4Controller handles SOCKS4 and SOCKS4a proxy connections. It only
+// parses requests; the streams go through the connector's pipeline.
+type SOCKS4Controller struct {
+	connector StreamConnector
+}
+
+// NewSOCKS4Controller creates a new SOCKS4Controller
+func NewSOCKS4Controller(connector StreamConnector) *SOCKS4Controller {
+	return &SOCKS4Controller{connector: connector}
+}
+
+// HandleConnection handles a SOCKS4 or SOCKS4a connection
+func (c *SOCKS4Controller) HandleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	// VN, CD, DSTPORT, DSTIP
+	var buf [8]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		log.Printf("read SOCKS4 request: %v", err)
+		return
+	}
+	if buf[0] != vo.SOCKS4Version {
+		log.Printf("unsupported SOCKS version: %d", buf[0])
+		return
+	}
+	port := int(buf[2])<<8 | int(buf[3])
+	ip := net.IP(buf[4:8])
+
+	// The user ID, and for SOCKS4a the host name, follow as NUL terminated
+	// strings. Read them byte by byte so no application data is consumed.
+	userID, err := readNulString(conn)
+	if err != nil {
+		log.Printf("read SOCKS4 user ID: %v", err)
+		return
+	}
+	host := ip.String()
+	if vo.SOCKS4aHost(ip) {
+		if host, err = readNulString(conn); err != nil {
+			log.Printf("read SOCKS4a host name: %v", err)
+			return
+		}
+	}
+	if buf[1] != vo.SOCKS4CmdConnect {
+		log.Printf("unsupported SOCKS4 command: %d", buf[1])
+		conn.Write(vo.SOCKS4Reply(vo.SOCKS4RespRejected, nil))
+		return
+	}
+	log.Printf("SOCKS4 protocol completed, target: %s:%d", host, port)
+
+	c.connector.Connect(conn, ConnectRequest{Host: host, Port: port, Username: userID}, func(bound *net.TCPAddr, err error) {
+		if err != nil {
+			conn.Write(vo.SOCKS4Reply(vo.SOCKS4RespRejected, nil))
+			return
+		}
+		conn.Write(vo.SOCKS4Reply(vo.SOCKS4RespGranted, bound))
+	})
+}
+
+// readNulString reads a NUL terminated string of at most
+// maxSOCKS4FieldLen bytes.
+func readNulString(r io.Reader) (string, error) {
+	var out []byte
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(out), nil
+		}
+		if len(out) == maxSOCKS4FieldLen {
+			return "", fmt.Errorf("field longer than %d bytes", maxSOCKS4FieldLen)
+		}
+		out = append(out, b[0])
+	}
+}
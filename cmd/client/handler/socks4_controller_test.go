@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// mockStreamConnector answers every request with err and records what the
+// frontend handed over, including the stream data the application sent.
+type mockStreamConnector struct {
+	bound *net.TCPAddr
+	err   error
+	calls []ConnectRequest
+	data  []byte
+}
+
+func (m *mockStreamConnector) Connect(conn net.Conn, req ConnectRequest, reply func(*net.TCPAddr, error)) {
+	m.calls = append(m.calls, req)
+	reply(m.bound, m.err)
+	if m.err == nil {
+		m.data, _ = io.ReadAll(conn)
+	}
+}
+
+func TestSOCKS4Controller_HandleConnection(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  []byte
+		wantHost string
+		wantUser string
+	}{
+		{
+			name:     "SOCKS4",
+			request:  []byte{0x04, 0x01, 0x00, 0x50, 10, 0, 0, 1, 'b', 'o', 'b', 0x00},
+			wantHost: "10.0.0.1",
+			wantUser: "bob",
+		},
+		{
+			name:     "SOCKS4a",
+			request:  append([]byte{0x04, 0x01, 0x00, 0x50, 0, 0, 0, 1, 0x00}, "example.ptor\x00"...),
+			wantHost: "example.ptor",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &mockConnection{readData: append(tt.request, "hello"...)}
+			connector := &mockStreamConnector{bound: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 8080}}
+			NewSOCKS4Controller(connector).HandleConnection(conn)
+
+			if len(connector.calls) != 1 {
+				t.Fatalf("connect calls = %d, want 1", len(connector.calls))
+			}
+			got := connector.calls[0]
+			if got.Host != tt.wantHost || got.Port != 80 || got.Username != tt.wantUser {
+				t.Errorf("request = %+v, want %s:80 for %q", got, tt.wantHost, tt.wantUser)
+			}
+			if string(connector.data) != "hello" {
+				t.Errorf("stream data = %q, want %q", connector.data, "hello")
+			}
+			want := []byte{0x00, vo.SOCKS4RespGranted, 0x1F, 0x90, 192, 0, 2, 1}
+			if !bytes.Equal(conn.writeData.Bytes(), want) {
+				t.Errorf("reply = %x, want %x", conn.writeData.Bytes(), want)
+			}
+		})
+	}
+}
+
+func TestSOCKS4Controller_HandleConnection_Rejected(t *testing.T) {
+	tests := []struct {
+		name      string
+		cmd       byte
+		err       error
+		wantCalls int
+	}{
+		{"stream refused", vo.SOCKS4CmdConnect, &entity.StreamRefusedError{Reason: vo.EndReasonConnectRefused}, 1},
+		{"bind", vo.SOCKS4CmdBind, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &mockConnection{readData: []byte{0x04, tt.cmd, 0x00, 0x50, 10, 0, 0, 1, 0x00}}
+			connector := &mockStreamConnector{err: tt.err}
+			NewSOCKS4Controller(connector).HandleConnection(conn)
+
+			if len(connector.calls) != tt.wantCalls {
+				t.Errorf("connect calls = %d, want %d", len(connector.calls), tt.wantCalls)
+			}
+			want := vo.SOCKS4Reply(vo.SOCKS4RespRejected, nil)
+			if !bytes.Equal(conn.writeData.Bytes(), want) {
+				t.Errorf("reply = %x, want %x", conn.writeData.Bytes(), want)
+			}
+		})
+	}
+}
@@ -1,60 +1,111 @@
 package handler
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strings"
+	"sync"
 
 	"ikedadada/go-ptor/cmd/client/usecase"
+	"ikedadada/go-ptor/shared/domain/entity"
 	vo "ikedadada/go-ptor/shared/domain/value_object"
 	"ikedadada/go-ptor/shared/service"
 )
 
+// maxStreamAttempts bounds how many circuits a SOCKS5 request may try
+// before its failure is reported to the application.
+const maxStreamAttempts = 2
+
+// errUnresolvable is reported to frontends when the target of a request
+// could not be resolved to an address or hidden service.
+var errUnresolvable = errors.New("cannot resolve target")
+
+// ConnectRequest is a request to connect an application to a target, as a
+// proxy frontend read it.
+type ConnectRequest struct {
+	Host string
+	Port int
+	// Username and Password are the credentials the application gave, if
+	// any. They are not checked and only serve as an isolation key.
+	Username string
+	Password string
+}
+
+// StreamConnector carries the streams of proxy frontends through the
+// network.
+type StreamConnector interface {
+	// Connect opens a stream to the target of req for the application on
+	// conn and calls reply with the outcome: the address the exit
+	// connected to, if it named one, or why the stream failed. If the
+	// stream opened it then relays data until either side is done.
+	Connect(conn net.Conn, req ConnectRequest, reply func(bound *net.TCPAddr, err error))
+}
+
+var _ StreamConnector = (*SOCKS5Controller)(nil)
+
 // SOCKS5Controller handles SOCKS5 proxy connections
 type SOCKS5Controller struct {
-	buildUC       usecase.BuildCircuitUseCase
+	acquireUC     usecase.AcquireCircuitUseCase
 	connectUC     usecase.SendConnectUseCase
-	openUC        usecase.OpenStreamUseCase
 	closeUC       usecase.CloseStreamUseCase
 	sendUC        usecase.SendDataUseCase
 	endUC         usecase.HandleEndUseCase
 	resolveUC     usecase.ResolveTargetAddressUseCase
 	receiveCellUC usecase.ReceiveCellUseCase
 	decryptCellUC usecase.DecryptCellDataUseCase
+	sendmeUC      usecase.SendSendmeUseCase
+	awaitUC       usecase.AwaitStreamUseCase
 	peSvc         service.PayloadEncodingService
-	smSvc         service.StreamManagerService
 	hops          int
+	isolation     vo.IsolationFlags // request properties that keep streams apart
+
+	mu      sync.Mutex
+	streams map[string]service.StreamManagerService // stream table of each circuit with open streams
+	writers map[streamKey]*streamWriter             // delivers the data of each registered stream
+}
+
+// streamKey names a stream; stream IDs are only unique within a circuit.
+type streamKey struct {
+	circuitID string
+	streamID  uint16
 }
 
 // NewSOCKS5Controller creates a new SOCKS5Controller
 func NewSOCKS5Controller(
-	buildUC usecase.BuildCircuitUseCase,
+	acquireUC usecase.AcquireCircuitUseCase,
 	connectUC usecase.SendConnectUseCase,
-	openUC usecase.OpenStreamUseCase,
 	closeUC usecase.CloseStreamUseCase,
 	sendUC usecase.SendDataUseCase,
 	endUC usecase.HandleEndUseCase,
 	resolveUC usecase.ResolveTargetAddressUseCase,
 	receiveCellUC usecase.ReceiveCellUseCase,
 	decryptCellUC usecase.DecryptCellDataUseCase,
+	sendmeUC usecase.SendSendmeUseCase,
+	awaitUC usecase.AwaitStreamUseCase,
 	peSvc service.PayloadEncodingService,
-	smSvc service.StreamManagerService,
 	hops int,
+	isolation vo.IsolationFlags,
 ) *SOCKS5Controller {
 	return &SOCKS5Controller{
-		buildUC:       buildUC,
+		acquireUC:     acquireUC,
 		connectUC:     connectUC,
-		openUC:        openUC,
 		closeUC:       closeUC,
 		sendUC:        sendUC,
 		endUC:         endUC,
 		resolveUC:     resolveUC,
 		receiveCellUC: receiveCellUC,
 		decryptCellUC: decryptCellUC,
+		sendmeUC:      sendmeUC,
+		awaitUC:       awaitUC,
 		peSvc:         peSvc,
-		smSvc:         smSvc,
 		hops:          hops,
+		isolation:     isolation,
+		streams:       make(map[string]service.StreamManagerService),
+		writers:       make(map[streamKey]*streamWriter),
 	}
 }
 
@@ -66,30 +117,62 @@ func (c *SOCKS5Controller) HandleConnection(conn net.Conn) {
 	log.Println("Starting SOCKS5 protocol handling")
 	var buf [262]byte
 
-	// Step 1: Read authentication methods
+	// Step 1: Negotiate the authentication method. Credentials are not
+	// checked; like in Tor they only serve as an isolation key.
 	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
 		log.Printf("read SOCKS version: %v", err)
 		return
 	}
+	if buf[0] != vo.SOCKS5Version {
+		log.Printf("unsupported SOCKS version: %d", buf[0])
+		return
+	}
 	n := int(buf[1])
 	if _, err := io.ReadFull(conn, buf[:n]); err != nil {
 		log.Printf("read SOCKS methods: %v", err)
 		return
 	}
-	conn.Write(vo.SOCKS5HandshakeResp)
+	var fields vo.IsolationFields
+	switch {
+	case bytes.IndexByte(buf[:n], vo.SOCKS5MethodUserPass) >= 0:
+		conn.Write(vo.SOCKS5UserPassResp)
+		user, pass, err := readUserPass(conn)
+		if err != nil {
+			log.Printf("read SOCKS credentials: %v", err)
+			conn.Write(vo.SOCKS5UserPassBadResp)
+			return
+		}
+		conn.Write(vo.SOCKS5UserPassOKResp)
+		fields.Username, fields.Password = user, pass
+	case bytes.IndexByte(buf[:n], vo.SOCKS5MethodNoAuth) >= 0:
+		conn.Write(vo.SOCKS5HandshakeResp)
+	default:
+		log.Printf("no acceptable SOCKS auth method offered")
+		conn.Write(vo.SOCKS5NoMethodResp)
+		return
+	}
 
 	// Step 2: Read connection request
 	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
 		log.Printf("read SOCKS request: %v", err)
 		return
 	}
-	if buf[1] != vo.SOCKS5CmdConnect {
-		log.Printf("unsupported SOCKS command: %d", buf[1])
+	if buf[0] != vo.SOCKS5Version {
+		log.Printf("unsupported SOCKS version: %d", buf[0])
+		return
+	}
+	cmd := buf[1]
+	if cmd != vo.SOCKS5CmdConnect && cmd != vo.SOCKS5CmdUDPAssociate && cmd != vo.SOCKS5CmdResolve {
+		log.Printf("unsupported SOCKS command: %d", cmd)
+		conn.Write(vo.SOCKS5Reply(vo.SOCKS5RespCmdUnsupported))
 		return
 	}
 
-	// Step 3: Parse target address
+	// Step 3: Parse target address. Replies use the address family of the
+	// request until the exit names the address it connected to. For UDP
+	// ASSOCIATE it is the address the application will send from.
 	var host string
+	ipv6 := buf[3] == vo.SOCKS5AddrIPv6
 	switch buf[3] {
 	case vo.SOCKS5AddrIPv4:
 		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
@@ -97,6 +180,12 @@ func (c *SOCKS5Controller) HandleConnection(conn net.Conn) {
 			return
 		}
 		host = net.IP(buf[:4]).String()
+	case vo.SOCKS5AddrIPv6:
+		if _, err := io.ReadFull(conn, buf[:16]); err != nil {
+			log.Printf("read IPv6 address: %v", err)
+			return
+		}
+		host = net.IP(buf[:16]).String()
 	case vo.SOCKS5AddrDomain:
 		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
 			log.Printf("read hostname length: %v", err)
@@ -110,6 +199,7 @@ func (c *SOCKS5Controller) HandleConnection(conn net.Conn) {
 		host = string(buf[:l])
 	default:
 		log.Printf("unsupported address type: %d", buf[3])
+		conn.Write(vo.SOCKS5Reply(vo.SOCKS5RespAddrUnsupported))
 		return
 	}
 
@@ -122,87 +212,279 @@ func (c *SOCKS5Controller) HandleConnection(conn net.Conn) {
 
 	log.Printf("SOCKS5 protocol completed, target: %s:%d", host, port)
 
-	// Phase 2: Resolve target address and build circuit
+	if cmd == vo.SOCKS5CmdUDPAssociate {
+		fields.Host, fields.Port = host, port
+		c.associate(conn, c.isolationKey(conn, fields), port, ipv6)
+		return
+	}
+	if cmd == vo.SOCKS5CmdResolve {
+		// like Tor, answer with the first address in BND.ADDR
+		fields.Host, fields.Port = host, port
+		answers, err := c.Resolve(host, c.isolationKey(conn, fields))
+		if err != nil {
+			log.Printf("resolve %s: %v", host, err)
+			conn.Write(socks5Reply(socks5FailureCode(err), nil, ipv6))
+			return
+		}
+		conn.Write(socks5Reply(vo.SOCKS5RespSuccess, &net.TCPAddr{IP: answers[0].IP}, ipv6))
+		return
+	}
+
+	c.Connect(conn, ConnectRequest{
+		Host:     host,
+		Port:     port,
+		Username: fields.Username,
+		Password: fields.Password,
+	}, func(bound *net.TCPAddr, err error) {
+		if err != nil {
+			conn.Write(socks5Reply(socks5FailureCode(err), nil, ipv6))
+			return
+		}
+		conn.Write(socks5Reply(vo.SOCKS5RespSuccess, bound, ipv6))
+	})
+}
+
+// Connect resolves the target of req, opens a stream to it on a circuit
+// and relays data between conn and the stream until either side is done.
+// The SOCKS4a and HTTP frontends share this pipeline, and with it the
+// circuits and stream tables of this controller.
+func (c *SOCKS5Controller) Connect(conn net.Conn, req ConnectRequest, reply func(bound *net.TCPAddr, err error)) {
+	isolationKey := c.isolationKey(conn, vo.IsolationFields{
+		Username: req.Username,
+		Password: req.Password,
+		Host:     req.Host,
+		Port:     req.Port,
+	})
+
+	// Phase 2: Resolve target address
 	resolveOut, err := c.resolveUC.Handle(usecase.ResolveTargetAddressInput{
-		Host: host,
-		Port: port,
+		Host: req.Host,
+		Port: req.Port,
 	})
 	if err != nil {
 		log.Println("resolve address:", err)
-		conn.Write(vo.SOCKS5HostUnreachResp)
+		reply(nil, fmt.Errorf("%w: %w", errUnresolvable, err))
 		return
 	}
-	addr := resolveOut.DialAddress
-	exitRelayID := resolveOut.ExitRelayID
 
-	log.Printf("building circuit hops=%d exitRelayID=%s", c.hops, exitRelayID)
-	buildOut, err := c.buildUC.Handle(usecase.BuildCircuitInput{Hops: c.hops, ExitRelayID: exitRelayID})
+	// Phase 3: Open the stream on a circuit
+	circuitID, streamID, bound, err := c.attach(conn, vo.CmdBegin, resolveOut.ExitRelayID, resolveOut.DialAddress, isolationKey, req.Port)
 	if err != nil {
-		log.Printf("build circuit: %v", err)
-		conn.Write(vo.SOCKS5ErrorResp)
+		log.Printf("open stream: %v", err)
+		reply(nil, err)
 		return
 	}
-	circuitID := buildOut.CircuitID
-	log.Printf("circuit built successfully cid=%s", circuitID)
+	log.Printf("stream connection established cid=%s sid=%d", circuitID, streamID)
+	reply(bound, nil)
 
-	// Phase 3: Setup stream management and start data relay
-	if err := c.setupStreamAndRelay(conn, circuitID, exitRelayID, addr); err != nil {
-		log.Println("setup stream and relay:", err)
-		return
+	// Phase 4: Relay data until either side is done
+	c.relay(conn, circuitID, streamID)
+}
+
+// isolationKey returns the isolation key of a request on conn.
+func (c *SOCKS5Controller) isolationKey(conn net.Conn, fields vo.IsolationFields) string {
+	if tcp, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		fields.ClientAddr = tcp.IP.String()
 	}
+	return c.isolation.Key(fields)
 }
 
-// setupStreamAndRelay sets up stream management and handles data relay
-func (c *SOCKS5Controller) setupStreamAndRelay(conn net.Conn, circuitID, exitRelayID, addr string) error {
-	// === 1. Initialize stream manager and start receiving loop ===
-	go c.recvLoop(circuitID)
+// attach opens a stream with cmd on a circuit whose exit allows port, if
+// it is set, and registers stream to receive its data. If the exit's reason for refusing the stream says
+// another circuit may succeed, the circuit of the failed attempt is
+// shunned and the stream tried once more.
+func (c *SOCKS5Controller) attach(stream net.Conn, cmd vo.CellCommand, exitRelayID, addr, isolationKey string, port int) (circuitID string, streamID uint16, bound *net.TCPAddr, err error) {
+	avoid := ""
+	for attempt := 1; ; attempt++ {
+		acqOut, err := c.acquire(exitRelayID, avoid, isolationKey, port)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		circuitID, streamID = acqOut.CircuitID, acqOut.StreamID
+
+		bound, err = c.openStream(stream, circuitID, streamID, exitRelayID, addr, acqOut.Version, cmd)
+		if err == nil {
+			return circuitID, streamID, bound, nil
+		}
+		log.Printf("open stream cid=%s attempt=%d: %v", circuitID, attempt, err)
+		if attempt < maxStreamAttempts && retryableStreamError(err) {
+			avoid = circuitID
+			continue
+		}
+		return "", 0, nil, err
+	}
+}
+
+// acquire takes a stream ID on a circuit for isolationKey whose exit
+// allows port, avoiding the circuit avoid, and starts receiving on the
+// circuit if it was just built.
+func (c *SOCKS5Controller) acquire(exitRelayID, avoid, isolationKey string, port int) (usecase.AcquireCircuitOutput, error) {
+	acqOut, err := c.acquireUC.Handle(usecase.AcquireCircuitInput{
+		Hops:         c.hops,
+		ExitRelayID:  exitRelayID,
+		Avoid:        avoid,
+		IsolationKey: isolationKey,
+		Port:         port,
+	})
+	if err != nil {
+		return usecase.AcquireCircuitOutput{}, fmt.Errorf("acquire circuit: %w", err)
+	}
+	if acqOut.Built {
+		log.Printf("circuit built successfully cid=%s", acqOut.CircuitID)
+		c.ReceiveCircuit(acqOut.CircuitID)
+	}
+	return acqOut, nil
+}
 
-	// === 2. Connect to hidden service if needed ===
+// Resolve asks an exit for the addresses of host without connecting
+// anywhere. The RESOLVE takes a stream ID on a circuit picked for
+// isolationKey, as a BEGIN would, and is retried like one.
+func (c *SOCKS5Controller) Resolve(host, isolationKey string) ([]vo.ResolvedAnswer, error) {
+	if strings.HasSuffix(strings.ToLower(host), ".ptor") {
+		return nil, fmt.Errorf("%w: hidden service %s has no address", errUnresolvable, host)
+	}
+	avoid := ""
+	for attempt := 1; ; attempt++ {
+		acqOut, err := c.acquire("", avoid, isolationKey, 0)
+		if err != nil {
+			return nil, err
+		}
+		answers, err := c.resolveOn(acqOut.CircuitID, acqOut.StreamID, acqOut.Version, host)
+		if err == nil {
+			return answers, nil
+		}
+		log.Printf("resolve cid=%s attempt=%d: %v", acqOut.CircuitID, attempt, err)
+		if attempt < maxStreamAttempts && retryableStreamError(err) {
+			avoid = acqOut.CircuitID
+			continue
+		}
+		return nil, err
+	}
+}
+
+// resolveOn sends a RESOLVE for host on stream streamID and waits for the
+// answer. The exit keeps no stream for it, so the stream ends locally.
+func (c *SOCKS5Controller) resolveOn(circuitID string, streamID uint16, version vo.ProtocolVersion, host string) ([]vo.ResolvedAnswer, error) {
+	defer c.endUC.Handle(usecase.HandleEndInput{CircuitID: circuitID, StreamID: streamID})
+
+	payload, err := c.peSvc.ForVersion(version).EncodeBeginPayload(&service.BeginPayloadDTO{
+		StreamID: streamID,
+		Target:   host,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encode resolve payload: %w", err)
+	}
+	if _, err := c.sendUC.Handle(usecase.SendDataInput{
+		CircuitID: circuitID,
+		StreamID:  streamID,
+		Data:      payload,
+		Cmd:       vo.CmdResolve,
+	}); err != nil {
+		return nil, fmt.Errorf("send %s command: %w", vo.CmdResolve, err)
+	}
+	out, err := c.awaitUC.Handle(usecase.AwaitStreamInput{
+		CircuitID: circuitID,
+		StreamID:  streamID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", host, err)
+	}
+	if len(out.Answers) == 0 {
+		return nil, fmt.Errorf("%w: no address for %s", errUnresolvable, host)
+	}
+	return out.Answers, nil
+}
+
+// readUserPass reads a username/password request (RFC 1929).
+func readUserPass(r io.Reader) (user, pass string, err error) {
+	var buf [255]byte
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", "", err
+	}
+	if buf[0] != vo.SOCKS5UserPassVersion {
+		return "", "", fmt.Errorf("unsupported auth version %d", buf[0])
+	}
+	l := int(buf[1])
+	if _, err := io.ReadFull(r, buf[:l]); err != nil {
+		return "", "", err
+	}
+	user = string(buf[:l])
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return "", "", err
+	}
+	l = int(buf[0])
+	if _, err := io.ReadFull(r, buf[:l]); err != nil {
+		return "", "", err
+	}
+	return user, string(buf[:l]), nil
+}
+
+// openStream asks the exit to connect stream streamID to addr, or to open
+// a UDP association if cmd is BEGIN_UDP, and waits for its answer, which
+// may name the address the exit connected to. The connection is registered
+// for the stream's data before the request goes out; a failed attempt
+// detaches it again.
+func (c *SOCKS5Controller) openStream(conn net.Conn, circuitID string, streamID uint16, exitRelayID, addr string, version vo.ProtocolVersion, cmd vo.CellCommand) (*net.TCPAddr, error) {
+	// === 1. Connect to hidden service if needed ===
 	if exitRelayID != "" {
 		log.Printf("connecting to hidden service cid=%s", circuitID)
 		if _, err := c.connectUC.Handle(usecase.SendConnectInput{CircuitID: circuitID}); err != nil {
 			log.Printf("failed to connect to hidden service cid=%s: %v", circuitID, err)
-			return fmt.Errorf("connect to hidden service: %w", err)
+			c.closeStream(circuitID, streamID)
+			return nil, fmt.Errorf("connect to hidden service: %w", err)
 		}
 		log.Printf("hidden service connection established cid=%s", circuitID)
 	}
 
-	// === 3. Open stream and register with manager ===
-	stOut, err := c.openUC.Handle(usecase.OpenStreamInput{CircuitID: circuitID})
-	if err != nil {
-		return fmt.Errorf("open stream: %w", err)
-	}
-	streamID := stOut.StreamID
-	c.smSvc.Add(uint16(streamID), conn)
-	defer c.smSvc.Remove(uint16(streamID))
+	// === 2. Register the stream in the circuit's table ===
+	c.register(circuitID, streamID, conn)
 	log.Printf("stream opened and registered cid=%s sid=%d", circuitID, streamID)
 
-	// === 4. Send BEGIN command to establish stream connection ===
-	payload, err := c.peSvc.EncodeBeginPayload(&service.BeginPayloadDTO{
-		StreamID: uint16(streamID),
+	// === 3. Send BEGIN or BEGIN_UDP command to establish the stream ===
+	payload, err := c.peSvc.ForVersion(version).EncodeBeginPayload(&service.BeginPayloadDTO{
+		StreamID: streamID,
 		Target:   addr,
 	})
 	if err != nil {
-		return fmt.Errorf("encode begin payload: %w", err)
+		c.abandonStream(circuitID, streamID)
+		return nil, fmt.Errorf("encode begin payload: %w", err)
 	}
 
 	log.Printf("establishing stream connection cid=%s sid=%d target=%s", circuitID, streamID, addr)
 	_, err = c.sendUC.Handle(usecase.SendDataInput{
 		CircuitID: circuitID,
-		StreamID:  uint16(streamID),
+		StreamID:  streamID,
 		Data:      payload,
-		Cmd:       vo.CmdBegin,
+		Cmd:       cmd,
 	})
 	if err != nil {
-		return fmt.Errorf("send begin command: %w", err)
+		c.abandonStream(circuitID, streamID)
+		return nil, fmt.Errorf("send %s command: %w", cmd, err)
 	}
-	log.Printf("stream connection established cid=%s sid=%d", circuitID, streamID)
 
-	// === 5. Notify client of successful connection ===
-	conn.Write(vo.SOCKS5SuccessResp)
+	// === 4. Wait for the exit to connect ===
+	out, err := c.awaitUC.Handle(usecase.AwaitStreamInput{
+		CircuitID: circuitID,
+		StreamID:  streamID,
+	})
+	if err != nil {
+		c.abandonStream(circuitID, streamID)
+		return nil, fmt.Errorf("begin stream: %w", err)
+	}
+	if out.BoundAddr == "" {
+		return nil, nil
+	}
+	// the exit sends an IP literal, so this does not look anything up
+	bound, _ := net.ResolveTCPAddr("tcp", out.BoundAddr)
+	return bound, nil
+}
 
-	// === 6. Handle data relay loop ===
-	buf := make([]byte, 4096)
+// relay copies application data into the stream until the application
+// closes its connection, then ends the stream.
+func (c *SOCKS5Controller) relay(conn net.Conn, circuitID string, streamID uint16) {
+	defer c.forget(circuitID, streamID, true)
+	// read at most one relay body worth of data so every read fits a cell
+	buf := make([]byte, service.MaxRelayDataSize)
 	for {
 		n, err := conn.Read(buf)
 
@@ -235,19 +517,134 @@ func (c *SOCKS5Controller) setupStreamAndRelay(conn net.Conn, circuitID, exitRel
 		}
 	}
 
-	// === 7. Cleanup stream resources ===
+	// Cleanup stream resources
+	c.closeStream(circuitID, streamID)
+}
+
+// abandonStream gives up a stream that never connected. The application's
+// connection stays open for the next attempt.
+func (c *SOCKS5Controller) abandonStream(circuitID string, streamID uint16) {
+	c.forget(circuitID, streamID, false)
+	c.closeStream(circuitID, streamID)
+}
+
+// closeStream ends a stream at the exit and forgets it locally.
+func (c *SOCKS5Controller) closeStream(circuitID string, streamID uint16) {
 	if _, err := c.closeUC.Handle(usecase.CloseStreamInput{
 		CircuitID: circuitID,
 		StreamID:  streamID,
 	}); err != nil {
 		log.Printf("failed to close stream cid=%s sid=%d: %v", circuitID, streamID, err)
 	}
+}
 
-	return nil
+// socks5FailureCode maps a failed stream to the SOCKS5 reply code for the
+// application: the exit's END reason if it refused the stream, TTL expired
+// if it never answered.
+func socks5FailureCode(err error) byte {
+	var refused *entity.StreamRefusedError
+	switch {
+	case errors.Is(err, errUnresolvable):
+		return vo.SOCKS5RespHostUnreach
+	case errors.As(err, &refused):
+		return refused.Reason.SOCKS5Reply()
+	case errors.Is(err, entity.ErrBeginTimeout):
+		return vo.SOCKS5RespTTLExpired
+	default:
+		return vo.SOCKS5RespGeneralError
+	}
+}
+
+// socks5Reply builds a reply carrying bound. Without a bound address it
+// carries the empty address of the family the request used.
+func socks5Reply(code byte, bound *net.TCPAddr, ipv6 bool) []byte {
+	if bound == nil && ipv6 {
+		bound = &net.TCPAddr{IP: net.IPv6zero}
+	}
+	return vo.SOCKS5ReplyAddr(code, bound)
+}
+
+// retryableStreamError reports whether a stream that failed to open might
+// succeed on another circuit: the exit gave a reason that does not blame
+// the target, or never answered at all.
+func retryableStreamError(err error) bool {
+	var refused *entity.StreamRefusedError
+	if errors.As(err, &refused) {
+		return refused.Reason.Retryable()
+	}
+	return errors.Is(err, entity.ErrBeginTimeout)
+}
+
+// ReceiveCircuit starts the receive loop of a new circuit. Circuits built
+// ahead of any SOCKS request are passed in here as well.
+func (c *SOCKS5Controller) ReceiveCircuit(circuitID string) {
+	go c.recvLoop(circuitID)
+}
+
+// register adds the application's connection to the stream table of its
+// circuit and starts the writer that hands it the stream's data.
+func (c *SOCKS5Controller) register(circuitID string, streamID uint16, conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sm, ok := c.streams[circuitID]
+	if !ok {
+		sm = service.NewStreamManagerService()
+		c.streams[circuitID] = sm
+	}
+	sm.Add(streamID, conn)
+	key := streamKey{circuitID, streamID}
+	if w, ok := c.writers[key]; ok {
+		w.stop()
+	}
+	c.writers[key] = newStreamWriter(conn)
+}
+
+// writer returns the writer delivering the data of a stream.
+func (c *SOCKS5Controller) writer(circuitID string, streamID uint16) (*streamWriter, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w, ok := c.writers[streamKey{circuitID, streamID}]
+	return w, ok
+}
+
+// lookup returns the connection registered for a stream of a circuit.
+func (c *SOCKS5Controller) lookup(circuitID string, streamID uint16) (net.Conn, bool) {
+	c.mu.Lock()
+	sm, ok := c.streams[circuitID]
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return sm.Get(streamID)
+}
+
+// forget removes a stream from the table of its circuit and drops the
+// table once it is empty. The connection is closed only if close is set.
+func (c *SOCKS5Controller) forget(circuitID string, streamID uint16, close bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := streamKey{circuitID, streamID}
+	if w, ok := c.writers[key]; ok {
+		w.stop()
+		delete(c.writers, key)
+	}
+	sm, ok := c.streams[circuitID]
+	if !ok {
+		return
+	}
+	if close {
+		sm.Remove(streamID)
+	} else {
+		sm.Detach(streamID)
+	}
+	if sm.Len() == 0 {
+		delete(c.streams, circuitID)
+	}
 }
 
 // recvLoop handles incoming data from the circuit
 func (c *SOCKS5Controller) recvLoop(circuitID string) {
+	defer c.shutdown(circuitID)
 	for {
 		// Step 1: Receive cell from circuit
 		receiveOut, err := c.receiveCellUC.Handle(usecase.ReceiveCellInput{
@@ -255,13 +652,11 @@ func (c *SOCKS5Controller) recvLoop(circuitID string) {
 		})
 		if err != nil {
 			log.Println("receive cell:", err)
-			c.smSvc.CloseAll()
 			return
 		}
 
 		if receiveOut.IsEOF {
 			log.Println("connection closed")
-			c.smSvc.CloseAll()
 			return
 		}
 
@@ -272,33 +667,86 @@ func (c *SOCKS5Controller) recvLoop(circuitID string) {
 		})
 		if err != nil {
 			log.Println("decrypt cell:", err)
-			c.smSvc.CloseAll()
 			return
 		}
 
 		if decryptOut.ShouldClose {
 			log.Println("circuit destroyed or all streams closed")
-			c.smSvc.CloseAll()
 			return
 		}
 
 		if decryptOut.CellData != nil {
 			switch decryptOut.CellData.Command {
 			case vo.CmdData:
-				// Forward decrypted data to the appropriate stream
-				if conn, ok := c.smSvc.Get(decryptOut.CellData.StreamID); ok {
-					conn.Write(decryptOut.CellData.Data)
+				c.deliverData(circuitID, decryptOut.CellData)
+			case vo.CmdDatagram:
+				// datagrams are not flow controlled and need no SENDME; one
+				// the application is too slow for is dropped
+				if w, ok := c.writer(circuitID, decryptOut.CellData.StreamID); ok {
+					if !w.enqueue(streamChunk{data: decryptOut.CellData.Data}) {
+						log.Printf("drop datagram cid=%s sid=%d: application too slow", circuitID, decryptOut.CellData.StreamID)
+					}
 				}
 			case vo.CmdEnd:
 				if decryptOut.CellData.StreamID == 0 {
 					// End all streams
-					c.smSvc.CloseAll()
 					return
-				} else {
-					// End specific stream
-					c.smSvc.Remove(decryptOut.CellData.StreamID)
 				}
+				c.endStream(circuitID, decryptOut.CellData.StreamID)
 			}
 		}
 	}
 }
+
+// deliverData queues the data of a DATA cell for the application. The
+// SENDME goes out only once the application took the data, so a stalled
+// reader stops the exit from sending more without stalling other streams.
+func (c *SOCKS5Controller) deliverData(circuitID string, cell *usecase.DecryptedCellData) {
+	sendme := func() {
+		if _, err := c.sendmeUC.Handle(usecase.SendSendmeInput{
+			CircuitID: circuitID,
+			StreamID:  cell.StreamID,
+		}); err != nil {
+			log.Println("send sendme:", err)
+		}
+	}
+	w, ok := c.writer(circuitID, cell.StreamID)
+	if !ok {
+		// nobody is left to read it; it still counts against the windows
+		sendme()
+		return
+	}
+	if !w.enqueue(streamChunk{data: cell.Data, written: sendme}) {
+		log.Printf("stream window overrun cid=%s sid=%d", circuitID, cell.StreamID)
+		c.forget(circuitID, cell.StreamID, true)
+	}
+}
+
+// endStream closes a stream the exit ended once the application has
+// taken the data that came before the END.
+func (c *SOCKS5Controller) endStream(circuitID string, streamID uint16) {
+	forget := func() { c.forget(circuitID, streamID, true) }
+	if w, ok := c.writer(circuitID, streamID); !ok || !w.enqueue(streamChunk{written: forget}) {
+		forget()
+	}
+}
+
+// shutdown closes the streams of a finished circuit. Ending the circuit
+// also wakes senders still waiting for a SENDME that will never arrive.
+// Streams of other circuits live in other tables and are not touched.
+func (c *SOCKS5Controller) shutdown(circuitID string) {
+	_, _ = c.endUC.Handle(usecase.HandleEndInput{CircuitID: circuitID})
+	c.mu.Lock()
+	sm, ok := c.streams[circuitID]
+	delete(c.streams, circuitID)
+	for key, w := range c.writers {
+		if key.circuitID == circuitID {
+			w.stop()
+			delete(c.writers, key)
+		}
+	}
+	c.mu.Unlock()
+	if ok {
+		sm.CloseAll()
+	}
+}
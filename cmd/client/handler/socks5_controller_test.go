@@ -10,6 +10,7 @@ import (
 
 	"ikedadada/go-ptor/cmd/client/usecase"
 	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
 	"ikedadada/go-ptor/shared/service"
 )
 
@@ -62,25 +63,37 @@ func (m *mockConnection) SetWriteDeadline(t time.Time) error {
 }
 
 // Mock UseCase implementations
-type mockBuildCircuitUseCase struct {
+type mockAcquireCircuitUseCase struct {
 	circuitID string
+	streamID  uint16
 	err       error
+	calls     int
+	avoided   []string
+	keys      []string // isolation key of each call
+	reused    bool     // report the circuit as already receiving
 }
 
-func (m *mockBuildCircuitUseCase) Handle(in usecase.BuildCircuitInput) (usecase.BuildCircuitOutput, error) {
+func (m *mockAcquireCircuitUseCase) Handle(in usecase.AcquireCircuitInput) (usecase.AcquireCircuitOutput, error) {
+	m.calls++
+	m.keys = append(m.keys, in.IsolationKey)
+	if in.Avoid != "" {
+		m.avoided = append(m.avoided, in.Avoid)
+	}
 	if m.err != nil {
-		return usecase.BuildCircuitOutput{}, m.err
+		return usecase.AcquireCircuitOutput{}, m.err
 	}
-	return usecase.BuildCircuitOutput{CircuitID: m.circuitID}, nil
+	return usecase.AcquireCircuitOutput{CircuitID: m.circuitID, StreamID: m.streamID, Built: !m.reused}, nil
 }
 
 type mockResolveTargetAddressUseCase struct {
 	dialAddress string
 	exitRelayID string
 	err         error
+	host        string // host of the last call
 }
 
 func (m *mockResolveTargetAddressUseCase) Handle(in usecase.ResolveTargetAddressInput) (usecase.ResolveTargetAddressOutput, error) {
+	m.host = in.Host
 	if m.err != nil {
 		return usecase.ResolveTargetAddressOutput{}, m.err
 	}
@@ -101,23 +114,15 @@ func (m *mockSendConnectUseCase) Handle(in usecase.SendConnectInput) (usecase.Se
 	return usecase.SendConnectOutput{Sent: true}, nil
 }
 
-type mockOpenStreamUseCase struct {
-	streamID int
-	err      error
-}
-
-func (m *mockOpenStreamUseCase) Handle(in usecase.OpenStreamInput) (usecase.OpenStreamOutput, error) {
-	if m.err != nil {
-		return usecase.OpenStreamOutput{}, m.err
-	}
-	return usecase.OpenStreamOutput{StreamID: uint16(m.streamID)}, nil
-}
-
 type mockSendDataUseCase struct {
-	err error
+	err  error
+	sent chan usecase.SendDataInput // receives every call if set
 }
 
 func (m *mockSendDataUseCase) Handle(in usecase.SendDataInput) (usecase.SendDataOutput, error) {
+	if m.sent != nil {
+		m.sent <- in
+	}
 	if m.err != nil {
 		return usecase.SendDataOutput{}, m.err
 	}
@@ -146,6 +151,32 @@ func (m *mockHandleEndUseCase) Handle(in usecase.HandleEndInput) (usecase.Handle
 	return usecase.HandleEndOutput{}, nil
 }
 
+type mockSendSendmeUseCase struct{}
+
+func (m *mockSendSendmeUseCase) Handle(in usecase.SendSendmeInput) (usecase.SendSendmeOutput, error) {
+	return usecase.SendSendmeOutput{}, nil
+}
+
+// mockAwaitStreamUseCase fails with errs in order, then with err.
+type mockAwaitStreamUseCase struct {
+	errs    []error
+	err     error
+	bound   string
+	answers []vo.ResolvedAnswer
+}
+
+func (m *mockAwaitStreamUseCase) Handle(in usecase.AwaitStreamInput) (usecase.AwaitStreamOutput, error) {
+	if len(m.errs) > 0 {
+		err := m.errs[0]
+		m.errs = m.errs[1:]
+		return usecase.AwaitStreamOutput{}, err
+	}
+	if m.err != nil {
+		return usecase.AwaitStreamOutput{}, m.err
+	}
+	return usecase.AwaitStreamOutput{Connected: true, BoundAddr: m.bound, Answers: m.answers}, nil
+}
+
 type mockReceiveCellUseCase struct {
 	cell    *entity.Cell
 	circuit *entity.Circuit
@@ -185,6 +216,10 @@ type mockPayloadEncodingService struct {
 	err          error
 }
 
+func (m *mockPayloadEncodingService) ForVersion(vo.ProtocolVersion) service.PayloadEncodingService {
+	return m
+}
+
 func (m *mockPayloadEncodingService) EncodeExtendPayload(dto *service.ExtendPayloadDTO) ([]byte, error) {
 	return nil, nil
 }
@@ -228,46 +263,6 @@ func (m *mockPayloadEncodingService) DecodeDataPayload(data []byte) (*service.Da
 	return nil, nil
 }
 
-type mockStreamManagerService struct {
-	mu      sync.Mutex
-	streams map[uint16]net.Conn
-}
-
-func (m *mockStreamManagerService) Add(id uint16, conn net.Conn) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if m.streams == nil {
-		m.streams = make(map[uint16]net.Conn)
-	}
-	m.streams[id] = conn
-}
-
-func (m *mockStreamManagerService) Get(id uint16) (net.Conn, bool) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	conn, ok := m.streams[id]
-	return conn, ok
-}
-
-func (m *mockStreamManagerService) Remove(id uint16) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if m.streams != nil {
-		delete(m.streams, id)
-	}
-}
-
-func (m *mockStreamManagerService) CloseAll() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if m.streams != nil {
-		for _, conn := range m.streams {
-			conn.Close()
-		}
-		m.streams = make(map[uint16]net.Conn)
-	}
-}
-
 func TestSOCKS5Controller_HandleConnection_InvalidSOCKS5Request(t *testing.T) {
 	// Create mock connection with invalid SOCKS5 data
 	conn := &mockConnection{
@@ -276,12 +271,12 @@ func TestSOCKS5Controller_HandleConnection_InvalidSOCKS5Request(t *testing.T) {
 
 	// Create controller with minimal mocks
 	controller := NewSOCKS5Controller(
-		nil, nil, nil, nil, nil, nil, // UseCases won't be called due to early error
+		nil, nil, nil, nil, nil, // UseCases won't be called due to early error
 		&mockResolveTargetAddressUseCase{},
-		nil, nil,
+		nil, nil, nil, nil,
 		&mockPayloadEncodingService{},
-		&mockStreamManagerService{},
 		3,
+		0,
 	)
 
 	// Test
@@ -318,23 +313,25 @@ func TestSOCKS5Controller_HandleConnection_SOCKS5ProtocolParsing(t *testing.T) {
 		dialAddress: "google.com:80",
 		exitRelayID: "",
 	}
-	buildUC := &mockBuildCircuitUseCase{
+	acquireUC := &mockAcquireCircuitUseCase{
 		circuitID: "test-circuit-123",
+		streamID:  1,
 	}
 
 	controller := NewSOCKS5Controller(
-		buildUC,
+		acquireUC,
 		&mockSendConnectUseCase{},
-		&mockOpenStreamUseCase{streamID: 1},
 		&mockCloseStreamUseCase{},
 		&mockSendDataUseCase{},
 		&mockHandleEndUseCase{},
 		resolveUC,
 		&mockReceiveCellUseCase{isEOF: true}, // Will cause recvLoop to exit immediately
 		&mockDecryptCellDataUseCase{},
+		&mockSendSendmeUseCase{},
+		&mockAwaitStreamUseCase{},
 		&mockPayloadEncodingService{beginPayload: []byte("begin-payload")},
-		&mockStreamManagerService{},
 		3,
+		0,
 	)
 
 	// Test
@@ -378,23 +375,25 @@ func TestSOCKS5Controller_HandleConnection_IPv4Address(t *testing.T) {
 		dialAddress: "192.168.1.1:8080",
 		exitRelayID: "",
 	}
-	buildUC := &mockBuildCircuitUseCase{
+	acquireUC := &mockAcquireCircuitUseCase{
 		circuitID: "test-circuit-456",
+		streamID:  2,
 	}
 
 	controller := NewSOCKS5Controller(
-		buildUC,
+		acquireUC,
 		&mockSendConnectUseCase{},
-		&mockOpenStreamUseCase{streamID: 2},
 		&mockCloseStreamUseCase{},
 		&mockSendDataUseCase{},
 		&mockHandleEndUseCase{},
 		resolveUC,
 		&mockReceiveCellUseCase{isEOF: true},
 		&mockDecryptCellDataUseCase{},
+		&mockSendSendmeUseCase{},
+		&mockAwaitStreamUseCase{},
 		&mockPayloadEncodingService{beginPayload: []byte("begin-payload")},
-		&mockStreamManagerService{},
 		3,
+		0,
 	)
 
 	// Test
@@ -410,6 +409,161 @@ func TestSOCKS5Controller_HandleConnection_IPv4Address(t *testing.T) {
 	}
 }
 
+func TestSOCKS5Controller_HandleConnection_BeginReply(t *testing.T) {
+	tests := []struct {
+		name     string
+		awaitErr error
+		want     byte
+	}{
+		{"connected", nil, vo.SOCKS5RespSuccess},
+		{"refused", &entity.StreamRefusedError{Reason: vo.EndReasonConnectRefused}, vo.SOCKS5RespConnRefused},
+		{"resolve failed", &entity.StreamRefusedError{Reason: vo.EndReasonResolveFailed}, vo.SOCKS5RespHostUnreach},
+		{"exit policy", &entity.StreamRefusedError{Reason: vo.EndReasonExitPolicy}, vo.SOCKS5RespNotAllowed},
+		{"timeout", entity.ErrBeginTimeout, vo.SOCKS5RespTTLExpired},
+		{"circuit gone", &entity.StreamRefusedError{Reason: vo.EndReasonDestroy}, vo.SOCKS5RespGeneralError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &mockConnection{readData: []byte{
+				0x05, 0x01, 0x00,
+				0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x00, 0x50,
+			}}
+			controller := NewSOCKS5Controller(
+				&mockAcquireCircuitUseCase{circuitID: "begin-reply", streamID: 4},
+				&mockSendConnectUseCase{},
+				&mockCloseStreamUseCase{},
+				&mockSendDataUseCase{},
+				&mockHandleEndUseCase{},
+				&mockResolveTargetAddressUseCase{dialAddress: "10.0.0.1:80"},
+				&mockReceiveCellUseCase{isEOF: true},
+				&mockDecryptCellDataUseCase{},
+				&mockSendSendmeUseCase{},
+				&mockAwaitStreamUseCase{err: tt.awaitErr},
+				&mockPayloadEncodingService{beginPayload: []byte("begin-payload")},
+				3,
+				0,
+			)
+			controller.HandleConnection(conn)
+
+			// the method selection reply comes first, then the CONNECT reply
+			written := conn.writeData.Bytes()
+			if len(written) < len(vo.SOCKS5HandshakeResp)+2 {
+				t.Fatalf("no CONNECT reply written: %x", written)
+			}
+			if got := written[len(vo.SOCKS5HandshakeResp)+1]; got != tt.want {
+				t.Errorf("reply code = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSOCKS5Controller_HandleConnection_Resolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		answers []vo.ResolvedAnswer
+		want    []byte
+	}{
+		{"answered", "example.com", []vo.ResolvedAnswer{{IP: net.IPv4(192, 0, 2, 7), TTL: time.Minute}},
+			[]byte{0x05, vo.SOCKS5RespSuccess, 0x00, 0x01, 192, 0, 2, 7, 0x00, 0x00}},
+		{"no address", "example.com", nil, vo.SOCKS5Reply(vo.SOCKS5RespHostUnreach)},
+		{"hidden service", "abc.ptor", nil, vo.SOCKS5Reply(vo.SOCKS5RespHostUnreach)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := []byte{0x05, 0x01, 0x00, 0x05, vo.SOCKS5CmdResolve, 0x00, 0x03, byte(len(tt.host))}
+			req = append(append(req, tt.host...), 0x00, 0x00)
+			conn := &mockConnection{readData: req}
+			sent := make(chan usecase.SendDataInput, 1)
+			controller := NewSOCKS5Controller(
+				&mockAcquireCircuitUseCase{circuitID: "resolve", streamID: 2},
+				&mockSendConnectUseCase{},
+				&mockCloseStreamUseCase{},
+				&mockSendDataUseCase{sent: sent},
+				&mockHandleEndUseCase{},
+				&mockResolveTargetAddressUseCase{},
+				&mockReceiveCellUseCase{isEOF: true},
+				&mockDecryptCellDataUseCase{},
+				&mockSendSendmeUseCase{},
+				&mockAwaitStreamUseCase{answers: tt.answers},
+				&mockPayloadEncodingService{beginPayload: []byte("resolve-payload")},
+				3,
+				0,
+			)
+			controller.HandleConnection(conn)
+
+			if got := conn.writeData.Bytes(); !bytes.HasSuffix(got, tt.want) {
+				t.Errorf("reply = %x, want %x", got, tt.want)
+			}
+			select {
+			case in := <-sent:
+				if in.Cmd != vo.CmdResolve {
+					t.Errorf("sent %s, want RESOLVE", in.Cmd)
+				}
+			default:
+				if tt.answers != nil {
+					t.Error("no RESOLVE sent")
+				}
+			}
+		})
+	}
+}
+
+func TestSOCKS5Controller_HandleConnection_RetriesOnFreshCircuit(t *testing.T) {
+	tests := []struct {
+		name         string
+		awaitErrs    []error
+		wantAcquires int
+		want         byte
+	}{
+		{"exit timed out", []error{&entity.StreamRefusedError{Reason: vo.EndReasonTimeout}}, 2, vo.SOCKS5RespSuccess},
+		{"circuit destroyed", []error{&entity.StreamRefusedError{Reason: vo.EndReasonDestroy}}, 2, vo.SOCKS5RespSuccess},
+		{"no answer", []error{entity.ErrBeginTimeout}, 2, vo.SOCKS5RespSuccess},
+		{"target refused", []error{&entity.StreamRefusedError{Reason: vo.EndReasonConnectRefused}}, 1, vo.SOCKS5RespConnRefused},
+		{"target unresolvable", []error{&entity.StreamRefusedError{Reason: vo.EndReasonResolveFailed}}, 1, vo.SOCKS5RespHostUnreach},
+		{"gives up", []error{entity.ErrBeginTimeout, &entity.StreamRefusedError{Reason: vo.EndReasonExitPolicy}}, 2, vo.SOCKS5RespNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &mockConnection{readData: []byte{
+				0x05, 0x01, 0x00,
+				0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x00, 0x50,
+			}}
+			acquireUC := &mockAcquireCircuitUseCase{circuitID: "retry", streamID: 5}
+			controller := NewSOCKS5Controller(
+				acquireUC,
+				&mockSendConnectUseCase{},
+				&mockCloseStreamUseCase{},
+				&mockSendDataUseCase{},
+				&mockHandleEndUseCase{},
+				&mockResolveTargetAddressUseCase{dialAddress: "10.0.0.1:80"},
+				&mockReceiveCellUseCase{isEOF: true},
+				&mockDecryptCellDataUseCase{},
+				&mockSendSendmeUseCase{},
+				&mockAwaitStreamUseCase{errs: tt.awaitErrs},
+				&mockPayloadEncodingService{beginPayload: []byte("begin-payload")},
+				3,
+				0,
+			)
+			controller.HandleConnection(conn)
+
+			if acquireUC.calls != tt.wantAcquires {
+				t.Errorf("circuits acquired = %d, want %d", acquireUC.calls, tt.wantAcquires)
+			}
+			if len(acquireUC.avoided) != tt.wantAcquires-1 {
+				t.Errorf("avoided circuits = %v, want the failed one on each retry", acquireUC.avoided)
+			}
+			written := conn.writeData.Bytes()
+			if len(written) != len(vo.SOCKS5HandshakeResp)+len(vo.SOCKS5SuccessResp) {
+				t.Fatalf("want exactly one CONNECT reply, wrote %x", written)
+			}
+			if got := written[len(vo.SOCKS5HandshakeResp)+1]; got != tt.want {
+				t.Errorf("reply code = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestSOCKS5Controller_HandleConnection_HiddenService(t *testing.T) {
 	// Create SOCKS5 request for hidden service (.ptor domain)
 	socks5Data := []byte{
@@ -430,23 +584,25 @@ func TestSOCKS5Controller_HandleConnection_HiddenService(t *testing.T) {
 		dialAddress: "test.ptor:80",
 		exitRelayID: "exit-relay-123", // Hidden service has exit relay ID
 	}
-	buildUC := &mockBuildCircuitUseCase{
+	acquireUC := &mockAcquireCircuitUseCase{
 		circuitID: "hidden-circuit-789",
+		streamID:  3,
 	}
 
 	controller := NewSOCKS5Controller(
-		buildUC,
+		acquireUC,
 		&mockSendConnectUseCase{}, // This will be called for hidden service
-		&mockOpenStreamUseCase{streamID: 3},
 		&mockCloseStreamUseCase{},
 		&mockSendDataUseCase{},
 		&mockHandleEndUseCase{},
 		resolveUC,
 		&mockReceiveCellUseCase{isEOF: true},
 		&mockDecryptCellDataUseCase{},
+		&mockSendSendmeUseCase{},
+		&mockAwaitStreamUseCase{},
 		&mockPayloadEncodingService{beginPayload: []byte("begin-payload")},
-		&mockStreamManagerService{},
 		3,
+		0,
 	)
 
 	// Test
@@ -486,12 +642,12 @@ func TestSOCKS5Controller_HandleConnection_UnsupportedAddressType(t *testing.T)
 	}
 
 	controller := NewSOCKS5Controller(
-		nil, nil, nil, nil, nil, nil, // UseCases won't be called due to parsing error
+		nil, nil, nil, nil, nil, // UseCases won't be called due to parsing error
 		&mockResolveTargetAddressUseCase{},
-		nil, nil,
+		nil, nil, nil, nil,
 		&mockPayloadEncodingService{},
-		&mockStreamManagerService{},
 		3,
+		0,
 	)
 
 	// Test
@@ -505,6 +661,9 @@ func TestSOCKS5Controller_HandleConnection_UnsupportedAddressType(t *testing.T)
 	if !closed {
 		t.Error("Expected connection to be closed after unsupported address type")
 	}
+	if got := conn.writeData.Bytes(); !bytes.HasSuffix(got, vo.SOCKS5Reply(vo.SOCKS5RespAddrUnsupported)) {
+		t.Errorf("reply = %x, want address type not supported", got)
+	}
 }
 
 func TestSOCKS5Controller_HandleConnection_UnsupportedCommand(t *testing.T) {
@@ -523,12 +682,12 @@ func TestSOCKS5Controller_HandleConnection_UnsupportedCommand(t *testing.T) {
 	}
 
 	controller := NewSOCKS5Controller(
-		nil, nil, nil, nil, nil, nil, // UseCases won't be called due to unsupported command
+		nil, nil, nil, nil, nil, // UseCases won't be called due to unsupported command
 		&mockResolveTargetAddressUseCase{},
-		nil, nil,
+		nil, nil, nil, nil,
 		&mockPayloadEncodingService{},
-		&mockStreamManagerService{},
 		3,
+		0,
 	)
 
 	// Test
@@ -542,4 +701,360 @@ func TestSOCKS5Controller_HandleConnection_UnsupportedCommand(t *testing.T) {
 	if !closed {
 		t.Error("Expected connection to be closed after unsupported command")
 	}
+	if got := conn.writeData.Bytes(); !bytes.HasSuffix(got, vo.SOCKS5Reply(vo.SOCKS5RespCmdUnsupported)) {
+		t.Errorf("reply = %x, want command not supported", got)
+	}
+}
+
+func TestSOCKS5Controller_StreamTablesPerCircuit(t *testing.T) {
+	controller := NewSOCKS5Controller(
+		nil, nil, nil, nil,
+		&mockHandleEndUseCase{},
+		nil, nil, nil, nil, nil, nil,
+		3,
+		0,
+	)
+	connA, connB := &mockConnection{}, &mockConnection{}
+	// both circuits number their first stream 1
+	controller.register("circuit-a", 1, connA)
+	controller.register("circuit-b", 1, connB)
+
+	if got, _ := controller.lookup("circuit-b", 1); got != connB {
+		t.Fatalf("stream 1 of circuit-b resolved to the wrong connection")
+	}
+
+	controller.shutdown("circuit-a")
+
+	if !connA.closed {
+		t.Error("stream of the finished circuit left open")
+	}
+	if connB.closed {
+		t.Error("stream of another circuit closed")
+	}
+	if _, ok := controller.lookup("circuit-a", 1); ok {
+		t.Error("finished circuit still has a stream table")
+	}
+
+	// the table goes away with the circuit's last stream
+	controller.forget("circuit-b", 1, false)
+	if connB.closed {
+		t.Error("detached stream closed")
+	}
+	if len(controller.streams) != 0 {
+		t.Errorf("stream tables left: %d", len(controller.streams))
+	}
+}
+
+// scriptedDecryptUseCase hands out the cells sent on cells, then reports
+// the circuit closed once cells is closed.
+type scriptedDecryptUseCase struct {
+	cells chan *usecase.DecryptedCellData
+}
+
+func (m *scriptedDecryptUseCase) Handle(in usecase.DecryptCellDataInput) (usecase.DecryptCellDataOutput, error) {
+	cell, ok := <-m.cells
+	if !ok {
+		return usecase.DecryptCellDataOutput{ShouldClose: true}, nil
+	}
+	return usecase.DecryptCellDataOutput{CellData: cell}, nil
+}
+
+// recordingSendmeUseCase reports the stream of every SENDME on sent.
+type recordingSendmeUseCase struct {
+	sent chan uint16
+}
+
+func (m *recordingSendmeUseCase) Handle(in usecase.SendSendmeInput) (usecase.SendSendmeOutput, error) {
+	m.sent <- in.StreamID
+	return usecase.SendSendmeOutput{}, nil
+}
+
+// An application that stops reading must hold up neither the receive loop
+// nor the other streams of its circuit, and its stream is acknowledged
+// only once it has taken the data.
+func TestSOCKS5Controller_RecvLoop_StalledStream(t *testing.T) {
+	decryptUC := &scriptedDecryptUseCase{cells: make(chan *usecase.DecryptedCellData)}
+	sendmeUC := &recordingSendmeUseCase{sent: make(chan uint16, 4)}
+	controller := NewSOCKS5Controller(
+		nil, nil, nil, nil,
+		&mockHandleEndUseCase{},
+		nil,
+		&mockReceiveCellUseCase{},
+		decryptUC,
+		sendmeUC,
+		nil, nil,
+		3,
+		0,
+	)
+	stalledApp, stalled := net.Pipe()
+	app, active := net.Pipe()
+	defer stalledApp.Close()
+	defer app.Close()
+	controller.register("circuit", 1, stalled)
+	controller.register("circuit", 2, active)
+
+	done := make(chan struct{})
+	go func() {
+		controller.recvLoop("circuit")
+		close(done)
+	}()
+	send := func(cell *usecase.DecryptedCellData) {
+		t.Helper()
+		select {
+		case decryptUC.cells <- cell:
+		case <-time.After(time.Second):
+			t.Fatal("receive loop blocked")
+		}
+	}
+	send(&usecase.DecryptedCellData{Command: vo.CmdData, StreamID: 1, Data: []byte("stalled")})
+	send(&usecase.DecryptedCellData{Command: vo.CmdData, StreamID: 2, Data: []byte("hello")})
+
+	app.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(app, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("active stream read %q, %v", buf, err)
+	}
+	if sid := <-sendmeUC.sent; sid != 2 {
+		t.Errorf("SENDME for stream %d, want the active stream 2", sid)
+	}
+	select {
+	case sid := <-sendmeUC.sent:
+		t.Fatalf("SENDME for stream %d before its application read", sid)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the data the stalled application takes late is acknowledged then
+	buf = make([]byte, 7)
+	if _, err := io.ReadFull(stalledApp, buf); err != nil {
+		t.Fatalf("stalled stream read: %v", err)
+	}
+	select {
+	case sid := <-sendmeUC.sent:
+		if sid != 1 {
+			t.Errorf("SENDME for stream %d, want 1", sid)
+		}
+	case <-time.After(time.Second):
+		t.Error("no SENDME once the stalled application read")
+	}
+
+	close(decryptUC.cells)
+	<-done
+}
+
+// userPassRequest returns a SOCKS5 CONNECT to 10.0.0.1:80 that
+// authenticates with user and pass.
+func userPassRequest(user, pass string) []byte {
+	req := []byte{0x05, 0x02, 0x00, 0x02, 0x01, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+	return append(req, 0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x00, 0x50)
+}
+
+func TestSOCKS5Controller_HandleConnection_IsolatesByCredentials(t *testing.T) {
+	acquireUC := &mockAcquireCircuitUseCase{circuitID: "isolated", streamID: 1}
+	controller := NewSOCKS5Controller(
+		acquireUC,
+		&mockSendConnectUseCase{},
+		&mockCloseStreamUseCase{},
+		&mockSendDataUseCase{},
+		&mockHandleEndUseCase{},
+		&mockResolveTargetAddressUseCase{dialAddress: "10.0.0.1:80"},
+		&mockReceiveCellUseCase{isEOF: true},
+		&mockDecryptCellDataUseCase{},
+		&mockSendSendmeUseCase{},
+		&mockAwaitStreamUseCase{},
+		&mockPayloadEncodingService{beginPayload: []byte("begin-payload")},
+		3,
+		vo.IsolateSOCKSAuth,
+	)
+
+	for _, creds := range [][2]string{{"alice", "pw"}, {"bob", "pw"}, {"alice", "pw"}, {"alice", "other"}} {
+		conn := &mockConnection{readData: userPassRequest(creds[0], creds[1])}
+		controller.HandleConnection(conn)
+
+		written := conn.writeData.Bytes()
+		want := append(append([]byte{}, vo.SOCKS5UserPassResp...), vo.SOCKS5UserPassOKResp...)
+		if !bytes.HasPrefix(written, want) {
+			t.Fatalf("auth replies = %x, want prefix %x", written, want)
+		}
+	}
+
+	keys := acquireUC.keys
+	if len(keys) != 4 {
+		t.Fatalf("acquired %d times, want 4", len(keys))
+	}
+	if keys[0] != keys[2] {
+		t.Errorf("same credentials got keys %q and %q", keys[0], keys[2])
+	}
+	if keys[0] == keys[1] || keys[0] == keys[3] {
+		t.Errorf("different credentials share a key: %q", keys)
+	}
+}
+
+func TestSOCKS5Controller_HandleConnection_NoAcceptableMethod(t *testing.T) {
+	// only GSSAPI is offered
+	conn := &mockConnection{readData: []byte{0x05, 0x01, 0x01}}
+	controller := NewSOCKS5Controller(
+		nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil,
+		3,
+		vo.IsolateSOCKSAuth,
+	)
+	controller.HandleConnection(conn)
+
+	if got := conn.writeData.Bytes(); !bytes.Equal(got, vo.SOCKS5NoMethodResp) {
+		t.Errorf("reply = %x, want %x", got, vo.SOCKS5NoMethodResp)
+	}
+}
+
+func TestSOCKS5Controller_HandleConnection_ReplyAddress(t *testing.T) {
+	ipv4Req := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x00, 0x50}
+	ipv6Req := append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x04}, net.ParseIP("2001:db8::1")...)
+	ipv6Req = append(ipv6Req, 0x00, 0x50)
+
+	tests := []struct {
+		name     string
+		req      []byte
+		bound    string
+		awaitErr error
+		wantHost string
+		want     []byte
+	}{
+		{"ipv4 without bound address", ipv4Req, "", nil, "10.0.0.1", vo.SOCKS5Reply(vo.SOCKS5RespSuccess)},
+		{"ipv4 bound", ipv4Req, "192.0.2.7:80", nil, "10.0.0.1",
+			vo.SOCKS5ReplyAddr(vo.SOCKS5RespSuccess, &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 80})},
+		{"ipv6 bound", ipv6Req, "[2001:db8::1]:80", nil, "2001:db8::1",
+			vo.SOCKS5ReplyAddr(vo.SOCKS5RespSuccess, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80})},
+		{"ipv6 without bound address", ipv6Req, "", nil, "2001:db8::1",
+			vo.SOCKS5ReplyAddr(vo.SOCKS5RespSuccess, &net.TCPAddr{IP: net.IPv6zero})},
+		{"ipv6 refused", ipv6Req, "", &entity.StreamRefusedError{Reason: vo.EndReasonConnectRefused}, "2001:db8::1",
+			vo.SOCKS5ReplyAddr(vo.SOCKS5RespConnRefused, &net.TCPAddr{IP: net.IPv6zero})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &mockConnection{readData: tt.req}
+			resolveUC := &mockResolveTargetAddressUseCase{dialAddress: "[2001:db8::1]:80"}
+			controller := NewSOCKS5Controller(
+				&mockAcquireCircuitUseCase{circuitID: "reply-address", streamID: 1},
+				&mockSendConnectUseCase{},
+				&mockCloseStreamUseCase{},
+				&mockSendDataUseCase{},
+				&mockHandleEndUseCase{},
+				resolveUC,
+				&mockReceiveCellUseCase{isEOF: true},
+				&mockDecryptCellDataUseCase{},
+				&mockSendSendmeUseCase{},
+				&mockAwaitStreamUseCase{err: tt.awaitErr, bound: tt.bound},
+				&mockPayloadEncodingService{beginPayload: []byte("begin-payload")},
+				3,
+				0,
+			)
+			controller.HandleConnection(conn)
+
+			if resolveUC.host != tt.wantHost {
+				t.Errorf("resolved host = %q, want %q", resolveUC.host, tt.wantHost)
+			}
+			got := conn.writeData.Bytes()[len(vo.SOCKS5HandshakeResp):]
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("reply = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+// tcpAddrConn gives one end of a pipe the addresses of a TCP connection
+// from 127.0.0.1.
+type tcpAddrConn struct {
+	net.Conn
+}
+
+func (c tcpAddrConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+}
+
+func (c tcpAddrConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+}
+
+func TestSOCKS5Controller_HandleConnection_UDPAssociate(t *testing.T) {
+	sendUC := &mockSendDataUseCase{sent: make(chan usecase.SendDataInput, 4)}
+	controller := NewSOCKS5Controller(
+		&mockAcquireCircuitUseCase{circuitID: "test-circuit-udp", streamID: 5, reused: true},
+		&mockSendConnectUseCase{},
+		&mockCloseStreamUseCase{},
+		sendUC,
+		&mockHandleEndUseCase{},
+		&mockResolveTargetAddressUseCase{},
+		nil, nil, nil,
+		&mockAwaitStreamUseCase{},
+		&mockPayloadEncodingService{beginPayload: []byte("begin-payload")},
+		3,
+		0,
+	)
+
+	app, proxy := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		controller.HandleConnection(tcpAddrConn{proxy})
+		close(done)
+	}()
+
+	// UDP ASSOCIATE from an unknown port
+	go app.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(app, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[3] != vo.SOCKS5RespSuccess || reply[5] != vo.SOCKS5AddrIPv4 {
+		t.Fatalf("reply = %x", reply[2:])
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[6:10]), Port: int(reply[10])<<8 | int(reply[11])}
+	if begin := <-sendUC.sent; begin.Cmd != vo.CmdBeginUDP || begin.StreamID != 5 {
+		t.Fatalf("first cell %s for stream %d, want BEGIN_UDP for 5", begin.Cmd, begin.StreamID)
+	}
+
+	// a request goes out as a DATAGRAM cell without RSV and FRAG
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer client.Close()
+	query, _ := vo.Datagram{Host: "10.0.0.53", Port: 53, Data: []byte("query")}.Bytes()
+	client.WriteToUDP(append([]byte{0, 0, 0}, query...), relayAddr)
+	select {
+	case in := <-sendUC.sent:
+		if in.Cmd != vo.CmdDatagram || in.CircuitID != "test-circuit-udp" || !bytes.Equal(in.Data, query) {
+			t.Fatalf("sent %s %x, want DATAGRAM %x", in.Cmd, in.Data, query)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("datagram not relayed")
+	}
+
+	// the exit's answer reaches the application as a SOCKS5 UDP reply
+	answer, _ := vo.Datagram{Host: "10.0.0.53", Port: 53, Data: []byte("answer")}.Bytes()
+	stream, ok := controller.lookup("test-circuit-udp", 5)
+	if !ok {
+		t.Fatal("association not registered")
+	}
+	stream.Write(answer)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 512)
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("read answer: %v", err)
+	}
+	if !bytes.Equal(buf[:n], append([]byte{0, 0, 0}, answer...)) {
+		t.Errorf("answer = %x", buf[:n])
+	}
+
+	// closing the control connection ends the association
+	app.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("association outlived its control connection")
+	}
+	if _, ok := controller.lookup("test-circuit-udp", 5); ok {
+		t.Error("association still registered")
+	}
 }
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"ikedadada/go-ptor/cmd/client/usecase"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+// maxDatagramSize is the largest UDP datagram read from an application.
+const maxDatagramSize = 64 * 1024
+
+// udpRequestHeaderSize is the size of the RSV and FRAG fields in front of
+// the address of a SOCKS5 UDP request.
+const udpRequestHeaderSize = 3
+
+// udpAssociation is the local end of a SOCKS5 UDP association. It sits in
+// the stream table like the connection of a TCP stream: Write hands a
+// datagram from the exit to the application and Close ends the
+// association together with its control connection.
+type udpAssociation struct {
+	*net.UDPConn
+	control    net.Conn
+	clientIP   net.IP // only datagrams from this IP are relayed; nil takes any
+	clientPort int    // if not zero, only datagrams from this port
+
+	mu     sync.Mutex
+	client *net.UDPAddr // where replies go: the source of the last datagram
+}
+
+// accept reports whether a datagram from addr comes from the application
+// that asked for the association, and makes addr the reply address if so.
+func (a *udpAssociation) accept(addr *net.UDPAddr) bool {
+	if a.clientIP != nil && !a.clientIP.Equal(addr.IP) {
+		return false
+	}
+	if a.clientPort != 0 && a.clientPort != addr.Port {
+		return false
+	}
+	a.mu.Lock()
+	a.client = addr
+	a.mu.Unlock()
+	return true
+}
+
+// Write sends b, a datagram as DATAGRAM cells carry it, to the application
+// as a SOCKS5 UDP reply. It is dropped while the application has not sent
+// anything yet, since there is nowhere to send it.
+func (a *udpAssociation) Write(b []byte) (int, error) {
+	a.mu.Lock()
+	client := a.client
+	a.mu.Unlock()
+	if client == nil {
+		return len(b), nil
+	}
+	pkt := append(make([]byte, udpRequestHeaderSize, udpRequestHeaderSize+len(b)), b...)
+	if _, err := a.WriteToUDP(pkt, client); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (a *udpAssociation) Close() error {
+	a.control.Close()
+	return a.UDPConn.Close()
+}
+
+// associate serves a UDP ASSOCIATE request. The application sends its
+// datagrams to a local UDP socket, which relays them through a UDP stream
+// to the exit. The association lasts as long as the control connection.
+// port is the source port the application announced, or zero.
+func (c *SOCKS5Controller) associate(conn net.Conn, isolationKey string, port int, ipv6 bool) {
+	// listen where the application reached us, and take datagrams only
+	// from the host it connected from
+	var localIP, clientIP net.IP
+	if tcp, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = tcp.IP
+	}
+	if tcp, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = tcp.IP
+	}
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		log.Printf("listen udp: %v", err)
+		conn.Write(socks5Reply(vo.SOCKS5RespGeneralError, nil, ipv6))
+		return
+	}
+	assoc := &udpAssociation{UDPConn: sock, control: conn, clientIP: clientIP, clientPort: port}
+
+	circuitID, streamID, _, err := c.attach(assoc, vo.CmdBeginUDP, "", "", isolationKey, 0)
+	if err != nil {
+		log.Printf("open udp stream: %v", err)
+		sock.Close()
+		conn.Write(socks5Reply(socks5FailureCode(err), nil, ipv6))
+		return
+	}
+	local := sock.LocalAddr().(*net.UDPAddr)
+	log.Printf("udp association established cid=%s sid=%d local=%s", circuitID, streamID, local)
+	conn.Write(socks5Reply(vo.SOCKS5RespSuccess, &net.TCPAddr{IP: local.IP, Port: local.Port}, ipv6))
+
+	go c.relayDatagrams(assoc, circuitID, streamID)
+
+	// nothing more is sent on the control connection; wait for it to close
+	_, _ = io.Copy(io.Discard, conn)
+	log.Printf("udp association closed cid=%s sid=%d", circuitID, streamID)
+	c.forget(circuitID, streamID, true)
+	c.closeStream(circuitID, streamID)
+}
+
+// relayDatagrams sends the application's datagrams into the UDP stream
+// until the association is closed. Fragmented requests are dropped, as
+// RFC 1928 allows.
+func (c *SOCKS5Controller) relayDatagrams(assoc *udpAssociation, circuitID string, streamID uint16) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := assoc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !assoc.accept(from) {
+			log.Printf("drop datagram from stranger %s cid=%s sid=%d", from, circuitID, streamID)
+			continue
+		}
+		if n < udpRequestHeaderSize || buf[2] != 0 {
+			log.Printf("drop fragmented datagram cid=%s sid=%d", circuitID, streamID)
+			continue
+		}
+		data := buf[udpRequestHeaderSize:n]
+		if _, err := vo.DatagramFrom(data); err != nil {
+			log.Printf("drop datagram cid=%s sid=%d: %v", circuitID, streamID, err)
+			continue
+		}
+		if len(data) > service.MaxRelayDataSize {
+			log.Printf("drop datagram cid=%s sid=%d: %d bytes with address, a cell holds %d", circuitID, streamID, len(data), service.MaxRelayDataSize)
+			continue
+		}
+		if _, err := c.sendUC.Handle(usecase.SendDataInput{
+			CircuitID: circuitID,
+			StreamID:  streamID,
+			Data:      data,
+			Cmd:       vo.CmdDatagram,
+		}); err != nil {
+			log.Printf("failed to send datagram cid=%s sid=%d: %v", circuitID, streamID, err)
+			assoc.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+)
+
+// streamQueueSize bounds the cells waiting for one application. The exit
+// sends no more than a stream window before the SENDME that only a written
+// cell triggers, so a well-behaved exit never fills it; the extra slot is
+// for the END that follows.
+const streamQueueSize = entity.StreamWindowStart + 1
+
+// streamChunk is data for the application and what to do once it has
+// been written.
+type streamChunk struct {
+	data    []byte
+	written func() // optional
+}
+
+// streamWriter hands the data of one stream to the application from its
+// own goroutine, so an application that stops reading holds up neither
+// the receive loop nor the other streams of its circuit.
+type streamWriter struct {
+	conn     net.Conn
+	queue    chan streamChunk
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newStreamWriter(conn net.Conn) *streamWriter {
+	w := &streamWriter{
+		conn:  conn,
+		queue: make(chan streamChunk, streamQueueSize),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// enqueue queues chunk without blocking. It reports false if the queue is
+// full or the writer has stopped.
+func (w *streamWriter) enqueue(chunk streamChunk) bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+	}
+	select {
+	case w.queue <- chunk:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop ends the writer. Chunks still queued are dropped.
+func (w *streamWriter) stop() {
+	w.stopOnce.Do(func() { close(w.done) })
+}
+
+func (w *streamWriter) run() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case chunk := <-w.queue:
+			if len(chunk.data) > 0 {
+				if _, err := w.conn.Write(chunk.data); err != nil {
+					log.Printf("write to application: %v", err)
+				}
+			}
+			if chunk.written != nil {
+				chunk.written()
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+
+	"ikedadada/go-ptor/shared/domain/repository"
+)
+
+// The virtual address ranges are the ones Tor uses for its automapped
+// addresses, so applications that special-case them keep working.
+var (
+	virtualIPv4Net = &net.IPNet{IP: net.IPv4(127, 192, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+	virtualIPv6Net = &net.IPNet{IP: net.ParseIP("fe80::"), Mask: net.CIDRMask(10, 128)}
+)
+
+// ErrVirtualAddressesExhausted is returned once every address of a virtual
+// range is taken.
+var ErrVirtualAddressesExhausted = errors.New("virtual addresses exhausted")
+
+type addressMapRepository struct {
+	mu    sync.Mutex
+	hosts map[string]string    // virtual address -> host
+	addrs map[string][2]net.IP // host -> IPv4 and IPv6 address
+	next  [2]int64             // offset of the next IPv4 and IPv6 address
+}
+
+// NewAddressMapRepository creates an in-memory address map. Mappings last
+// as long as the process.
+func NewAddressMapRepository() repository.AddressMapRepository {
+	return &addressMapRepository{
+		hosts: make(map[string]string),
+		addrs: make(map[string][2]net.IP),
+		next:  [2]int64{1, 1}, // skip the network address
+	}
+}
+
+func (r *addressMapRepository) Map(host string, ipv6 bool) (net.IP, error) {
+	host = strings.ToLower(host)
+	family, network := 0, virtualIPv4Net
+	if ipv6 {
+		family, network = 1, virtualIPv6Net
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addrs := r.addrs[host]
+	if ip := addrs[family]; ip != nil {
+		return ip, nil
+	}
+	ip, err := nthAddress(network, r.next[family])
+	if err != nil {
+		return nil, err
+	}
+	r.next[family]++
+	addrs[family] = ip
+	r.addrs[host] = addrs
+	r.hosts[ip.String()] = host
+	return ip, nil
+}
+
+func (r *addressMapRepository) Lookup(ip net.IP) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	host, ok := r.hosts[ip.String()]
+	return host, ok
+}
+
+// nthAddress returns the address n places into network, leaving out the
+// last one of the range.
+func nthAddress(network *net.IPNet, n int64) (net.IP, error) {
+	ones, bits := network.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	offset := big.NewInt(n)
+	if offset.Cmp(new(big.Int).Sub(size, big.NewInt(1))) >= 0 {
+		return nil, ErrVirtualAddressesExhausted
+	}
+	sum := new(big.Int).Add(new(big.Int).SetBytes(network.IP), offset).Bytes()
+	ip := make(net.IP, bits/8)
+	copy(ip[len(ip)-len(sum):], sum)
+	return ip, nil
+}
@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestAddressMapRepository_MapAndLookup(t *testing.T) {
+	repo := NewAddressMapRepository()
+
+	v4, err := repo.Map("Abc.ptor", false)
+	if err != nil {
+		t.Fatalf("map: %v", err)
+	}
+	if !virtualIPv4Net.Contains(v4) || v4.To4() == nil {
+		t.Errorf("IPv4 address %s outside %s", v4, virtualIPv4Net)
+	}
+	v6, err := repo.Map("abc.ptor", true)
+	if err != nil {
+		t.Fatalf("map: %v", err)
+	}
+	if !virtualIPv6Net.Contains(v6) || v6.To4() != nil {
+		t.Errorf("IPv6 address %s outside %s", v6, virtualIPv6Net)
+	}
+
+	again, _ := repo.Map("ABC.ptor", false)
+	if !again.Equal(v4) {
+		t.Errorf("second mapping %s, want %s", again, v4)
+	}
+	other, _ := repo.Map("def.ptor", false)
+	if other.Equal(v4) {
+		t.Errorf("two hosts share %s", other)
+	}
+
+	for _, ip := range []net.IP{v4, v6} {
+		if host, ok := repo.Lookup(ip); !ok || host != "abc.ptor" {
+			t.Errorf("Lookup(%s) = %q, %v", ip, host, ok)
+		}
+	}
+	if _, ok := repo.Lookup(net.IPv4(127, 0, 0, 1)); ok {
+		t.Error("unmapped address found")
+	}
+}
+
+func TestAddressMapRepository_Exhausted(t *testing.T) {
+	network := &net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(30, 32)}
+	for n, want := range map[int64]string{1: "10.0.0.1", 2: "10.0.0.2"} {
+		if ip, err := nthAddress(network, n); err != nil || ip.String() != want {
+			t.Errorf("nthAddress(%d) = %s, %v, want %s", n, ip, err, want)
+		}
+	}
+	if _, err := nthAddress(network, 3); !errors.Is(err, ErrVirtualAddressesExhausted) {
+		t.Errorf("err = %v, want %v", err, ErrVirtualAddressesExhausted)
+	}
+}
@@ -0,0 +1,84 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"ikedadada/go-ptor/shared/domain/repository"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// buildTimeStateDTO is the layout of the build time state file.
+type buildTimeStateDTO struct {
+	BuildTimes []buildTimeDTO `json:"build_times"`
+}
+
+type buildTimeDTO struct {
+	Hops      int   `json:"hops"`
+	ElapsedMS int64 `json:"elapsed_ms"`
+	TimedOut  bool  `json:"timed_out,omitempty"`
+}
+
+type buildTimeRepository struct {
+	mu    sync.Mutex
+	path  string
+	times []vo.BuildTime
+}
+
+// NewBuildTimeRepository creates a build time repository that keeps its
+// state in the JSON file at path, loading the build times saved there.
+// Every change is written back at once. An empty path keeps the build
+// times in memory only.
+func NewBuildTimeRepository(path string) (repository.BuildTimeRepository, error) {
+	r := &buildTimeRepository{path: path}
+	if path == "" {
+		return r, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read build time state: %w", err)
+	}
+	var state buildTimeStateDTO
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("parse build time state %s: %w", path, err)
+	}
+	for _, t := range state.BuildTimes {
+		if t.Hops <= 0 || t.ElapsedMS < 0 {
+			return nil, fmt.Errorf("build time state %s: invalid entry %+v", path, t)
+		}
+		r.times = append(r.times, vo.BuildTime{Hops: t.Hops, Elapsed: time.Duration(t.ElapsedMS) * time.Millisecond, TimedOut: t.TimedOut})
+	}
+	return r, nil
+}
+
+func (r *buildTimeRepository) All() ([]vo.BuildTime, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.times), nil
+}
+
+func (r *buildTimeRepository) Save(times []vo.BuildTime) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.times = slices.Clone(times)
+	if r.path == "" {
+		return nil
+	}
+	state := buildTimeStateDTO{BuildTimes: make([]buildTimeDTO, len(r.times))}
+	for i, t := range r.times {
+		state.BuildTimes[i] = buildTimeDTO{Hops: t.Hops, ElapsedMS: t.Elapsed.Milliseconds(), TimedOut: t.TimedOut}
+	}
+	if err := writeStateFile(r.path, state); err != nil {
+		return fmt.Errorf("build time state: %w", err)
+	}
+	return nil
+}
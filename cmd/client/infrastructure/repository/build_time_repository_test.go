@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+func TestBuildTimeRepository_Persists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "build_times.json")
+	repo, err := NewBuildTimeRepository(path)
+	if err != nil {
+		t.Fatalf("new repository: %v", err)
+	}
+	if ts, _ := repo.All(); len(ts) != 0 {
+		t.Fatalf("fresh repository has %d build times", len(ts))
+	}
+	want := []vo.BuildTime{
+		{Hops: 3, Elapsed: 420 * time.Millisecond},
+		{Hops: 3, Elapsed: 2 * time.Second, TimedOut: true},
+		{Hops: 1, Elapsed: 35 * time.Millisecond},
+	}
+	if err := repo.Save(want); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	again, err := NewBuildTimeRepository(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got, _ := again.All(); !slices.Equal(got, want) {
+		t.Errorf("reloaded %+v, want %+v", got, want)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary state file left behind")
+	}
+}
+
+func TestBuildTimeRepository_BadState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "build_times.json")
+	if err := os.WriteFile(path, []byte(`{"build_times":[{"hops":0,"elapsed_ms":10}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBuildTimeRepository(path); err == nil {
+		t.Error("expected error for a build without hops")
+	}
+	if err := os.WriteFile(path, []byte(`not json`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBuildTimeRepository(path); err == nil {
+		t.Error("expected error for a malformed state file")
+	}
+}
@@ -122,6 +122,11 @@ func (r *connStateRepository) RemoveStream(circuitID vo.CircuitID, streamID vo.S
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	// Wake a sender waiting for a SENDME on this stream
+	if st, ok := r.m[circuitID]; ok {
+		st.CloseStreamWindow(streamID)
+	}
+
 	streams, exists := r.streams[circuitID]
 	if !exists {
 		return nil
@@ -146,11 +151,15 @@ func (r *connStateRepository) DestroyAllStreams(circuitID vo.CircuitID) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	st := r.m[circuitID]
 	if streams, exists := r.streams[circuitID]; exists {
-		for _, conn := range streams {
+		for sid, conn := range streams {
 			if conn != nil {
 				conn.Close()
 			}
+			if st != nil {
+				st.CloseStreamWindow(sid)
+			}
 		}
 		delete(r.streams, circuitID)
 	}
@@ -15,7 +15,7 @@ import (
 func TestConnStateRepo_AddFindDelete(t *testing.T) {
 	repo := repoimpl.NewConnStateRepository(time.Second)
 	id := vo.NewCircuitID()
-	st := entity.NewConnState(vo.AESKey{}, vo.Nonce{}, nil, nil)
+	st := entity.NewConnState(vo.AESKey{}, vo.AESKey{}, vo.Nonce{}, nil, nil)
 	if err := repo.Add(id, st); err != nil {
 		t.Fatalf("add: %v", err)
 	}
@@ -37,7 +37,7 @@ func TestConnStateRepo_GC(t *testing.T) {
 	up, down := net.Pipe()
 	defer up.Close()
 	defer down.Close()
-	st := entity.NewConnState(vo.AESKey{}, vo.Nonce{}, up, down)
+	st := entity.NewConnState(vo.AESKey{}, vo.AESKey{}, vo.Nonce{}, up, down)
 	if err := repo.Add(id, st); err != nil {
 		t.Fatalf("add: %v", err)
 	}
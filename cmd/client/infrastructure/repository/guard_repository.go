@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	"ikedadada/go-ptor/shared/domain/repository"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// guardStateDTO is the layout of the guard state file.
+type guardStateDTO struct {
+	Guards []guardDTO `json:"guards"`
+}
+
+type guardDTO struct {
+	RelayID     string    `json:"relay_id"`
+	SampledAt   time.Time `json:"sampled_at"`
+	ConfirmedAt time.Time `json:"confirmed_at,omitzero"`
+	FailedAt    time.Time `json:"failed_at,omitzero"`
+	Failures    int       `json:"failures,omitempty"`
+}
+
+type guardRepository struct {
+	mu     sync.Mutex
+	path   string
+	guards []*entity.Guard // in the order they were sampled
+}
+
+// NewGuardRepository creates a guard repository that keeps its state in
+// the JSON file at path, loading the guards saved there. Every change is
+// written back at once. An empty path keeps the guards in memory only.
+func NewGuardRepository(path string) (repository.GuardRepository, error) {
+	r := &guardRepository{path: path}
+	if path == "" {
+		return r, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read guard state: %w", err)
+	}
+	var state guardStateDTO
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("parse guard state %s: %w", path, err)
+	}
+	for _, g := range state.Guards {
+		id, err := vo.NewRelayID(g.RelayID)
+		if err != nil {
+			return nil, fmt.Errorf("guard state %s: invalid relay id %q: %w", path, g.RelayID, err)
+		}
+		r.guards = append(r.guards, entity.RestoreGuard(id, g.SampledAt, g.ConfirmedAt, g.FailedAt, g.Failures))
+	}
+	return r, nil
+}
+
+func (r *guardRepository) All() ([]*entity.Guard, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.guards), nil
+}
+
+func (r *guardRepository) Save(g *entity.Guard) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.index(g.RelayID())
+	if i < 0 {
+		r.guards = append(r.guards, g)
+	} else {
+		r.guards[i] = g
+	}
+	return r.flush()
+}
+
+func (r *guardRepository) Delete(id vo.RelayID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.index(id)
+	if i < 0 {
+		return nil
+	}
+	r.guards = slices.Delete(r.guards, i, i+1)
+	return r.flush()
+}
+
+func (r *guardRepository) index(id vo.RelayID) int {
+	return slices.IndexFunc(r.guards, func(g *entity.Guard) bool { return g.RelayID().Equal(id) })
+}
+
+// flush writes the guards to the state file. The caller must hold r.mu.
+func (r *guardRepository) flush() error {
+	if r.path == "" {
+		return nil
+	}
+	state := guardStateDTO{Guards: make([]guardDTO, len(r.guards))}
+	for i, g := range r.guards {
+		state.Guards[i] = guardDTO{
+			RelayID:     g.RelayID().String(),
+			SampledAt:   g.SampledAt(),
+			ConfirmedAt: g.ConfirmedAt(),
+			FailedAt:    g.FailedAt(),
+			Failures:    g.Failures(),
+		}
+	}
+	if err := writeStateFile(r.path, state); err != nil {
+		return fmt.Errorf("guard state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+func TestGuardRepository_Persists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "guards.json")
+	repo, err := NewGuardRepository(path)
+	if err != nil {
+		t.Fatalf("new repository: %v", err)
+	}
+	if gs, _ := repo.All(); len(gs) != 0 {
+		t.Fatalf("fresh repository has %d guards", len(gs))
+	}
+
+	sampled := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	a, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	b, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440001")
+	c, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440002")
+	ga := entity.NewGuard(a, sampled)
+	for _, g := range []*entity.Guard{ga, entity.NewGuard(b, sampled.Add(time.Minute)), entity.NewGuard(c, sampled.Add(2*time.Minute))} {
+		if err := repo.Save(g); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	ga.Confirm(sampled.Add(time.Hour))
+	ga.Fail(sampled.Add(2 * time.Hour))
+	if err := repo.Save(ga); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := repo.Delete(b); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	again, err := NewGuardRepository(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	gs, _ := again.All()
+	if len(gs) != 2 || !gs[0].RelayID().Equal(a) || !gs[1].RelayID().Equal(c) {
+		t.Fatalf("reloaded %d guards, want %s and %s in order", len(gs), a, c)
+	}
+	got := gs[0]
+	if !got.SampledAt().Equal(sampled) || !got.ConfirmedAt().Equal(sampled.Add(time.Hour)) ||
+		!got.FailedAt().Equal(sampled.Add(2*time.Hour)) || got.Failures() != 1 {
+		t.Errorf("reloaded guard %+v does not match the saved one", got)
+	}
+	if !gs[1].ConfirmedAt().IsZero() {
+		t.Errorf("unconfirmed guard reloaded as confirmed at %v", gs[1].ConfirmedAt())
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary state file left behind")
+	}
+}
+
+func TestGuardRepository_BadState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "guards.json")
+	if err := os.WriteFile(path, []byte(`{"guards":[{"relay_id":"nope"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewGuardRepository(path); err == nil {
+		t.Error("expected error for an invalid relay id")
+	}
+	if err := os.WriteFile(path, []byte(`not json`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewGuardRepository(path); err == nil {
+		t.Error("expected error for a malformed state file")
+	}
+}
+
+func TestGuardRepository_InMemory(t *testing.T) {
+	repo, err := NewGuardRepository("")
+	if err != nil {
+		t.Fatalf("new repository: %v", err)
+	}
+	id, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	if err := repo.Save(entity.NewGuard(id, time.Now())); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if gs, _ := repo.All(); len(gs) != 1 {
+		t.Errorf("got %d guards, want 1", len(gs))
+	}
+}
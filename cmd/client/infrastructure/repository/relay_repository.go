@@ -23,9 +23,14 @@ func NewRelayRepository(httpClient http.HTTPClient, directoryURL string) (reposi
 
 	url := strings.TrimRight(directoryURL, "/") + "/relays"
 	type relayDTO struct {
-		ID       string `json:"id"`
-		Endpoint string `json:"endpoint"`
-		PubKey   string `json:"pubkey"`
+		ID                string   `json:"id"`
+		Endpoint          string   `json:"endpoint"`
+		PubKey            string   `json:"pubkey"`
+		ExitPolicy        string   `json:"exit_policy"`
+		Bandwidth         uint32   `json:"bandwidth"`
+		MeasuredBandwidth uint32   `json:"measured_bandwidth"`
+		Flags             []string `json:"flags"`
+		Family            []string `json:"family"`
 	}
 
 	var rs []relayDTO
@@ -65,8 +70,29 @@ func NewRelayRepository(httpClient http.HTTPClient, directoryURL string) (reposi
 			return nil, fmt.Errorf("parse pubkey: %w", err)
 		}
 
+		// Relays that publish no exit policy are taken to use the default
+		policy := vo.DefaultExitPolicy()
+		if r.ExitPolicy != "" {
+			if policy, err = vo.ParseExitPolicy(r.ExitPolicy); err != nil {
+				return nil, fmt.Errorf("parse exit policy of relay %s: %w", r.ID, err)
+			}
+		}
+
+		family := make([]vo.RelayID, 0, len(r.Family))
+		for _, f := range r.Family {
+			fid, err := vo.NewRelayID(f)
+			if err != nil {
+				return nil, fmt.Errorf("invalid family member %q of relay %s: %w", f, r.ID, err)
+			}
+			family = append(family, fid)
+		}
+
 		// Create relay entity and set online
 		relay := entity.NewRelay(rid, ep, pk)
+		relay.SetExitPolicy(policy)
+		relay.SetBandwidth(vo.Bandwidth{Advertised: r.Bandwidth, Measured: r.MeasuredBandwidth})
+		relay.SetFlags(vo.ParseRelayFlags(r.Flags))
+		relay.SetFamily(family)
 		relay.SetOnline()
 
 		// Append to slice
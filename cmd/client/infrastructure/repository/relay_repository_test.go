@@ -3,7 +3,9 @@ package repository_test
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"testing"
 
@@ -148,3 +150,124 @@ func TestRelayRepo_AllOnline(t *testing.T) {
 		t.Errorf("expected only online relay, got %+v", list)
 	}
 }
+
+// testPubKeyPEM returns a fresh RSA public key in PEM form.
+func testPubKeyPEM(t *testing.T) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal pkix: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestRelayRepo_ExitPolicy(t *testing.T) {
+	type relayDTO struct {
+		ID         string `json:"id"`
+		Endpoint   string `json:"endpoint"`
+		PubKey     string `json:"pubkey"`
+		ExitPolicy string `json:"exit_policy,omitempty"`
+	}
+
+	pemStr := testPubKeyPEM(t)
+	mockClient := &mockHTTPClient{
+		response: []relayDTO{
+			{ID: "550e8400-e29b-41d4-a716-446655440000", Endpoint: "127.0.0.1:5000", PubKey: pemStr, ExitPolicy: "accept *:443,reject *:*"},
+			{ID: "550e8400-e29b-41d4-a716-446655440001", Endpoint: "127.0.0.1:5001", PubKey: pemStr},
+		},
+	}
+	repo, err := repoImpl.NewRelayRepository(mockClient, "http://test.com")
+	if err != nil {
+		t.Fatalf("NewRelayRepository: %v", err)
+	}
+
+	id, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	r, err := repo.FindByID(id)
+	if err != nil {
+		t.Fatalf("FindByID: %v", err)
+	}
+	if !r.ExitPolicy().AllowsPort(443) || r.ExitPolicy().AllowsPort(22) {
+		t.Errorf("published policy not applied: %s", r.ExitPolicy())
+	}
+
+	// a relay publishing no policy is taken to use the default one
+	id, _ = vo.NewRelayID("550e8400-e29b-41d4-a716-446655440001")
+	if r, err = repo.FindByID(id); err != nil {
+		t.Fatalf("FindByID: %v", err)
+	}
+	if got, want := r.ExitPolicy().String(), vo.DefaultExitPolicy().String(); got != want {
+		t.Errorf("policy = %s, want default %s", got, want)
+	}
+
+	mockClient.response = []relayDTO{{ID: "550e8400-e29b-41d4-a716-446655440000", Endpoint: "127.0.0.1:5000", PubKey: pemStr, ExitPolicy: "allow everything"}}
+	if _, err := repoImpl.NewRelayRepository(mockClient, "http://test.com"); err == nil {
+		t.Errorf("expected error for a malformed exit policy")
+	}
+}
+
+func TestRelayRepo_BandwidthAndFlags(t *testing.T) {
+	type relayDTO struct {
+		ID                string   `json:"id"`
+		Endpoint          string   `json:"endpoint"`
+		PubKey            string   `json:"pubkey"`
+		Bandwidth         uint32   `json:"bandwidth,omitempty"`
+		MeasuredBandwidth uint32   `json:"measured_bandwidth,omitempty"`
+		Flags             []string `json:"flags,omitempty"`
+	}
+	mockClient := &mockHTTPClient{
+		response: []relayDTO{
+			{ID: "550e8400-e29b-41d4-a716-446655440000", Endpoint: "127.0.0.1:5000", PubKey: testPubKeyPEM(t), Bandwidth: 2000, MeasuredBandwidth: 1500, Flags: []string{"Guard", "Fast", "Running"}},
+		},
+	}
+	repo, err := repoImpl.NewRelayRepository(mockClient, "http://test.com")
+	if err != nil {
+		t.Fatalf("NewRelayRepository: %v", err)
+	}
+	id, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	r, err := repo.FindByID(id)
+	if err != nil {
+		t.Fatalf("FindByID: %v", err)
+	}
+	if got, want := r.Bandwidth(), (vo.Bandwidth{Advertised: 2000, Measured: 1500}); got != want {
+		t.Errorf("bandwidth = %+v, want %+v", got, want)
+	}
+	if got, want := r.Flags(), vo.RelayFlagGuard|vo.RelayFlagFast; got != want {
+		t.Errorf("flags = %s, want %s", got, want)
+	}
+}
+
+func TestRelayRepo_Family(t *testing.T) {
+	type relayDTO struct {
+		ID       string   `json:"id"`
+		Endpoint string   `json:"endpoint"`
+		PubKey   string   `json:"pubkey"`
+		Family   []string `json:"family,omitempty"`
+	}
+	pemStr := testPubKeyPEM(t)
+	mockClient := &mockHTTPClient{
+		response: []relayDTO{
+			{ID: "550e8400-e29b-41d4-a716-446655440000", Endpoint: "127.0.0.1:5000", PubKey: pemStr, Family: []string{"550e8400-e29b-41d4-a716-446655440001"}},
+			{ID: "550e8400-e29b-41d4-a716-446655440001", Endpoint: "127.0.0.1:5001", PubKey: pemStr, Family: []string{"550e8400-e29b-41d4-a716-446655440000"}},
+		},
+	}
+	repo, err := repoImpl.NewRelayRepository(mockClient, "http://test.com")
+	if err != nil {
+		t.Fatalf("NewRelayRepository: %v", err)
+	}
+	a, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	b, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440001")
+	ra, _ := repo.FindByID(a)
+	rb, _ := repo.FindByID(b)
+	if ra == nil || rb == nil || !ra.InFamily(rb) {
+		t.Fatalf("relays listing each other are not one family")
+	}
+
+	mockClient.response = []relayDTO{{ID: "550e8400-e29b-41d4-a716-446655440000", Endpoint: "127.0.0.1:5000", PubKey: pemStr, Family: []string{"relay2"}}}
+	if _, err := repoImpl.NewRelayRepository(mockClient, "http://test.com"); err == nil {
+		t.Errorf("expected error for an invalid family member")
+	}
+}
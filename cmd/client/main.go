@@ -1,26 +1,89 @@
 package main
 
 import (
+	"expvar"
 	"flag"
 	"log"
 	"net"
+	nethttp "net/http"
+	"os"
+	"path/filepath"
+	"time"
 
 	"ikedadada/go-ptor/cmd/client/handler"
 	"ikedadada/go-ptor/cmd/client/infrastructure/http"
 	infraRepo "ikedadada/go-ptor/cmd/client/infrastructure/repository"
 	"ikedadada/go-ptor/cmd/client/usecase"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
 	"ikedadada/go-ptor/shared/service"
 )
 
+// poolInterval is how often the circuit pool is checked for circuits that
+// were used, died or sat idle.
+const poolInterval = time.Second
+
 func main() {
 	hops := flag.Int("hops", 3, "number of hops")
 	socks := flag.String("socks", ":9050", "SOCKS5 listen address")
+	socks4 := flag.String("socks4", "", "SOCKS4/SOCKS4a listen address (disabled when empty)")
+	httpProxy := flag.String("http-proxy", "", "HTTP proxy listen address (disabled when empty)")
+	dnsPort := flag.String("dns", "", "DNS listen address for UDP and TCP (disabled when empty)")
 	dirURL := flag.String("dir", "", "base directory URL")
+	beginTimeout := flag.Duration("begin-timeout", 15*time.Second, "time to wait for the exit to open a stream")
+	maxDirtiness := flag.Duration("max-circuit-dirtiness", 10*time.Minute, "how long after its first stream a circuit takes new streams")
+	maxStreams := flag.Int("max-circuit-streams", 64, "how many streams a circuit carries before a new one is built")
+	poolMin := flag.Int("pool-min", 2, "number of clean circuits below which the pool is refilled")
+	poolMax := flag.Int("pool-max", 4, "number of clean circuits a pool refill builds up to")
+	poolHidden := flag.Int("pool-hidden", 1, "number of clean circuits kept for each hidden service relay")
+	poolIdle := flag.Duration("pool-idle", 30*time.Minute, "how long a clean circuit waits for a stream before it is torn down")
+	isolate := flag.String("isolate", "auth", "comma separated request properties that keep streams on separate circuits: auth, addr, port, client or none")
+	metrics := flag.String("metrics", "", "listen address for expvar metrics (disabled when empty)")
+	guardState := flag.String("guard-state", defaultStatePath("guards.json"), "file the entry guards are kept in (in memory only when empty)")
+	guards := flag.Int("guards", 3, "number of entry guards circuits are spread over")
+	guardLifetime := flag.Duration("guard-lifetime", 60*24*time.Hour, "how long an entry guard is used before it is replaced")
+	guardFailures := flag.Int("guard-failures", 3, "consecutive failures after which an entry guard is left alone")
+	guardRetry := flag.Duration("guard-retry", time.Hour, "how long a failing entry guard is left alone")
+	enforceFamily := flag.Bool("enforce-family", true, "keep relays that declare each other as family out of one circuit")
+	ipv4Subnet := flag.Int("ipv4-subnet", 16, "prefix length of the IPv4 subnets that hold at most one relay of a circuit (0 to turn off)")
+	ipv6Subnet := flag.Int("ipv6-subnet", 32, "prefix length of the IPv6 subnets that hold at most one relay of a circuit (0 to turn off)")
+	buildTimes := flag.String("build-times", defaultStatePath("build_times.json"), "file the circuit build times are kept in (in memory only when empty)")
+	buildTimeout := flag.Duration("build-timeout", 10*time.Second, "circuit build timeout until enough build times were recorded to learn one")
+	buildQuantile := flag.Float64("build-timeout-quantile", 0.8, "share of circuit builds the learned timeout lets finish")
+	buildTimeoutMin := flag.Duration("build-timeout-min", time.Second, "lower bound of the learned circuit build timeout")
+	buildTimeoutMax := flag.Duration("build-timeout-max", time.Minute, "upper bound of the learned circuit build timeout")
+	entryNodes := flag.String("entry-nodes", "", "comma separated relay IDs, fingerprints or CIDR ranges that alone may be the first hop")
+	exitNodes := flag.String("exit-nodes", "", "comma separated relay IDs, fingerprints or CIDR ranges that alone may be the exit")
+	excludeNodes := flag.String("exclude-nodes", "", "comma separated relay IDs, fingerprints or CIDR ranges never to build circuits through")
+	strictNodes := flag.Bool("strict-nodes", false, "refuse hidden service circuits whose relay is in -exclude-nodes")
+	legacyV1 := flag.Bool("legacy-v1", false, "redial relays that close the connection on VERSIONS as v1, unless they answered VERSIONS before")
 	flag.Parse()
 
 	if *dirURL == "" {
 		log.Fatal("base directory URL required")
 	}
+	isolation, err := vo.ParseIsolationFlags(*isolate)
+	if err != nil {
+		log.Fatal("parse -isolate:", err)
+	}
+	if *buildQuantile <= 0 || *buildQuantile >= 1 {
+		log.Fatal("-build-timeout-quantile must be between 0 and 1")
+	}
+	if *buildTimeoutMin > *buildTimeoutMax {
+		log.Fatal("-build-timeout-min exceeds -build-timeout-max")
+	}
+	restrictions := service.PathRestrictions{Family: *enforceFamily, IPv4Prefix: *ipv4Subnet, IPv6Prefix: *ipv6Subnet, StrictNodes: *strictNodes}
+	if err := restrictions.Validate(); err != nil {
+		log.Fatal("path restrictions:", err)
+	}
+	if restrictions.EntryNodes, err = vo.ParseNodeSet(*entryNodes); err != nil {
+		log.Fatal("parse -entry-nodes:", err)
+	}
+	if restrictions.ExitNodes, err = vo.ParseNodeSet(*exitNodes); err != nil {
+		log.Fatal("parse -exit-nodes:", err)
+	}
+	if restrictions.ExcludeNodes, err = vo.ParseNodeSet(*excludeNodes); err != nil {
+		log.Fatal("parse -exclude-nodes:", err)
+	}
 
 	// Initialize HTTP client
 	httpClient := http.NewHTTPClient()
@@ -37,49 +100,149 @@ func main() {
 	}
 
 	cRepo := infraRepo.NewCircuitRepository()
+	gRepo, err := infraRepo.NewGuardRepository(*guardState)
+	if err != nil {
+		log.Fatal("initialize guard repository:", err)
+	}
+	btRepo, err := infraRepo.NewBuildTimeRepository(*buildTimes)
+	if err != nil {
+		log.Fatal("initialize build time repository:", err)
+	}
+	amRepo := infraRepo.NewAddressMapRepository()
 
 	// Initialize services and use cases
-	cbSvc := service.NewTCPCircuitBuildService()
+	cbSvc := service.NewTCPCircuitBuildServiceWith(service.NewVersionNegotiationServiceWith(vo.SupportedProtocolVersions(), *legacyV1))
 	cSvc := service.NewCryptoService()
 	crSvc := service.NewCellReaderService()
 	peSvc := service.NewPayloadEncodingService()
-	buildUC := usecase.NewBuildCircuitUseCase(rRepo, cRepo, cbSvc, cSvc, peSvc)
+	rmSvc := service.NewEndReasonMetricsService()
+	expvar.Publish("end_reasons", rmSvc)
+	pmSvc := service.NewCircuitPoolMetricsService()
+	expvar.Publish("circuit_pool", pmSvc)
+	psSvc := service.NewPathSelectionService(restrictions)
+	guardUC := usecase.NewEntryGuardUseCase(gRepo, psSvc, usecase.GuardPolicy{
+		Size:        *guards,
+		Lifetime:    *guardLifetime,
+		MaxFailures: *guardFailures,
+		RetryAfter:  *guardRetry,
+	})
+	cbtUC := usecase.NewCircuitBuildTimeoutUseCase(btRepo, usecase.BuildTimeoutPolicy{
+		Initial:    *buildTimeout,
+		Quantile:   *buildQuantile,
+		MinSamples: 100,
+		MaxSamples: 1000,
+		Min:        *buildTimeoutMin,
+		Max:        *buildTimeoutMax,
+	})
+	buildUC := usecase.NewBuildCircuitUseCase(rRepo, cRepo, cbSvc, cSvc, peSvc, psSvc, guardUC, cbtUC)
 
-	openUC := usecase.NewOpenStreamUseCase(cRepo)
+	acquireUC := usecase.NewAcquireCircuitUseCase(cRepo, buildUC, peSvc, pmSvc, usecase.CircuitReusePolicy{
+		MaxDirtiness: *maxDirtiness,
+		MaxStreams:   *maxStreams,
+	})
 	closeUC := usecase.NewCloseStreamUseCase(cRepo, peSvc)
 	sendUC := usecase.NewSendDataUseCase(cRepo, cSvc, peSvc)
 	connectUC := usecase.NewSendConnectUseCase(cRepo, cSvc, peSvc)
 	endUC := usecase.NewHandleEndUseCase(cRepo)
 
 	// Initialize new use cases
-	resolveUC := usecase.NewResolveTargetAddressUseCase(hsRepo)
+	resolveUC := usecase.NewResolveTargetAddressUseCase(hsRepo, amRepo)
 	receiveCellUC := usecase.NewReceiveCellUseCase(cRepo, crSvc)
-	decryptCellUC := usecase.NewDecryptCellDataUseCase(cSvc, peSvc)
-
-	// Create stream manager service
-	smSvc := service.NewStreamManagerService()
+	decryptCellUC := usecase.NewDecryptCellDataUseCase(cSvc, peSvc, rmSvc)
+	sendmeUC := usecase.NewSendSendmeUseCase(cRepo, cSvc, peSvc)
+	awaitUC := usecase.NewAwaitStreamUseCase(cRepo, *beginTimeout)
 
 	// Create SOCKS5 controller
 	socks5Controller := handler.NewSOCKS5Controller(
-		buildUC,
+		acquireUC,
 		connectUC,
-		openUC,
 		closeUC,
 		sendUC,
 		endUC,
 		resolveUC,
 		receiveCellUC,
 		decryptCellUC,
+		sendmeUC,
+		awaitUC,
 		peSvc,
-		smSvc,
 		*hops,
+		isolation,
 	)
 
-	ln, err := net.Listen("tcp", *socks)
+	poolUC := usecase.NewMaintainCircuitPoolUseCase(cRepo, hsRepo, buildUC, peSvc, usecase.CircuitPoolPolicy{
+		Min:         *poolMin,
+		Max:         *poolMax,
+		Hidden:      *poolHidden,
+		IdleTimeout: *poolIdle,
+	})
+	go func() {
+		for {
+			out, err := poolUC.Handle(usecase.MaintainCircuitPoolInput{
+				Hops:    *hops,
+				OnBuilt: socks5Controller.ReceiveCircuit,
+			})
+			if err != nil {
+				log.Println("maintain circuit pool:", err)
+			}
+			if out.Built > 0 || out.Expired > 0 {
+				log.Printf("circuit pool built=%d expired=%d", out.Built, out.Expired)
+			}
+			time.Sleep(poolInterval)
+		}
+	}()
+
+	if *metrics != "" {
+		go func() {
+			log.Println("metrics listening on", *metrics)
+			log.Println("metrics:", nethttp.ListenAndServe(*metrics, expvar.Handler()))
+		}()
+	}
+
+	// the other frontends hand their streams to the SOCKS5 controller, so
+	// all of them share its circuits
+	if *socks4 != "" {
+		ln := listen("SOCKS4", *socks4)
+		go serve(ln, handler.NewSOCKS4Controller(socks5Controller).HandleConnection)
+	}
+	if *httpProxy != "" {
+		ln := listen("HTTP", *httpProxy)
+		go serve(ln, handler.NewHTTPProxyController(socks5Controller).HandleConnection)
+	}
+	if *dnsPort != "" {
+		dnsController := handler.NewDNSController(socks5Controller, usecase.NewMapAddressUseCase(hsRepo, amRepo))
+		pc, err := net.ListenPacket("udp", *dnsPort)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go dnsController.ServePacket(pc)
+		ln := listen("DNS", pc.LocalAddr().String())
+		go serve(ln, dnsController.HandleConnection)
+	}
+	serve(listen("SOCKS5", *socks), socks5Controller.HandleConnection)
+}
+
+// defaultStatePath returns the state file name in the user's configuration
+// directory, or in the working directory if there is none.
+func defaultStatePath(name string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return name
+	}
+	return filepath.Join(dir, "go-ptor", name)
+}
+
+// listen opens the TCP listener of a frontend.
+func listen(name, addr string) net.Listener {
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println("SOCKS5 proxy listening on", ln.Addr())
+	log.Printf("%s listening on %s", name, ln.Addr())
+	return ln
+}
+
+// serve hands each connection accepted on ln to handle.
+func serve(ln net.Listener, handle func(net.Conn)) {
 	for {
 		c, err := ln.Accept()
 		if err != nil {
@@ -88,7 +251,7 @@ func main() {
 		}
 		log.Printf("request connection from %s", c.RemoteAddr())
 		go func(conn net.Conn) {
-			socks5Controller.HandleConnection(conn)
+			handle(conn)
 			log.Printf("response connection closed %s", conn.RemoteAddr())
 		}(c)
 	}
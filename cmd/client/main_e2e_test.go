@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -84,13 +85,34 @@ func buildHiddenBin(t *testing.T) string {
 	return exe
 }
 
+// writeRelayKey stores a fresh relay identity key for the relay binary and
+// returns its path with the matching public key PEM for the directory.
+func writeRelayKey(t *testing.T) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "relay.pem")
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(path, privPEM, 0600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal pkix: %v", err)
+	}
+	return path, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
 func TestClientMain_E2E(t *testing.T) {
 	socks := freePort(t)
 	relayAddr := freePort(t)
 
+	relayKeyPath, relayPem := writeRelayKey(t)
 	relayExe := buildRelayBin(t)
 	rctx, rcancel := context.WithCancel(context.Background())
-	rcmd := exec.CommandContext(rctx, relayExe, "-listen", relayAddr)
+	// the target listens on loopback, which the default exit policy rejects
+	rcmd := exec.CommandContext(rctx, relayExe, "-listen", relayAddr, "-priv", relayKeyPath, "-exit-policy", "accept *:*")
 	var rout bytes.Buffer
 	rcmd.Stdout = &rout
 	rcmd.Stderr = &rout
@@ -113,22 +135,15 @@ func TestClientMain_E2E(t *testing.T) {
 	defer targetSrv.Close()
 	targetAddr := targetSrv.Listener.Addr().(*net.TCPAddr)
 
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		t.Fatalf("generate key: %v", err)
-	}
-	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
-	if err != nil {
-		t.Fatalf("marshal pkix: %v", err)
-	}
-	pem := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
 	// Create data in new array format
 	relayID := uuid.NewString()
 	relays := []map[string]interface{}{
 		{
-			"id":       relayID,
-			"endpoint": relayAddr,
-			"pubkey":   pem,
+			"id":          relayID,
+			"endpoint":    relayAddr,
+			"pubkey":      relayPem,
+			"exit_policy": "accept *:*",
+			"flags":       []string{"Exit", "Fast", "Stable"},
 		},
 	}
 	hiddenServices := []map[string]interface{}{}
@@ -147,7 +162,8 @@ func TestClientMain_E2E(t *testing.T) {
 
 	exe := buildBin(t)
 	ctx, cancel := context.WithCancel(context.Background())
-	cmd := exec.CommandContext(ctx, exe, "-hops", "1", "-socks", socks, "-dir", srv.URL)
+	httpProxy := freePort(t)
+	cmd := exec.CommandContext(ctx, exe, "-hops", "1", "-socks", socks, "-http-proxy", httpProxy, "-dir", srv.URL, "-pool-min", "0", "-pool-max", "0", "-guard-state", "", "-build-times", "")
 	var buf bytes.Buffer
 	cmd.Stdout = &buf
 	cmd.Stderr = &buf
@@ -163,6 +179,35 @@ func TestClientMain_E2E(t *testing.T) {
 	// Give client time to initialize
 	time.Sleep(2 * time.Second)
 
+	// with the pool off, the second request shares the circuit built for the first
+	for i := 0; i < 2; i++ {
+		if body := socksGet(t, socks, targetAddr); body != "ok" {
+			t.Fatalf("request %d: unexpected body: %q", i, body)
+		}
+	}
+	// so does a request through the HTTP proxy frontend
+	proxyURL, _ := url.Parse("http://" + httpProxy)
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 10 * time.Second}
+	resp, err := hc.Get("http://" + targetAddr.String() + "/")
+	if err != nil {
+		t.Fatalf("request through HTTP proxy: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Fatalf("HTTP proxy: unexpected body: %q", body)
+	}
+	cancel()
+	cmd.Wait()
+	if n := strings.Count(buf.String(), "circuit built successfully"); n != 1 {
+		t.Errorf("circuits built = %d, want 1", n)
+	}
+}
+
+// socksGet fetches / from target through the SOCKS5 proxy and returns the
+// response body.
+func socksGet(t *testing.T, socks string, target *net.TCPAddr) string {
+	t.Helper()
 	c, err := waitDial(socks, 5*time.Second)
 	if err != nil {
 		t.Fatalf("dial socks: %v", err)
@@ -176,17 +221,17 @@ func TestClientMain_E2E(t *testing.T) {
 	authResp := make([]byte, 2)
 	io.ReadFull(r, authResp)
 
-	ip := targetAddr.IP.To4()
+	ip := target.IP.To4()
 	req := []byte{5, 1, 0, 1}
 	req = append(req, ip...)
-	req = append(req, byte(targetAddr.Port>>8), byte(targetAddr.Port))
+	req = append(req, byte(target.Port>>8), byte(target.Port))
 	w.Write(req)
 	w.Flush()
 
 	connectResp := make([]byte, 10)
 	io.ReadFull(r, connectResp)
 
-	fmt.Fprintf(w, "GET / HTTP/1.0\r\nHost: %s\r\n\r\n", targetAddr.IP.String())
+	fmt.Fprintf(w, "GET / HTTP/1.0\r\nHost: %s\r\n\r\n", target.IP.String())
 	w.Flush()
 
 	resp, err := http.ReadResponse(r, nil)
@@ -194,9 +239,7 @@ func TestClientMain_E2E(t *testing.T) {
 		t.Fatalf("read response: %v", err)
 	}
 	body, _ := io.ReadAll(resp.Body)
-	if string(body) != "ok" {
-		t.Fatalf("unexpected body: %q", body)
-	}
+	return string(body)
 }
 
 func TestClientMain_HiddenService(t *testing.T) {
@@ -234,9 +277,11 @@ func TestClientMain_HiddenService(t *testing.T) {
 		t.Fatalf("dial hidden: %v", err)
 	}
 
+	exitKeyPath, exitPem := writeRelayKey(t)
+	midKeyPath, midPem := writeRelayKey(t)
 	relayExe := buildRelayBin(t)
 	rctx, rcancel := context.WithCancel(context.Background())
-	rcmd := exec.CommandContext(rctx, relayExe, "-listen", relayAddr)
+	rcmd := exec.CommandContext(rctx, relayExe, "-listen", relayAddr, "-priv", exitKeyPath)
 	rcmd.Env = append(os.Environ(), "PTOR_HIDDEN_ADDR="+hiddenAddr)
 	var rout bytes.Buffer
 	rcmd.Stdout = &rout
@@ -255,7 +300,7 @@ func TestClientMain_HiddenService(t *testing.T) {
 	}
 
 	rctx2, cancel2 := context.WithCancel(context.Background())
-	rcmd2 := exec.CommandContext(rctx2, relayExe, "-listen", relay2Addr)
+	rcmd2 := exec.CommandContext(rctx2, relayExe, "-listen", relay2Addr, "-priv", midKeyPath)
 	var rout2 bytes.Buffer
 	rcmd2.Stdout = &rout2
 	rcmd2.Stderr = &rout2
@@ -273,9 +318,6 @@ func TestClientMain_HiddenService(t *testing.T) {
 
 	der, _ := x509.MarshalPKIXPublicKey(key.Public())
 	hidPem := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
-	relKey, _ := rsa.GenerateKey(rand.Reader, 2048)
-	relDer, _ := x509.MarshalPKIXPublicKey(&relKey.PublicKey)
-	relPem := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: relDer}))
 	hidAddr := vo.NewHiddenAddr(key.Public().(ed25519.PublicKey)).String()
 	exitID := uuid.NewString()
 	midID := uuid.NewString()
@@ -285,12 +327,14 @@ func TestClientMain_HiddenService(t *testing.T) {
 		{
 			"id":       midID,
 			"endpoint": relay2Addr,
-			"pubkey":   relPem,
+			"pubkey":   midPem,
+			"flags":    []string{"Guard", "Fast", "Stable"},
 		},
 		{
 			"id":       exitID,
 			"endpoint": relayAddr,
-			"pubkey":   relPem,
+			"pubkey":   exitPem,
+			"flags":    []string{"Exit", "Fast", "Stable"},
 		},
 	}
 	hiddenServices := []map[string]interface{}{
@@ -315,7 +359,7 @@ func TestClientMain_HiddenService(t *testing.T) {
 
 	exe := buildBin(t)
 	ctx, cancel := context.WithCancel(context.Background())
-	cmd := exec.CommandContext(ctx, exe, "-hops", "2", "-socks", socks, "-dir", dirSrv.URL)
+	cmd := exec.CommandContext(ctx, exe, "-hops", "2", "-socks", socks, "-dir", dirSrv.URL, "-guard-state", filepath.Join(t.TempDir(), "guards.json"), "-build-times", filepath.Join(t.TempDir(), "build_times.json"), "-ipv4-subnet", "0")
 	var buf2 bytes.Buffer
 	cmd.Stdout = &buf2
 	cmd.Stderr = &buf2
@@ -47,7 +47,7 @@ func TestResolveAddress_CaseInsensitive(t *testing.T) {
 	}
 
 	// Test the resolve functionality directly through the UseCase
-	resolveUC := usecase.NewResolveTargetAddressUseCase(hsRepo)
+	resolveUC := usecase.NewResolveTargetAddressUseCase(hsRepo, repository.NewAddressMapRepository())
 
 	result, err := resolveUC.Handle(usecase.ResolveTargetAddressInput{
 		Host: "LOWER.PTOR",
@@ -0,0 +1,259 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	"ikedadada/go-ptor/shared/domain/repository"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+// maxBuildAttempts is how many circuits are built for a stream when the
+// builds run into the circuit build timeout.
+const maxBuildAttempts = 3
+
+// AcquireCircuitInput describes the stream a circuit is wanted for.
+type AcquireCircuitInput struct {
+	Hops        int
+	ExitRelayID string // pins the exit; such circuits carry a single stream
+	Avoid       string // circuit that just failed a stream; it is retired first
+	// IsolationKey keeps the stream off circuits used by streams with
+	// another key. See vo.IsolationFlags.
+	IsolationKey string
+	// Port is the target port, if known. Circuits whose exit policy
+	// rejects it are passed over.
+	Port int
+}
+
+// AcquireCircuitOutput names the circuit and the stream opened on it.
+type AcquireCircuitOutput struct {
+	CircuitID string `json:"circuit_id"`
+	StreamID  uint16 `json:"stream_id"`
+	// Version is the payload encoding the exit accepts for BEGIN/CONNECT.
+	Version vo.ProtocolVersion `json:"version"`
+	// Built is set for a new circuit whose cells nobody receives yet; the
+	// caller starts receiving them. Only one caller is told so.
+	Built bool `json:"built"`
+}
+
+// CircuitReusePolicy limits how long and how much a circuit is shared.
+type CircuitReusePolicy struct {
+	// MaxDirtiness is how long after its first stream a circuit still
+	// takes new streams.
+	MaxDirtiness time.Duration
+	// MaxStreams is how many streams a circuit carries over its lifetime.
+	MaxStreams int
+}
+
+// AcquireCircuitUseCase opens a stream on a live circuit that the reuse
+// policy still allows and the stream's isolation key admits, and builds a
+// new circuit when there is none. Only the latter counts as a pool miss.
+type AcquireCircuitUseCase interface {
+	Handle(in AcquireCircuitInput) (AcquireCircuitOutput, error)
+}
+
+type acquireCircuitUseCaseImpl struct {
+	mu      sync.Mutex // one caller picks or claims a circuit at a time
+	cRepo   repository.CircuitRepository
+	buildUC BuildCircuitUseCase
+	peSvc   service.PayloadEncodingService
+	pmSvc   service.CircuitPoolMetricsService
+	policy  CircuitReusePolicy
+}
+
+// NewAcquireCircuitUseCase returns a use case that shares circuits among
+// streams as far as policy allows.
+func NewAcquireCircuitUseCase(cRepo repository.CircuitRepository, buildUC BuildCircuitUseCase, peSvc service.PayloadEncodingService, pmSvc service.CircuitPoolMetricsService, policy CircuitReusePolicy) AcquireCircuitUseCase {
+	return &acquireCircuitUseCaseImpl{cRepo: cRepo, buildUC: buildUC, peSvc: peSvc, pmSvc: pmSvc, policy: policy}
+}
+
+func (uc *acquireCircuitUseCaseImpl) Handle(in AcquireCircuitInput) (AcquireCircuitOutput, error) {
+	if in.Avoid != "" {
+		cid, err := vo.CircuitIDFrom(in.Avoid)
+		if err != nil {
+			return AcquireCircuitOutput{}, fmt.Errorf("parse circuit id: %w", err)
+		}
+		if cir, err := uc.cRepo.Find(cid); err == nil {
+			uc.retire(cir)
+		}
+	}
+
+	for {
+		out, ok, err := uc.openExisting(in)
+		if ok || err != nil {
+			return out, err
+		}
+		// a build takes several round trips; other streams keep picking
+		// circuits in the meantime
+		uc.pmSvc.Miss()
+		cir, err := uc.build(in)
+		if err != nil {
+			return AcquireCircuitOutput{}, err
+		}
+		if out, ok, err := uc.openBuilt(cir, in); ok || err != nil {
+			return out, err
+		}
+		// a caller that found no circuit while we built took this one
+		// first; it did not build, so look again
+	}
+}
+
+// openExisting opens the stream on a live circuit, if there is one.
+func (uc *acquireCircuitUseCaseImpl) openExisting(in AcquireCircuitInput) (AcquireCircuitOutput, bool, error) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	cir, err := uc.find(in.ExitRelayID, in.IsolationKey, in.Port)
+	if err != nil || cir == nil {
+		return AcquireCircuitOutput{}, false, err
+	}
+	uc.pmSvc.Hit()
+	out, err := uc.open(cir, in.IsolationKey)
+	return out, true, err
+}
+
+// openBuilt opens the stream on cir, built for it. The circuit was in the
+// repository while it was built, so another caller may have taken it, and
+// then that caller starts receiving on it. It reports false if that left
+// the circuit unfit for this stream.
+func (uc *acquireCircuitUseCaseImpl) openBuilt(cir *entity.Circuit, in AcquireCircuitInput) (AcquireCircuitOutput, bool, error) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	if in.ExitRelayID != "" {
+		if !cir.Retire() {
+			return AcquireCircuitOutput{}, false, nil
+		}
+	} else if cir.Retired() {
+		return AcquireCircuitOutput{}, false, nil
+	}
+	out, err := uc.open(cir, in.IsolationKey)
+	if errors.Is(err, entity.ErrStreamIsolated) {
+		return AcquireCircuitOutput{}, false, nil
+	}
+	return out, true, err
+}
+
+// find returns a live circuit for a stream to exitRelayID, or to any exit
+// that allows port if it is empty.
+func (uc *acquireCircuitUseCaseImpl) find(exitRelayID, isolationKey string, port int) (*entity.Circuit, error) {
+	if exitRelayID == "" {
+		return uc.pick(isolationKey, port)
+	}
+	exit, err := vo.NewRelayID(exitRelayID)
+	if err != nil {
+		return nil, fmt.Errorf("parse exit relay id: %w", err)
+	}
+	return uc.pickPinned(exit)
+}
+
+// pick returns the reusable circuit to put the next stream on and retires
+// the ones the policy no longer allows. Only circuits that isolationKey
+// admits, and whose exit allows port if it is set, are candidates.
+// Circuits already in use come first, fewest streams first, so clean ones
+// stay in the pool for later. It returns nil if none is left.
+func (uc *acquireCircuitUseCaseImpl) pick(isolationKey string, port int) (*entity.Circuit, error) {
+	circuits, err := uc.cRepo.ListActive()
+	if err != nil {
+		return nil, fmt.Errorf("list circuits: %w", err)
+	}
+	now := time.Now()
+	var best *entity.Circuit
+	bestClean, bestLoad := false, 0
+	for _, cir := range circuits {
+		if cir.Retired() || cir.ExitPinned() {
+			continue
+		}
+		if !uc.reusable(cir, now) {
+			uc.retire(cir)
+			continue
+		}
+		if !cir.Admits(isolationKey) {
+			continue
+		}
+		if port != 0 && !cir.ExitPolicy().AllowsPort(port) {
+			continue
+		}
+		clean, load := cir.DirtiedAt().IsZero(), len(cir.ActiveStreams())
+		if best == nil || (bestClean && !clean) || (clean == bestClean && load < bestLoad) {
+			best, bestClean, bestLoad = cir, clean, load
+		}
+	}
+	return best, nil
+}
+
+// pickPinned returns a clean circuit built to exit, retired so it carries
+// this stream only, or nil if there is none.
+func (uc *acquireCircuitUseCaseImpl) pickPinned(exit vo.RelayID) (*entity.Circuit, error) {
+	circuits, err := uc.cRepo.ListActive()
+	if err != nil {
+		return nil, fmt.Errorf("list circuits: %w", err)
+	}
+	for _, cir := range circuits {
+		if cir.ExitPinned() && cir.Exit().Equal(exit) && cir.Retire() {
+			return cir, nil
+		}
+	}
+	return nil, nil
+}
+
+// reusable reports whether the policy lets cir take another stream.
+func (uc *acquireCircuitUseCaseImpl) reusable(cir *entity.Circuit, now time.Time) bool {
+	if cir.StreamsOpened() >= uc.policy.MaxStreams {
+		return false
+	}
+	dirty := cir.DirtiedAt()
+	return dirty.IsZero() || now.Sub(dirty) < uc.policy.MaxDirtiness
+}
+
+// retire takes cir out of service. A circuit without streams is torn down
+// right away; otherwise closing its last stream does it.
+func (uc *acquireCircuitUseCaseImpl) retire(cir *entity.Circuit) {
+	if cir.Retire() && len(cir.ActiveStreams()) == 0 {
+		_ = closeCircuit(uc.peSvc, cir)
+	}
+}
+
+// build builds a circuit for the stream described by in. It runs without
+// the lock, so a slow build holds up no stream that could reuse a circuit.
+func (uc *acquireCircuitUseCaseImpl) build(in AcquireCircuitInput) (*entity.Circuit, error) {
+	var out BuildCircuitOutput
+	var err error
+	// a build that ran into the learned timeout is slower than most, so
+	// another path is tried instead of waiting for it
+	for attempt := 1; attempt <= maxBuildAttempts; attempt++ {
+		out, err = uc.buildUC.Handle(BuildCircuitInput{Hops: in.Hops, ExitRelayID: in.ExitRelayID, ExitPort: in.Port})
+		if !errors.Is(err, ErrCircuitBuildTimeout) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("build circuit: %w", err)
+	}
+	cid, err := vo.CircuitIDFrom(out.CircuitID)
+	if err != nil {
+		return nil, fmt.Errorf("parse circuit id: %w", err)
+	}
+	cir, err := uc.cRepo.Find(cid)
+	if err != nil {
+		return nil, fmt.Errorf("circuit not found: %w", err)
+	}
+	return cir, nil
+}
+
+// open opens a stream on cir. The first caller to open one on a circuit
+// built for a stream is the one to start receiving on it.
+func (uc *acquireCircuitUseCaseImpl) open(cir *entity.Circuit, isolationKey string) (AcquireCircuitOutput, error) {
+	st, err := cir.OpenIsolatedStream(isolationKey)
+	if err != nil {
+		return AcquireCircuitOutput{}, fmt.Errorf("open stream: %w", err)
+	}
+	return AcquireCircuitOutput{
+		CircuitID: cir.ID().String(),
+		StreamID:  st.ID.UInt16(),
+		Version:   cir.PayloadVersion(),
+		Built:     cir.ClaimReceiver(),
+	}, nil
+}
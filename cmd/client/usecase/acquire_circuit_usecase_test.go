@@ -0,0 +1,457 @@
+package usecase_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"ikedadada/go-ptor/cmd/client/usecase"
+	"ikedadada/go-ptor/shared/domain/entity"
+	"ikedadada/go-ptor/shared/domain/repository"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+type mockRepoAcquire struct {
+	mu sync.Mutex
+	m  map[vo.CircuitID]*entity.Circuit
+}
+
+func (r *mockRepoAcquire) Save(c *entity.Circuit) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.m[c.ID()] = c
+	return nil
+}
+func (r *mockRepoAcquire) Find(id vo.CircuitID) (*entity.Circuit, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.m[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	return c, nil
+}
+func (r *mockRepoAcquire) Delete(id vo.CircuitID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.m, id)
+	return nil
+}
+func (r *mockRepoAcquire) ListActive() ([]*entity.Circuit, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]*entity.Circuit, 0, len(r.m))
+	for _, c := range r.m {
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// mockBuildAcquire saves a fresh one-hop circuit on every call. If block
+// is set, a build reports on entered and waits for block to close. If
+// stall is set, it does the same after saving the circuit.
+type mockBuildAcquire struct {
+	repo    *mockRepoAcquire
+	calls   int
+	last    usecase.BuildCircuitInput
+	err     error
+	block   chan struct{}
+	stall   chan struct{}
+	entered chan struct{}
+}
+
+func (m *mockBuildAcquire) Handle(in usecase.BuildCircuitInput) (usecase.BuildCircuitOutput, error) {
+	if m.block != nil {
+		m.entered <- struct{}{}
+		<-m.block
+	}
+	m.calls++
+	m.last = in
+	if m.err != nil {
+		return usecase.BuildCircuitOutput{}, m.err
+	}
+	rid, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	cir, err := entity.NewCircuit(vo.NewCircuitID(), []vo.RelayID{rid}, []vo.AESKey{key}, []vo.AESKey{key}, []vo.Nonce{nonce}, vo.NewRSAPrivKey(rawKey))
+	if err != nil {
+		return usecase.BuildCircuitOutput{}, err
+	}
+	cir.SetConn(0, &mockConnForClose{})
+	if in.ExitRelayID != "" {
+		cir.PinExit()
+	}
+	_ = m.repo.Save(cir)
+	if stall := m.stall; stall != nil {
+		m.entered <- struct{}{}
+		<-stall
+	}
+	return usecase.BuildCircuitOutput{CircuitID: cir.ID().String()}, nil
+}
+
+func newAcquireUseCase(policy usecase.CircuitReusePolicy) (usecase.AcquireCircuitUseCase, *mockBuildAcquire, *mockRepoAcquire) {
+	uc, build, repo, _ := newAcquireUseCaseWithMetrics(policy)
+	return uc, build, repo
+}
+
+func newAcquireUseCaseWithMetrics(policy usecase.CircuitReusePolicy) (usecase.AcquireCircuitUseCase, *mockBuildAcquire, *mockRepoAcquire, service.CircuitPoolMetricsService) {
+	repo := &mockRepoAcquire{m: make(map[vo.CircuitID]*entity.Circuit)}
+	build := &mockBuildAcquire{repo: repo}
+	pmSvc := service.NewCircuitPoolMetricsService()
+	return usecase.NewAcquireCircuitUseCase(repo, build, service.NewPayloadEncodingService(), pmSvc, policy), build, repo, pmSvc
+}
+
+func TestAcquireCircuitUseCase_ReusesCircuit(t *testing.T) {
+	uc, build, _ := newAcquireUseCase(usecase.CircuitReusePolicy{MaxDirtiness: time.Minute, MaxStreams: 3})
+
+	var first usecase.AcquireCircuitOutput
+	for i := 0; i < 3; i++ {
+		out, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1})
+		if err != nil {
+			t.Fatalf("acquire %d: %v", i, err)
+		}
+		if i == 0 {
+			first = out
+			if !out.Built {
+				t.Errorf("first circuit not reported as built")
+			}
+			continue
+		}
+		if out.Built || out.CircuitID != first.CircuitID {
+			t.Errorf("acquire %d: got circuit %s built=%v, want reuse of %s", i, out.CircuitID, out.Built, first.CircuitID)
+		}
+		if out.StreamID == first.StreamID {
+			t.Errorf("acquire %d: stream ID %d reused", i, out.StreamID)
+		}
+	}
+	if build.calls != 1 {
+		t.Errorf("circuits built = %d, want 1", build.calls)
+	}
+
+	// the stream quota is used up
+	out, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if !out.Built || out.CircuitID == first.CircuitID {
+		t.Errorf("circuit with %d streams reused", 3)
+	}
+}
+
+func TestAcquireCircuitUseCase_Dirtiness(t *testing.T) {
+	uc, build, repo := newAcquireUseCase(usecase.CircuitReusePolicy{MaxDirtiness: time.Millisecond, MaxStreams: 10})
+
+	first, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	second, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if second.CircuitID == first.CircuitID || build.calls != 2 {
+		t.Errorf("dirty circuit reused")
+	}
+	cid, _ := vo.CircuitIDFrom(first.CircuitID)
+	cir, _ := repo.Find(cid)
+	if !cir.Retired() {
+		t.Errorf("dirty circuit not retired")
+	}
+}
+
+func TestAcquireCircuitUseCase_PinnedExit(t *testing.T) {
+	uc, build, _ := newAcquireUseCase(usecase.CircuitReusePolicy{MaxDirtiness: time.Minute, MaxStreams: 10})
+
+	in := usecase.AcquireCircuitInput{Hops: 1, ExitRelayID: "550e8400-e29b-41d4-a716-446655440000"}
+	first, err := uc.Handle(in)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if _, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1}); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	second, err := uc.Handle(in)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if build.calls != 3 || first.CircuitID == second.CircuitID {
+		t.Errorf("pinned circuit shared: builds=%d", build.calls)
+	}
+}
+
+func TestAcquireCircuitUseCase_Avoid(t *testing.T) {
+	uc, build, repo := newAcquireUseCase(usecase.CircuitReusePolicy{MaxDirtiness: time.Minute, MaxStreams: 10})
+
+	first, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	second, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1, Avoid: first.CircuitID})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if second.CircuitID == first.CircuitID || build.calls != 2 {
+		t.Errorf("avoided circuit reused")
+	}
+	cid, _ := vo.CircuitIDFrom(first.CircuitID)
+	cir, _ := repo.Find(cid)
+	if !cir.Retired() {
+		t.Errorf("avoided circuit not retired")
+	}
+}
+
+func TestAcquireCircuitUseCase_BuildError(t *testing.T) {
+	uc, build, _ := newAcquireUseCase(usecase.CircuitReusePolicy{MaxDirtiness: time.Minute, MaxStreams: 10})
+	build.err = errors.New("no relays")
+	if _, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1}); err == nil {
+		t.Fatal("expected error")
+	}
+	if build.calls != 1 {
+		t.Errorf("failed build tried %d times, want once", build.calls)
+	}
+
+	// builds that time out are tried on new paths a few times
+	build.calls = 0
+	build.err = fmt.Errorf("%w after 1s: i/o timeout", usecase.ErrCircuitBuildTimeout)
+	if _, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1}); !errors.Is(err, usecase.ErrCircuitBuildTimeout) {
+		t.Fatalf("err = %v, want ErrCircuitBuildTimeout", err)
+	}
+	if build.calls != 3 {
+		t.Errorf("timed out build tried %d times, want 3", build.calls)
+	}
+}
+
+func TestAcquireCircuitUseCase_Pool(t *testing.T) {
+	uc, build, repo, pmSvc := newAcquireUseCaseWithMetrics(usecase.CircuitReusePolicy{MaxDirtiness: time.Minute, MaxStreams: 10})
+	exitID := "550e8400-e29b-41d4-a716-446655440000"
+
+	// pre-build one clean circuit of each kind and receive on it, as the
+	// pool maintainer does
+	general, _ := build.Handle(usecase.BuildCircuitInput{Hops: 1})
+	pinned, _ := build.Handle(usecase.BuildCircuitInput{Hops: 1, ExitRelayID: exitID})
+	for _, b := range []usecase.BuildCircuitOutput{general, pinned} {
+		cid, _ := vo.CircuitIDFrom(b.CircuitID)
+		cir, _ := repo.Find(cid)
+		cir.ClaimReceiver()
+	}
+
+	out, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if out.CircuitID != general.CircuitID || out.Built {
+		t.Errorf("general stream got circuit %s built=%v, want pooled %s", out.CircuitID, out.Built, general.CircuitID)
+	}
+	out, err = uc.Handle(usecase.AcquireCircuitInput{Hops: 1, ExitRelayID: exitID})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if out.CircuitID != pinned.CircuitID || out.Built {
+		t.Errorf("hidden stream got circuit %s built=%v, want pooled %s", out.CircuitID, out.Built, pinned.CircuitID)
+	}
+	if pmSvc.Hits() != 2 || pmSvc.Misses() != 0 {
+		t.Errorf("hits=%d misses=%d, want 2 and 0", pmSvc.Hits(), pmSvc.Misses())
+	}
+
+	// the pooled hidden circuit is used up
+	out, err = uc.Handle(usecase.AcquireCircuitInput{Hops: 1, ExitRelayID: exitID})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if !out.Built || pmSvc.Misses() != 1 {
+		t.Errorf("second hidden stream built=%v misses=%d, want a new circuit", out.Built, pmSvc.Misses())
+	}
+}
+
+func TestAcquireCircuitUseCase_PrefersUsedCircuits(t *testing.T) {
+	uc, build, _ := newAcquireUseCase(usecase.CircuitReusePolicy{MaxDirtiness: time.Minute, MaxStreams: 10})
+
+	first, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	clean, _ := build.Handle(usecase.BuildCircuitInput{Hops: 1})
+	out, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if out.CircuitID != first.CircuitID {
+		t.Errorf("stream went to clean circuit %s, want used circuit %s", clean.CircuitID, first.CircuitID)
+	}
+}
+
+func TestAcquireCircuitUseCase_Isolation(t *testing.T) {
+	uc, build, _ := newAcquireUseCase(usecase.CircuitReusePolicy{MaxDirtiness: time.Minute, MaxStreams: 10})
+	alice := vo.IsolateSOCKSAuth.Key(vo.IsolationFields{Username: "alice", Password: "pw"})
+	bob := vo.IsolateSOCKSAuth.Key(vo.IsolationFields{Username: "bob", Password: "pw"})
+
+	circuitOf := make(map[string]string)
+	for _, key := range []string{alice, bob, alice, bob} {
+		out, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1, IsolationKey: key})
+		if err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+		if cid, ok := circuitOf[key]; ok && cid != out.CircuitID {
+			t.Errorf("same credentials got circuits %s and %s", cid, out.CircuitID)
+		}
+		circuitOf[key] = out.CircuitID
+	}
+	if circuitOf[alice] == circuitOf[bob] {
+		t.Errorf("different credentials share circuit %s", circuitOf[alice])
+	}
+	if build.calls != 2 {
+		t.Errorf("circuits built = %d, want 2", build.calls)
+	}
+
+	// a clean pooled circuit takes any key, then only that key
+	clean, _ := build.Handle(usecase.BuildCircuitInput{Hops: 1})
+	carol := vo.IsolateSOCKSAuth.Key(vo.IsolationFields{Username: "carol"})
+	out, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1, IsolationKey: carol})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if out.CircuitID != clean.CircuitID {
+		t.Errorf("new key got circuit %s, want pooled %s", out.CircuitID, clean.CircuitID)
+	}
+}
+
+// A stream that can reuse a circuit must not wait for another stream's
+// circuit to be built.
+func TestAcquireCircuitUseCase_BuildDoesNotBlockReuse(t *testing.T) {
+	uc, build, _ := newAcquireUseCase(usecase.CircuitReusePolicy{MaxDirtiness: time.Minute, MaxStreams: 10})
+	alice := vo.IsolateSOCKSAuth.Key(vo.IsolationFields{Username: "alice"})
+	bob := vo.IsolateSOCKSAuth.Key(vo.IsolationFields{Username: "bob"})
+
+	first, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1, IsolationKey: alice})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	build.block, build.entered = make(chan struct{}), make(chan struct{})
+	type result struct {
+		out usecase.AcquireCircuitOutput
+		err error
+	}
+	built := make(chan result, 1)
+	go func() {
+		out, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1, IsolationKey: bob})
+		built <- result{out, err}
+	}()
+	<-build.entered
+
+	reused := make(chan result, 1)
+	go func() {
+		out, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1, IsolationKey: alice})
+		reused <- result{out, err}
+	}()
+	select {
+	case r := <-reused:
+		if r.err != nil || r.out.CircuitID != first.CircuitID {
+			t.Errorf("reuse got circuit %s err=%v, want %s", r.out.CircuitID, r.err, first.CircuitID)
+		}
+	case <-time.After(time.Second):
+		t.Error("reuse waited for another stream's build")
+	}
+
+	close(build.block)
+	r := <-built
+	if r.err != nil {
+		t.Fatalf("acquire: %v", r.err)
+	}
+	if !r.out.Built || r.out.CircuitID == first.CircuitID {
+		t.Errorf("isolated stream got circuit %s built=%v, want a new one", r.out.CircuitID, r.out.Built)
+	}
+}
+
+// A stream that finds the circuit another stream is building, before the
+// builder claims it, takes it over. Exactly one of them must then start
+// receiving on it, or the taker's stream is never answered.
+func TestAcquireCircuitUseCase_BuiltCircuitTakenFirst(t *testing.T) {
+	exitID := "550e8400-e29b-41d4-a716-446655440000"
+	alice := vo.IsolateSOCKSAuth.Key(vo.IsolationFields{Username: "alice"})
+	bob := vo.IsolateSOCKSAuth.Key(vo.IsolationFields{Username: "bob"})
+	tests := []struct {
+		name           string
+		builder, taker usecase.AcquireCircuitInput
+	}{
+		{"other isolation key", usecase.AcquireCircuitInput{Hops: 1, IsolationKey: alice}, usecase.AcquireCircuitInput{Hops: 1, IsolationKey: bob}},
+		{"pinned exit", usecase.AcquireCircuitInput{Hops: 1, ExitRelayID: exitID}, usecase.AcquireCircuitInput{Hops: 1, ExitRelayID: exitID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uc, build, _ := newAcquireUseCase(usecase.CircuitReusePolicy{MaxDirtiness: time.Minute, MaxStreams: 10})
+			stall := make(chan struct{})
+			build.stall, build.entered = stall, make(chan struct{})
+
+			type result struct {
+				out usecase.AcquireCircuitOutput
+				err error
+			}
+			built := make(chan result, 1)
+			go func() {
+				out, err := uc.Handle(tt.builder)
+				built <- result{out, err}
+			}()
+			<-build.entered
+
+			taken, err := uc.Handle(tt.taker)
+			if err != nil {
+				t.Fatalf("acquire: %v", err)
+			}
+			build.stall = nil
+			close(stall)
+			r := <-built
+			if r.err != nil {
+				t.Fatalf("acquire: %v", r.err)
+			}
+
+			if !taken.Built {
+				t.Errorf("stream that took circuit %s does not receive on it", taken.CircuitID)
+			}
+			if r.out.CircuitID == taken.CircuitID || !r.out.Built {
+				t.Errorf("builder got circuit %s built=%v, want a new one it receives on", r.out.CircuitID, r.out.Built)
+			}
+		})
+	}
+}
+
+func TestAcquireCircuitUseCase_ExitPolicy(t *testing.T) {
+	uc, build, repo := newAcquireUseCase(usecase.CircuitReusePolicy{MaxDirtiness: time.Minute, MaxStreams: 10})
+
+	web, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1, Port: 443})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	cid, _ := vo.CircuitIDFrom(web.CircuitID)
+	cir, _ := repo.Find(cid)
+	policy, err := vo.ParseExitPolicy("accept *:80,accept *:443,reject *:*")
+	if err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+	cir.SetExitPolicy(policy)
+
+	out, err := uc.Handle(usecase.AcquireCircuitInput{Hops: 1, Port: 80})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if out.CircuitID != web.CircuitID {
+		t.Errorf("port 80 got circuit %s, want %s", out.CircuitID, web.CircuitID)
+	}
+	out, err = uc.Handle(usecase.AcquireCircuitInput{Hops: 1, Port: 22})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if out.CircuitID == web.CircuitID {
+		t.Errorf("port 22 went to a circuit whose exit rejects it")
+	}
+	if build.calls != 2 || build.last.ExitPort != 22 {
+		t.Errorf("builds = %d, last exit port %d; want 2 builds for port 22", build.calls, build.last.ExitPort)
+	}
+}
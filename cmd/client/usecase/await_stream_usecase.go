@@ -0,0 +1,68 @@
+package usecase
+
+import (
+	"fmt"
+	"time"
+
+	"ikedadada/go-ptor/shared/domain/repository"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// AwaitStreamInput identifies a stream whose BEGIN has been sent.
+type AwaitStreamInput struct {
+	CircuitID string
+	StreamID  uint16
+}
+
+// AwaitStreamOutput reports that the exit connected the stream.
+type AwaitStreamOutput struct {
+	Connected bool `json:"connected"`
+	// BoundAddr is the address the exit connected the stream to, as
+	// "host:port", or empty if the exit did not say.
+	BoundAddr string `json:"bound_addr"`
+	// Answers are the addresses the exit found, if the stream carried a
+	// RESOLVE rather than a BEGIN.
+	Answers []vo.ResolvedAnswer `json:"answers"`
+}
+
+// AwaitStreamUseCase waits for the exit to answer BEGIN with BEGIN_ACK, or
+// RESOLVE with RESOLVED, or either with END. A refused stream yields an error wrapping *entity.StreamRefusedError,
+// and a missing answer one wrapping entity.ErrBeginTimeout.
+type AwaitStreamUseCase interface {
+	Handle(in AwaitStreamInput) (AwaitStreamOutput, error)
+}
+
+type awaitStreamUseCaseImpl struct {
+	cRepo   repository.CircuitRepository
+	timeout time.Duration
+}
+
+// NewAwaitStreamUseCase returns a use case that waits up to timeout for
+// each stream to connect.
+func NewAwaitStreamUseCase(cRepo repository.CircuitRepository, timeout time.Duration) AwaitStreamUseCase {
+	return &awaitStreamUseCaseImpl{cRepo: cRepo, timeout: timeout}
+}
+
+func (uc *awaitStreamUseCaseImpl) Handle(in AwaitStreamInput) (AwaitStreamOutput, error) {
+	cid, err := vo.CircuitIDFrom(in.CircuitID)
+	if err != nil {
+		return AwaitStreamOutput{}, fmt.Errorf("parse circuit id: %w", err)
+	}
+	sid, err := vo.StreamIDFrom(in.StreamID)
+	if err != nil {
+		return AwaitStreamOutput{}, fmt.Errorf("parse stream id: %w", err)
+	}
+	cir, err := uc.cRepo.Find(cid)
+	if err != nil {
+		return AwaitStreamOutput{}, fmt.Errorf("circuit not found: %w", err)
+	}
+	if err := cir.AwaitStream(sid, uc.timeout); err != nil {
+		return AwaitStreamOutput{}, fmt.Errorf("await stream %d: %w", in.StreamID, err)
+	}
+	out := AwaitStreamOutput{Connected: true}
+	if bound := cir.StreamBoundAddr(sid); bound != nil {
+		out.BoundAddr = bound.String()
+	}
+	out.Answers = cir.StreamAnswers(sid)
+	return out, nil
+}
@@ -0,0 +1,88 @@
+package usecase_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"ikedadada/go-ptor/cmd/client/usecase"
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+// exitReply returns a cmd cell for stream sid sealed by the only hop of
+// cir, the way an exit sends its first reply.
+func exitReply(t *testing.T, cir *entity.Circuit, cmd vo.CellCommand, sid uint16, data []byte) *entity.Cell {
+	t.Helper()
+	cSvc := service.NewCryptoService()
+	key := cir.HopKey(0, vo.DirectionBackward)
+	body, _, err := cSvc.SealRelayBody(key, vo.DirectionBackward, [32]byte{}, data)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	enc, _ := cSvc.AESCTR(key, cir.HopBaseNonce(0).Sequence(vo.NonceSpaceUpstream, 0), body)
+	p, _ := service.NewPayloadEncodingService().EncodeDataPayload(&service.DataPayloadDTO{StreamID: sid, Data: enc})
+	return &entity.Cell{Cmd: cmd, Version: vo.ProtocolV1, Payload: p}
+}
+
+func TestAwaitStreamUseCase_Handle(t *testing.T) {
+	peSvc := service.NewPayloadEncodingService()
+	ack := func(t *testing.T, cir *entity.Circuit, sid uint16) *entity.Cell {
+		return exitReply(t, cir, vo.CmdBeginAck, sid, nil)
+	}
+	ackAt := func(t *testing.T, cir *entity.Circuit, sid uint16) *entity.Cell {
+		bound := vo.BoundAddrBytes(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80})
+		return exitReply(t, cir, vo.CmdBeginAck, sid, bound)
+	}
+	end := func(t *testing.T, cir *entity.Circuit, sid uint16) *entity.Cell {
+		return exitReply(t, cir, vo.CmdEnd, sid, vo.EndReasonResolveFailed.Bytes())
+	}
+
+	tests := []struct {
+		name       string
+		reply      func(t *testing.T, cir *entity.Circuit, sid uint16) *entity.Cell
+		wantReason vo.EndReason
+		wantErr    error
+		wantBound  string
+	}{
+		{"begin ack", ack, 0, nil, ""},
+		{"begin ack with address", ackAt, 0, nil, "[2001:db8::1]:80"},
+		{"end", end, vo.EndReasonResolveFailed, nil, ""},
+		{"ack for another stream", func(t *testing.T, cir *entity.Circuit, sid uint16) *entity.Cell { return ack(t, cir, sid+1) }, 0, entity.ErrBeginTimeout, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			circuit, err := makeTestCircuit()
+			if err != nil {
+				t.Fatalf("setup circuit: %v", err)
+			}
+			st, _ := circuit.OpenStream()
+			repo := &mockCircuitRepoOpen{circuit: circuit}
+			uc := usecase.NewAwaitStreamUseCase(repo, 50*time.Millisecond)
+			decryptUC := usecase.NewDecryptCellDataUseCase(service.NewCryptoService(), peSvc, service.NewEndReasonMetricsService())
+
+			if _, err := decryptUC.Handle(usecase.DecryptCellDataInput{Cell: tt.reply(t, circuit, st.ID.UInt16()), Circuit: circuit}); err != nil {
+				t.Fatalf("decrypt reply: %v", err)
+			}
+			out, err := uc.Handle(usecase.AwaitStreamInput{CircuitID: circuit.ID().String(), StreamID: st.ID.UInt16()})
+
+			var refused *entity.StreamRefusedError
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantReason != 0:
+				if !errors.As(err, &refused) || refused.Reason != tt.wantReason {
+					t.Errorf("err = %v, want refusal with %s", err, tt.wantReason)
+				}
+			default:
+				if err != nil || !out.Connected || out.BoundAddr != tt.wantBound {
+					t.Errorf("out = %+v, err = %v, want bound address %q", out, err, tt.wantBound)
+				}
+			}
+		})
+	}
+}
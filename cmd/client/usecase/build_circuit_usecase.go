@@ -5,23 +5,29 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"ikedadada/go-ptor/shared/domain/aggregate"
 	"ikedadada/go-ptor/shared/domain/entity"
 	"ikedadada/go-ptor/shared/domain/repository"
 	vo "ikedadada/go-ptor/shared/domain/value_object"
 	"ikedadada/go-ptor/shared/service"
+	"log"
 	"net"
 	"time"
 )
 
+// ErrCircuitBuildTimeout is returned when a circuit was not built within
+// the time the circuit build timeout use case gave it.
+var ErrCircuitBuildTimeout = errors.New("circuit build timed out")
+
 // ---------- DTO ----------
 
 // BuildCircuitInput はユーザーが指定できるパラメータ
 type BuildCircuitInput struct {
 	Hops        int    // 省略時はデフォルト (3)
 	ExitRelayID string // 任意。指定時は最終 hop をこのリレーに固定
+	ExitPort    int    // 任意。指定時はこのポートを許可する出口ポリシーのリレーを最終 hop に選ぶ
 }
 
 // BuildCircuitOutput は UI / API に返すレスポンス
@@ -31,6 +37,8 @@ type BuildCircuitOutput struct {
 	Keys      [][]byte      `json:"aes_keys"` // Base64 等はプレゼン層で
 	Nonces    [][]byte      `json:"nonces"`   // 同上
 	AddrList  []vo.Endpoint `json:"endpoints"`
+	// Version is the payload encoding the exit accepts for BEGIN/CONNECT.
+	Version vo.ProtocolVersion `json:"version"`
 }
 
 // BuildCircuitUseCase creates new circuits according to the input parameters.
@@ -46,11 +54,17 @@ type buildCircuitUseCaseImpl struct {
 	cbSvc service.CircuitBuildService
 	cSvc  service.CryptoService
 	peSvc service.PayloadEncodingService
+	psSvc service.PathSelectionService
+	guard EntryGuardUseCase
+	cbt   CircuitBuildTimeoutUseCase
 }
 
-// NewBuildCircuitUseCase creates a use case for building circuits.
-func NewBuildCircuitUseCase(rRepo repository.RelayRepository, cRepo repository.CircuitRepository, cbSvc service.CircuitBuildService, cSvc service.CryptoService, peSvc service.PayloadEncodingService) BuildCircuitUseCase {
-	return &buildCircuitUseCaseImpl{rRepo: rRepo, cRepo: cRepo, cbSvc: cbSvc, cSvc: cSvc, peSvc: peSvc}
+// NewBuildCircuitUseCase creates a use case for building circuits. psSvc
+// picks the relays of each circuit; the first hop of circuits with more
+// than one hop is always one of guard's entry guards. Each build has the
+// time cbt gives it, and its time is recorded there.
+func NewBuildCircuitUseCase(rRepo repository.RelayRepository, cRepo repository.CircuitRepository, cbSvc service.CircuitBuildService, cSvc service.CryptoService, peSvc service.PayloadEncodingService, psSvc service.PathSelectionService, guard EntryGuardUseCase, cbt CircuitBuildTimeoutUseCase) BuildCircuitUseCase {
+	return &buildCircuitUseCaseImpl{rRepo: rRepo, cRepo: cRepo, cbSvc: cbSvc, cSvc: cSvc, peSvc: peSvc, psSvc: psSvc, guard: guard, cbt: cbt}
 }
 
 func (uc *buildCircuitUseCaseImpl) Handle(in BuildCircuitInput) (BuildCircuitOutput, error) {
@@ -63,13 +77,14 @@ func (uc *buildCircuitUseCaseImpl) Handle(in BuildCircuitInput) (BuildCircuitOut
 			return BuildCircuitOutput{}, err
 		}
 	}
-	cir, err := uc.build(in.Hops, exitID)
+	cir, err := uc.build(in.Hops, exitID, in.ExitPort)
 	if err != nil {
 		return BuildCircuitOutput{}, err
 	}
 
 	out := BuildCircuitOutput{
 		CircuitID: cir.ID().String(),
+		Version:   cir.PayloadVersion(),
 	}
 
 	// Relay ID
@@ -79,8 +94,8 @@ func (uc *buildCircuitUseCaseImpl) Handle(in BuildCircuitInput) (BuildCircuitOut
 
 	// 鍵・ノンス（array → slice 変換）
 	for i := range cir.Hops() {
-		key := cir.HopKey(i)         // [32]byte
-		nonce := cir.HopBaseNonce(i) // [12]byte - use base nonce for circuit info
+		key := cir.HopKey(i, vo.DirectionForward) // [32]byte
+		nonce := cir.HopBaseNonce(i)              // [12]byte - use base nonce for circuit info
 		out.Keys = append(out.Keys, key[:])
 		out.Nonces = append(out.Nonces, nonce[:])
 	}
@@ -88,7 +103,7 @@ func (uc *buildCircuitUseCaseImpl) Handle(in BuildCircuitInput) (BuildCircuitOut
 	return out, nil
 }
 
-func (uc *buildCircuitUseCaseImpl) build(hops int, exit vo.RelayID) (*entity.Circuit, error) {
+func (uc *buildCircuitUseCaseImpl) build(hops int, exit vo.RelayID, exitPort int) (_ *entity.Circuit, err error) {
 	if hops <= 0 {
 		hops = 3
 	}
@@ -110,10 +125,9 @@ func (uc *buildCircuitUseCaseImpl) build(hops int, exit vo.RelayID) (*entity.Cir
 		if r.Status() != entity.Online {
 			return nil, fmt.Errorf("exit relay not online")
 		}
-		for i, rel := range relays {
+		for _, rel := range relays {
 			if rel.ID().Equal(exit) {
 				exitRelay = rel
-				relays = append(relays[:i], relays[i+1:]...)
 				break
 			}
 		}
@@ -121,28 +135,23 @@ func (uc *buildCircuitUseCaseImpl) build(hops int, exit vo.RelayID) (*entity.Cir
 			// exit relay was not in online list
 			return nil, fmt.Errorf("exit relay not in online list")
 		}
-		if hops == 1 {
-			relays = []*entity.Relay{}
-		}
 	}
 
-	// 2. 無作為に hops 個選出（重複なし）
-	if err := secureShuffle(relays); err != nil {
-		return nil, fmt.Errorf("shuffle relays: %w", err)
-	}
-	var selected []*entity.Relay
-	if exitRelay == nil {
-		selected = relays[:hops]
-	} else {
-		if hops-1 > len(relays) {
-			return nil, fmt.Errorf("not enough online relays (need %d)", hops)
+	// 2. 入口はガードから、残りは位置ごとにフラグの合うリレーを帯域で重み付けして選出（同じリレー・ファミリー・サブネットは同じ回路に入れない）
+	var entry *entity.Relay
+	if hops > 1 {
+		if entry, err = uc.guard.Pick(relays, exitRelay); err != nil {
+			return nil, fmt.Errorf("pick entry guard: %w", err)
 		}
-		selected = append(selected, relays[:hops-1]...)
-		selected = append(selected, exitRelay)
+	}
+	selected, err := uc.psSvc.SelectPath(relays, hops, entry, exitRelay, exitPort)
+	if err != nil {
+		return nil, fmt.Errorf("select path: %w", err)
 	}
 
 	relayIDs := make([]vo.RelayID, 0, hops)
-	keys := make([]vo.AESKey, hops)
+	fwdKeys := make([]vo.AESKey, hops)
+	bwdKeys := make([]vo.AESKey, hops)
 	nonces := make([]vo.Nonce, hops)
 
 	for _, r := range selected {
@@ -159,8 +168,37 @@ func (uc *buildCircuitUseCaseImpl) build(hops int, exit vo.RelayID) (*entity.Cir
 	cid := vo.NewCircuitID()
 
 	// --- build circuit over the network ---
-	const ioTimeout = 10 * time.Second
-	dialCtx, cancel := context.WithTimeout(context.Background(), ioTimeout)
+	// The guard counts as reached once the first hop answered CREATED.
+	entryReached := false
+	if entry != nil {
+		defer func() {
+			if err := uc.guard.Report(entry.ID(), entryReached); err != nil {
+				log.Printf("record entry guard %s: %v", entry.ID(), err)
+			}
+		}()
+	}
+	// ダイヤルから最後の CREATED までを学習済みのタイムアウト内に収める
+	timeout := uc.cbt.Timeout(hops)
+	start := time.Now()
+	deadline := start.Add(timeout)
+	completed := false
+	defer func() {
+		elapsed := time.Since(start)
+		timedOut := !completed && !time.Now().Before(deadline)
+		if !completed && !timedOut {
+			// other failures say nothing about how long a build takes
+			return
+		}
+		if timedOut {
+			log.Printf("circuit build timed out after %s", timeout)
+			elapsed = timeout
+			err = fmt.Errorf("%w after %s: %w", ErrCircuitBuildTimeout, timeout, err)
+		}
+		if err := uc.cbt.Record(hops, elapsed, timedOut); err != nil {
+			log.Printf("record circuit build time: %v", err)
+		}
+	}()
+	dialCtx, cancel := context.WithDeadline(context.Background(), deadline)
 	defer cancel()
 	type dialRes struct {
 		c   net.Conn
@@ -174,6 +212,12 @@ func (uc *buildCircuitUseCaseImpl) build(hops int, exit vo.RelayID) (*entity.Cir
 	var conn net.Conn
 	select {
 	case <-dialCtx.Done():
+		go func() {
+			// close the connection if the dial still succeeds
+			if res := <-dch; res.c != nil {
+				res.c.Close()
+			}
+		}()
 		return nil, fmt.Errorf("dial: %w", dialCtx.Err())
 	case res := <-dch:
 		if res.err != nil {
@@ -181,6 +225,11 @@ func (uc *buildCircuitUseCaseImpl) build(hops int, exit vo.RelayID) (*entity.Cir
 		}
 		conn = res.c
 	}
+	// Link-level payloads follow the version spoken with the first hop;
+	// relays re-encode them for their own links.
+	linkVer := entity.LinkVersion(conn)
+	pe := uc.peSvc.ForVersion(linkVer)
+	var exitVer vo.ProtocolVersion
 
 	for i := 0; i < hops; i++ {
 		next := ""
@@ -195,9 +244,10 @@ func (uc *buildCircuitUseCaseImpl) build(hops int, exit vo.RelayID) (*entity.Cir
 		}
 		var pubArr [32]byte
 		copy(pubArr[:], cliPub)
-		payload, err := uc.peSvc.EncodeExtendPayload(&service.ExtendPayloadDTO{
-			NextHop:   next,
-			ClientPub: pubArr,
+		payload, err := pe.EncodeExtendPayload(&service.ExtendPayloadDTO{
+			NextHop:    next,
+			ClientPub:  pubArr,
+			MaxVersion: vo.ProtocolLatest,
 		})
 		if err != nil {
 			_ = uc.cbSvc.TeardownCircuit(conn, cid)
@@ -211,7 +261,8 @@ func (uc *buildCircuitUseCaseImpl) build(hops int, exit vo.RelayID) (*entity.Cir
 			conn.Close()
 			return nil, err
 		}
-		_ = conn.SetDeadline(time.Now().Add(ioTimeout))
+		cell.SetVersion(linkVer)
+		_ = conn.SetDeadline(deadline)
 		if err := uc.cbSvc.SendExtendCell(conn, cell); err != nil {
 			_ = uc.cbSvc.TeardownCircuit(conn, cid)
 			conn.Close()
@@ -224,35 +275,56 @@ func (uc *buildCircuitUseCaseImpl) build(hops int, exit vo.RelayID) (*entity.Cir
 			return nil, err
 		}
 		_ = conn.SetDeadline(time.Time{})
-		created, err := uc.peSvc.DecodeCreatedPayload(resp)
+		created, err := pe.DecodeCreatedPayload(resp)
 		if err != nil {
 			_ = uc.cbSvc.TeardownCircuit(conn, cid)
 			conn.Close()
 			return nil, err
 		}
+		// Fail closed: a CREATED reply that is not signed by the identity key
+		// published in the directory may come from a man-in-the-middle.
+		if err := uc.cSvc.VerifyHandshakeAuth(selected[i].PubKey(), cliPub, created.RelayPub[:], created.Auth); err != nil {
+			_ = uc.cbSvc.TeardownCircuit(conn, cid)
+			conn.Close()
+			return nil, fmt.Errorf("verify hop %d relay %s: %w", i, selected[i].ID(), err)
+		}
 		secret, err := uc.cSvc.X25519Shared(cliPriv, created.RelayPub[:])
 		if err != nil {
 			_ = uc.cbSvc.TeardownCircuit(conn, cid)
 			conn.Close()
 			return nil, err
 		}
-		key, nonce, err := uc.cSvc.DeriveKeyNonce(secret)
+		fwdKey, bwdKey, nonce, err := uc.cSvc.DeriveHopKeys(secret)
 		if err != nil {
 			_ = uc.cbSvc.TeardownCircuit(conn, cid)
 			conn.Close()
 			return nil, err
 		}
-		keys[i] = key
+		fwdKeys[i] = fwdKey
+		bwdKeys[i] = bwdKey
 		nonces[i] = nonce
+		if i == 0 {
+			entryReached = true
+		}
+		if i == hops-1 {
+			// the exit derives the same version from our EXTEND
+			exitVer = vo.EndToEndVersion(created.MaxVersion)
+		}
 	}
+	completed = true
 
-	circuit, err := entity.NewCircuit(cid, relayIDs, keys, nonces, priv)
+	circuit, err := entity.NewCircuit(cid, relayIDs, fwdKeys, bwdKeys, nonces, priv)
 	if err != nil {
 		_ = uc.cbSvc.TeardownCircuit(conn, cid)
 		conn.Close()
 		return nil, err
 	}
 	circuit.SetConn(0, conn)
+	circuit.SetPayloadVersion(exitVer)
+	circuit.SetExitPolicy(selected[hops-1].ExitPolicy())
+	if exitRelay != nil {
+		circuit.PinExit()
+	}
 
 	// 5. 保存
 	if err := uc.cRepo.Save(circuit); err != nil {
@@ -263,15 +335,3 @@ func (uc *buildCircuitUseCaseImpl) build(hops int, exit vo.RelayID) (*entity.Cir
 
 	return circuit, nil
 }
-
-func secureShuffle[T any](xs []T) error {
-	for i := len(xs) - 1; i > 0; i-- {
-		var b [2]byte
-		if _, err := rand.Read(b[:]); err != nil { // crypto/rand
-			return err
-		}
-		j := int(binary.BigEndian.Uint16(b[:])) % (i + 1)
-		xs[i], xs[j] = xs[j], xs[i]
-	}
-	return nil
-}
@@ -1,11 +1,16 @@
 package usecase_test
 
 import (
+	"context"
 	"crypto/ecdh"
 	"crypto/rand"
+	"crypto/rsa"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
@@ -56,14 +61,32 @@ type mockDialer struct {
 	sendCalled    int
 	createdCalled int
 	destroyCalled int
+
+	// identity signs CREATED replies; forgeAuth corrupts the tag.
+	identity  *vo.RSAPrivKey
+	forgeAuth bool
+	clientPub []byte
+	// dialDelay is how long the first relay takes to answer.
+	dialDelay time.Duration
+	// relayMax is the MaxVersion relays advertise in CREATED, and
+	// clientMax the one the client sent in its last EXTEND.
+	relayMax  vo.ProtocolVersion
+	clientMax vo.ProtocolVersion
 }
 
 func (m *mockDialer) ConnectToRelay(string) (net.Conn, error) {
 	m.dialCalled++
+	time.Sleep(m.dialDelay)
 	return dummyConn{}, nil
 }
-func (m *mockDialer) SendExtendCell(net.Conn, *aggregate.RelayCell) error {
+func (m *mockDialer) SendExtendCell(_ net.Conn, cell *aggregate.RelayCell) error {
 	m.sendCalled++
+	p, err := service.NewPayloadEncodingService().DecodeExtendPayload(cell.Data())
+	if err != nil {
+		return err
+	}
+	m.clientPub = p.ClientPub[:]
+	m.clientMax = p.MaxVersion
 	return nil
 }
 func (m *mockDialer) WaitForCreatedResponse(net.Conn) ([]byte, error) {
@@ -71,8 +94,15 @@ func (m *mockDialer) WaitForCreatedResponse(net.Conn) ([]byte, error) {
 	kp, _ := ecdh.X25519().GenerateKey(rand.Reader)
 	var pub [32]byte
 	copy(pub[:], kp.PublicKey().Bytes())
+	auth, err := service.NewCryptoService().HandshakeAuth(m.identity, m.clientPub, pub[:])
+	if err != nil {
+		return nil, err
+	}
+	if m.forgeAuth {
+		auth[0] ^= 0xFF
+	}
 	payloadEncoder := service.NewPayloadEncodingService()
-	b, _ := payloadEncoder.EncodeCreatedPayload(&service.CreatedPayloadDTO{RelayPub: pub})
+	b, _ := payloadEncoder.EncodeCreatedPayload(&service.CreatedPayloadDTO{RelayPub: pub, Auth: auth, MaxVersion: m.relayMax})
 	return b, nil
 }
 func (m *mockDialer) TeardownCircuit(net.Conn, vo.CircuitID) error {
@@ -80,6 +110,45 @@ func (m *mockDialer) TeardownCircuit(net.Conn, vo.CircuitID) error {
 	return nil
 }
 
+// mockEntryGuard hands out guard, or else the first relay other than
+// avoid, and records the reports it gets.
+type mockEntryGuard struct {
+	guard   *entity.Relay
+	reports []bool
+}
+
+func (m *mockEntryGuard) Pick(online []*entity.Relay, avoid *entity.Relay) (*entity.Relay, error) {
+	if m.guard != nil {
+		return m.guard, nil
+	}
+	for _, r := range online {
+		if avoid == nil || !r.ID().Equal(avoid.ID()) {
+			return r, nil
+		}
+	}
+	return nil, usecase.ErrNoUsableGuard
+}
+func (m *mockEntryGuard) Report(_ vo.RelayID, reached bool) error {
+	m.reports = append(m.reports, reached)
+	return nil
+}
+
+type mockBuildTimeout struct {
+	timeout time.Duration
+	records []vo.BuildTime
+}
+
+func (m *mockBuildTimeout) Timeout(int) time.Duration {
+	if m.timeout == 0 {
+		return 10 * time.Second
+	}
+	return m.timeout
+}
+func (m *mockBuildTimeout) Record(hops int, elapsed time.Duration, timedOut bool) error {
+	m.records = append(m.records, vo.BuildTime{Hops: hops, Elapsed: elapsed, TimedOut: timedOut})
+	return nil
+}
+
 type dummyConn struct{}
 
 func (dummyConn) Read([]byte) (int, error)         { return 0, io.EOF }
@@ -91,25 +160,86 @@ func (dummyConn) SetDeadline(time.Time) error      { return nil }
 func (dummyConn) SetReadDeadline(time.Time) error  { return nil }
 func (dummyConn) SetWriteDeadline(time.Time) error { return nil }
 
-func makeTestRelay(id string) (*entity.Relay, error) {
+var (
+	testIdentityOnce sync.Once
+	testIdentity     *vo.RSAPrivKey
+)
+
+// testRelayIdentity returns an RSA identity key shared by all test relays so
+// the mock dialer can sign CREATED replies the client will accept.
+func testRelayIdentity() *vo.RSAPrivKey {
+	testIdentityOnce.Do(func() {
+		raw, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		testIdentity = vo.NewRSAPrivKey(raw)
+	})
+	return testIdentity
+}
+
+func makeTestRelay(id, host string) (*entity.Relay, error) {
 	relayID, err := vo.NewRelayID(id)
 	if err != nil {
 		return nil, err
 	}
-	endpoint, _ := vo.NewEndpoint("127.0.0.1", 9000)
-	pubKey := vo.RSAPubKey{} // Use a zero-value or mock key for testing
+	endpoint, _ := vo.NewEndpoint(host, 9000)
+	pubKey := testRelayIdentity().PublicKey().(vo.RSAPubKey)
 	relay := entity.NewRelay(relayID, endpoint, pubKey)
+	relay.SetBandwidth(vo.Bandwidth{Measured: 100})
+	relay.SetFlags(vo.RelayFlagGuard | vo.RelayFlagExit | vo.RelayFlagStable | vo.RelayFlagFast)
 	relay.SetOnline() // Ensure the relay is marked as online
 	return relay, nil
 }
 
-func TestBuildCircuitUseCase_Handle_Table(t *testing.T) {
-	relay, err := makeTestRelay("550e8400-e29b-41d4-a716-446655440000")
-	if err != nil {
-		t.Fatalf("setup relay: %v", err)
+// makeTestRelays returns n online relays with distinct IDs, each in a /16
+// of its own.
+func makeTestRelays(t *testing.T, n int) []*entity.Relay {
+	t.Helper()
+	relays := make([]*entity.Relay, n)
+	for i := range relays {
+		r, err := makeTestRelay(fmt.Sprintf("550e8400-e29b-41d4-a716-%012d", i), fmt.Sprintf("10.%d.0.1", i))
+		if err != nil {
+			t.Fatalf("setup relay: %v", err)
+		}
+		relays[i] = r
+	}
+	return relays
+}
+
+func TestBuildCircuitUseCase_Handle_PayloadVersion(t *testing.T) {
+	relays := makeTestRelays(t, 3)
+	tests := []struct {
+		name     string
+		relayMax vo.ProtocolVersion
+		want     vo.ProtocolVersion
+	}{
+		{"exit predating MaxVersion", 0, vo.ProtocolV1},
+		{"v1 exit", vo.ProtocolV1, vo.ProtocolV1},
+		{"v2 exit", vo.ProtocolV2, vo.ProtocolV2},
+		{"newer exit", 0x07, vo.ProtocolLatest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cbSvc := &mockDialer{identity: testRelayIdentity(), relayMax: tt.relayMax}
+			uc := usecase.NewBuildCircuitUseCase(&mockRelayRepo{online: relays}, &mockCircuitRepo{}, cbSvc, service.NewCryptoService(), service.NewPayloadEncodingService(), service.NewPathSelectionService(service.DefaultPathRestrictions()), &mockEntryGuard{}, &mockBuildTimeout{})
+			out, err := uc.Handle(usecase.BuildCircuitInput{Hops: 3})
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+			if cbSvc.clientMax != vo.ProtocolLatest {
+				t.Errorf("EXTEND advertised %v, want %v", cbSvc.clientMax, vo.ProtocolLatest)
+			}
+			if out.Version != tt.want {
+				t.Errorf("payload version = %v, want %v", out.Version, tt.want)
+			}
+		})
 	}
-	exitRelay, _ := makeTestRelay("550e8400-e29b-41d4-a716-446655440000")
-	exitRelay.SetOnline()
+}
+
+func TestBuildCircuitUseCase_Handle_Table(t *testing.T) {
+	relays := makeTestRelays(t, 3)
+	exitRelay := relays[2]
 
 	tests := []struct {
 		name          string
@@ -120,21 +250,21 @@ func TestBuildCircuitUseCase_Handle_Table(t *testing.T) {
 		hops          int
 		expectsErr    bool
 	}{
-		{"ok", []*entity.Relay{relay, relay, relay}, exitRelay, nil, nil, 3, false},
-		{"not enough relays", []*entity.Relay{relay}, nil, nil, nil, 3, true},
+		{"ok", relays, exitRelay, nil, nil, 3, false},
+		{"not enough relays", relays[2:], nil, nil, nil, 3, true},
 		{"repo error", nil, nil, errors.New("repo error"), nil, 3, true},
-		{"save error", []*entity.Relay{relay, relay, relay}, exitRelay, nil, errors.New("save error"), 3, true},
+		{"save error", relays, exitRelay, nil, errors.New("save error"), 3, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			rr := &mockRelayRepo{online: tt.online, findByIDRelay: tt.findByIDRelay, err: tt.relayErr}
 			cr := &mockCircuitRepo{err: tt.saveErr}
-			cbSvc := &mockDialer{}
+			cbSvc := &mockDialer{identity: testRelayIdentity()}
 			cSvc := service.NewCryptoService()
 			peSvc := service.NewPayloadEncodingService()
-			uc := usecase.NewBuildCircuitUseCase(rr, cr, cbSvc, cSvc, peSvc)
+			uc := usecase.NewBuildCircuitUseCase(rr, cr, cbSvc, cSvc, peSvc, service.NewPathSelectionService(service.DefaultPathRestrictions()), &mockEntryGuard{}, &mockBuildTimeout{})
 
-			out, err := uc.Handle(usecase.BuildCircuitInput{Hops: tt.hops, ExitRelayID: "550e8400-e29b-41d4-a716-446655440000"})
+			out, err := uc.Handle(usecase.BuildCircuitInput{Hops: tt.hops, ExitRelayID: exitRelay.ID().String()})
 			if tt.expectsErr && err == nil {
 				t.Errorf("expected error")
 			}
@@ -144,6 +274,148 @@ func TestBuildCircuitUseCase_Handle_Table(t *testing.T) {
 			if !tt.expectsErr && out.CircuitID == "" {
 				t.Errorf("expected CircuitID")
 			}
+			if !tt.expectsErr && !cr.saved.ExitPinned() {
+				t.Errorf("circuit to a chosen exit not pinned")
+			}
 		})
 	}
 }
+
+func TestBuildCircuitUseCase_Handle_RejectsForgedCreated(t *testing.T) {
+	rr := &mockRelayRepo{online: makeTestRelays(t, 3)}
+	cr := &mockCircuitRepo{}
+	cbSvc := &mockDialer{identity: testRelayIdentity(), forgeAuth: true}
+	guard := &mockEntryGuard{}
+	uc := usecase.NewBuildCircuitUseCase(rr, cr, cbSvc, service.NewCryptoService(), service.NewPayloadEncodingService(), service.NewPathSelectionService(service.DefaultPathRestrictions()), guard, &mockBuildTimeout{})
+
+	_, err := uc.Handle(usecase.BuildCircuitInput{Hops: 3})
+	if !errors.Is(err, service.ErrHandshakeAuth) {
+		t.Fatalf("expected ErrHandshakeAuth, got %v", err)
+	}
+	if cr.saved != nil {
+		t.Errorf("circuit must not be saved when verification fails")
+	}
+	if cbSvc.destroyCalled != 1 {
+		t.Errorf("expected teardown once, got %d", cbSvc.destroyCalled)
+	}
+	if len(guard.reports) != 1 || guard.reports[0] {
+		t.Errorf("guard reports = %v, want one failure", guard.reports)
+	}
+}
+
+func TestBuildCircuitUseCase_Handle_RejectsUnknownIdentity(t *testing.T) {
+	relay, err := makeTestRelay("550e8400-e29b-41d4-a716-446655440000", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("setup relay: %v", err)
+	}
+	// The relay answering the handshake holds a different key from the one
+	// published in the directory.
+	raw, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	rr := &mockRelayRepo{online: []*entity.Relay{relay}}
+	cr := &mockCircuitRepo{}
+	cbSvc := &mockDialer{identity: vo.NewRSAPrivKey(raw)}
+	uc := usecase.NewBuildCircuitUseCase(rr, cr, cbSvc, service.NewCryptoService(), service.NewPayloadEncodingService(), service.NewPathSelectionService(service.DefaultPathRestrictions()), &mockEntryGuard{}, &mockBuildTimeout{})
+
+	if _, err := uc.Handle(usecase.BuildCircuitInput{Hops: 1}); !errors.Is(err, service.ErrHandshakeAuth) {
+		t.Fatalf("expected ErrHandshakeAuth, got %v", err)
+	}
+	if cr.saved != nil {
+		t.Errorf("circuit must not be saved when verification fails")
+	}
+}
+
+func TestBuildCircuitUseCase_Handle_ExitPort(t *testing.T) {
+	webOnly, err := vo.ParseExitPolicy("accept *:80,accept *:443,reject *:*")
+	if err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+	relays := makeTestRelays(t, 3)
+	for _, r := range relays {
+		r.SetExitPolicy(webOnly)
+	}
+	// only the last relay lets streams out to port 22
+	relays[2].SetExitPolicy(vo.ExitPolicy{})
+
+	for i := 0; i < 10; i++ {
+		rr := &mockRelayRepo{online: append([]*entity.Relay(nil), relays...)}
+		cr := &mockCircuitRepo{}
+		uc := usecase.NewBuildCircuitUseCase(rr, cr, &mockDialer{identity: testRelayIdentity()}, service.NewCryptoService(), service.NewPayloadEncodingService(), service.NewPathSelectionService(service.DefaultPathRestrictions()), &mockEntryGuard{}, &mockBuildTimeout{})
+		if _, err := uc.Handle(usecase.BuildCircuitInput{Hops: 2, ExitPort: 22}); err != nil {
+			t.Fatalf("build: %v", err)
+		}
+		hops := cr.saved.Hops()
+		if !hops[len(hops)-1].Equal(relays[2].ID()) {
+			t.Fatalf("exit %s does not allow port 22", hops[len(hops)-1])
+		}
+		if !cr.saved.ExitPolicy().AllowsPort(22) {
+			t.Errorf("circuit does not carry its exit's policy")
+		}
+	}
+
+	rr := &mockRelayRepo{online: relays[:2]}
+	uc := usecase.NewBuildCircuitUseCase(rr, &mockCircuitRepo{}, &mockDialer{identity: testRelayIdentity()}, service.NewCryptoService(), service.NewPayloadEncodingService(), service.NewPathSelectionService(service.DefaultPathRestrictions()), &mockEntryGuard{}, &mockBuildTimeout{})
+	if _, err := uc.Handle(usecase.BuildCircuitInput{Hops: 2, ExitPort: 22}); err == nil {
+		t.Errorf("expected error when no exit allows the port")
+	}
+}
+
+func TestBuildCircuitUseCase_Handle_EntryGuard(t *testing.T) {
+	relays := makeTestRelays(t, 4)
+	guard := &mockEntryGuard{guard: relays[3]}
+	cr := &mockCircuitRepo{}
+	uc := usecase.NewBuildCircuitUseCase(&mockRelayRepo{online: relays}, cr, &mockDialer{identity: testRelayIdentity()}, service.NewCryptoService(), service.NewPayloadEncodingService(), service.NewPathSelectionService(service.DefaultPathRestrictions()), guard, &mockBuildTimeout{})
+
+	for i := 0; i < 10; i++ {
+		if _, err := uc.Handle(usecase.BuildCircuitInput{Hops: 3}); err != nil {
+			t.Fatalf("build: %v", err)
+		}
+		if hops := cr.saved.Hops(); !hops[0].Equal(relays[3].ID()) {
+			t.Fatalf("first hop %s is not the entry guard", hops[0])
+		}
+	}
+	if len(guard.reports) != 10 || slices.Contains(guard.reports, false) {
+		t.Errorf("guard reports = %v, want 10 successes", guard.reports)
+	}
+
+	// one-hop circuits have no entry apart from the exit
+	guard.reports = nil
+	if _, err := uc.Handle(usecase.BuildCircuitInput{Hops: 1}); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if len(guard.reports) != 0 {
+		t.Errorf("one-hop circuit reported to the guard: %v", guard.reports)
+	}
+}
+
+func TestBuildCircuitUseCase_Handle_Timeout(t *testing.T) {
+	relays := makeTestRelays(t, 3)
+	cbt := &mockBuildTimeout{}
+	uc := usecase.NewBuildCircuitUseCase(&mockRelayRepo{online: relays}, &mockCircuitRepo{}, &mockDialer{identity: testRelayIdentity()}, service.NewCryptoService(), service.NewPayloadEncodingService(), service.NewPathSelectionService(service.DefaultPathRestrictions()), &mockEntryGuard{}, cbt)
+	if _, err := uc.Handle(usecase.BuildCircuitInput{Hops: 3}); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if len(cbt.records) != 1 || cbt.records[0].TimedOut || cbt.records[0].Hops != 3 {
+		t.Fatalf("records = %+v, want one completed 3 hop build", cbt.records)
+	}
+
+	// the first relay answers only after the learned timeout
+	cbt = &mockBuildTimeout{timeout: 20 * time.Millisecond}
+	guard := &mockEntryGuard{}
+	uc = usecase.NewBuildCircuitUseCase(&mockRelayRepo{online: relays}, &mockCircuitRepo{}, &mockDialer{identity: testRelayIdentity(), dialDelay: time.Second}, service.NewCryptoService(), service.NewPayloadEncodingService(), service.NewPathSelectionService(service.DefaultPathRestrictions()), guard, cbt)
+	start := time.Now()
+	if _, err := uc.Handle(usecase.BuildCircuitInput{Hops: 3}); !errors.Is(err, usecase.ErrCircuitBuildTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the dial to time out", err)
+	}
+	if d := time.Since(start); d >= 500*time.Millisecond {
+		t.Errorf("build gave up after %s, want about the 20ms timeout", d)
+	}
+	if len(cbt.records) != 1 || !cbt.records[0].TimedOut || cbt.records[0].Elapsed != 20*time.Millisecond {
+		t.Errorf("records = %+v, want one timeout after 20ms", cbt.records)
+	}
+	if len(guard.reports) != 1 || guard.reports[0] {
+		t.Errorf("guard reports = %v, want one failure", guard.reports)
+	}
+}
@@ -0,0 +1,182 @@
+package usecase
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"ikedadada/go-ptor/shared/domain/repository"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+const (
+	// buildTimeBinWidth and buildTimeModes say how the scale of the Pareto
+	// distribution is estimated, like Tor's circuit build timeout does: the
+	// build times are put in bins buildTimeBinWidth wide, and the scale is
+	// the mean of the buildTimeModes most common bins.
+	buildTimeBinWidth = 10 * time.Millisecond
+	buildTimeModes    = 10
+)
+
+// BuildTimeoutPolicy says how the circuit build timeout is learned.
+type BuildTimeoutPolicy struct {
+	// Initial is the timeout of circuits of a length fewer than MinSamples
+	// builds were recorded for.
+	Initial time.Duration
+	// Quantile is the share of builds expected to finish within the
+	// timeout, 0.8 in Tor. Slower builds are given up.
+	Quantile float64
+	// MinSamples is the number of builds the timeout is learned from, and
+	// MaxSamples the number of recent builds that are kept.
+	MinSamples int
+	MaxSamples int
+	// Min and Max bound the learned timeout.
+	Min time.Duration
+	Max time.Duration
+}
+
+// CircuitBuildTimeoutUseCase learns how long building a circuit may take
+// from the build times of earlier circuits, the way Tor does: it fits a
+// Pareto distribution to them and sets the timeout at the policy's
+// quantile.
+type CircuitBuildTimeoutUseCase interface {
+	// Timeout returns the time a circuit of hops hops has to be built,
+	// from dialing the first relay to the last CREATED.
+	Timeout(hops int) time.Duration
+	// Record adds the time a circuit of hops hops took to build, or the
+	// timeout it ran into if timedOut is set.
+	Record(hops int, elapsed time.Duration, timedOut bool) error
+}
+
+type circuitBuildTimeoutUseCaseImpl struct {
+	mu     sync.Mutex
+	btRepo repository.BuildTimeRepository
+	policy BuildTimeoutPolicy
+}
+
+// NewCircuitBuildTimeoutUseCase creates a circuit build timeout use case
+// keeping the build times in btRepo.
+func NewCircuitBuildTimeoutUseCase(btRepo repository.BuildTimeRepository, policy BuildTimeoutPolicy) CircuitBuildTimeoutUseCase {
+	return &circuitBuildTimeoutUseCaseImpl{btRepo: btRepo, policy: policy}
+}
+
+func (uc *circuitBuildTimeoutUseCaseImpl) Timeout(hops int) time.Duration {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	times, err := uc.btRepo.All()
+	if err != nil {
+		log.Printf("list build times: %v", err)
+		return uc.policy.Initial
+	}
+	return uc.timeout(times, hops)
+}
+
+func (uc *circuitBuildTimeoutUseCaseImpl) Record(hops int, elapsed time.Duration, timedOut bool) error {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	times, err := uc.btRepo.All()
+	if err != nil {
+		return fmt.Errorf("list build times: %w", err)
+	}
+	times = append(times, vo.BuildTime{Hops: hops, Elapsed: elapsed, TimedOut: timedOut})
+	if n := len(times) - uc.policy.MaxSamples; n > 0 {
+		times = times[n:]
+	}
+	if err := uc.btRepo.Save(times); err != nil {
+		return fmt.Errorf("save build times: %w", err)
+	}
+	if countHops(times, hops) == uc.policy.MinSamples {
+		log.Printf("learned circuit build timeout %s for %d hops", uc.timeout(times, hops), hops)
+	}
+	return nil
+}
+
+// countHops returns how many of times are for circuits of hops hops.
+func countHops(times []vo.BuildTime, hops int) int {
+	n := 0
+	for _, t := range times {
+		if t.Hops == hops {
+			n++
+		}
+	}
+	return n
+}
+
+// timeout fits a Pareto distribution to the build times of circuits of
+// hops hops and returns its policy quantile within the policy's bounds.
+func (uc *circuitBuildTimeoutUseCaseImpl) timeout(times []vo.BuildTime, hops int) time.Duration {
+	times = slices.DeleteFunc(slices.Clone(times), func(t vo.BuildTime) bool { return t.Hops != hops })
+	if len(times) == 0 || len(times) < uc.policy.MinSamples {
+		return uc.policy.Initial
+	}
+	xm := paretoScale(times)
+	// The maximum likelihood estimate of the shape. Builds that timed out
+	// are censored: they took at least their timeout, so they add to the
+	// sum but not to the number of observed builds.
+	var completed int
+	var sum float64
+	for _, t := range times {
+		sum += math.Log(max(t.Elapsed.Seconds(), xm) / xm)
+		if !t.TimedOut {
+			completed++
+		}
+	}
+	if completed == 0 {
+		return uc.policy.Max
+	}
+	if sum == 0 {
+		// every build took the scale
+		return clampDuration(time.Duration(xm*float64(time.Second)), uc.policy.Min, uc.policy.Max)
+	}
+	alpha := float64(completed) / sum
+	q := xm / math.Pow(1-uc.policy.Quantile, 1/alpha)
+	if math.IsInf(q, 0) || q > uc.policy.Max.Seconds() {
+		return uc.policy.Max
+	}
+	return clampDuration(time.Duration(q*float64(time.Second)), uc.policy.Min, uc.policy.Max)
+}
+
+// paretoScale returns the mean, in seconds, of the middles of the most
+// common bins weighted by their counts: the mode of the build times, which
+// is where a Pareto distribution starts.
+func paretoScale(times []vo.BuildTime) float64 {
+	bins := make(map[int64]int)
+	for _, t := range times {
+		if !t.TimedOut {
+			bins[int64(t.Elapsed/buildTimeBinWidth)]++
+		}
+	}
+	type bin struct {
+		n     int64
+		count int
+	}
+	var common []bin
+	for n, count := range bins {
+		common = append(common, bin{n, count})
+	}
+	slices.SortFunc(common, func(a, b bin) int {
+		if c := cmp.Compare(b.count, a.count); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.n, b.n)
+	})
+	var total, weighted float64
+	for _, b := range common[:min(len(common), buildTimeModes)] {
+		mid := (float64(b.n) + 0.5) * buildTimeBinWidth.Seconds()
+		weighted += mid * float64(b.count)
+		total += float64(b.count)
+	}
+	if total == 0 {
+		// only timeouts: the scale hardly matters
+		return buildTimeBinWidth.Seconds()
+	}
+	return weighted / total
+}
+
+func clampDuration(d, lo, hi time.Duration) time.Duration {
+	return min(max(d, lo), hi)
+}
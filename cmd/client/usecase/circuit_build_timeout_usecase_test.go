@@ -0,0 +1,135 @@
+package usecase_test
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+
+	"ikedadada/go-ptor/cmd/client/usecase"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+type mockBuildTimeRepo struct {
+	times []vo.BuildTime
+}
+
+func (m *mockBuildTimeRepo) All() ([]vo.BuildTime, error) { return slices.Clone(m.times), nil }
+func (m *mockBuildTimeRepo) Save(times []vo.BuildTime) error {
+	m.times = slices.Clone(times)
+	return nil
+}
+
+var testBuildTimeoutPolicy = usecase.BuildTimeoutPolicy{
+	Initial:    10 * time.Second,
+	Quantile:   0.8,
+	MinSamples: 100,
+	MaxSamples: 1000,
+	Min:        10 * time.Millisecond,
+	Max:        time.Minute,
+}
+
+// paretoBuildTimes returns n build times drawn from a Pareto distribution
+// with scale xm and shape alpha.
+func paretoBuildTimes(rng *rand.Rand, n int, xm time.Duration, alpha float64) []time.Duration {
+	out := make([]time.Duration, n)
+	for i := range out {
+		u := 1 - rng.Float64() // (0, 1]
+		out[i] = time.Duration(float64(xm) / math.Pow(u, 1/alpha))
+	}
+	return out
+}
+
+func TestCircuitBuildTimeoutUseCase_Initial(t *testing.T) {
+	repo := &mockBuildTimeRepo{}
+	uc := usecase.NewCircuitBuildTimeoutUseCase(repo, testBuildTimeoutPolicy)
+	for i := 0; i < 99; i++ {
+		if err := uc.Record(3, 100*time.Millisecond, false); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+		// builds of other lengths are learned separately
+		if err := uc.Record(1, 100*time.Millisecond, false); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+	if got := uc.Timeout(3); got != 10*time.Second {
+		t.Fatalf("timeout after 99 builds = %s, want the initial 10s", got)
+	}
+	if err := uc.Record(3, 100*time.Millisecond, false); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if got := uc.Timeout(3); got >= time.Second {
+		t.Errorf("timeout after 100 builds of 100ms = %s", got)
+	}
+	if got := uc.Timeout(2); got != 10*time.Second {
+		t.Errorf("timeout for 2 hops = %s, want the initial 10s", got)
+	}
+}
+
+func TestCircuitBuildTimeoutUseCase_FitsPareto(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	repo := &mockBuildTimeRepo{}
+	uc := usecase.NewCircuitBuildTimeoutUseCase(repo, testBuildTimeoutPolicy)
+	for _, d := range paretoBuildTimes(rng, 1000, 500*time.Millisecond, 3) {
+		if err := uc.Record(3, d, false); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+	// the 80% quantile of the distribution is xm / 0.2^(1/alpha)
+	want := 500 * time.Millisecond.Seconds() / math.Pow(0.2, 1.0/3)
+	if got := uc.Timeout(3).Seconds(); math.Abs(got-want)/want > 0.15 {
+		t.Errorf("timeout = %.3fs, want about %.3fs", got, want)
+	}
+
+	// only the most recent builds are kept
+	if err := uc.Record(3, time.Second, false); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if len(repo.times) != 1000 || repo.times[999].Elapsed != time.Second {
+		t.Errorf("history holds %d builds, want the latest 1000", len(repo.times))
+	}
+}
+
+func TestCircuitBuildTimeoutUseCase_Timeouts(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	times := paretoBuildTimes(rng, 500, 200*time.Millisecond, 2)
+	completed := &mockBuildTimeRepo{}
+	censored := &mockBuildTimeRepo{}
+	for _, d := range times {
+		completed.times = append(completed.times, vo.BuildTime{Hops: 3, Elapsed: d})
+		censored.times = append(censored.times, vo.BuildTime{Hops: 3, Elapsed: d})
+	}
+	// builds that ran into a 1s timeout took at least that long
+	for i := 0; i < 100; i++ {
+		censored.times = append(censored.times, vo.BuildTime{Hops: 3, Elapsed: time.Second, TimedOut: true})
+	}
+	base := usecase.NewCircuitBuildTimeoutUseCase(completed, testBuildTimeoutPolicy).Timeout(3)
+	if got := usecase.NewCircuitBuildTimeoutUseCase(censored, testBuildTimeoutPolicy).Timeout(3); got <= base {
+		t.Errorf("timeout with timed out builds %s, want more than %s", got, base)
+	}
+
+	// nothing completes: wait as long as the policy allows
+	allOut := &mockBuildTimeRepo{}
+	for i := 0; i < 100; i++ {
+		allOut.times = append(allOut.times, vo.BuildTime{Hops: 3, Elapsed: time.Second, TimedOut: true})
+	}
+	if got := usecase.NewCircuitBuildTimeoutUseCase(allOut, testBuildTimeoutPolicy).Timeout(3); got != time.Minute {
+		t.Errorf("timeout with every build timed out = %s, want the 1m maximum", got)
+	}
+}
+
+func TestCircuitBuildTimeoutUseCase_Bounds(t *testing.T) {
+	repo := &mockBuildTimeRepo{}
+	policy := testBuildTimeoutPolicy
+	policy.Min = time.Second
+	uc := usecase.NewCircuitBuildTimeoutUseCase(repo, policy)
+	for i := 0; i < 100; i++ {
+		if err := uc.Record(3, time.Duration(i%5)*time.Millisecond, false); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+	if got := uc.Timeout(3); got != time.Second {
+		t.Errorf("timeout for builds of a few ms = %s, want the 1s minimum", got)
+	}
+}
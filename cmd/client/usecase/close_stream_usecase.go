@@ -52,30 +52,41 @@ func (uc *closeStreamUseCaseImpl) Handle(in CloseStreamInput) (CloseStreamOutput
 	cir.CloseStream(sid) // ドメイン側の状態更新
 
 	// END セル送信
-	payload, err := uc.payload.EncodeDataPayload(&service.DataPayloadDTO{StreamID: sid.UInt16()})
-	if err != nil {
-		return CloseStreamOutput{}, err
-	}
-	cell, err := entity.NewCell(vo.CmdEnd, payload)
-	if err != nil {
-		return CloseStreamOutput{}, err
-	}
-	if err := cell.SendToConnection(cir.Conn(0), cid); err != nil {
+	if err := sendEnd(uc.payload, cir, sid.UInt16()); err != nil {
 		return CloseStreamOutput{}, err
 	}
 
-	if len(cir.ActiveStreams()) == 0 { // 最後のストリームなら制御 END
-		payload, err := uc.payload.EncodeDataPayload(&service.DataPayloadDTO{StreamID: 0})
-		if err != nil {
-			return CloseStreamOutput{}, err
-		}
-		cell, err := entity.NewCell(vo.CmdEnd, payload)
-		if err != nil {
-			return CloseStreamOutput{}, err
-		}
-		if err := cell.SendToConnection(cir.Conn(0), cid); err != nil {
+	// 退役済み回路の最後のストリームなら制御 END
+	if cir.Retired() && len(cir.ActiveStreams()) == 0 {
+		if err := closeCircuit(uc.payload, cir); err != nil {
 			return CloseStreamOutput{}, err
 		}
 	}
 	return CloseStreamOutput{Closed: true}, nil
 }
+
+// sendEnd tells the exit that stream sid is done. Stream ID zero ends the
+// whole circuit.
+func sendEnd(pe service.PayloadEncodingService, cir *entity.Circuit, sid uint16) error {
+	linkVer := entity.LinkVersion(cir.Conn(0))
+	payload, err := pe.ForVersion(linkVer).EncodeDataPayload(&service.DataPayloadDTO{StreamID: sid, Data: vo.EndReasonDone.Bytes()})
+	if err != nil {
+		return err
+	}
+	cell, err := entity.NewCell(vo.CmdEnd, payload)
+	if err != nil {
+		return err
+	}
+	cell.Version = linkVer
+	return cell.SendToConnection(cir.Conn(0), cir.ID())
+}
+
+// closeCircuit tears down a retired circuit that no longer carries streams.
+// Closing the connection ends the circuit's receive loop, which forgets it.
+func closeCircuit(pe service.PayloadEncodingService, cir *entity.Circuit) error {
+	err := sendEnd(pe, cir, 0)
+	if conn := cir.Conn(0); conn != nil {
+		conn.Close()
+	}
+	return err
+}
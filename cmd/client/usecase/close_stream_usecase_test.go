@@ -82,13 +82,45 @@ func TestCloseStreamInteractor_Handle(t *testing.T) {
 		})
 	}
 
-	t.Run("control end on last stream", func(t *testing.T) {
+	t.Run("live circuit stays open", func(t *testing.T) {
 		cRepo := &mockCircuitRepoClose{circuit: circuit}
 		peSvc := service.NewPayloadEncodingService()
 		uc := usecase.NewCloseStreamUseCase(cRepo, peSvc)
 		if _, err := uc.Handle(usecase.CloseStreamInput{CircuitID: circuit.ID().String(), StreamID: st.ID.UInt16()}); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		// Test passes if no error occurs and circuit connection is used
+		if sid := lastEndStreamID(t, conn); sid != st.ID.UInt16() {
+			t.Errorf("last END for stream %d, want %d", sid, st.ID.UInt16())
+		}
 	})
+
+	t.Run("control end on last stream of retired circuit", func(t *testing.T) {
+		circuit.Retire()
+		cRepo := &mockCircuitRepoClose{circuit: circuit}
+		peSvc := service.NewPayloadEncodingService()
+		uc := usecase.NewCloseStreamUseCase(cRepo, peSvc)
+		if _, err := uc.Handle(usecase.CloseStreamInput{CircuitID: circuit.ID().String(), StreamID: st.ID.UInt16()}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if sid := lastEndStreamID(t, conn); sid != 0 {
+			t.Errorf("last END for stream %d, want control END", sid)
+		}
+	})
+}
+
+// lastEndStreamID decodes the stream ID of the last END cell written to conn.
+func lastEndStreamID(t *testing.T, conn *mockConnForClose) uint16 {
+	t.Helper()
+	cell, err := entity.Decode(conn.lastWritten[16:])
+	if err != nil {
+		t.Fatalf("decode cell: %v", err)
+	}
+	if cell.Cmd != vo.CmdEnd {
+		t.Fatalf("last cell cmd = %d, want END", cell.Cmd)
+	}
+	p, err := service.NewPayloadEncodingService().DecodeDataPayload(cell.Payload)
+	if err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	return p.StreamID
 }
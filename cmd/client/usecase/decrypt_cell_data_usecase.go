@@ -20,6 +20,8 @@ type DecryptedCellData struct {
 	StreamID uint16
 	Data     []byte
 	Command  vo.CellCommand
+	Reason   vo.EndReason // set for END and DESTROY cells
+	Detail   string       // optional explanation that came with Reason
 }
 
 // DecryptCellDataOutput contains the decrypted cell data
@@ -36,23 +38,26 @@ type DecryptCellDataUseCase interface {
 type decryptCellDataUseCaseImpl struct {
 	cSvc  service.CryptoService
 	peSvc service.PayloadEncodingService
+	rmSvc service.EndReasonMetricsService
 }
 
 // NewDecryptCellDataUseCase creates a new use case for decrypting cell data
 func NewDecryptCellDataUseCase(
 	cSvc service.CryptoService,
 	peSvc service.PayloadEncodingService,
+	rmSvc service.EndReasonMetricsService,
 ) DecryptCellDataUseCase {
 	return &decryptCellDataUseCaseImpl{
 		cSvc:  cSvc,
 		peSvc: peSvc,
+		rmSvc: rmSvc,
 	}
 }
 
 func (uc *decryptCellDataUseCaseImpl) Handle(in DecryptCellDataInput) (DecryptCellDataOutput, error) {
 	// Handle different cell types
 	switch in.Cell.Cmd {
-	case vo.CmdData:
+	case vo.CmdData, vo.CmdDatagram:
 		cellData, err := uc.handleDataCell(in.Cell, in.Circuit)
 		if err != nil {
 			log.Printf("handle data cell error: %v", err)
@@ -60,8 +65,24 @@ func (uc *decryptCellDataUseCaseImpl) Handle(in DecryptCellDataInput) (DecryptCe
 		}
 		return DecryptCellDataOutput{CellData: cellData}, nil
 
+	case vo.CmdBeginAck:
+		cellData, err := uc.handleBeginAckCell(in.Cell, in.Circuit)
+		if err != nil {
+			log.Printf("handle begin ack cell error: %v", err)
+			return DecryptCellDataOutput{}, err
+		}
+		return DecryptCellDataOutput{CellData: cellData}, nil
+
+	case vo.CmdResolved:
+		cellData, err := uc.handleResolvedCell(in.Cell, in.Circuit)
+		if err != nil {
+			log.Printf("handle resolved cell error: %v", err)
+			return DecryptCellDataOutput{}, err
+		}
+		return DecryptCellDataOutput{CellData: cellData}, nil
+
 	case vo.CmdEnd:
-		cellData, err := uc.handleEndCell(in.Cell)
+		cellData, err := uc.handleEndCell(in.Cell, in.Circuit)
 		if err != nil {
 			log.Printf("handle end cell error: %v", err)
 			return DecryptCellDataOutput{}, err
@@ -72,7 +93,15 @@ func (uc *decryptCellDataUseCaseImpl) Handle(in DecryptCellDataInput) (DecryptCe
 		}, nil
 
 	case vo.CmdDestroy:
-		return DecryptCellDataOutput{ShouldClose: true}, nil
+		return DecryptCellDataOutput{CellData: uc.handleDestroyCell(in.Cell), ShouldClose: true}, nil
+
+	case vo.CmdSendme:
+		cellData, err := uc.handleSendmeCell(in.Cell, in.Circuit)
+		if err != nil {
+			log.Printf("handle sendme cell error: %v", err)
+			return DecryptCellDataOutput{}, err
+		}
+		return DecryptCellDataOutput{CellData: cellData}, nil
 
 	default:
 		log.Printf("unhandled cell command: %v", in.Cell.Cmd)
@@ -82,7 +111,7 @@ func (uc *decryptCellDataUseCaseImpl) Handle(in DecryptCellDataInput) (DecryptCe
 
 // handleDataCell processes incoming data cells and decrypts onion layers
 func (uc *decryptCellDataUseCaseImpl) handleDataCell(cell *entity.Cell, cir *entity.Circuit) (*DecryptedCellData, error) {
-	dp, err := uc.peSvc.DecodeDataPayload(cell.Payload)
+	dp, err := uc.peSvc.ForVersion(cell.Version).DecodeDataPayload(cell.Payload)
 	if err != nil {
 		return nil, fmt.Errorf("decode data payload: %w", err)
 	}
@@ -100,37 +129,122 @@ func (uc *decryptCellDataUseCaseImpl) handleDataCell(cell *entity.Cell, cir *ent
 	}, nil
 }
 
-// handleEndCell processes stream end commands
-func (uc *decryptCellDataUseCaseImpl) handleEndCell(cell *entity.Cell) (*DecryptedCellData, error) {
-	sid := uint16(0)
-	if len(cell.Payload) > 0 {
-		if p, err := uc.peSvc.DecodeDataPayload(cell.Payload); err == nil {
-			sid = p.StreamID
-		}
+// handleBeginAckCell marks the acknowledged stream as connected and keeps
+// the address the exit connected it to. The ack for a CONNECT names no
+// stream. Acks are sealed by the hop that sent them; one that no hop
+// recognizes was made up or changed on the way and is rejected.
+func (uc *decryptCellDataUseCaseImpl) handleBeginAckCell(cell *entity.Cell, cir *entity.Circuit) (*DecryptedCellData, error) {
+	p, err := uc.peSvc.ForVersion(cell.Version).DecodeDataPayload(cell.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("decode begin ack payload: %w", err)
 	}
+	body, err := uc.decryptOnionLayers(p.Data, cir)
+	if err != nil {
+		return nil, fmt.Errorf("begin ack: %w", err)
+	}
+	if p.StreamID != 0 {
+		bound, _ := vo.BoundAddrFrom(body)
+		cir.AcceptStream(vo.StreamID(p.StreamID), bound)
+	}
+	return &DecryptedCellData{StreamID: p.StreamID, Command: cell.Cmd}, nil
+}
+
+// handleResolvedCell decrypts the answer to a RESOLVE and hands the
+// addresses to the stream that asked.
+func (uc *decryptCellDataUseCaseImpl) handleResolvedCell(cell *entity.Cell, cir *entity.Circuit) (*DecryptedCellData, error) {
+	cellData, err := uc.handleDataCell(cell, cir)
+	if err != nil {
+		return nil, err
+	}
+	answers, err := vo.ResolvedFrom(cellData.Data)
+	if err != nil {
+		return nil, fmt.Errorf("decode resolved answers: %w", err)
+	}
+	cir.ResolveStream(vo.StreamID(cellData.StreamID), answers)
+	return cellData, nil
+}
+
+// handleEndCell processes stream end commands. An END for a stream that
+// was never acknowledged refuses it with the reason the exit gave. ENDs are
+// sealed by the hop that sent them, so the reason and detail are known to
+// come from it; one that no hop recognizes is rejected.
+func (uc *decryptCellDataUseCaseImpl) handleEndCell(cell *entity.Cell, cir *entity.Circuit) (*DecryptedCellData, error) {
+	p, err := uc.peSvc.ForVersion(cell.Version).DecodeDataPayload(cell.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("decode end payload: %w", err)
+	}
+	body, err := uc.decryptOnionLayers(p.Data, cir)
+	if err != nil {
+		return nil, fmt.Errorf("end: %w", err)
+	}
+	reason := vo.EndReasonFrom(body)
+	detail := vo.EndDetailFrom(body)
+	if p.StreamID != 0 {
+		cir.RefuseStream(vo.StreamID(p.StreamID), reason)
+	}
+	uc.rmSvc.Record(cell.Cmd, reason)
+	log.Printf("end sid=%d reason=%s detail=%q", p.StreamID, reason, detail)
 
 	return &DecryptedCellData{
-		StreamID: sid,
+		StreamID: p.StreamID,
 		Data:     nil,
 		Command:  cell.Cmd,
+		Reason:   reason,
+		Detail:   detail,
 	}, nil
 }
 
-// decryptOnionLayers decrypts multi-layer onion encryption for response data
-func (uc *decryptCellDataUseCaseImpl) decryptOnionLayers(data []byte, cir *entity.Circuit) ([]byte, error) {
-	hopCount := len(cir.Hops())
+// handleDestroyCell reports why a relay tore the circuit down. DESTROY is
+// not onion encrypted, so the reason is the raw payload.
+func (uc *decryptCellDataUseCaseImpl) handleDestroyCell(cell *entity.Cell) *DecryptedCellData {
+	reason := vo.EndReasonFrom(cell.Payload)
+	detail := vo.EndDetailFrom(cell.Payload)
+	uc.rmSvc.Record(cell.Cmd, reason)
+	log.Printf("destroy reason=%s detail=%q", reason, detail)
+	return &DecryptedCellData{Command: cell.Cmd, Reason: reason, Detail: detail}
+}
 
-	// Decrypt each layer in reverse circuit order (first hop to exit hop)
-	for hop := 0; hop < hopCount; hop++ {
-		key := cir.HopKey(hop)
+// handleSendmeCell opens the package window the SENDME acknowledges.
+// Stream ID zero refers to the circuit window. Only a SENDME the exit
+// sealed is acted on; anything a relay on the path made up is rejected.
+func (uc *decryptCellDataUseCaseImpl) handleSendmeCell(cell *entity.Cell, cir *entity.Circuit) (*DecryptedCellData, error) {
+	p, err := uc.peSvc.ForVersion(cell.Version).DecodeDataPayload(cell.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("decode sendme payload: %w", err)
+	}
+	if _, err := uc.decryptOnionLayers(p.Data, cir); err != nil {
+		return nil, fmt.Errorf("sendme: %w", err)
+	}
+	if p.StreamID == 0 {
+		if err := cir.Window().Acknowledge(); err != nil {
+			return nil, fmt.Errorf("circuit sendme: %w", err)
+		}
+	} else if w, ok := cir.StreamWindow(vo.StreamID(p.StreamID)); ok {
+		if err := w.Acknowledge(); err != nil {
+			return nil, fmt.Errorf("stream %d sendme: %w", p.StreamID, err)
+		}
+	}
+	return &DecryptedCellData{StreamID: p.StreamID, Command: cell.Cmd}, nil
+}
+
+// decryptOnionLayers peels one layer per hop, starting at the first hop,
+// until a hop recognizes the relay body as its own.
+func (uc *decryptCellDataUseCaseImpl) decryptOnionLayers(data []byte, cir *entity.Circuit) ([]byte, error) {
+	for hop := range cir.Hops() {
+		key := cir.HopKey(hop, vo.DirectionBackward)
 		nonce := cir.HopUpstreamDataNonce(hop)
 
-		decrypted, err := uc.cSvc.AESOpen(key, nonce, data)
+		decrypted, err := uc.cSvc.AESCTR(key, nonce, data)
 		if err != nil {
 			return nil, fmt.Errorf("response decrypt failed hop=%d: %w", hop, err)
 		}
+		body, digest, ok := uc.cSvc.OpenRelayBody(key, vo.DirectionBackward, cir.HopDigest(hop, vo.DirectionBackward), decrypted)
+		if ok {
+			cir.SetHopDigest(hop, vo.DirectionBackward, digest)
+			return body, nil
+		}
 		data = decrypted
 	}
 
-	return data, nil
+	return nil, fmt.Errorf("response not recognized by any hop")
 }
@@ -1,15 +1,106 @@
 package usecase
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
 	"testing"
+	"time"
 
 	"ikedadada/go-ptor/shared/domain/entity"
 	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
 )
 
+// backwardCell builds a DATA cell for stream 1 originated by hop origin, with a layer
+// added by every hop between it and the client.
+func backwardCell(t *testing.T, cSvc service.CryptoService, keys []vo.AESKey, nonces []vo.Nonce, origin int, data []byte) *entity.Cell {
+	t.Helper()
+	enc, _, err := cSvc.SealRelayBody(keys[origin], vo.DirectionBackward, [32]byte{}, data)
+	if err != nil {
+		t.Fatalf("SealRelayBody: %v", err)
+	}
+	for hop := origin; hop >= 0; hop-- {
+		if enc, err = cSvc.AESCTR(keys[hop], nonces[hop].Sequence(vo.NonceSpaceUpstream, 0), enc); err != nil {
+			t.Fatalf("AESCTR: %v", err)
+		}
+	}
+	peSvc := service.NewPayloadEncodingService()
+	payload, err := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: 1, Data: enc})
+	if err != nil {
+		t.Fatalf("EncodeDataPayload: %v", err)
+	}
+	return &entity.Cell{Cmd: vo.CmdData, Version: vo.ProtocolV1, Payload: payload}
+}
+
+func TestDecryptCellDataUseCase_Handle_RecognizesOriginHop(t *testing.T) {
+	const hops = 3
+	cSvc := service.NewCryptoService()
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ids := make([]vo.RelayID, hops)
+	fwdKeys := make([]vo.AESKey, hops)
+	keys := make([]vo.AESKey, hops)
+	nonces := make([]vo.Nonce, hops)
+	for i := range ids {
+		ids[i], _ = vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+		fwdKeys[i], _ = vo.NewAESKey()
+		keys[i], _ = vo.NewAESKey()
+		nonces[i], _ = vo.NewNonce()
+	}
+
+	for origin := 0; origin < hops; origin++ {
+		// replies are sealed and layered with the backward keys only
+		cir, err := entity.NewCircuit(vo.NewCircuitID(), ids, fwdKeys, keys, nonces, vo.NewRSAPrivKey(rawKey))
+		if err != nil {
+			t.Fatalf("NewCircuit: %v", err)
+		}
+		uc := NewDecryptCellDataUseCase(cSvc, service.NewPayloadEncodingService(), service.NewEndReasonMetricsService())
+		cell := backwardCell(t, cSvc, keys, nonces, origin, []byte("reply"))
+
+		result, err := uc.Handle(DecryptCellDataInput{Cell: cell, Circuit: cir})
+		if err != nil {
+			t.Fatalf("origin %d: Handle: %v", origin, err)
+		}
+		if string(result.CellData.Data) != "reply" {
+			t.Errorf("origin %d: data = %q", origin, result.CellData.Data)
+		}
+		for hop := 0; hop < hops; hop++ {
+			advanced := cir.HopDigest(hop, vo.DirectionBackward) != [32]byte{}
+			if advanced != (hop == origin) {
+				t.Errorf("origin %d: hop %d digest advanced = %v", origin, hop, advanced)
+			}
+		}
+	}
+}
+
+func TestDecryptCellDataUseCase_Handle_UnrecognizedData(t *testing.T) {
+	cSvc := service.NewCryptoService()
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	id, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	key, _ := vo.NewAESKey()
+	otherKey, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cir, err := entity.NewCircuit(vo.NewCircuitID(), []vo.RelayID{id}, []vo.AESKey{key}, []vo.AESKey{key}, []vo.Nonce{nonce}, vo.NewRSAPrivKey(rawKey))
+	if err != nil {
+		t.Fatalf("NewCircuit: %v", err)
+	}
+
+	// the body was stamped with a key the client does not share
+	body, _, _ := cSvc.SealRelayBody(otherKey, vo.DirectionBackward, [32]byte{}, []byte("reply"))
+	enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceUpstream, 0), body)
+	payload, _ := service.NewPayloadEncodingService().EncodeDataPayload(&service.DataPayloadDTO{StreamID: 1, Data: enc})
+	cell := &entity.Cell{Cmd: vo.CmdData, Version: vo.ProtocolV1, Payload: payload}
+
+	uc := NewDecryptCellDataUseCase(cSvc, service.NewPayloadEncodingService(), service.NewEndReasonMetricsService())
+	if _, err := uc.Handle(DecryptCellDataInput{Cell: cell, Circuit: cir}); err == nil {
+		t.Error("expected error for unrecognized data cell")
+	}
+}
+
 func TestDecryptCellDataUseCase_Handle_DestroyCell(t *testing.T) {
 	// Create mock cell
-	cell, err := entity.NewCell(vo.CmdDestroy, []byte("test payload"))
+	cell, err := entity.NewCell(vo.CmdDestroy, vo.EndReasonTimeout.WithDetail("next hop stalled"))
 	if err != nil {
 		t.Fatalf("NewCell: %v", err)
 	}
@@ -17,8 +108,9 @@ func TestDecryptCellDataUseCase_Handle_DestroyCell(t *testing.T) {
 	// Create mock circuit
 	circuit := &entity.Circuit{}
 
-	// Create use case with nil services (won't be called for destroy cell)
-	uc := NewDecryptCellDataUseCase(nil, nil)
+	// Create use case with nil crypto services (won't be called for destroy cell)
+	rmSvc := service.NewEndReasonMetricsService()
+	uc := NewDecryptCellDataUseCase(nil, nil, rmSvc)
 
 	// Test
 	result, err := uc.Handle(DecryptCellDataInput{
@@ -33,8 +125,53 @@ func TestDecryptCellDataUseCase_Handle_DestroyCell(t *testing.T) {
 	if !result.ShouldClose {
 		t.Error("Expected ShouldClose to be true for destroy cell")
 	}
-	if result.CellData != nil {
-		t.Error("Expected CellData to be nil for destroy cell")
+	if result.CellData == nil || result.CellData.Reason != vo.EndReasonTimeout || result.CellData.Detail != "next hop stalled" {
+		t.Errorf("destroy cell data = %+v, want reason %s with detail", result.CellData, vo.EndReasonTimeout)
+	}
+	if got := rmSvc.Count(vo.CmdDestroy, vo.EndReasonTimeout); got != 1 {
+		t.Errorf("destroy metric = %d, want 1", got)
+	}
+}
+
+func TestDecryptCellDataUseCase_Handle_EndReason(t *testing.T) {
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	id, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cir, err := entity.NewCircuit(vo.NewCircuitID(), []vo.RelayID{id}, []vo.AESKey{key}, []vo.AESKey{key}, []vo.Nonce{nonce}, vo.NewRSAPrivKey(rawKey))
+	if err != nil {
+		t.Fatalf("NewCircuit: %v", err)
+	}
+	st, _ := cir.OpenStream()
+
+	peSvc := service.NewPayloadEncodingService()
+	rmSvc := service.NewEndReasonMetricsService()
+	cSvc := service.NewCryptoService()
+	uc := NewDecryptCellDataUseCase(cSvc, peSvc, rmSvc)
+
+	cell := backwardCell(t, cSvc, []vo.AESKey{key}, []vo.Nonce{nonce}, 0, vo.EndReasonExitPolicy.WithDetail("port 25"))
+	cell.Cmd = vo.CmdEnd
+	result, err := uc.Handle(DecryptCellDataInput{Cell: cell, Circuit: cir})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	if result.ShouldClose {
+		t.Error("END for one stream closed the circuit")
+	}
+	if result.CellData.Reason != vo.EndReasonExitPolicy || result.CellData.Detail != "port 25" {
+		t.Errorf("reason = %s detail = %q", result.CellData.Reason, result.CellData.Detail)
+	}
+	if got := rmSvc.Count(vo.CmdEnd, vo.EndReasonExitPolicy); got != 1 {
+		t.Errorf("end metric = %d, want 1", got)
+	}
+
+	// a relay on the path cannot make up the reason of an END
+	forged, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: st.ID.UInt16(), Data: vo.EndReasonConnectRefused.Bytes()})
+	if _, err := uc.Handle(DecryptCellDataInput{Cell: &entity.Cell{Cmd: vo.CmdEnd, Version: vo.ProtocolV1, Payload: forged}, Circuit: cir}); err == nil {
+		t.Error("unsealed END accepted")
+	}
+	if got := rmSvc.Count(vo.CmdEnd, vo.EndReasonConnectRefused); got != 0 {
+		t.Errorf("unsealed END counted %d times", got)
 	}
 }
 
@@ -49,7 +186,7 @@ func TestDecryptCellDataUseCase_Handle_UnhandledCommand(t *testing.T) {
 	circuit := &entity.Circuit{}
 
 	// Create use case with nil services (won't be called for unhandled command)
-	uc := NewDecryptCellDataUseCase(nil, nil)
+	uc := NewDecryptCellDataUseCase(nil, nil, nil)
 
 	// Test
 	result, err := uc.Handle(DecryptCellDataInput{
@@ -68,3 +205,184 @@ func TestDecryptCellDataUseCase_Handle_UnhandledCommand(t *testing.T) {
 		t.Error("Expected CellData to be nil for unhandled command")
 	}
 }
+
+func TestDecryptCellDataUseCase_Handle_Sendme(t *testing.T) {
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	id, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cir, err := entity.NewCircuit(vo.NewCircuitID(), []vo.RelayID{id}, []vo.AESKey{key}, []vo.AESKey{key}, []vo.Nonce{nonce}, vo.NewRSAPrivKey(rawKey))
+	if err != nil {
+		t.Fatalf("NewCircuit: %v", err)
+	}
+	st, _ := cir.OpenStream()
+	sw, _ := cir.StreamWindow(st.ID)
+	for i := 0; i < entity.StreamWindowIncrement; i++ {
+		_ = sw.Package()
+		_ = cir.Window().Package()
+	}
+
+	cSvc := service.NewCryptoService()
+	peSvc := service.NewPayloadEncodingService()
+	uc := NewDecryptCellDataUseCase(cSvc, peSvc, service.NewEndReasonMetricsService())
+	// the exit seals each SENDME in turn, chaining its backward digest
+	exit := entity.NewConnState(key, key, nonce, nil, nil)
+	sendme := func(sid uint16) *entity.Cell {
+		body, digest, _ := cSvc.SealRelayBody(key, vo.DirectionBackward, exit.Digest(vo.DirectionBackward), nil)
+		exit.SetDigest(vo.DirectionBackward, digest)
+		enc, _ := cSvc.AESCTR(key, exit.UpstreamDataNonce(), body)
+		payload, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: sid, Data: enc})
+		return &entity.Cell{Cmd: vo.CmdSendme, Version: vo.ProtocolV1, Payload: payload}
+	}
+
+	if _, err := uc.Handle(DecryptCellDataInput{Cell: sendme(st.ID.UInt16()), Circuit: cir}); err != nil {
+		t.Fatalf("stream sendme: %v", err)
+	}
+	if got := sw.PackageWindow(); got != entity.StreamWindowStart {
+		t.Errorf("stream window = %d, want %d", got, entity.StreamWindowStart)
+	}
+
+	// the circuit window only had 50 cells outstanding, so a SENDME for
+	// 100 is a protocol violation
+	if _, err := uc.Handle(DecryptCellDataInput{Cell: sendme(0), Circuit: cir}); err == nil {
+		t.Error("expected error for circuit SENDME beyond the window")
+	}
+}
+
+// A relay on the path must not be able to open the windows by making up
+// SENDMEs of its own.
+func TestDecryptCellDataUseCase_Handle_SendmeBadDigest(t *testing.T) {
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	id, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cSvc := service.NewCryptoService()
+	peSvc := service.NewPayloadEncodingService()
+
+	body, _, _ := cSvc.SealRelayBody(key, vo.DirectionBackward, [32]byte{}, nil)
+	body[2] ^= 0xff
+	enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceUpstream, 0), body)
+	forged, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{Data: enc})
+	bare, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{})
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"digest does not match", forged},
+		{"bare unsealed sendme", bare},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cir, err := entity.NewCircuit(vo.NewCircuitID(), []vo.RelayID{id}, []vo.AESKey{key}, []vo.AESKey{key}, []vo.Nonce{nonce}, vo.NewRSAPrivKey(rawKey))
+			if err != nil {
+				t.Fatalf("NewCircuit: %v", err)
+			}
+			for i := 0; i < entity.CircuitWindowIncrement; i++ {
+				_ = cir.Window().Package()
+			}
+			want := cir.Window().PackageWindow()
+
+			uc := NewDecryptCellDataUseCase(cSvc, peSvc, service.NewEndReasonMetricsService())
+			cell := &entity.Cell{Cmd: vo.CmdSendme, Version: vo.ProtocolV1, Payload: tt.payload}
+			if _, err := uc.Handle(DecryptCellDataInput{Cell: cell, Circuit: cir}); err == nil {
+				t.Error("expected forged SENDME to be rejected")
+			}
+			if got := cir.Window().PackageWindow(); got != want {
+				t.Errorf("forged SENDME moved the circuit window to %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestDecryptCellDataUseCase_Handle_Resolved(t *testing.T) {
+	const hops = 2
+	cSvc := service.NewCryptoService()
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ids := make([]vo.RelayID, hops)
+	keys := make([]vo.AESKey, hops)
+	nonces := make([]vo.Nonce, hops)
+	for i := range ids {
+		ids[i], _ = vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+		keys[i], _ = vo.NewAESKey()
+		nonces[i], _ = vo.NewNonce()
+	}
+	cir, err := entity.NewCircuit(vo.NewCircuitID(), ids, keys, keys, nonces, vo.NewRSAPrivKey(rawKey))
+	if err != nil {
+		t.Fatalf("NewCircuit: %v", err)
+	}
+	st, _ := cir.OpenStream()
+
+	want := []vo.ResolvedAnswer{{IP: net.IPv4(192, 0, 2, 1), TTL: time.Minute}}
+	cell := backwardCell(t, cSvc, keys, nonces, hops-1, vo.ResolvedBytes(want, service.MaxRelayDataSize))
+	cell.Cmd = vo.CmdResolved
+	uc := NewDecryptCellDataUseCase(cSvc, service.NewPayloadEncodingService(), service.NewEndReasonMetricsService())
+	if _, err := uc.Handle(DecryptCellDataInput{Cell: cell, Circuit: cir}); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+
+	if err := cir.AwaitStream(st.ID, time.Second); err != nil {
+		t.Fatalf("stream not settled: %v", err)
+	}
+	got := cir.StreamAnswers(st.ID)
+	if len(got) != 1 || !got[0].IP.Equal(want[0].IP) || got[0].TTL != want[0].TTL {
+		t.Errorf("answers = %v, want %v", got, want)
+	}
+}
+
+func TestDecryptCellDataUseCase_Handle_BeginAckSealed(t *testing.T) {
+	const hops = 2
+	cSvc := service.NewCryptoService()
+	peSvc := service.NewPayloadEncodingService()
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ids := make([]vo.RelayID, hops)
+	keys := make([]vo.AESKey, hops)
+	nonces := make([]vo.Nonce, hops)
+	for i := range ids {
+		ids[i], _ = vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+		keys[i], _ = vo.NewAESKey()
+		nonces[i], _ = vo.NewNonce()
+	}
+	bound := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 8443}
+
+	// what the middle relay receives from the exit
+	exitBody, _, _ := cSvc.SealRelayBody(keys[1], vo.DirectionBackward, [32]byte{}, vo.BoundAddrBytes(bound))
+	seen, _ := cSvc.AESCTR(keys[1], nonces[1].Sequence(vo.NonceSpaceUpstream, 0), exitBody)
+	if bytes.Contains(seen, bound.IP.To4()) || bytes.Contains(seen, []byte{0x20, 0xfb}) {
+		t.Fatalf("bound address visible to the middle relay: %x", seen)
+	}
+
+	for _, tamper := range []bool{false, true} {
+		cir, err := entity.NewCircuit(vo.NewCircuitID(), ids, keys, keys, nonces, vo.NewRSAPrivKey(rawKey))
+		if err != nil {
+			t.Fatalf("NewCircuit: %v", err)
+		}
+		st, _ := cir.OpenStream()
+		cell := backwardCell(t, cSvc, keys, nonces, hops-1, vo.BoundAddrBytes(bound))
+		cell.Cmd = vo.CmdBeginAck
+		if tamper {
+			// the middle relay flips a bit before passing the ack on
+			p, _ := peSvc.DecodeDataPayload(cell.Payload)
+			p.Data[10] ^= 0x01
+			cell.Payload, _ = peSvc.EncodeDataPayload(p)
+		}
+
+		uc := NewDecryptCellDataUseCase(cSvc, peSvc, service.NewEndReasonMetricsService())
+		_, err = uc.Handle(DecryptCellDataInput{Cell: cell, Circuit: cir})
+		if tamper {
+			if err == nil {
+				t.Error("tampered ack accepted")
+			}
+			if got := cir.StreamBoundAddr(st.ID); got != nil {
+				t.Errorf("tampered ack bound the stream to %v", got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Handle: %v", err)
+		}
+		if got := cir.StreamBoundAddr(st.ID); got == nil || got.String() != bound.String() {
+			t.Errorf("bound = %v, want %v", got, bound)
+		}
+	}
+}
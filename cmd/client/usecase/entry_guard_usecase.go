@@ -0,0 +1,158 @@
+package usecase
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"slices"
+	"sync"
+	"time"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	"ikedadada/go-ptor/shared/domain/repository"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+// ErrNoUsableGuard is returned when none of the entry guards can take a
+// circuit and the guard set is too large to sample another one.
+var ErrNoUsableGuard = errors.New("no usable entry guard")
+
+// GuardPolicy says how the client keeps its entry guards.
+type GuardPolicy struct {
+	// Size is the number of guards circuits are spread over. The set
+	// holds at most twice as many, so guards that fail cannot make the
+	// client try one relay after another as its entry.
+	Size int
+	// Lifetime is how long a guard stays in the set before it is
+	// replaced by a freshly sampled one.
+	Lifetime time.Duration
+	// MaxFailures is the number of consecutive failures after which a
+	// guard is left alone for RetryAfter.
+	MaxFailures int
+	RetryAfter  time.Duration
+}
+
+// EntryGuardUseCase keeps the client's entry guards: a small set of
+// relays, sampled by bandwidth from those with the Guard flag, that take
+// the first hop of every circuit for as long as they last.
+type EntryGuardUseCase interface {
+	// Pick returns the guard for the first hop of a new circuit. Only
+	// relays in online that may share a circuit with avoid, the circuit's
+	// exit if it is chosen already, are considered.
+	Pick(online []*entity.Relay, avoid *entity.Relay) (*entity.Relay, error)
+	// Report records whether a circuit got through the guard for relay id.
+	Report(id vo.RelayID, reached bool) error
+}
+
+type entryGuardUseCaseImpl struct {
+	mu     sync.Mutex
+	gRepo  repository.GuardRepository
+	psSvc  service.PathSelectionService
+	policy GuardPolicy
+	now    func() time.Time
+}
+
+// NewEntryGuardUseCase creates an entry guard use case keeping its guards
+// in gRepo and sampling new ones with psSvc.
+func NewEntryGuardUseCase(gRepo repository.GuardRepository, psSvc service.PathSelectionService, policy GuardPolicy) EntryGuardUseCase {
+	return &entryGuardUseCaseImpl{gRepo: gRepo, psSvc: psSvc, policy: policy, now: time.Now}
+}
+
+func (uc *entryGuardUseCaseImpl) Pick(online []*entity.Relay, avoid *entity.Relay) (*entity.Relay, error) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	now := uc.now()
+
+	guards, err := uc.gRepo.All()
+	if err != nil {
+		return nil, fmt.Errorf("list guards: %w", err)
+	}
+	byID := make(map[vo.RelayID]*entity.Relay, len(online))
+	var related []vo.RelayID // relays that may not share a circuit with avoid
+	for _, r := range online {
+		byID[r.ID()] = r
+		if avoid != nil && uc.psSvc.Related(r, avoid) {
+			related = append(related, r.ID())
+		}
+	}
+	var sampled, expired []vo.RelayID
+	var usable []*entity.Relay // in the order the guards were sampled
+	for _, g := range guards {
+		if g.Expired(now, uc.policy.Lifetime) {
+			log.Printf("entry guard %s expired", g.RelayID())
+			if err := uc.gRepo.Delete(g.RelayID()); err != nil {
+				return nil, fmt.Errorf("drop guard: %w", err)
+			}
+			expired = append(expired, g.RelayID())
+			continue
+		}
+		r, ok := byID[g.RelayID()]
+		if ok && !uc.psSvc.MayEnter(r) {
+			// sampled before the entry nodes were restricted
+			log.Printf("entry guard %s is no longer allowed as entry", g.RelayID())
+			if err := uc.gRepo.Delete(g.RelayID()); err != nil {
+				return nil, fmt.Errorf("drop guard: %w", err)
+			}
+			continue
+		}
+		sampled = append(sampled, g.RelayID())
+		if ok && !slices.ContainsFunc(related, r.ID().Equal) && g.Usable(now, uc.policy.MaxFailures, uc.policy.RetryAfter) {
+			usable = append(usable, r)
+		}
+	}
+
+	for len(usable) < uc.policy.Size && len(sampled) < 2*uc.policy.Size {
+		// a guard that just expired is not sampled again right away
+		exclude := slices.Concat(sampled, expired, related)
+		r, err := uc.psSvc.SelectGuard(online, exclude)
+		if errors.Is(err, service.ErrNoSuitableRelay) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sample guard: %w", err)
+		}
+		if err := uc.gRepo.Save(entity.NewGuard(r.ID(), now)); err != nil {
+			return nil, fmt.Errorf("save guard: %w", err)
+		}
+		log.Printf("sampled entry guard %s", r.ID())
+		sampled = append(sampled, r.ID())
+		usable = append(usable, r)
+	}
+
+	if len(usable) == 0 {
+		return nil, ErrNoUsableGuard
+	}
+	primary := usable[:min(len(usable), uc.policy.Size)]
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(primary))))
+	if err != nil {
+		return nil, err
+	}
+	return primary[n.Int64()], nil
+}
+
+func (uc *entryGuardUseCaseImpl) Report(id vo.RelayID, reached bool) error {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	guards, err := uc.gRepo.All()
+	if err != nil {
+		return fmt.Errorf("list guards: %w", err)
+	}
+	i := slices.IndexFunc(guards, func(g *entity.Guard) bool { return g.RelayID().Equal(id) })
+	if i < 0 {
+		// the guard was rotated out while the circuit was built
+		return nil
+	}
+	g := guards[i]
+	if reached {
+		g.Confirm(uc.now())
+	} else {
+		g.Fail(uc.now())
+		if g.Failures() == uc.policy.MaxFailures {
+			log.Printf("entry guard %s failed %d times, retrying in %s", id, g.Failures(), uc.policy.RetryAfter)
+		}
+	}
+	return uc.gRepo.Save(g)
+}
@@ -0,0 +1,231 @@
+package usecase_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"ikedadada/go-ptor/cmd/client/usecase"
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+type mockGuardRepo struct {
+	guards []*entity.Guard
+}
+
+func (m *mockGuardRepo) All() ([]*entity.Guard, error) { return slices.Clone(m.guards), nil }
+func (m *mockGuardRepo) Save(g *entity.Guard) error {
+	if i := m.index(g.RelayID()); i >= 0 {
+		m.guards[i] = g
+	} else {
+		m.guards = append(m.guards, g)
+	}
+	return nil
+}
+func (m *mockGuardRepo) Delete(id vo.RelayID) error {
+	if i := m.index(id); i >= 0 {
+		m.guards = slices.Delete(m.guards, i, i+1)
+	}
+	return nil
+}
+func (m *mockGuardRepo) index(id vo.RelayID) int {
+	return slices.IndexFunc(m.guards, func(g *entity.Guard) bool { return g.RelayID().Equal(id) })
+}
+
+// makeGuardRelays returns n online relays flagged Guard and Fast.
+func makeGuardRelays(t *testing.T, n int) []*entity.Relay {
+	t.Helper()
+	relays := makeTestRelays(t, n)
+	for _, r := range relays {
+		r.SetFlags(vo.RelayFlagGuard | vo.RelayFlagFast)
+	}
+	return relays
+}
+
+var testGuardPolicy = usecase.GuardPolicy{Size: 2, Lifetime: 30 * 24 * time.Hour, MaxFailures: 2, RetryAfter: time.Hour}
+
+func TestEntryGuardUseCase_SamplesPersistentSet(t *testing.T) {
+	relays := makeGuardRelays(t, 10)
+	relays[0].SetFlags(vo.RelayFlagFast) // not a guard
+	repo := &mockGuardRepo{}
+	uc := usecase.NewEntryGuardUseCase(repo, service.NewPathSelectionService(service.DefaultPathRestrictions()), testGuardPolicy)
+
+	picked := make(map[vo.RelayID]int)
+	for i := 0; i < 200; i++ {
+		g, err := uc.Pick(relays, nil)
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		picked[g.ID()]++
+	}
+	if len(repo.guards) != 2 {
+		t.Fatalf("guard set has %d guards, want 2", len(repo.guards))
+	}
+	for _, g := range repo.guards {
+		if g.RelayID().Equal(relays[0].ID()) {
+			t.Errorf("relay without the Guard flag sampled")
+		}
+		if picked[g.RelayID()] == 0 {
+			t.Errorf("guard %s never used", g.RelayID())
+		}
+	}
+	if len(picked) != 2 {
+		t.Errorf("circuits entered at %d relays, want only the 2 guards", len(picked))
+	}
+
+	// a new client reading the same state keeps the guards
+	again := usecase.NewEntryGuardUseCase(repo, service.NewPathSelectionService(service.DefaultPathRestrictions()), testGuardPolicy)
+	g, err := again.Pick(relays, nil)
+	if err != nil {
+		t.Fatalf("pick: %v", err)
+	}
+	if picked[g.ID()] == 0 {
+		t.Errorf("restarted client picked %s outside its guard set", g.ID())
+	}
+}
+
+func TestEntryGuardUseCase_Rotation(t *testing.T) {
+	relays := makeGuardRelays(t, 4)
+	old := entity.NewGuard(relays[0].ID(), time.Now().Add(-31*24*time.Hour))
+	fresh := entity.NewGuard(relays[1].ID(), time.Now().Add(-24*time.Hour))
+	repo := &mockGuardRepo{guards: []*entity.Guard{old, fresh}}
+	uc := usecase.NewEntryGuardUseCase(repo, service.NewPathSelectionService(service.DefaultPathRestrictions()), testGuardPolicy)
+
+	if _, err := uc.Pick(relays, nil); err != nil {
+		t.Fatalf("pick: %v", err)
+	}
+	if repo.index(relays[0].ID()) >= 0 {
+		t.Errorf("expired guard still in the set")
+	}
+	if repo.index(relays[1].ID()) != 0 || len(repo.guards) != 2 {
+		t.Errorf("guard set %d long, want the fresh guard and one replacement", len(repo.guards))
+	}
+}
+
+func TestEntryGuardUseCase_Failures(t *testing.T) {
+	relays := makeGuardRelays(t, 6)
+	repo := &mockGuardRepo{}
+	uc := usecase.NewEntryGuardUseCase(repo, service.NewPathSelectionService(service.DefaultPathRestrictions()), usecase.GuardPolicy{Size: 1, Lifetime: 30 * 24 * time.Hour, MaxFailures: 2, RetryAfter: time.Hour})
+
+	first, err := uc.Pick(relays, nil)
+	if err != nil {
+		t.Fatalf("pick: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := uc.Report(first.ID(), false); err != nil {
+			t.Fatalf("report: %v", err)
+		}
+	}
+	second, err := uc.Pick(relays, nil)
+	if err != nil {
+		t.Fatalf("pick: %v", err)
+	}
+	if second == first {
+		t.Fatalf("failing guard still picked")
+	}
+	for i := 0; i < 2; i++ {
+		_ = uc.Report(second.ID(), false)
+	}
+	// the set holds twice the size at most: with both guards failing no
+	// third relay becomes the entry
+	if _, err := uc.Pick(relays, nil); !errors.Is(err, usecase.ErrNoUsableGuard) {
+		t.Fatalf("err = %v, want ErrNoUsableGuard", err)
+	}
+	if len(repo.guards) != 2 {
+		t.Errorf("guard set has %d guards, want 2", len(repo.guards))
+	}
+
+	// after the retry interval the first guard, sampled earlier, is back
+	repo.guards[0] = entity.RestoreGuard(first.ID(), repo.guards[0].SampledAt(), time.Time{}, time.Now().Add(-time.Hour), 2)
+	if g, err := uc.Pick(relays, nil); err != nil || g != first {
+		t.Fatalf("pick = %v, %v; want the first guard again", g, err)
+	}
+	if err := uc.Report(first.ID(), true); err != nil {
+		t.Fatalf("report: %v", err)
+	}
+	if g := repo.guards[0]; g.Failures() != 0 || g.ConfirmedAt().IsZero() {
+		t.Errorf("confirmed guard has %d failures, confirmed at %v", g.Failures(), g.ConfirmedAt())
+	}
+}
+
+func TestEntryGuardUseCase_Avoid(t *testing.T) {
+	relays := makeGuardRelays(t, 3)
+	repo := &mockGuardRepo{guards: []*entity.Guard{entity.NewGuard(relays[0].ID(), time.Now())}}
+	uc := usecase.NewEntryGuardUseCase(repo, service.NewPathSelectionService(service.DefaultPathRestrictions()), usecase.GuardPolicy{Size: 1, Lifetime: time.Hour, MaxFailures: 2, RetryAfter: time.Hour})
+
+	for i := 0; i < 20; i++ {
+		g, err := uc.Pick(relays, relays[0])
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		if g == relays[0] {
+			t.Fatalf("picked the relay to avoid")
+		}
+	}
+	if g, err := uc.Pick(relays, nil); err != nil || g != relays[0] {
+		t.Errorf("pick = %v, %v; want the first guard", g, err)
+	}
+}
+
+func TestEntryGuardUseCase_AvoidFamily(t *testing.T) {
+	relays := makeGuardRelays(t, 3)
+	// the first guard and the exit are run by one operator
+	relays[0].SetFamily([]vo.RelayID{relays[2].ID()})
+	relays[2].SetFamily([]vo.RelayID{relays[0].ID()})
+	repo := &mockGuardRepo{guards: []*entity.Guard{entity.NewGuard(relays[0].ID(), time.Now())}}
+	uc := usecase.NewEntryGuardUseCase(repo, service.NewPathSelectionService(service.DefaultPathRestrictions()), usecase.GuardPolicy{Size: 1, Lifetime: time.Hour, MaxFailures: 2, RetryAfter: time.Hour})
+
+	for i := 0; i < 20; i++ {
+		g, err := uc.Pick(relays, relays[2])
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		if g != relays[1] {
+			t.Fatalf("picked %s, want the guard outside the exit's family", g.ID())
+		}
+	}
+}
+
+func TestEntryGuardUseCase_EntryNodes(t *testing.T) {
+	relays := makeGuardRelays(t, 4)
+	relays[3].SetFlags(vo.RelayFlagFast) // named as an entry, so no Guard flag needed
+	entryNodes, err := vo.ParseNodeSet(relays[2].ID().String() + "," + relays[3].ID().String())
+	if err != nil {
+		t.Fatalf("parse nodes: %v", err)
+	}
+	rules := service.DefaultPathRestrictions()
+	rules.EntryNodes = entryNodes
+	// sampled before the entry nodes were set
+	repo := &mockGuardRepo{guards: []*entity.Guard{entity.NewGuard(relays[0].ID(), time.Now())}}
+	uc := usecase.NewEntryGuardUseCase(repo, service.NewPathSelectionService(rules), testGuardPolicy)
+
+	for i := 0; i < 50; i++ {
+		g, err := uc.Pick(relays, nil)
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		if g != relays[2] && g != relays[3] {
+			t.Fatalf("picked %s outside the entry nodes", g.ID())
+		}
+	}
+	if repo.index(relays[0].ID()) >= 0 {
+		t.Errorf("guard outside the entry nodes kept in the set")
+	}
+}
+
+func TestEntryGuardUseCase_NoGuardRelays(t *testing.T) {
+	relays := makeTestRelays(t, 3)
+	for _, r := range relays {
+		r.SetFlags(vo.RelayFlagFast)
+	}
+	uc := usecase.NewEntryGuardUseCase(&mockGuardRepo{}, service.NewPathSelectionService(service.DefaultPathRestrictions()), testGuardPolicy)
+	if _, err := uc.Pick(relays, nil); !errors.Is(err, usecase.ErrNoUsableGuard) {
+		t.Errorf("err = %v, want ErrNoUsableGuard", err)
+	}
+	if err := uc.Report(relays[0].ID(), true); err != nil {
+		t.Errorf("report for a relay outside the set: %v", err)
+	}
+}
@@ -15,7 +15,8 @@ type HandleEndInput struct {
 
 // HandleEndOutput reports the result of closing streams.
 type HandleEndOutput struct {
-	Closed bool `json:"closed"`
+	Closed  bool     `json:"closed"`
+	Streams []uint16 `json:"streams"` // streams that were still open
 }
 
 // HandleEndUseCase processes incoming END cells.
@@ -45,11 +46,14 @@ func (uc *handleEndUseCaseImpl) Handle(in HandleEndInput) (HandleEndOutput, erro
 
 	if in.StreamID == 0 {
 		// close entire circuit
+		out := HandleEndOutput{Closed: true}
 		for _, sid := range cir.ActiveStreams() {
 			cir.CloseStream(sid)
+			out.Streams = append(out.Streams, sid.UInt16())
 		}
+		cir.Window().Close()
 		_ = uc.cRepo.Delete(cid)
-		return HandleEndOutput{Closed: true}, nil
+		return out, nil
 	}
 
 	sid, err := vo.StreamIDFrom(in.StreamID)
@@ -57,5 +61,5 @@ func (uc *handleEndUseCaseImpl) Handle(in HandleEndInput) (HandleEndOutput, erro
 		return HandleEndOutput{}, fmt.Errorf("parse stream id: %w", err)
 	}
 	cir.CloseStream(sid)
-	return HandleEndOutput{Closed: true}, nil
+	return HandleEndOutput{Closed: true, Streams: []uint16{in.StreamID}}, nil
 }
@@ -31,7 +31,7 @@ func makeCircuitForEnd() (*entity.Circuit, vo.StreamID, error) {
 	nonce, _ := vo.NewNonce()
 	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
 	priv := vo.NewRSAPrivKey(rawKey)
-	cir, err := entity.NewCircuit(id, []vo.RelayID{rid}, []vo.AESKey{key}, []vo.Nonce{nonce}, priv)
+	cir, err := entity.NewCircuit(id, []vo.RelayID{rid}, []vo.AESKey{key}, []vo.AESKey{key}, []vo.Nonce{nonce}, priv)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -76,6 +76,21 @@ func TestHandleEndUseCase(t *testing.T) {
 		}
 	})
 
+	t.Run("circuit reports open streams", func(t *testing.T) {
+		cir, sid, err := makeCircuitForEnd()
+		if err != nil {
+			t.Fatalf("setup: %v", err)
+		}
+		uc := usecase.NewHandleEndUseCase(&mockRepoEnd{cir: cir})
+		out, err := uc.Handle(usecase.HandleEndInput{CircuitID: cir.ID().String()})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(out.Streams) != 1 || out.Streams[0] != sid.UInt16() {
+			t.Errorf("streams = %v, want [%d]", out.Streams, sid.UInt16())
+		}
+	})
+
 	t.Run("not found", func(t *testing.T) {
 		repo := &mockRepoEnd{cir: nil, find: repository.ErrNotFound}
 		uc := usecase.NewHandleEndUseCase(repo)
@@ -0,0 +1,151 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"ikedadada/go-ptor/shared/domain/repository"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+// MaintainCircuitPoolInput configures one pass over the circuit pool.
+type MaintainCircuitPoolInput struct {
+	Hops int
+	// OnBuilt is called with the ID of every circuit the pass builds, before
+	// the next build starts, to start receiving on it. It is not called
+	// for a circuit a stream took, and started receiving on, first.
+	OnBuilt func(circuitID string)
+}
+
+// MaintainCircuitPoolOutput reports what a pass changed.
+type MaintainCircuitPoolOutput struct {
+	Built   int `json:"built"`
+	Expired int `json:"expired"`
+}
+
+// CircuitPoolPolicy sets how many clean circuits, which no stream has used
+// yet, the client keeps ready.
+type CircuitPoolPolicy struct {
+	// Min is the number of clean circuits below which the pool is refilled.
+	Min int
+	// Max is the number of clean circuits a refill builds up to.
+	Max int
+	// Hidden is the number of clean circuits kept for each relay that
+	// serves a hidden service.
+	Hidden int
+	// IdleTimeout is how long a clean circuit waits for a stream before it
+	// is torn down.
+	IdleTimeout time.Duration
+}
+
+// MaintainCircuitPoolUseCase tears down clean circuits that sat idle too
+// long and builds new ones until the pool is full again. It is meant to be
+// run periodically in the background.
+type MaintainCircuitPoolUseCase interface {
+	Handle(in MaintainCircuitPoolInput) (MaintainCircuitPoolOutput, error)
+}
+
+type maintainCircuitPoolUseCaseImpl struct {
+	cRepo   repository.CircuitRepository
+	hsRepo  repository.HiddenServiceRepository
+	buildUC BuildCircuitUseCase
+	peSvc   service.PayloadEncodingService
+	policy  CircuitPoolPolicy
+}
+
+// NewMaintainCircuitPoolUseCase returns a use case that keeps the pool of
+// clean circuits filled as policy asks.
+func NewMaintainCircuitPoolUseCase(cRepo repository.CircuitRepository, hsRepo repository.HiddenServiceRepository, buildUC BuildCircuitUseCase, peSvc service.PayloadEncodingService, policy CircuitPoolPolicy) MaintainCircuitPoolUseCase {
+	return &maintainCircuitPoolUseCaseImpl{cRepo: cRepo, hsRepo: hsRepo, buildUC: buildUC, peSvc: peSvc, policy: policy}
+}
+
+func (uc *maintainCircuitPoolUseCaseImpl) Handle(in MaintainCircuitPoolInput) (MaintainCircuitPoolOutput, error) {
+	var out MaintainCircuitPoolOutput
+	circuits, err := uc.cRepo.ListActive()
+	if err != nil {
+		return out, fmt.Errorf("list circuits: %w", err)
+	}
+
+	// count clean circuits to random exits and per pinned exit
+	general := 0
+	pinned := make(map[vo.RelayID]int)
+	now := time.Now()
+	for _, cir := range circuits {
+		if cir.Retired() || !cir.DirtiedAt().IsZero() {
+			continue
+		}
+		if now.Sub(cir.BuiltAt()) >= uc.policy.IdleTimeout {
+			if cir.Retire() && len(cir.ActiveStreams()) == 0 {
+				_ = closeCircuit(uc.peSvc, cir)
+			}
+			out.Expired++
+			continue
+		}
+		if cir.ExitPinned() {
+			pinned[cir.Exit()]++
+		} else {
+			general++
+		}
+	}
+
+	if general < uc.policy.Min {
+		if err := uc.fill(in, "", uc.policy.Max-general, &out); err != nil {
+			return out, err
+		}
+	}
+
+	if uc.policy.Hidden <= 0 {
+		return out, nil
+	}
+	services, err := uc.hsRepo.All()
+	if err != nil {
+		return out, fmt.Errorf("list hidden services: %w", err)
+	}
+	for _, hs := range services {
+		exit := hs.RelayID()
+		n := pinned[exit]
+		if n >= uc.policy.Hidden {
+			continue
+		}
+		// several services may share a relay
+		pinned[exit] = uc.policy.Hidden
+		err := uc.fill(in, exit.String(), uc.policy.Hidden-n, &out)
+		if errors.Is(err, service.ErrExcludedRelay) {
+			// the user excluded the service's relay; streams to it are
+			// refused as well
+			log.Printf("circuit pool skips excluded hidden service relay %s", exit)
+			continue
+		}
+		if err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+// fill builds count circuits to exitRelayID, or to random exits if it is
+// empty.
+func (uc *maintainCircuitPoolUseCaseImpl) fill(in MaintainCircuitPoolInput, exitRelayID string, count int, out *MaintainCircuitPoolOutput) error {
+	for i := 0; i < count; i++ {
+		built, err := uc.buildUC.Handle(BuildCircuitInput{Hops: in.Hops, ExitRelayID: exitRelayID})
+		if err != nil {
+			return fmt.Errorf("build circuit: %w", err)
+		}
+		out.Built++
+		cid, err := vo.CircuitIDFrom(built.CircuitID)
+		if err != nil {
+			return fmt.Errorf("parse circuit id: %w", err)
+		}
+		cir, err := uc.cRepo.Find(cid)
+		if err != nil {
+			return fmt.Errorf("circuit not found: %w", err)
+		}
+		if in.OnBuilt != nil && cir.ClaimReceiver() {
+			in.OnBuilt(built.CircuitID)
+		}
+	}
+	return nil
+}
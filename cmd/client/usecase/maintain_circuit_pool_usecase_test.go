@@ -0,0 +1,160 @@
+package usecase_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"ikedadada/go-ptor/cmd/client/usecase"
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+type mockHiddenRepoPool struct {
+	services []*entity.HiddenService
+}
+
+func (m *mockHiddenRepoPool) FindByAddress(vo.HiddenAddr) (*entity.HiddenService, error) {
+	return nil, errors.New("not found")
+}
+func (m *mockHiddenRepoPool) FindByAddressString(string) (*entity.HiddenService, error) {
+	return nil, errors.New("not found")
+}
+func (m *mockHiddenRepoPool) All() ([]*entity.HiddenService, error) { return m.services, nil }
+func (m *mockHiddenRepoPool) Save(*entity.HiddenService) error      { return nil }
+
+// makeHiddenServices returns n services hosted on the relay the mock
+// builder uses as exit.
+func makeHiddenServices(n int) []*entity.HiddenService {
+	relayID, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	out := make([]*entity.HiddenService, 0, n)
+	for i := 0; i < n; i++ {
+		pub, _, _ := ed25519.GenerateKey(rand.Reader)
+		out = append(out, entity.NewHiddenService(vo.NewHiddenAddr(pub), relayID, vo.Ed25519PubKey{PublicKey: pub}))
+	}
+	return out
+}
+
+func TestMaintainCircuitPoolUseCase_Fill(t *testing.T) {
+	repo := &mockRepoAcquire{m: make(map[vo.CircuitID]*entity.Circuit)}
+	build := &mockBuildAcquire{repo: repo}
+	uc := usecase.NewMaintainCircuitPoolUseCase(repo, &mockHiddenRepoPool{services: makeHiddenServices(2)}, build, service.NewPayloadEncodingService(), usecase.CircuitPoolPolicy{
+		Min:         2,
+		Max:         3,
+		Hidden:      1,
+		IdleTimeout: time.Minute,
+	})
+
+	var receiving []string
+	in := usecase.MaintainCircuitPoolInput{Hops: 1, OnBuilt: func(cid string) { receiving = append(receiving, cid) }}
+	out, err := uc.Handle(in)
+	if err != nil {
+		t.Fatalf("maintain: %v", err)
+	}
+	// three general circuits and one for the relay both services share
+	if out.Built != 4 || len(receiving) != 4 {
+		t.Fatalf("built=%d receiving=%d, want 4", out.Built, len(receiving))
+	}
+	pinned := 0
+	circuits, _ := repo.ListActive()
+	for _, cir := range circuits {
+		if cir.ExitPinned() {
+			pinned++
+		}
+	}
+	if pinned != 1 {
+		t.Errorf("pinned circuits = %d, want 1", pinned)
+	}
+
+	// a full pool is left alone
+	if out, _ := uc.Handle(in); out.Built != 0 {
+		t.Errorf("full pool built %d circuits", out.Built)
+	}
+
+	// using two clean circuits drops the pool below Min
+	used := 0
+	for _, cir := range circuits {
+		if !cir.ExitPinned() && used < 2 {
+			cir.OpenStream()
+			used++
+		}
+	}
+	if out, _ := uc.Handle(in); out.Built != 2 {
+		t.Errorf("refill built %d circuits, want 2", out.Built)
+	}
+}
+
+func TestMaintainCircuitPoolUseCase_IdleTimeout(t *testing.T) {
+	repo := &mockRepoAcquire{m: make(map[vo.CircuitID]*entity.Circuit)}
+	build := &mockBuildAcquire{repo: repo}
+	uc := usecase.NewMaintainCircuitPoolUseCase(repo, &mockHiddenRepoPool{}, build, service.NewPayloadEncodingService(), usecase.CircuitPoolPolicy{
+		Min:         1,
+		Max:         1,
+		IdleTimeout: time.Millisecond,
+	})
+
+	if _, err := uc.Handle(usecase.MaintainCircuitPoolInput{Hops: 1}); err != nil {
+		t.Fatalf("maintain: %v", err)
+	}
+	circuits, _ := repo.ListActive()
+	time.Sleep(5 * time.Millisecond)
+
+	out, err := uc.Handle(usecase.MaintainCircuitPoolInput{Hops: 1})
+	if err != nil {
+		t.Fatalf("maintain: %v", err)
+	}
+	if out.Expired != 1 || out.Built != 1 {
+		t.Errorf("expired=%d built=%d, want 1 and 1", out.Expired, out.Built)
+	}
+	if !circuits[0].Retired() {
+		t.Errorf("idle circuit not retired")
+	}
+}
+
+func TestMaintainCircuitPoolUseCase_BuildError(t *testing.T) {
+	repo := &mockRepoAcquire{m: make(map[vo.CircuitID]*entity.Circuit)}
+	build := &mockBuildAcquire{repo: repo, err: errors.New("no relays")}
+	uc := usecase.NewMaintainCircuitPoolUseCase(repo, &mockHiddenRepoPool{}, build, service.NewPayloadEncodingService(), usecase.CircuitPoolPolicy{
+		Min:         1,
+		Max:         2,
+		IdleTimeout: time.Minute,
+	})
+	if _, err := uc.Handle(usecase.MaintainCircuitPoolInput{Hops: 1}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// excludingBuild fails to build circuits to a chosen exit, as the build use
+// case does when StrictNodes excludes it.
+type excludingBuild struct {
+	*mockBuildAcquire
+}
+
+func (m excludingBuild) Handle(in usecase.BuildCircuitInput) (usecase.BuildCircuitOutput, error) {
+	if in.ExitRelayID != "" {
+		return usecase.BuildCircuitOutput{}, fmt.Errorf("select path: exit %s: %w", in.ExitRelayID, service.ErrExcludedRelay)
+	}
+	return m.mockBuildAcquire.Handle(in)
+}
+
+func TestMaintainCircuitPoolUseCase_ExcludedHiddenRelay(t *testing.T) {
+	repo := &mockRepoAcquire{m: make(map[vo.CircuitID]*entity.Circuit)}
+	build := excludingBuild{&mockBuildAcquire{repo: repo}}
+	uc := usecase.NewMaintainCircuitPoolUseCase(repo, &mockHiddenRepoPool{services: makeHiddenServices(2)}, build, service.NewPayloadEncodingService(), usecase.CircuitPoolPolicy{
+		Min:         1,
+		Max:         1,
+		Hidden:      1,
+		IdleTimeout: time.Minute,
+	})
+	out, err := uc.Handle(usecase.MaintainCircuitPoolInput{Hops: 1})
+	if err != nil {
+		t.Fatalf("maintain: %v", err)
+	}
+	if out.Built != 1 {
+		t.Errorf("built %d circuits, want only the general one", out.Built)
+	}
+}
@@ -0,0 +1,54 @@
+package usecase
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"ikedadada/go-ptor/shared/domain/repository"
+)
+
+// MapAddressInput names the hidden service to map
+type MapAddressInput struct {
+	Host string
+	IPv6 bool
+}
+
+// MapAddressOutput contains the virtual address that stands for the host
+type MapAddressOutput struct {
+	IP net.IP
+}
+
+// MapAddressUseCase gives hidden services virtual IP addresses, so that
+// applications that resolve names before connecting can still reach them
+// through the SOCKS port
+type MapAddressUseCase interface {
+	Handle(in MapAddressInput) (MapAddressOutput, error)
+}
+
+type mapAddressUseCaseImpl struct {
+	hsRepo repository.HiddenServiceRepository
+	amRepo repository.AddressMapRepository
+}
+
+// NewMapAddressUseCase creates a new use case for mapping hidden service addresses
+func NewMapAddressUseCase(hsRepo repository.HiddenServiceRepository, amRepo repository.AddressMapRepository) MapAddressUseCase {
+	return &mapAddressUseCaseImpl{hsRepo: hsRepo, amRepo: amRepo}
+}
+
+func (uc *mapAddressUseCaseImpl) Handle(in MapAddressInput) (MapAddressOutput, error) {
+	host := strings.ToLower(in.Host)
+	if !strings.HasSuffix(host, ".ptor") {
+		return MapAddressOutput{}, fmt.Errorf("%w: %s is not a hidden service address", repository.ErrInvalidInput, in.Host)
+	}
+	// only known hidden services get an address, so lookups of
+	// mistyped names fail right away
+	if _, err := uc.hsRepo.FindByAddressString(host); err != nil {
+		return MapAddressOutput{}, fmt.Errorf("hidden service not found: %s: %w", in.Host, repository.ErrNotFound)
+	}
+	ip, err := uc.amRepo.Map(host, in.IPv6)
+	if err != nil {
+		return MapAddressOutput{}, fmt.Errorf("map %s: %w", in.Host, err)
+	}
+	return MapAddressOutput{IP: ip}, nil
+}
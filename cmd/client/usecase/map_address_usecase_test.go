@@ -0,0 +1,80 @@
+package usecase_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"ikedadada/go-ptor/cmd/client/usecase"
+	"ikedadada/go-ptor/shared/domain/entity"
+	"ikedadada/go-ptor/shared/domain/repository"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+type mockHiddenRepoMap struct {
+	known string
+}
+
+func (m *mockHiddenRepoMap) FindByAddress(vo.HiddenAddr) (*entity.HiddenService, error) {
+	return nil, repository.ErrNotFound
+}
+func (m *mockHiddenRepoMap) FindByAddressString(addr string) (*entity.HiddenService, error) {
+	if addr != m.known {
+		return nil, repository.ErrNotFound
+	}
+	return &entity.HiddenService{}, nil
+}
+func (m *mockHiddenRepoMap) All() ([]*entity.HiddenService, error) { return nil, nil }
+func (m *mockHiddenRepoMap) Save(*entity.HiddenService) error      { return nil }
+
+type mockAddressMap struct {
+	mapped []string
+}
+
+func (m *mockAddressMap) Map(host string, ipv6 bool) (net.IP, error) {
+	m.mapped = append(m.mapped, host)
+	if ipv6 {
+		return net.ParseIP("fe80::1"), nil
+	}
+	return net.IPv4(127, 192, 0, 1), nil
+}
+func (m *mockAddressMap) Lookup(net.IP) (string, bool) { return "", false }
+
+func TestMapAddressUseCase_Handle(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      usecase.MapAddressInput
+		want    net.IP
+		wantErr error
+	}{
+		{"ipv4", usecase.MapAddressInput{Host: "Known.ptor"}, net.IPv4(127, 192, 0, 1), nil},
+		{"ipv6", usecase.MapAddressInput{Host: "known.ptor", IPv6: true}, net.ParseIP("fe80::1"), nil},
+		{"unknown service", usecase.MapAddressInput{Host: "unknown.ptor"}, nil, repository.ErrNotFound},
+		{"not a hidden service", usecase.MapAddressInput{Host: "example.com"}, nil, repository.ErrInvalidInput},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			amRepo := &mockAddressMap{}
+			uc := usecase.NewMapAddressUseCase(&mockHiddenRepoMap{known: "known.ptor"}, amRepo)
+			out, err := uc.Handle(tt.in)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				if len(amRepo.mapped) != 0 {
+					t.Errorf("mapped %v", amRepo.mapped)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handle: %v", err)
+			}
+			if !out.IP.Equal(tt.want) {
+				t.Errorf("IP = %s, want %s", out.IP, tt.want)
+			}
+			if len(amRepo.mapped) != 1 || amRepo.mapped[0] != "known.ptor" {
+				t.Errorf("mapped %v, want the lower-case name", amRepo.mapped)
+			}
+		})
+	}
+}
@@ -46,7 +46,7 @@ func makeTestCircuit() (*entity.Circuit, error) {
 		return nil, err
 	}
 	priv := vo.NewRSAPrivKey(rawKey)
-	c, err := entity.NewCircuit(id, []vo.RelayID{relayID}, []vo.AESKey{key}, []vo.Nonce{nonce}, priv)
+	c, err := entity.NewCircuit(id, []vo.RelayID{relayID}, []vo.AESKey{key}, []vo.AESKey{key}, []vo.Nonce{nonce}, priv)
 	if err != nil {
 		return nil, err
 	}
@@ -27,14 +27,22 @@ type ResolveTargetAddressUseCase interface {
 
 type resolveTargetAddressUseCaseImpl struct {
 	hsRepo repository.HiddenServiceRepository
+	amRepo repository.AddressMapRepository
 }
 
 // NewResolveTargetAddressUseCase creates a new use case for address resolution
-func NewResolveTargetAddressUseCase(hsRepo repository.HiddenServiceRepository) ResolveTargetAddressUseCase {
-	return &resolveTargetAddressUseCaseImpl{hsRepo: hsRepo}
+func NewResolveTargetAddressUseCase(hsRepo repository.HiddenServiceRepository, amRepo repository.AddressMapRepository) ResolveTargetAddressUseCase {
+	return &resolveTargetAddressUseCaseImpl{hsRepo: hsRepo, amRepo: amRepo}
 }
 
 func (uc *resolveTargetAddressUseCaseImpl) Handle(in ResolveTargetAddressInput) (ResolveTargetAddressOutput, error) {
+	// A virtual address handed out by the DNS port stands for the hidden
+	// service it was mapped to
+	if ip := net.ParseIP(in.Host); ip != nil {
+		if host, ok := uc.amRepo.Lookup(ip); ok {
+			in.Host = host
+		}
+	}
 	hostLower := strings.ToLower(in.Host)
 	exitRelayID := ""
 
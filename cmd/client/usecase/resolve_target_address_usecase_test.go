@@ -4,6 +4,7 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"errors"
+	"net"
 	"testing"
 
 	"ikedadada/go-ptor/shared/domain/entity"
@@ -52,6 +53,20 @@ func (m *mockHiddenServiceRepository) All() ([]*entity.HiddenService, error) {
 	return result, nil
 }
 
+// mockAddressMapRepository maps the virtual address 127.192.0.1 to test.ptor
+type mockAddressMapRepository struct{}
+
+func (m *mockAddressMapRepository) Map(host string, ipv6 bool) (net.IP, error) {
+	return net.IPv4(127, 192, 0, 1), nil
+}
+
+func (m *mockAddressMapRepository) Lookup(ip net.IP) (string, bool) {
+	if ip.Equal(net.IPv4(127, 192, 0, 1)) {
+		return "test.ptor", true
+	}
+	return "", false
+}
+
 func TestResolveTargetAddressUseCase_Handle(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -121,6 +136,25 @@ func TestResolveTargetAddressUseCase_Handle(t *testing.T) {
 			},
 			expectError: false,
 		},
+		{
+			name: "Virtual address of a hidden service",
+			input: ResolveTargetAddressInput{
+				Host: "127.192.0.1",
+				Port: 80,
+			},
+			setupMock: func(m *mockHiddenServiceRepository) {
+				pub, _, _ := ed25519.GenerateKey(rand.Reader)
+
+				addr := vo.HiddenAddrFromString("test.ptor")
+				relayID, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440002")
+				m.Save(entity.NewHiddenService(addr, relayID, vo.Ed25519PubKey{PublicKey: pub}))
+			},
+			expected: ResolveTargetAddressOutput{
+				DialAddress: "test.ptor:80",
+				ExitRelayID: "550e8400-e29b-41d4-a716-446655440002",
+			},
+			expectError: false,
+		},
 		{
 			name: "Hidden service address - not found",
 			input: ResolveTargetAddressInput{
@@ -160,7 +194,7 @@ func TestResolveTargetAddressUseCase_Handle(t *testing.T) {
 			mockRepo := newMockHiddenServiceRepository()
 			tt.setupMock(mockRepo)
 
-			uc := NewResolveTargetAddressUseCase(mockRepo)
+			uc := NewResolveTargetAddressUseCase(mockRepo, &mockAddressMapRepository{})
 			result, err := uc.Handle(tt.input)
 
 			if tt.expectError {
@@ -48,22 +48,31 @@ func (uc *sendConnectUseCaseImpl) Handle(in SendConnectInput) (SendConnectOutput
 	}
 	payload := []byte{}
 	if in.Target != "" {
-		payload, err = uc.peSvc.EncodeConnectPayload(&service.ConnectPayloadDTO{Target: in.Target})
+		payload, err = uc.peSvc.ForVersion(cir.PayloadVersion()).EncodeConnectPayload(&service.ConnectPayloadDTO{Target: in.Target})
 		if err != nil {
 			return SendConnectOutput{}, err
 		}
 	}
 
+	cir.LockSend()
+	defer cir.UnlockSend()
+	exit := len(cir.Hops()) - 1
+	body, digest, err := uc.cSvc.SealRelayBody(cir.HopKey(exit, vo.DirectionForward), vo.DirectionForward, cir.HopDigest(exit, vo.DirectionForward), payload)
+	if err != nil {
+		return SendConnectOutput{}, err
+	}
+	cir.SetHopDigest(exit, vo.DirectionForward, digest)
+
 	keys := make([][32]byte, 0, len(cir.Hops()))
 	nonces := make([][12]byte, 0, len(cir.Hops()))
 
 	// Generate nonces in normal order for array indexing
 	for i := range cir.Hops() {
-		keys = append(keys, cir.HopKey(i))
+		keys = append(keys, cir.HopKey(i, vo.DirectionForward))
 		nonces = append(nonces, cir.HopBeginNonce(i)) // CONNECT uses BEGIN nonce
 	}
 
-	enc, err := uc.cSvc.AESMultiSeal(keys, nonces, payload)
+	enc, err := uc.cSvc.AESMultiCTR(keys, nonces, body)
 	if err != nil {
 		return SendConnectOutput{}, err
 	}
@@ -72,6 +81,7 @@ func (uc *sendConnectUseCaseImpl) Handle(in SendConnectInput) (SendConnectOutput
 	if err != nil {
 		return SendConnectOutput{}, err
 	}
+	cell.Version = entity.LinkVersion(cir.Conn(0))
 	if err := cell.SendToConnection(cir.Conn(0), cid); err != nil {
 		return SendConnectOutput{}, err
 	}
@@ -57,7 +57,7 @@ func makeTestCircuitConnect() (*entity.Circuit, *mockConnToTestCapture, error) {
 	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
 	priv := vo.NewRSAPrivKey(rawKey)
 	conn := &mockConnToTestCapture{}
-	cir, err := entity.NewCircuit(id, []vo.RelayID{rid}, []vo.AESKey{key}, []vo.Nonce{nonce}, priv)
+	cir, err := entity.NewCircuit(id, []vo.RelayID{rid}, []vo.AESKey{key}, []vo.AESKey{key}, []vo.Nonce{nonce}, priv)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -95,7 +95,7 @@ func TestSendConnectUseCase_Handle(t *testing.T) {
 			k := make([][32]byte, len(cir.Hops()))
 			n := make([][12]byte, len(cir.Hops()))
 			for i := range cir.Hops() {
-				k[i] = cir.HopKey(i)
+				k[i] = cir.HopKey(i, vo.DirectionForward)
 				n[i] = cir.HopBeginNoncePeek(i)
 			}
 
@@ -133,10 +133,14 @@ func TestSendConnectUseCase_Handle(t *testing.T) {
 			}
 
 			// Decrypt payload and verify
-			out, err := cSvc.AESMultiOpen(k, n, cell.Payload)
+			body, err := cSvc.AESMultiCTR(k, n, cell.Payload)
 			if err != nil {
 				t.Fatalf("decrypt: %v", err)
 			}
+			out, _, ok := cSvc.OpenRelayBody(k[len(k)-1], vo.DirectionForward, [32]byte{}, body)
+			if !ok {
+				t.Fatalf("body not recognized by the exit")
+			}
 			if tt.input.Target != "" && string(out) != string(payload) {
 				t.Errorf("payload mismatch")
 			}
@@ -66,45 +66,71 @@ func (uc *sendDataUseCaseImpl) Handle(in SendDataInput) (SendDataOutput, error)
 		return SendDataOutput{}, fmt.Errorf("stream not active")
 	}
 
-	// onion encrypt payload
-	plain := in.Data
 	cmd := in.Cmd
 	if cmd == 0 {
 		cmd = vo.CmdData
 	}
+
+	// reject oversized data before it takes a slot in the flow control windows
+	if len(in.Data) > service.MaxRelayDataSize {
+		return SendDataOutput{}, fmt.Errorf("data too long for one cell: %d bytes", len(in.Data))
+	}
+
+	// DATA cells count against the flow control windows: block until the
+	// exit has acknowledged enough earlier cells. Datagrams may be lost
+	// anyway and are never held back.
+	if cmd == vo.CmdData {
+		if err := packageCell(cir, sid); err != nil {
+			return SendDataOutput{}, fmt.Errorf("wait for sendme: %w", err)
+		}
+	}
+
+	// other streams share the circuit: hold it until the cell is on the wire
+	cir.LockSend()
+	defer cir.UnlockSend()
+
+	// address the relay body to the exit so only it recognizes the cell
+	exit := len(cir.Hops()) - 1
+	plain, digest, err := uc.cSvc.SealRelayBody(cir.HopKey(exit, vo.DirectionForward), vo.DirectionForward, cir.HopDigest(exit, vo.DirectionForward), in.Data)
+	if err != nil {
+		return SendDataOutput{}, err
+	}
+	cir.SetHopDigest(exit, vo.DirectionForward, digest)
+
+	// onion encrypt payload
 	keys := make([][32]byte, 0, len(cir.Hops()))
 	nonces := make([][12]byte, 0, len(cir.Hops()))
 
 	// Generate nonces in normal order for array indexing
 	for i := range cir.Hops() {
-		keys = append(keys, cir.HopKey(i))
+		keys = append(keys, cir.HopKey(i, vo.DirectionForward))
 		var nonce vo.Nonce
-		if cmd == vo.CmdBegin {
+		if cmd == vo.CmdBegin || cmd == vo.CmdBeginUDP || cmd == vo.CmdResolve {
 			nonce = cir.HopBeginNonce(i)
 		} else {
 			nonce = cir.HopDataNonce(i)
 		}
 		nonces = append(nonces, nonce)
-		log.Printf("send encrypt hop=%d cmd=%d nonce=%x key=%x", i, cmd, nonce, cir.HopKey(i))
+		log.Printf("send encrypt hop=%d cmd=%d nonce=%x key=%x", i, cmd, nonce, cir.HopKey(i, vo.DirectionForward))
 	}
 
-	log.Printf("multi-seal input cid=%s plainLen=%d", in.CircuitID, len(plain))
-	enc, err := uc.cSvc.AESMultiSeal(keys, nonces, plain)
+	enc, err := uc.cSvc.AESMultiCTR(keys, nonces, plain)
 	if err != nil {
-		log.Printf("multi-seal failed cid=%s error=%v", in.CircuitID, err)
+		log.Printf("onion encrypt failed cid=%s error=%v", in.CircuitID, err)
 		return SendDataOutput{}, err
 	}
-	log.Printf("multi-seal success cid=%s encLen=%d", in.CircuitID, len(enc))
 
+	conn := cir.Conn(0)
+	linkVer := entity.LinkVersion(conn)
 	var payload []byte
 	switch cmd {
-	case vo.CmdData:
-		// DATA commands need gob-encoded DataPayloadDTO
-		payload, err = uc.peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: sid.UInt16(), Data: enc})
+	case vo.CmdData, vo.CmdDatagram:
+		// DATA commands wrap the ciphertext in a DataPayloadDTO encoded for the link
+		payload, err = uc.peSvc.ForVersion(linkVer).EncodeDataPayload(&service.DataPayloadDTO{StreamID: sid.UInt16(), Data: enc})
 		if err != nil {
 			return SendDataOutput{}, err
 		}
-	case vo.CmdBegin:
+	case vo.CmdBegin, vo.CmdBeginUDP, vo.CmdResolve:
 		// BEGIN commands use raw encrypted data directly
 		payload = enc
 	default:
@@ -115,8 +141,21 @@ func (uc *sendDataUseCaseImpl) Handle(in SendDataInput) (SendDataOutput, error)
 	if err != nil {
 		return SendDataOutput{}, err
 	}
-	if err := cell.SendToConnection(cir.Conn(0), cid); err != nil {
+	cell.Version = linkVer
+	if err := cell.SendToConnection(conn, cid); err != nil {
 		return SendDataOutput{}, err
 	}
 	return SendDataOutput{BytesSent: len(in.Data)}, nil
 }
+
+// packageCell takes one cell from the stream and circuit package windows.
+func packageCell(cir *entity.Circuit, sid vo.StreamID) error {
+	w, ok := cir.StreamWindow(sid)
+	if !ok {
+		return fmt.Errorf("stream not active")
+	}
+	if err := w.Package(); err != nil {
+		return err
+	}
+	return cir.Window().Package()
+}
@@ -128,7 +128,7 @@ func TestSendData_OnionRoundTrip(t *testing.T) {
 	}
 	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
 	priv := vo.NewRSAPrivKey(rawKey)
-	cir, err := entity.NewCircuit(vo.NewCircuitID(), ids, keys, nonces, priv)
+	cir, err := entity.NewCircuit(vo.NewCircuitID(), ids, keys, keys, nonces, priv)
 	if err != nil {
 		t.Fatalf("circuit: %v", err)
 	}
@@ -162,12 +162,16 @@ func TestSendData_OnionRoundTrip(t *testing.T) {
 	n2 := make([][12]byte, hops)
 	for i := 0; i < hops; i++ {
 		k2[i] = keys[i]
-		n2[i] = nonces[i]
+		n2[i] = nonces[i].Sequence(vo.NonceSpaceData, 0)
 	}
-	out, err := cSvc.AESMultiOpen(k2, n2, dto.Data)
+	body, err := cSvc.AESMultiCTR(k2, n2, dto.Data)
 	if err != nil {
 		t.Fatalf("decrypt: %v", err)
 	}
+	out, _, ok := cSvc.OpenRelayBody(k2[hops-1], vo.DirectionForward, [32]byte{}, body)
+	if !ok {
+		t.Fatalf("body not recognized by the exit")
+	}
 	if string(out) != string(data) {
 		t.Errorf("round-trip mismatch")
 	}
@@ -188,7 +192,7 @@ func TestSendData_BeginRoundTrip(t *testing.T) {
 	}
 	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
 	priv := vo.NewRSAPrivKey(rawKey)
-	cir, err := entity.NewCircuit(vo.NewCircuitID(), ids, keys, nonces, priv)
+	cir, err := entity.NewCircuit(vo.NewCircuitID(), ids, keys, keys, nonces, priv)
 	if err != nil {
 		t.Fatalf("circuit: %v", err)
 	}
@@ -216,13 +220,137 @@ func TestSendData_BeginRoundTrip(t *testing.T) {
 	n2 := make([][12]byte, hops)
 	for i := 0; i < hops; i++ {
 		k2[i] = keys[i]
-		n2[i] = nonces[i]
+		n2[i] = nonces[i].Sequence(vo.NonceSpaceBegin, 0)
 	}
-	out, err := cSvc.AESMultiOpen(k2, n2, cell.Payload)
+	body, err := cSvc.AESMultiCTR(k2, n2, cell.Payload)
 	if err != nil {
 		t.Fatalf("decrypt: %v", err)
 	}
+	out, _, ok := cSvc.OpenRelayBody(k2[hops-1], vo.DirectionForward, [32]byte{}, body)
+	if !ok {
+		t.Fatalf("body not recognized by the exit")
+	}
 	if string(out) != string(payload) {
 		t.Errorf("round-trip mismatch")
 	}
 }
+
+func TestSendData_PayloadSizeIndependentOfHops(t *testing.T) {
+	relayID, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	priv := vo.NewRSAPrivKey(rawKey)
+	cSvc := service.NewCryptoService()
+	peSvc := service.NewPayloadEncodingService()
+
+	for _, hops := range []int{1, 3} {
+		ids := make([]vo.RelayID, hops)
+		keys := make([]vo.AESKey, hops)
+		nonces := make([]vo.Nonce, hops)
+		for i := 0; i < hops; i++ {
+			ids[i] = relayID
+			keys[i], _ = vo.NewAESKey()
+			nonces[i], _ = vo.NewNonce()
+		}
+		cir, err := entity.NewCircuit(vo.NewCircuitID(), ids, keys, keys, nonces, priv)
+		if err != nil {
+			t.Fatalf("circuit: %v", err)
+		}
+		st, _ := cir.OpenStream()
+		conn := &recordConn{}
+		cir.SetConn(0, conn)
+		uc := usecase.NewSendDataUseCase(&mockCircuitRepoSend{circuit: cir}, cSvc, peSvc)
+
+		// a full read from the application fits in one cell on any circuit
+		in := usecase.SendDataInput{CircuitID: cir.ID().String(), StreamID: st.ID.UInt16(), Data: make([]byte, service.MaxRelayDataSize)}
+		if _, err := uc.Handle(in); err != nil {
+			t.Fatalf("%d hops: handle: %v", hops, err)
+		}
+		cell, err := entity.Decode(conn.data)
+		if err != nil {
+			t.Fatalf("%d hops: decode cell: %v", hops, err)
+		}
+		dto, err := peSvc.DecodeDataPayload(cell.Payload)
+		if err != nil {
+			t.Fatalf("%d hops: decode payload: %v", hops, err)
+		}
+		if len(dto.Data) != service.RelayPayloadSize {
+			t.Errorf("%d hops: relay payload is %d bytes, want %d", hops, len(dto.Data), service.RelayPayloadSize)
+		}
+
+		in.Data = make([]byte, service.MaxRelayDataSize+1)
+		if _, err := uc.Handle(in); err == nil {
+			t.Errorf("%d hops: expected error for oversized data", hops)
+		}
+	}
+}
+
+func TestSendData_WaitsForSendme(t *testing.T) {
+	circuit, err := makeTestCircuit()
+	if err != nil {
+		t.Fatalf("setup circuit: %v", err)
+	}
+	st, err := circuit.OpenStream()
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	conn := &mockConnForSendData{}
+	circuit.SetConn(0, conn)
+	uc := usecase.NewSendDataUseCase(&mockCircuitRepoSend{circuit: circuit}, service.NewCryptoService(), service.NewPayloadEncodingService())
+
+	// the exit has not acknowledged anything yet: use up the stream window
+	w, _ := circuit.StreamWindow(st.ID)
+	for i := 0; i < entity.StreamWindowStart; i++ {
+		if err := w.Package(); err != nil {
+			t.Fatalf("package: %v", err)
+		}
+	}
+
+	in := usecase.SendDataInput{CircuitID: circuit.ID().String(), StreamID: st.ID.UInt16(), Data: []byte("hello")}
+	done := make(chan error, 1)
+	go func() {
+		_, err := uc.Handle(in)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("DATA sent with an empty stream window")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if conn.lastWritten != nil {
+		t.Fatal("cell written while waiting for SENDME")
+	}
+
+	if err := w.Acknowledge(); err != nil {
+		t.Fatalf("acknowledge: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("send after SENDME: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send still blocked after SENDME")
+	}
+	if got := circuit.Window().PackageWindow(); got != entity.CircuitWindowStart-1 {
+		t.Errorf("circuit window = %d, want %d", got, entity.CircuitWindowStart-1)
+	}
+
+	// BEGIN cells are not flow controlled
+	if _, err := uc.Handle(usecase.SendDataInput{CircuitID: in.CircuitID, StreamID: in.StreamID, Data: []byte("target"), Cmd: vo.CmdBegin}); err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	if got := circuit.Window().PackageWindow(); got != entity.CircuitWindowStart-1 {
+		t.Errorf("circuit window after BEGIN = %d, want %d", got, entity.CircuitWindowStart-1)
+	}
+
+	// neither are datagrams, even with the stream window empty again
+	if err := w.Package(); err != nil {
+		t.Fatalf("package: %v", err)
+	}
+	if _, err := uc.Handle(usecase.SendDataInput{CircuitID: in.CircuitID, StreamID: in.StreamID, Data: []byte("dns"), Cmd: vo.CmdDatagram}); err != nil {
+		t.Fatalf("datagram: %v", err)
+	}
+	if got := circuit.Window().PackageWindow(); got != entity.CircuitWindowStart-1 {
+		t.Errorf("circuit window after DATAGRAM = %d, want %d", got, entity.CircuitWindowStart-1)
+	}
+}
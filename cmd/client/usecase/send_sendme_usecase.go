@@ -0,0 +1,120 @@
+package usecase
+
+import (
+	"fmt"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	"ikedadada/go-ptor/shared/domain/repository"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+// SendSendmeInput identifies a DATA cell that was written to the application.
+type SendSendmeInput struct {
+	CircuitID string
+	StreamID  uint16
+}
+
+// SendSendmeOutput reports which SENDME cells were sent.
+type SendSendmeOutput struct {
+	CircuitSendme bool `json:"circuit_sendme"`
+	StreamSendme  bool `json:"stream_sendme"`
+}
+
+// SendSendmeUseCase counts delivered DATA cells against the deliver windows
+// and acknowledges them to the exit with SENDME cells. Calling it only after
+// the data reached the application lets a slow reader throttle the exit.
+// SENDMEs are sealed for the exit and onion encrypted like DATA, so a relay
+// on the path can neither forge one nor tell it apart from data.
+type SendSendmeUseCase interface {
+	Handle(in SendSendmeInput) (SendSendmeOutput, error)
+}
+
+type sendSendmeUseCaseImpl struct {
+	cRepo repository.CircuitRepository
+	cSvc  service.CryptoService
+	peSvc service.PayloadEncodingService
+}
+
+// NewSendSendmeUseCase returns a use case for acknowledging delivered data.
+func NewSendSendmeUseCase(cRepo repository.CircuitRepository, cSvc service.CryptoService, peSvc service.PayloadEncodingService) SendSendmeUseCase {
+	return &sendSendmeUseCaseImpl{cRepo: cRepo, cSvc: cSvc, peSvc: peSvc}
+}
+
+func (uc *sendSendmeUseCaseImpl) Handle(in SendSendmeInput) (SendSendmeOutput, error) {
+	cid, err := vo.CircuitIDFrom(in.CircuitID)
+	if err != nil {
+		return SendSendmeOutput{}, err
+	}
+	sid, err := vo.StreamIDFrom(in.StreamID)
+	if err != nil {
+		return SendSendmeOutput{}, err
+	}
+	cir, err := uc.cRepo.Find(cid)
+	if err != nil {
+		return SendSendmeOutput{}, fmt.Errorf("circuit not found: %w", err)
+	}
+
+	var out SendSendmeOutput
+	if w, ok := cir.StreamWindow(sid); ok {
+		due, err := w.Deliver()
+		if err != nil {
+			return out, fmt.Errorf("stream %d: %w", in.StreamID, err)
+		}
+		if due {
+			if err := uc.send(cir, cid, sid.UInt16()); err != nil {
+				return out, err
+			}
+			out.StreamSendme = true
+		}
+	}
+	due, err := cir.Window().Deliver()
+	if err != nil {
+		return out, fmt.Errorf("circuit: %w", err)
+	}
+	if due {
+		// stream ID zero acknowledges the circuit window
+		if err := uc.send(cir, cid, 0); err != nil {
+			return out, err
+		}
+		out.CircuitSendme = true
+	}
+	return out, nil
+}
+
+func (uc *sendSendmeUseCaseImpl) send(cir *entity.Circuit, cid vo.CircuitID, sid uint16) error {
+	// SENDMEs take the next DATA nonces, so they share the send lock
+	cir.LockSend()
+	defer cir.UnlockSend()
+
+	exit := len(cir.Hops()) - 1
+	body, digest, err := uc.cSvc.SealRelayBody(cir.HopKey(exit, vo.DirectionForward), vo.DirectionForward, cir.HopDigest(exit, vo.DirectionForward), nil)
+	if err != nil {
+		return err
+	}
+	cir.SetHopDigest(exit, vo.DirectionForward, digest)
+
+	keys := make([][32]byte, 0, len(cir.Hops()))
+	nonces := make([][12]byte, 0, len(cir.Hops()))
+	for i := range cir.Hops() {
+		keys = append(keys, cir.HopKey(i, vo.DirectionForward))
+		nonces = append(nonces, cir.HopDataNonce(i))
+	}
+	enc, err := uc.cSvc.AESMultiCTR(keys, nonces, body)
+	if err != nil {
+		return err
+	}
+
+	conn := cir.Conn(0)
+	linkVer := entity.LinkVersion(conn)
+	payload, err := uc.peSvc.ForVersion(linkVer).EncodeDataPayload(&service.DataPayloadDTO{StreamID: sid, Data: enc})
+	if err != nil {
+		return err
+	}
+	cell, err := entity.NewCell(vo.CmdSendme, payload)
+	if err != nil {
+		return err
+	}
+	cell.Version = linkVer
+	return cell.SendToConnection(conn, cid)
+}
@@ -0,0 +1,100 @@
+package usecase_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"ikedadada/go-ptor/cmd/client/usecase"
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+// cellLogConn decodes every cell written to it.
+type cellLogConn struct {
+	cells []*entity.Cell
+}
+
+func (c *cellLogConn) Write(p []byte) (int, error) {
+	cell, err := entity.Decode(p[16:])
+	if err != nil {
+		return 0, err
+	}
+	c.cells = append(c.cells, cell)
+	return len(p), nil
+}
+
+func (c *cellLogConn) Read([]byte) (int, error)         { return 0, nil }
+func (c *cellLogConn) Close() error                     { return nil }
+func (c *cellLogConn) LocalAddr() net.Addr              { return nil }
+func (c *cellLogConn) RemoteAddr() net.Addr             { return nil }
+func (c *cellLogConn) SetDeadline(time.Time) error      { return nil }
+func (c *cellLogConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *cellLogConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestSendSendmeUseCase_Handle(t *testing.T) {
+	circuit, err := makeTestCircuit()
+	if err != nil {
+		t.Fatalf("setup circuit: %v", err)
+	}
+	st, err := circuit.OpenStream()
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	conn := &cellLogConn{}
+	circuit.SetConn(0, conn)
+	cSvc := service.NewCryptoService()
+	peSvc := service.NewPayloadEncodingService()
+	uc := usecase.NewSendSendmeUseCase(&mockCircuitRepoSend{circuit: circuit}, cSvc, peSvc)
+
+	in := usecase.SendSendmeInput{CircuitID: circuit.ID().String(), StreamID: st.ID.UInt16()}
+	streamSendmes, circuitSendmes := 0, 0
+	for i := 0; i < entity.CircuitWindowIncrement; i++ {
+		out, err := uc.Handle(in)
+		if err != nil {
+			t.Fatalf("deliver %d: %v", i, err)
+		}
+		if out.StreamSendme {
+			streamSendmes++
+		}
+		if out.CircuitSendme {
+			circuitSendmes++
+		}
+	}
+
+	wantStream := entity.CircuitWindowIncrement / entity.StreamWindowIncrement
+	if streamSendmes != wantStream || circuitSendmes != 1 {
+		t.Fatalf("sendmes stream=%d circuit=%d, want %d and 1", streamSendmes, circuitSendmes, wantStream)
+	}
+	if len(conn.cells) != wantStream+1 {
+		t.Fatalf("cells written = %d, want %d", len(conn.cells), wantStream+1)
+	}
+	// the exit must recognize every SENDME in the order it was sent
+	exit := entity.NewConnState(circuit.HopKey(0, vo.DirectionForward), circuit.HopKey(0, vo.DirectionBackward), circuit.HopBaseNonce(0), nil, nil)
+	for i, cell := range conn.cells {
+		if cell.Cmd != vo.CmdSendme {
+			t.Fatalf("cell %d cmd = %s, want SENDME", i, cell.Cmd)
+		}
+		p, err := peSvc.DecodeDataPayload(cell.Payload)
+		if err != nil {
+			t.Fatalf("decode sendme: %v", err)
+		}
+		want := st.ID.UInt16()
+		if i == len(conn.cells)-1 {
+			want = 0 // circuit-level SENDME
+		}
+		if p.StreamID != want {
+			t.Errorf("cell %d stream = %d, want %d", i, p.StreamID, want)
+		}
+		dec, err := cSvc.AESCTR(exit.Key(vo.DirectionForward), exit.DataNonce(), p.Data)
+		if err != nil {
+			t.Fatalf("decrypt sendme: %v", err)
+		}
+		_, digest, ok := cSvc.OpenRelayBody(exit.Key(vo.DirectionForward), vo.DirectionForward, exit.Digest(vo.DirectionForward), dec)
+		if !ok {
+			t.Fatalf("cell %d not recognized by the exit", i)
+		}
+		exit.SetDigest(vo.DirectionForward, digest)
+	}
+}
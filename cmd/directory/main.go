@@ -13,6 +13,19 @@ type relayDTO struct {
 	ID       string `json:"id"` // Unique identifier for the relay
 	Endpoint string `json:"endpoint"`
 	PubKey   string `json:"pubkey"`
+	// ExitPolicy lists the relay's exit policy rules as the relay logs
+	// them at startup. Clients pick exits that allow the port they need.
+	ExitPolicy string `json:"exit_policy,omitempty"`
+	// Bandwidth is what the relay advertises and MeasuredBandwidth what the
+	// directory measured, both in KB/s. Clients weigh relays by them.
+	Bandwidth         uint32 `json:"bandwidth,omitempty"`
+	MeasuredBandwidth uint32 `json:"measured_bandwidth,omitempty"`
+	// Flags say which positions of a circuit the relay may take: Guard,
+	// Exit, Stable, Fast and HSDir.
+	Flags []string `json:"flags,omitempty"`
+	// Family lists the IDs of the relays run by the same operator. Two
+	// relays are kept out of one circuit only if each lists the other.
+	Family []string `json:"family,omitempty"`
 }
 
 // HiddenServiceInfo maps a hidden service address to its relay and public key.
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -15,7 +16,7 @@ import (
 
 // RelayHandler handles relay connections and cell processing
 type RelayHandler struct {
-	csRepo      repository.ConnStateRepository
+	csRepo      repository.RelayConnStateRepository
 	crSvc       service.CellReaderService
 	csSvc       service.CellSenderService
 	extendUC    usecase.HandleExtendUseCase
@@ -24,11 +25,15 @@ type RelayHandler struct {
 	endStreamUC usecase.HandleEndStreamUseCase
 	destroyUC   usecase.HandleDestroyUseCase
 	connectUC   usecase.HandleConnectUseCase
+	sendmeUC    usecase.HandleSendmeUseCase
+	udpUC       usecase.HandleUDPUseCase
+	resolveUC   usecase.HandleResolveUseCase
+	vnSvc       service.VersionNegotiationService
 }
 
 // NewRelayHandler creates a new relay handler
 func NewRelayHandler(
-	csRepo repository.ConnStateRepository,
+	csRepo repository.RelayConnStateRepository,
 	crSvc service.CellReaderService,
 	csSvc service.CellSenderService,
 	extendUC usecase.HandleExtendUseCase,
@@ -37,6 +42,10 @@ func NewRelayHandler(
 	endStreamUC usecase.HandleEndStreamUseCase,
 	destroyUC usecase.HandleDestroyUseCase,
 	connectUC usecase.HandleConnectUseCase,
+	sendmeUC usecase.HandleSendmeUseCase,
+	udpUC usecase.HandleUDPUseCase,
+	resolveUC usecase.HandleResolveUseCase,
+	vnSvc service.VersionNegotiationService,
 ) *RelayHandler {
 	return &RelayHandler{
 		csRepo:      csRepo,
@@ -48,6 +57,10 @@ func NewRelayHandler(
 		endStreamUC: endStreamUC,
 		destroyUC:   destroyUC,
 		connectUC:   connectUC,
+		sendmeUC:    sendmeUC,
+		udpUC:       udpUC,
+		resolveUC:   resolveUC,
+		vnSvc:       vnSvc,
 	}
 }
 
@@ -59,6 +72,8 @@ func (h *RelayHandler) ServeConn(c net.Conn) {
 		log.Printf("ServeConn stop local=%s remote=%s", c.LocalAddr(), c.RemoteAddr())
 	}()
 
+	// Links we dialed ourselves were negotiated before the first EXTEND.
+	_, negotiated := c.(*entity.Link)
 	for {
 		cid, cell, err := h.crSvc.ReadCell(c)
 		if err != nil {
@@ -68,14 +83,38 @@ func (h *RelayHandler) ServeConn(c net.Conn) {
 			return
 		}
 		log.Printf("cell cid=%s cmd=%d len=%d", cid.String(), cell.Cmd, len(cell.Payload))
+		if cell.Cmd == vo.CmdVersions {
+			if negotiated {
+				log.Printf("ignore repeated VERSIONS remote=%s", c.RemoteAddr())
+				continue
+			}
+			link, err := h.vnSvc.Respond(c, cell)
+			if err != nil {
+				log.Println("negotiate versions:", err)
+				return
+			}
+			c, negotiated = link, true
+			continue
+		}
+		// A peer that opens with any other cell predates VERSIONS and
+		// keeps speaking v1 on this link.
+		negotiated = true
 		if err := h.HandleCell(c, cid, cell); err != nil {
 			log.Println("handle:", err)
 		}
 	}
 }
 
-// HandleCell routes cells to appropriate handlers
-func (h *RelayHandler) HandleCell(up net.Conn, cid vo.CircuitID, cell *entity.Cell) error {
+// HandleCell routes cells to appropriate handlers. The link a cell arrived
+// on tells which way it travels: cells from the downstream link head back to
+// the client, everything else heads towards the exit.
+func (h *RelayHandler) HandleCell(from net.Conn, cid vo.CircuitID, cell *entity.Cell) error {
+	// Cells from the next hop carry the ID we picked for that link; usecases
+	// always work with the ID of the upstream link.
+	viaOutbound := false
+	if in, err := h.csRepo.InboundID(from, cid); err == nil {
+		cid, viaOutbound = in, true
+	}
 	st, err := h.csRepo.Find(cid)
 	switch {
 	case errors.Is(err, repository.ErrNotFound) && cell.Cmd == vo.CmdEnd:
@@ -83,26 +122,61 @@ func (h *RelayHandler) HandleCell(up net.Conn, cid vo.CircuitID, cell *entity.Ce
 		return nil
 	case errors.Is(err, repository.ErrNotFound) && cell.Cmd == vo.CmdExtend:
 		// new circuit request
-		return h.extendUC.Extend(up, cid, cell)
+		return h.extendUC.Extend(from, cid, cell)
 	case err != nil:
 		return err
 	}
 
+	dir := st.DirectionFrom(from)
+	if viaOutbound != (dir == vo.DirectionBackward) {
+		return fmt.Errorf("circuit ID not valid on this link cid=%s", cid.String())
+	}
+	if dir == vo.DirectionBackward {
+		switch cell.Cmd {
+		case vo.CmdBeginAck:
+			return h.beginUC.BeginAck(st, cid, cell)
+		case vo.CmdCreated:
+			st.LockSend()
+			defer st.UnlockSend()
+			return h.csSvc.ForwardCell(st.Up(), cid, cell)
+		case vo.CmdData:
+			return h.dataUC.Data(st, cid, cell, dir, h.ensureServeDown)
+		case vo.CmdDatagram:
+			return h.udpUC.Datagram(st, cid, cell, dir, h.ensureServeDown)
+		case vo.CmdResolved:
+			return h.resolveUC.Resolved(st, cid, cell)
+		case vo.CmdEnd:
+			return h.endStreamUC.EndStream(st, cid, cell, dir, h.ensureServeDown)
+		case vo.CmdDestroy:
+			return h.destroyUC.Destroy(st, cid, cell, dir)
+		case vo.CmdSendme:
+			return h.sendmeUC.Sendme(st, cid, cell, dir, h.ensureServeDown)
+		default:
+			return fmt.Errorf("unexpected %s cell from downstream cid=%s", cell.Cmd, cid.String())
+		}
+	}
+
 	switch cell.Cmd {
 	case vo.CmdBegin:
 		return h.beginUC.Begin(st, cid, cell, h.ensureServeDown)
-	case vo.CmdBeginAck:
-		return h.csSvc.ForwardCell(st.Up(), cid, cell)
 	case vo.CmdEnd:
-		return h.endStreamUC.EndStream(st, cid, cell, h.ensureServeDown)
+		return h.endStreamUC.EndStream(st, cid, cell, dir, h.ensureServeDown)
 	case vo.CmdDestroy:
-		return h.destroyUC.Destroy(st, cid)
+		return h.destroyUC.Destroy(st, cid, cell, dir)
 	case vo.CmdExtend:
-		return h.extendUC.ForwardExtend(st, cid, cell)
+		return h.extendUC.ForwardExtend(st, cid, cell, h.ensureServeDown)
 	case vo.CmdConnect:
 		return h.connectUC.Connect(st, cid, cell, h.ensureServeDown)
 	case vo.CmdData:
-		return h.dataUC.Data(st, cid, cell, h.ensureServeDown)
+		return h.dataUC.Data(st, cid, cell, dir, h.ensureServeDown)
+	case vo.CmdSendme:
+		return h.sendmeUC.Sendme(st, cid, cell, dir, h.ensureServeDown)
+	case vo.CmdBeginUDP:
+		return h.udpUC.BeginUDP(st, cid, cell, h.ensureServeDown)
+	case vo.CmdDatagram:
+		return h.udpUC.Datagram(st, cid, cell, dir, h.ensureServeDown)
+	case vo.CmdResolve:
+		return h.resolveUC.Resolve(st, cid, cell, h.ensureServeDown)
 	default:
 		return nil
 	}
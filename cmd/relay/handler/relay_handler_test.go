@@ -1,6 +1,7 @@
 package handler_test
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"io"
@@ -26,14 +27,17 @@ func TestRelayHandler_HandleCellExtend(t *testing.T) {
 	// Create cell sender and usecases
 	cellSender := service.NewCellSenderService()
 	payloadEncoder := service.NewPayloadEncodingService()
-	extendUC := usecase.NewHandleExtendUseCase(priv, repo, crypto, cellSender, payloadEncoder)
-	beginUC := usecase.NewHandleBeginUseCase(repo, crypto, cellSender, payloadEncoder)
+	extendUC := usecase.NewHandleExtendUseCase(priv, repo, crypto, cellSender, payloadEncoder, service.NewVersionNegotiationService())
+	beginUC := usecase.NewHandleBeginUseCase(repo, crypto, cellSender, payloadEncoder, vo.ExitPolicy{})
 	dataUC := usecase.NewHandleDataUseCase(repo, crypto, cellSender, payloadEncoder)
-	endStreamUC := usecase.NewHandleEndStreamUseCase(repo, cellSender, payloadEncoder)
+	endStreamUC := usecase.NewHandleEndStreamUseCase(repo, crypto, cellSender, payloadEncoder)
 	destroyUC := usecase.NewHandleDestroyUseCase(repo, cellSender)
 	connectUC := usecase.NewHandleConnectUseCase(repo, crypto, cellSender, payloadEncoder)
+	sendmeUC := usecase.NewHandleSendmeUseCase(repo, crypto, cellSender, payloadEncoder)
+	udpUC := usecase.NewHandleUDPUseCase(repo, crypto, cellSender, payloadEncoder, vo.DefaultExitPolicy(), time.Minute)
+	resolveUC := usecase.NewHandleResolveUseCase(repo, repository.NewResolveCacheRepository(16), crypto, cellSender, payloadEncoder, service.NewDNSResolverService("127.0.0.1:53", time.Second))
 
-	h := handler.NewRelayHandler(repo, reader, cellSender, extendUC, beginUC, dataUC, endStreamUC, destroyUC, connectUC)
+	h := handler.NewRelayHandler(repo, reader, cellSender, extendUC, beginUC, dataUC, endStreamUC, destroyUC, connectUC, sendmeUC, udpUC, resolveUC, service.NewVersionNegotiationService())
 
 	// Create extend cell
 	_, pub, _ := crypto.X25519Generate()
@@ -48,20 +52,12 @@ func TestRelayHandler_HandleCellExtend(t *testing.T) {
 	go func() { errCh <- h.HandleCell(up1, cid, cell) }()
 
 	// Should create circuit and send created response
-	hdr := make([]byte, 20)
-	if _, err := io.ReadFull(up2, hdr); err != nil {
-		t.Fatalf("read header: %v", err)
-	}
-	if vo.CellCommand(hdr[16]) != vo.CmdCreated {
-		t.Fatalf("expected created, got %d", hdr[16])
+	_, resp, err := service.NewCellReaderService().ReadCell(up2)
+	if err != nil {
+		t.Fatalf("read created: %v", err)
 	}
-	// Read payload
-	l := int(hdr[18])<<8 | int(hdr[19])
-	if l > 0 {
-		payload := make([]byte, l)
-		if _, err := io.ReadFull(up2, payload); err != nil {
-			t.Fatalf("read payload: %v", err)
-		}
+	if resp.Cmd != vo.CmdCreated {
+		t.Fatalf("expected created, got %d", resp.Cmd)
 	}
 
 	if err := <-errCh; err != nil {
@@ -85,35 +81,46 @@ func TestRelayHandler_HandleCellBeginAck(t *testing.T) {
 	peSvc := service.NewPayloadEncodingService()
 
 	// Create dummy usecases (not used for this test)
-	extendUC := usecase.NewHandleExtendUseCase(nil, csRepo, cSvc, csSvc, peSvc)
-	beginUC := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc)
+	extendUC := usecase.NewHandleExtendUseCase(nil, csRepo, cSvc, csSvc, peSvc, service.NewVersionNegotiationService())
+	beginUC := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc, vo.ExitPolicy{})
 	dataUC := usecase.NewHandleDataUseCase(csRepo, cSvc, csSvc, peSvc)
-	endStreamUC := usecase.NewHandleEndStreamUseCase(csRepo, csSvc, peSvc)
+	endStreamUC := usecase.NewHandleEndStreamUseCase(csRepo, cSvc, csSvc, peSvc)
 	destroyUC := usecase.NewHandleDestroyUseCase(csRepo, csSvc)
 	connectUC := usecase.NewHandleConnectUseCase(csRepo, cSvc, csSvc, peSvc)
+	sendmeUC := usecase.NewHandleSendmeUseCase(csRepo, cSvc, csSvc, peSvc)
+	udpUC := usecase.NewHandleUDPUseCase(csRepo, cSvc, csSvc, peSvc, vo.DefaultExitPolicy(), time.Minute)
+	resolveUC := usecase.NewHandleResolveUseCase(csRepo, repository.NewResolveCacheRepository(16), cSvc, csSvc, peSvc, service.NewDNSResolverService("127.0.0.1:53", time.Second))
 
-	h := handler.NewRelayHandler(csRepo, crSvc, csSvc, extendUC, beginUC, dataUC, endStreamUC, destroyUC, connectUC)
+	h := handler.NewRelayHandler(csRepo, crSvc, csSvc, extendUC, beginUC, dataUC, endStreamUC, destroyUC, connectUC, sendmeUC, udpUC, resolveUC, service.NewVersionNegotiationService())
 
 	// Create state
 	key, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
 	cid := vo.NewCircuitID()
 	up1, up2 := net.Pipe()
+	down1, _ := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, nil)
+	st := entity.NewConnState(key, key, nonce, up1, down1)
 	csRepo.Add(cid, st)
+	out := vo.NewCircuitID()
+	csRepo.AddOutbound(cid, out)
 
-	// Create begin ack cell
-	cell := &entity.Cell{Cmd: vo.CmdBeginAck, Version: vo.ProtocolV1}
+	// Create begin ack cell arriving from the next hop, sealed further down
+	sealed := bytes.Repeat([]byte{0x5a}, service.RelayPayloadSize)
+	payload, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: 1, Data: sealed})
+	cell := &entity.Cell{Cmd: vo.CmdBeginAck, Version: vo.ProtocolV1, Payload: payload}
 
 	errCh := make(chan error, 1)
-	go func() { errCh <- h.HandleCell(up1, cid, cell) }()
+	go func() { errCh <- h.HandleCell(down1, out, cell) }()
 
 	// Should forward cell upstream
 	buf := make([]byte, 16+entity.MaxCellSize)
 	if _, err := io.ReadFull(up2, buf); err != nil {
 		t.Fatalf("read forward: %v", err)
 	}
+	if string(buf[:16]) != string(cid.Bytes()) {
+		t.Errorf("relayed with circuit ID %x, want upstream ID %s", buf[:16], cid)
+	}
 	fwd, err := entity.Decode(buf[16:])
 	if err != nil {
 		t.Fatalf("decode forward: %v", err)
@@ -121,12 +128,19 @@ func TestRelayHandler_HandleCellBeginAck(t *testing.T) {
 	if fwd.Cmd != vo.CmdBeginAck {
 		t.Fatalf("cmd %d", fwd.Cmd)
 	}
+	// our layer is added on the way back
+	p, _ := peSvc.DecodeDataPayload(fwd.Payload)
+	want, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceUpstream, 0), sealed)
+	if p.StreamID != 1 || !bytes.Equal(p.Data, want) {
+		t.Errorf("forwarded ack sid=%d without our layer", p.StreamID)
+	}
 
 	if err := <-errCh; err != nil {
 		t.Fatalf("handle cell error: %v", err)
 	}
 
 	st.Up().Close()
+	st.Down().Close()
 }
 
 func TestRelayHandler_HandleCellDestroy(t *testing.T) {
@@ -137,14 +151,17 @@ func TestRelayHandler_HandleCellDestroy(t *testing.T) {
 	peSvc := service.NewPayloadEncodingService()
 
 	// Create dummy usecases (not used for this test)
-	extendUC := usecase.NewHandleExtendUseCase(nil, csRepo, cSvc, csSvc, peSvc)
-	beginUC := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc)
+	extendUC := usecase.NewHandleExtendUseCase(nil, csRepo, cSvc, csSvc, peSvc, service.NewVersionNegotiationService())
+	beginUC := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc, vo.ExitPolicy{})
 	dataUC := usecase.NewHandleDataUseCase(csRepo, cSvc, csSvc, peSvc)
-	endStreamUC := usecase.NewHandleEndStreamUseCase(csRepo, csSvc, peSvc)
+	endStreamUC := usecase.NewHandleEndStreamUseCase(csRepo, cSvc, csSvc, peSvc)
 	destroyUC := usecase.NewHandleDestroyUseCase(csRepo, csSvc)
 	connectUC := usecase.NewHandleConnectUseCase(csRepo, cSvc, csSvc, peSvc)
+	sendmeUC := usecase.NewHandleSendmeUseCase(csRepo, cSvc, csSvc, peSvc)
+	udpUC := usecase.NewHandleUDPUseCase(csRepo, cSvc, csSvc, peSvc, vo.DefaultExitPolicy(), time.Minute)
+	resolveUC := usecase.NewHandleResolveUseCase(csRepo, repository.NewResolveCacheRepository(16), cSvc, csSvc, peSvc, service.NewDNSResolverService("127.0.0.1:53", time.Second))
 
-	h := handler.NewRelayHandler(csRepo, crSvc, csSvc, extendUC, beginUC, dataUC, endStreamUC, destroyUC, connectUC)
+	h := handler.NewRelayHandler(csRepo, crSvc, csSvc, extendUC, beginUC, dataUC, endStreamUC, destroyUC, connectUC, sendmeUC, udpUC, resolveUC, service.NewVersionNegotiationService())
 
 	// Create state
 	key, _ := vo.NewAESKey()
@@ -153,11 +170,13 @@ func TestRelayHandler_HandleCellDestroy(t *testing.T) {
 	up1, _ := net.Pipe()
 	down1, down2 := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, down1)
+	st := entity.NewConnState(key, key, nonce, up1, down1)
 	csRepo.Add(cid, st)
+	out := vo.NewCircuitID()
+	csRepo.AddOutbound(cid, out)
 
 	// Create destroy cell
-	cell := &entity.Cell{Cmd: vo.CmdDestroy, Version: vo.ProtocolV1}
+	cell := &entity.Cell{Cmd: vo.CmdDestroy, Version: vo.ProtocolV1, Payload: vo.EndReasonTimeout.Bytes()}
 
 	errCh := make(chan error, 1)
 	go func() { errCh <- h.HandleCell(up1, cid, cell) }()
@@ -167,6 +186,9 @@ func TestRelayHandler_HandleCellDestroy(t *testing.T) {
 	if _, err := io.ReadFull(down2, buf); err != nil {
 		t.Fatalf("read forward: %v", err)
 	}
+	if string(buf[:16]) != string(out.Bytes()) {
+		t.Errorf("forwarded with circuit ID %x, want downstream ID %s", buf[:16], out)
+	}
 	fwd, err := entity.Decode(buf[16:])
 	if err != nil {
 		t.Fatalf("decode forward: %v", err)
@@ -174,6 +196,9 @@ func TestRelayHandler_HandleCellDestroy(t *testing.T) {
 	if fwd.Cmd != vo.CmdDestroy {
 		t.Fatalf("cmd %d", fwd.Cmd)
 	}
+	if got := vo.EndReasonFrom(fwd.Payload); got != vo.EndReasonTimeout {
+		t.Errorf("forwarded reason %s, want %s", got, vo.EndReasonTimeout)
+	}
 
 	if err := <-errCh; err != nil {
 		t.Fatalf("handle cell error: %v", err)
@@ -196,14 +221,17 @@ func TestRelayHandler_HandleCellEndUnknown(t *testing.T) {
 	peSvc := service.NewPayloadEncodingService()
 
 	// Create dummy usecases (not used for this test)
-	extendUC := usecase.NewHandleExtendUseCase(nil, csRepo, cSvc, csSvc, peSvc)
-	beginUC := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc)
+	extendUC := usecase.NewHandleExtendUseCase(nil, csRepo, cSvc, csSvc, peSvc, service.NewVersionNegotiationService())
+	beginUC := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc, vo.ExitPolicy{})
 	dataUC := usecase.NewHandleDataUseCase(csRepo, cSvc, csSvc, peSvc)
-	endStreamUC := usecase.NewHandleEndStreamUseCase(csRepo, csSvc, peSvc)
+	endStreamUC := usecase.NewHandleEndStreamUseCase(csRepo, cSvc, csSvc, peSvc)
 	destroyUC := usecase.NewHandleDestroyUseCase(csRepo, csSvc)
 	connectUC := usecase.NewHandleConnectUseCase(csRepo, cSvc, csSvc, peSvc)
+	sendmeUC := usecase.NewHandleSendmeUseCase(csRepo, cSvc, csSvc, peSvc)
+	udpUC := usecase.NewHandleUDPUseCase(csRepo, cSvc, csSvc, peSvc, vo.DefaultExitPolicy(), time.Minute)
+	resolveUC := usecase.NewHandleResolveUseCase(csRepo, repository.NewResolveCacheRepository(16), cSvc, csSvc, peSvc, service.NewDNSResolverService("127.0.0.1:53", time.Second))
 
-	h := handler.NewRelayHandler(csRepo, crSvc, csSvc, extendUC, beginUC, dataUC, endStreamUC, destroyUC, connectUC)
+	h := handler.NewRelayHandler(csRepo, crSvc, csSvc, extendUC, beginUC, dataUC, endStreamUC, destroyUC, connectUC, sendmeUC, udpUC, resolveUC, service.NewVersionNegotiationService())
 
 	// Create end cell for unknown circuit
 	cid := vo.NewCircuitID()
@@ -215,6 +243,107 @@ func TestRelayHandler_HandleCellEndUnknown(t *testing.T) {
 	}
 }
 
+func TestRelayHandler_HandleCellRejectsForwardOnlyFromDownstream(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Second)
+	cSvc := service.NewCryptoService()
+	crSvc := service.NewCellReaderService()
+	csSvc := service.NewCellSenderService()
+	peSvc := service.NewPayloadEncodingService()
+
+	extendUC := usecase.NewHandleExtendUseCase(nil, csRepo, cSvc, csSvc, peSvc, service.NewVersionNegotiationService())
+	beginUC := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc, vo.ExitPolicy{})
+	dataUC := usecase.NewHandleDataUseCase(csRepo, cSvc, csSvc, peSvc)
+	endStreamUC := usecase.NewHandleEndStreamUseCase(csRepo, cSvc, csSvc, peSvc)
+	destroyUC := usecase.NewHandleDestroyUseCase(csRepo, csSvc)
+	connectUC := usecase.NewHandleConnectUseCase(csRepo, cSvc, csSvc, peSvc)
+	sendmeUC := usecase.NewHandleSendmeUseCase(csRepo, cSvc, csSvc, peSvc)
+	udpUC := usecase.NewHandleUDPUseCase(csRepo, cSvc, csSvc, peSvc, vo.DefaultExitPolicy(), time.Minute)
+	resolveUC := usecase.NewHandleResolveUseCase(csRepo, repository.NewResolveCacheRepository(16), cSvc, csSvc, peSvc, service.NewDNSResolverService("127.0.0.1:53", time.Second))
+
+	h := handler.NewRelayHandler(csRepo, crSvc, csSvc, extendUC, beginUC, dataUC, endStreamUC, destroyUC, connectUC, sendmeUC, udpUC, resolveUC, service.NewVersionNegotiationService())
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, _ := net.Pipe()
+	down1, _ := net.Pipe()
+	defer up1.Close()
+	defer down1.Close()
+
+	st := entity.NewConnState(key, key, nonce, up1, down1)
+	csRepo.Add(cid, st)
+	out := vo.NewCircuitID()
+	csRepo.AddOutbound(cid, out)
+
+	for _, cmd := range []vo.CellCommand{vo.CmdBegin, vo.CmdConnect, vo.CmdExtend} {
+		t.Run(cmd.String(), func(t *testing.T) {
+			cell := &entity.Cell{Cmd: cmd, Version: vo.ProtocolV1, Payload: []byte{1}}
+			if err := h.HandleCell(down1, out, cell); err == nil {
+				t.Errorf("expected error for %s from downstream", cmd)
+			}
+		})
+	}
+	if begin, _ := st.GetCounters(); begin != 0 {
+		t.Errorf("rejected cells consumed nonces: begin counter=%d", begin)
+	}
+}
+
+func TestRelayHandler_HandleCellRejectsIDFromWrongLink(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Second)
+	cSvc := service.NewCryptoService()
+	crSvc := service.NewCellReaderService()
+	csSvc := service.NewCellSenderService()
+	peSvc := service.NewPayloadEncodingService()
+
+	extendUC := usecase.NewHandleExtendUseCase(nil, csRepo, cSvc, csSvc, peSvc, service.NewVersionNegotiationService())
+	beginUC := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc, vo.ExitPolicy{})
+	dataUC := usecase.NewHandleDataUseCase(csRepo, cSvc, csSvc, peSvc)
+	endStreamUC := usecase.NewHandleEndStreamUseCase(csRepo, cSvc, csSvc, peSvc)
+	destroyUC := usecase.NewHandleDestroyUseCase(csRepo, csSvc)
+	connectUC := usecase.NewHandleConnectUseCase(csRepo, cSvc, csSvc, peSvc)
+	sendmeUC := usecase.NewHandleSendmeUseCase(csRepo, cSvc, csSvc, peSvc)
+	udpUC := usecase.NewHandleUDPUseCase(csRepo, cSvc, csSvc, peSvc, vo.DefaultExitPolicy(), time.Minute)
+	resolveUC := usecase.NewHandleResolveUseCase(csRepo, repository.NewResolveCacheRepository(16), cSvc, csSvc, peSvc, service.NewDNSResolverService("127.0.0.1:53", time.Second))
+
+	h := handler.NewRelayHandler(csRepo, crSvc, csSvc, extendUC, beginUC, dataUC, endStreamUC, destroyUC, connectUC, sendmeUC, udpUC, resolveUC, service.NewVersionNegotiationService())
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, _ := net.Pipe()
+	down1, _ := net.Pipe()
+	down2, _ := net.Pipe()
+	defer up1.Close()
+	defer down1.Close()
+	defer down2.Close()
+
+	st := entity.NewConnState(key, key, nonce, up1, down1)
+	csRepo.Add(cid, st)
+	out := vo.NewCircuitID()
+	csRepo.AddOutbound(cid, out)
+
+	tests := []struct {
+		name string
+		from net.Conn
+		id   vo.CircuitID
+	}{
+		{"downstream ID from upstream", up1, out},
+		{"upstream ID from downstream", down1, cid},
+		{"downstream ID from another next hop", down2, out},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cell := &entity.Cell{Cmd: vo.CmdDestroy, Version: vo.ProtocolV1}
+			if err := h.HandleCell(tt.from, tt.id, cell); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+	if _, err := csRepo.Find(cid); err != nil {
+		t.Error("circuit destroyed by a cell with a foreign ID")
+	}
+}
+
 func TestRelayHandler_ServeConn(t *testing.T) {
 	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
 	priv := vo.NewRSAPrivKey(rawKey)
@@ -225,14 +354,17 @@ func TestRelayHandler_ServeConn(t *testing.T) {
 	peSvc := service.NewPayloadEncodingService()
 
 	// Create dummy usecases (not used for this test)
-	extendUC := usecase.NewHandleExtendUseCase(priv, csRepo, cSvc, csSvc, peSvc)
-	beginUC := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc)
+	extendUC := usecase.NewHandleExtendUseCase(priv, csRepo, cSvc, csSvc, peSvc, service.NewVersionNegotiationService())
+	beginUC := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc, vo.ExitPolicy{})
 	dataUC := usecase.NewHandleDataUseCase(csRepo, cSvc, csSvc, peSvc)
-	endStreamUC := usecase.NewHandleEndStreamUseCase(csRepo, csSvc, peSvc)
+	endStreamUC := usecase.NewHandleEndStreamUseCase(csRepo, cSvc, csSvc, peSvc)
 	destroyUC := usecase.NewHandleDestroyUseCase(csRepo, csSvc)
 	connectUC := usecase.NewHandleConnectUseCase(csRepo, cSvc, csSvc, peSvc)
+	sendmeUC := usecase.NewHandleSendmeUseCase(csRepo, cSvc, csSvc, peSvc)
+	udpUC := usecase.NewHandleUDPUseCase(csRepo, cSvc, csSvc, peSvc, vo.DefaultExitPolicy(), time.Minute)
+	resolveUC := usecase.NewHandleResolveUseCase(csRepo, repository.NewResolveCacheRepository(16), cSvc, csSvc, peSvc, service.NewDNSResolverService("127.0.0.1:53", time.Second))
 
-	h := handler.NewRelayHandler(csRepo, crSvc, csSvc, extendUC, beginUC, dataUC, endStreamUC, destroyUC, connectUC)
+	h := handler.NewRelayHandler(csRepo, crSvc, csSvc, extendUC, beginUC, dataUC, endStreamUC, destroyUC, connectUC, sendmeUC, udpUC, resolveUC, service.NewVersionNegotiationService())
 
 	// Create pipe connection
 	conn1, conn2 := net.Pipe()
@@ -262,20 +394,12 @@ func TestRelayHandler_ServeConn(t *testing.T) {
 	}
 
 	// Should receive created response
-	hdr := make([]byte, 20)
-	if _, err := io.ReadFull(conn2, hdr); err != nil {
-		t.Fatalf("read header: %v", err)
-	}
-	if vo.CellCommand(hdr[16]) != vo.CmdCreated {
-		t.Fatalf("expected created, got %d", hdr[16])
+	_, resp, err := service.NewCellReaderService().ReadCell(conn2)
+	if err != nil {
+		t.Fatalf("read created: %v", err)
 	}
-	// Read payload
-	l := int(hdr[18])<<8 | int(hdr[19])
-	if l > 0 {
-		payload := make([]byte, l)
-		if _, err := io.ReadFull(conn2, payload); err != nil {
-			t.Fatalf("read payload: %v", err)
-		}
+	if resp.Cmd != vo.CmdCreated {
+		t.Fatalf("expected created, got %d", resp.Cmd)
 	}
 
 	conn1.Close()
@@ -289,3 +413,136 @@ func TestRelayHandler_ServeConn(t *testing.T) {
 		t.Fatal("timeout waiting for ServeConn to complete")
 	}
 }
+
+func TestRelayHandler_ServeConn_NegotiatesVersions(t *testing.T) {
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	priv := vo.NewRSAPrivKey(rawKey)
+	csRepo := repository.NewConnStateRepository(time.Second)
+	cSvc := service.NewCryptoService()
+	crSvc := service.NewCellReaderService()
+	csSvc := service.NewCellSenderService()
+	peSvc := service.NewPayloadEncodingService()
+	vnSvc := service.NewVersionNegotiationService()
+
+	extendUC := usecase.NewHandleExtendUseCase(priv, csRepo, cSvc, csSvc, peSvc, vnSvc)
+	beginUC := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc, vo.ExitPolicy{})
+	dataUC := usecase.NewHandleDataUseCase(csRepo, cSvc, csSvc, peSvc)
+	endStreamUC := usecase.NewHandleEndStreamUseCase(csRepo, cSvc, csSvc, peSvc)
+	destroyUC := usecase.NewHandleDestroyUseCase(csRepo, csSvc)
+	connectUC := usecase.NewHandleConnectUseCase(csRepo, cSvc, csSvc, peSvc)
+	sendmeUC := usecase.NewHandleSendmeUseCase(csRepo, cSvc, csSvc, peSvc)
+	udpUC := usecase.NewHandleUDPUseCase(csRepo, cSvc, csSvc, peSvc, vo.DefaultExitPolicy(), time.Minute)
+	resolveUC := usecase.NewHandleResolveUseCase(csRepo, repository.NewResolveCacheRepository(16), cSvc, csSvc, peSvc, service.NewDNSResolverService("127.0.0.1:53", time.Second))
+	h := handler.NewRelayHandler(csRepo, crSvc, csSvc, extendUC, beginUC, dataUC, endStreamUC, destroyUC, connectUC, sendmeUC, udpUC, resolveUC, vnSvc)
+
+	conn1, conn2 := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeConn(conn1)
+	}()
+
+	link, err := vnSvc.Initiate(conn2)
+	if err != nil {
+		t.Fatalf("initiate: %v", err)
+	}
+	if link.Version() != vo.ProtocolV2 {
+		t.Fatalf("negotiated %v, want v2", link.Version())
+	}
+
+	// EXTEND encoded for the negotiated version
+	pe := peSvc.ForVersion(link.Version())
+	_, pub, _ := cSvc.X25519Generate()
+	var pubArr [32]byte
+	copy(pubArr[:], pub)
+	payload, _ := pe.EncodeExtendPayload(&service.ExtendPayloadDTO{ClientPub: pubArr})
+	cell := &entity.Cell{Cmd: vo.CmdExtend, Version: link.Version(), Payload: payload}
+	if err := cell.SendToConnection(link, vo.NewCircuitID()); err != nil {
+		t.Fatalf("write extend: %v", err)
+	}
+
+	_, resp, err := crSvc.ReadCell(link)
+	if err != nil {
+		t.Fatalf("read created: %v", err)
+	}
+	if resp.Cmd != vo.CmdCreated || resp.Version != vo.ProtocolV2 {
+		t.Fatalf("created cell cmd=%d ver=%d", resp.Cmd, resp.Version)
+	}
+	created, err := pe.DecodeCreatedPayload(resp.Payload)
+	if err != nil {
+		t.Fatalf("decode created: %v", err)
+	}
+	if created.MaxVersion != vo.ProtocolLatest {
+		t.Errorf("created MaxVersion = %v, want %v", created.MaxVersion, vo.ProtocolLatest)
+	}
+
+	link.Close()
+	conn1.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for ServeConn to complete")
+	}
+}
+
+func TestRelayHandler_HandleCellCreated(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Second)
+	cSvc := service.NewCryptoService()
+	crSvc := service.NewCellReaderService()
+	csSvc := service.NewCellSenderService()
+	peSvc := service.NewPayloadEncodingService()
+
+	extendUC := usecase.NewHandleExtendUseCase(nil, csRepo, cSvc, csSvc, peSvc, service.NewVersionNegotiationService())
+	beginUC := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc, vo.ExitPolicy{})
+	dataUC := usecase.NewHandleDataUseCase(csRepo, cSvc, csSvc, peSvc)
+	endStreamUC := usecase.NewHandleEndStreamUseCase(csRepo, cSvc, csSvc, peSvc)
+	destroyUC := usecase.NewHandleDestroyUseCase(csRepo, csSvc)
+	connectUC := usecase.NewHandleConnectUseCase(csRepo, cSvc, csSvc, peSvc)
+	sendmeUC := usecase.NewHandleSendmeUseCase(csRepo, cSvc, csSvc, peSvc)
+	udpUC := usecase.NewHandleUDPUseCase(csRepo, cSvc, csSvc, peSvc, vo.DefaultExitPolicy(), time.Minute)
+	resolveUC := usecase.NewHandleResolveUseCase(csRepo, repository.NewResolveCacheRepository(16), cSvc, csSvc, peSvc, service.NewDNSResolverService("127.0.0.1:53", time.Second))
+
+	h := handler.NewRelayHandler(csRepo, crSvc, csSvc, extendUC, beginUC, dataUC, endStreamUC, destroyUC, connectUC, sendmeUC, udpUC, resolveUC, service.NewVersionNegotiationService())
+
+	// legacy client upstream, v2 relay downstream
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, up2 := net.Pipe()
+	down1, down2 := net.Pipe()
+	defer up2.Close()
+	defer down2.Close()
+
+	st := entity.NewConnState(key, key, nonce, up1, entity.NewLink(down1, vo.ProtocolV2))
+	csRepo.Add(cid, st)
+	out := vo.NewCircuitID()
+	csRepo.AddOutbound(cid, out)
+
+	want := &service.CreatedPayloadDTO{RelayPub: [32]byte{9}, Auth: []byte("sig"), MaxVersion: vo.ProtocolV2}
+	body, _ := peSvc.ForVersion(vo.ProtocolV2).EncodeCreatedPayload(want)
+	cell := &entity.Cell{Cmd: vo.CmdCreated, Version: vo.ProtocolV2, Payload: body}
+
+	// CREATED arrives on the downstream link through the regular receive loop
+	go h.ServeConn(st.Down())
+	if err := cell.SendToConnection(down2, out); err != nil {
+		t.Fatalf("write created: %v", err)
+	}
+
+	gotCID, resp, err := crSvc.ReadCell(up2)
+	if err != nil {
+		t.Fatalf("read relayed created: %v", err)
+	}
+	if !gotCID.Equal(cid) || resp.Cmd != vo.CmdCreated {
+		t.Fatalf("relayed cid=%s cmd=%d", gotCID, resp.Cmd)
+	}
+	if resp.Version != vo.ProtocolV1 {
+		t.Fatalf("relayed version %v, want v1", resp.Version)
+	}
+	got, err := peSvc.DecodeCreatedPayload(resp.Payload)
+	if err != nil {
+		t.Fatalf("legacy client cannot decode created: %v", err)
+	}
+	if got.RelayPub != want.RelayPub || string(got.Auth) != string(want.Auth) || got.MaxVersion != want.MaxVersion {
+		t.Errorf("created = %+v, want %+v", got, want)
+	}
+}
@@ -10,18 +10,28 @@ import (
 	vo "ikedadada/go-ptor/shared/domain/value_object"
 )
 
+// linkCircuitID names a circuit by the link it is used on and its ID there.
+type linkCircuitID struct {
+	link net.Conn
+	id   vo.CircuitID
+}
+
 type connStateRepository struct {
 	mu      sync.RWMutex
 	ttl     time.Duration
 	m       map[vo.CircuitID]*entity.ConnState
+	out     map[vo.CircuitID]linkCircuitID // upstream ID -> downstream link and ID
+	in      map[linkCircuitID]vo.CircuitID // downstream link and ID -> upstream ID
 	streams map[vo.CircuitID]map[vo.StreamID]net.Conn
 }
 
 // NewConnStateRepository creates an in-memory connection state repository with automatic cleanup.
-func NewConnStateRepository(ttl time.Duration) repository.ConnStateRepository {
+func NewConnStateRepository(ttl time.Duration) repository.RelayConnStateRepository {
 	r := &connStateRepository{
 		ttl:     ttl,
 		m:       make(map[vo.CircuitID]*entity.ConnState),
+		out:     make(map[vo.CircuitID]linkCircuitID),
+		in:      make(map[linkCircuitID]vo.CircuitID),
 		streams: make(map[vo.CircuitID]map[vo.StreamID]net.Conn),
 	}
 	go r.gc()
@@ -55,6 +65,7 @@ func (r *connStateRepository) Delete(id vo.CircuitID) error {
 	if ok {
 		st.Close()
 		delete(r.m, id)
+		r.forgetOutbound(id)
 		// Close all streams for this circuit
 		if streams, exists := r.streams[id]; exists {
 			for _, conn := range streams {
@@ -69,6 +80,50 @@ func (r *connStateRepository) Delete(id vo.CircuitID) error {
 	return nil
 }
 
+func (r *connStateRepository) AddOutbound(in, out vo.CircuitID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st, ok := r.m[in]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	key := linkCircuitID{link: st.Down(), id: out}
+	if _, taken := r.in[key]; taken {
+		return repository.ErrDuplicate
+	}
+	r.out[in] = key
+	r.in[key] = in
+	return nil
+}
+
+func (r *connStateRepository) OutboundID(in vo.CircuitID) (vo.CircuitID, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out, ok := r.out[in]
+	if !ok {
+		return vo.CircuitID{}, repository.ErrNotFound
+	}
+	return out.id, nil
+}
+
+func (r *connStateRepository) InboundID(down net.Conn, out vo.CircuitID) (vo.CircuitID, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	in, ok := r.in[linkCircuitID{link: down, id: out}]
+	if !ok {
+		return vo.CircuitID{}, repository.ErrNotFound
+	}
+	return in, nil
+}
+
+// forgetOutbound drops the ID mapping of circuit in. Callers hold r.mu.
+func (r *connStateRepository) forgetOutbound(in vo.CircuitID) {
+	if out, ok := r.out[in]; ok {
+		delete(r.in, out)
+		delete(r.out, in)
+	}
+}
+
 func (r *connStateRepository) gc() {
 	interval := r.ttl / 2
 	if interval < time.Second {
@@ -81,6 +136,7 @@ func (r *connStateRepository) gc() {
 			if time.Since(st.LastUsed()) > r.ttl {
 				st.Close()
 				delete(r.m, id)
+				r.forgetOutbound(id)
 			}
 		}
 		r.mu.Unlock()
@@ -122,6 +178,11 @@ func (r *connStateRepository) RemoveStream(circuitID vo.CircuitID, streamID vo.S
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	// Wake a sender waiting for a SENDME on this stream
+	if st, ok := r.m[circuitID]; ok {
+		st.CloseStreamWindow(streamID)
+	}
+
 	streams, exists := r.streams[circuitID]
 	if !exists {
 		return nil
@@ -146,11 +207,15 @@ func (r *connStateRepository) DestroyAllStreams(circuitID vo.CircuitID) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	st := r.m[circuitID]
 	if streams, exists := r.streams[circuitID]; exists {
-		for _, conn := range streams {
+		for sid, conn := range streams {
 			if conn != nil {
 				conn.Close()
 			}
+			if st != nil {
+				st.CloseStreamWindow(sid)
+			}
 		}
 		delete(r.streams, circuitID)
 	}
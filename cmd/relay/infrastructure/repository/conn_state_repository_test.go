@@ -57,7 +57,7 @@ func TestNewConnStateRepository(t *testing.T) {
 	}
 
 	// Verify it implements ConnStateRepository interface
-	var _ repository.ConnStateRepository = repo
+	var _ repository.RelayConnStateRepository = repo
 }
 
 func TestConnStateRepository_Add(t *testing.T) {
@@ -69,7 +69,7 @@ func TestConnStateRepository_Add(t *testing.T) {
 	copy(key[:], make([]byte, 32))
 	baseNonce := vo.Nonce{}
 	copy(baseNonce[:], make([]byte, 12))
-	state := entity.NewConnState(key, baseNonce, nil, nil)
+	state := entity.NewConnState(key, key, baseNonce, nil, nil)
 
 	err := repo.Add(circuitID, state)
 	if err != nil {
@@ -105,7 +105,7 @@ func TestConnStateRepository_Delete(t *testing.T) {
 	copy(key[:], make([]byte, 32))
 	baseNonce := vo.Nonce{}
 	copy(baseNonce[:], make([]byte, 12))
-	state := entity.NewConnState(key, baseNonce, nil, nil)
+	state := entity.NewConnState(key, key, baseNonce, nil, nil)
 
 	err := repo.Add(circuitID, state)
 	if err != nil {
@@ -125,6 +125,58 @@ func TestConnStateRepository_Delete(t *testing.T) {
 	}
 }
 
+func TestConnStateRepository_OutboundID(t *testing.T) {
+	repo := NewConnStateRepository(time.Minute)
+	in := vo.NewCircuitID()
+	out := vo.NewCircuitID()
+	down, otherDown := &relayConnStateTestConn{}, &relayConnStateTestConn{}
+	state := entity.NewConnState(vo.AESKey{}, vo.AESKey{}, vo.Nonce{}, nil, down)
+
+	if err := repo.AddOutbound(in, out); err != repository.ErrNotFound {
+		t.Errorf("AddOutbound for unknown circuit: expected ErrNotFound, got: %v", err)
+	}
+	if err := repo.Add(in, state); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := repo.AddOutbound(in, out); err != nil {
+		t.Fatalf("AddOutbound failed: %v", err)
+	}
+
+	other := vo.NewCircuitID()
+	repo.Add(other, entity.NewConnState(vo.AESKey{}, vo.AESKey{}, vo.Nonce{}, nil, down))
+	if err := repo.AddOutbound(other, out); err != repository.ErrDuplicate {
+		t.Errorf("reusing outbound ID on one link: expected ErrDuplicate, got: %v", err)
+	}
+
+	// another link may use the same ID for a different circuit
+	third := vo.NewCircuitID()
+	repo.Add(third, entity.NewConnState(vo.AESKey{}, vo.AESKey{}, vo.Nonce{}, nil, otherDown))
+	if err := repo.AddOutbound(third, out); err != nil {
+		t.Errorf("same outbound ID on another link: %v", err)
+	}
+
+	if got, err := repo.OutboundID(in); err != nil || got != out {
+		t.Errorf("OutboundID = %v, %v; want %v", got, err, out)
+	}
+	if got, err := repo.InboundID(down, out); err != nil || got != in {
+		t.Errorf("InboundID = %v, %v; want %v", got, err, in)
+	}
+	if got, err := repo.InboundID(otherDown, out); err != nil || got != third {
+		t.Errorf("InboundID on the other link = %v, %v; want %v", got, err, third)
+	}
+	if _, err := repo.InboundID(&relayConnStateTestConn{}, out); err != repository.ErrNotFound {
+		t.Errorf("InboundID on an unrelated link: expected ErrNotFound, got: %v", err)
+	}
+
+	repo.Delete(in)
+	if _, err := repo.OutboundID(in); err != repository.ErrNotFound {
+		t.Errorf("OutboundID after delete: expected ErrNotFound, got: %v", err)
+	}
+	if _, err := repo.InboundID(down, out); err != repository.ErrNotFound {
+		t.Errorf("InboundID after delete: expected ErrNotFound, got: %v", err)
+	}
+}
+
 func TestConnStateRepository_Delete_WithStreams(t *testing.T) {
 	repo := NewConnStateRepository(time.Minute)
 	circuitID := vo.NewCircuitID()
@@ -135,7 +187,7 @@ func TestConnStateRepository_Delete_WithStreams(t *testing.T) {
 	copy(key[:], make([]byte, 32))
 	baseNonce := vo.Nonce{}
 	copy(baseNonce[:], make([]byte, 12))
-	state := entity.NewConnState(key, baseNonce, nil, nil)
+	state := entity.NewConnState(key, key, baseNonce, nil, nil)
 
 	err := repo.Add(circuitID, state)
 	if err != nil {
@@ -392,7 +444,7 @@ func TestConnStateRepository_GarbageCollection(t *testing.T) {
 	copy(key[:], make([]byte, 32))
 	baseNonce := vo.Nonce{}
 	copy(baseNonce[:], make([]byte, 12))
-	state := entity.NewConnState(key, baseNonce, nil, nil)
+	state := entity.NewConnState(key, key, baseNonce, nil, nil)
 
 	err := repo.Add(circuitID, state)
 	if err != nil {
@@ -424,7 +476,7 @@ func TestConnStateRepository_TouchUpdatesLastUsed(t *testing.T) {
 	copy(key[:], make([]byte, 32))
 	baseNonce := vo.Nonce{}
 	copy(baseNonce[:], make([]byte, 12))
-	state := entity.NewConnState(key, baseNonce, nil, nil)
+	state := entity.NewConnState(key, key, baseNonce, nil, nil)
 
 	err := repo.Add(circuitID, state)
 	if err != nil {
@@ -455,7 +507,7 @@ func TestConnStateRepository_ConcurrentAccess(t *testing.T) {
 	copy(key[:], make([]byte, 32))
 	baseNonce := vo.Nonce{}
 	copy(baseNonce[:], make([]byte, 12))
-	state := entity.NewConnState(key, baseNonce, nil, nil)
+	state := entity.NewConnState(key, key, baseNonce, nil, nil)
 
 	err := repo.Add(circuitID, state)
 	if err != nil {
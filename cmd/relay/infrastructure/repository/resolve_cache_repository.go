@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"ikedadada/go-ptor/shared/domain/repository"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// maxResolveCacheTTL caps how long an answer is cached, whatever its TTL.
+const maxResolveCacheTTL = time.Hour
+
+type resolveCacheEntry struct {
+	answers []vo.ResolvedAnswer
+	stored  time.Time
+	expires time.Time
+}
+
+type resolveCacheRepository struct {
+	mu         sync.Mutex
+	maxEntries int
+	m          map[string]resolveCacheEntry
+	now        func() time.Time
+}
+
+// NewResolveCacheRepository creates an in-memory cache of lookups that
+// holds at most maxEntries host names.
+func NewResolveCacheRepository(maxEntries int) repository.ResolveCacheRepository {
+	return &resolveCacheRepository{
+		maxEntries: maxEntries,
+		m:          make(map[string]resolveCacheEntry),
+		now:        time.Now,
+	}
+}
+
+func (r *resolveCacheRepository) Get(host string) ([]vo.ResolvedAnswer, bool) {
+	key := strings.ToLower(host)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.m[key]
+	if !ok {
+		return nil, false
+	}
+	now := r.now()
+	if !now.Before(e.expires) {
+		delete(r.m, key)
+		return nil, false
+	}
+	// count down the TTLs by the time the answers spent in the cache
+	age := now.Sub(e.stored).Truncate(time.Second)
+	out := make([]vo.ResolvedAnswer, len(e.answers))
+	for i, a := range e.answers {
+		out[i] = vo.ResolvedAnswer{IP: a.IP, TTL: max(a.TTL-age, 0)}
+	}
+	return out, true
+}
+
+func (r *resolveCacheRepository) Put(host string, answers []vo.ResolvedAnswer) {
+	if len(answers) == 0 || r.maxEntries <= 0 {
+		return
+	}
+	ttl := maxResolveCacheTTL
+	for _, a := range answers {
+		ttl = min(ttl, a.TTL)
+	}
+	if ttl <= 0 {
+		return
+	}
+	key := strings.ToLower(host)
+	now := r.now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.m[key]; !ok && len(r.m) >= r.maxEntries {
+		r.evict(now)
+	}
+	r.m[key] = resolveCacheEntry{
+		answers: append([]vo.ResolvedAnswer(nil), answers...),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+}
+
+// evict makes room for one more entry: it drops the expired entries, or
+// the one closest to expiry if none has. The caller must hold the lock.
+func (r *resolveCacheRepository) evict(now time.Time) {
+	var soonest string
+	for k, e := range r.m {
+		if !now.Before(e.expires) {
+			delete(r.m, k)
+			continue
+		}
+		if soonest == "" || e.expires.Before(r.m[soonest].expires) {
+			soonest = k
+		}
+	}
+	if len(r.m) >= r.maxEntries {
+		delete(r.m, soonest)
+	}
+}
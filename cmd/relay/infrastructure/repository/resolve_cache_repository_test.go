@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+func TestResolveCacheRepository_HonoursTTL(t *testing.T) {
+	r := NewResolveCacheRepository(10).(*resolveCacheRepository)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+
+	r.Put("Example.COM", []vo.ResolvedAnswer{
+		{IP: net.IPv4(192, 0, 2, 1), TTL: 5 * time.Minute},
+		{IP: net.ParseIP("2001:db8::1"), TTL: time.Minute},
+	})
+
+	now = now.Add(20 * time.Second)
+	got, ok := r.Get("example.com")
+	if !ok || len(got) != 2 {
+		t.Fatalf("got %v, %v; want both answers", got, ok)
+	}
+	if got[0].TTL != 5*time.Minute-20*time.Second || got[1].TTL != 40*time.Second {
+		t.Errorf("TTLs = %v, %v; want them counted down by 20s", got[0].TTL, got[1].TTL)
+	}
+
+	// the entry lives as long as its shortest TTL
+	now = now.Add(40 * time.Second)
+	if _, ok := r.Get("example.com"); ok {
+		t.Error("entry outlived its shortest TTL")
+	}
+}
+
+func TestResolveCacheRepository_ZeroTTLNotCached(t *testing.T) {
+	r := NewResolveCacheRepository(10)
+	r.Put("example.com", []vo.ResolvedAnswer{{IP: net.IPv4(192, 0, 2, 1)}})
+	if _, ok := r.Get("example.com"); ok {
+		t.Error("answer with zero TTL cached")
+	}
+}
+
+func TestResolveCacheRepository_Evicts(t *testing.T) {
+	r := NewResolveCacheRepository(2).(*resolveCacheRepository)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+
+	r.Put("a.example", []vo.ResolvedAnswer{{IP: net.IPv4(192, 0, 2, 1), TTL: time.Hour}})
+	r.Put("b.example", []vo.ResolvedAnswer{{IP: net.IPv4(192, 0, 2, 2), TTL: time.Minute}})
+	r.Put("c.example", []vo.ResolvedAnswer{{IP: net.IPv4(192, 0, 2, 3), TTL: time.Hour}})
+
+	if _, ok := r.Get("b.example"); ok {
+		t.Error("entry closest to expiry kept")
+	}
+	for _, host := range []string{"a.example", "c.example"} {
+		if _, ok := r.Get(host); !ok {
+			t.Errorf("%s evicted", host)
+		}
+	}
+}
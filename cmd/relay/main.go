@@ -21,6 +21,13 @@ func main() {
 	listen := flag.String("listen", ":5000", "listen address")
 	privPath := flag.String("priv", "", "RSA private key")
 	ttl := flag.Duration("ttl", defaultTTL(), "circuit entry TTL")
+	exitPolicySpec := flag.String("exit-policy", vo.DefaultExitPolicySpec, "comma separated exit policy rules, such as \"accept *:443,reject *:*\"")
+	exitPolicyFile := flag.String("exit-policy-file", "", "file with one exit policy rule per line; replaces -exit-policy")
+	exitUDP := flag.Bool("exit-udp", false, "let clients relay UDP datagrams through this exit")
+	udpIdle := flag.Duration("udp-idle", 2*time.Minute, "close UDP associations idle this long")
+	dnsServer := flag.String("dns", service.SystemDNSServer(), "DNS server that answers RESOLVE cells, as host:port")
+	dnsCache := flag.Int("dns-cache", 1024, "number of host names whose addresses are cached for RESOLVE")
+	legacyV1 := flag.Bool("legacy-v1", false, "redial next hops that close the connection on VERSIONS as v1, unless they answered VERSIONS before")
 	flag.Parse()
 	var priv vo.PrivateKey
 	var err error
@@ -36,19 +43,35 @@ func main() {
 			log.Fatal(err)
 		}
 	}
+	if pub, ok := priv.PublicKey().(vo.RSAPubKey); ok {
+		// clients name the relay by this in -entry-nodes and the like
+		log.Printf("identity fingerprint: %s", pub.Fingerprint())
+	}
+	policy, err := loadExitPolicy(*exitPolicySpec, *exitPolicyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	policy.AllowUDP = *exitUDP
+	// publish this line as exit_policy in the relay's directory entry
+	log.Printf("exit policy: %s", policy)
+
 	csRepo := repository.NewConnStateRepository(*ttl)
 	cSvc := service.NewCryptoService()
 	crSvc := service.NewCellReaderService()
 	csSvc := service.NewCellSenderService()
 	peSvc := service.NewPayloadEncodingService()
+	vnSvc := service.NewVersionNegotiationServiceWith(vo.SupportedProtocolVersions(), *legacyV1)
 
 	// Create individual usecases
-	extendUC := usecase.NewHandleExtendUseCase(priv, csRepo, cSvc, csSvc, peSvc)
-	beginUC := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc)
+	extendUC := usecase.NewHandleExtendUseCase(priv, csRepo, cSvc, csSvc, peSvc, vnSvc)
+	beginUC := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc, policy)
 	dataUC := usecase.NewHandleDataUseCase(csRepo, cSvc, csSvc, peSvc)
-	endStreamUC := usecase.NewHandleEndStreamUseCase(csRepo, csSvc, peSvc)
+	endStreamUC := usecase.NewHandleEndStreamUseCase(csRepo, cSvc, csSvc, peSvc)
 	destroyUC := usecase.NewHandleDestroyUseCase(csRepo, csSvc)
 	connectUC := usecase.NewHandleConnectUseCase(csRepo, cSvc, csSvc, peSvc)
+	sendmeUC := usecase.NewHandleSendmeUseCase(csRepo, cSvc, csSvc, peSvc)
+	udpUC := usecase.NewHandleUDPUseCase(csRepo, cSvc, csSvc, peSvc, policy, *udpIdle)
+	resolveUC := usecase.NewHandleResolveUseCase(csRepo, repository.NewResolveCacheRepository(*dnsCache), cSvc, csSvc, peSvc, service.NewDNSResolverService(*dnsServer, 5*time.Second))
 
 	// Create handler with all usecases
 	relayHandler := handler.NewRelayHandler(
@@ -61,6 +84,10 @@ func main() {
 		endStreamUC,
 		destroyUC,
 		connectUC,
+		sendmeUC,
+		udpUC,
+		resolveUC,
+		vnSvc,
 	)
 
 	ln, err := net.Listen("tcp", *listen)
@@ -90,6 +117,28 @@ func loadPrivateKey(path string) (vo.PrivateKey, error) {
 	return vo.ParsePrivateKeyFromPEM(b)
 }
 
+// loadExitPolicy reads the exit policy from path if it is set, or from spec
+// otherwise. The private keyword also covers the relay's own addresses, so
+// clients cannot reach services that listen on them.
+func loadExitPolicy(spec, path string) (vo.ExitPolicy, error) {
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return vo.ExitPolicy{}, err
+		}
+		spec = string(b)
+	}
+	var self []net.IP
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok {
+				self = append(self, n.IP)
+			}
+		}
+	}
+	return vo.ParseExitPolicy(spec, self...)
+}
+
 // defaultTTL returns the TTL for circuit entries derived from the
 // PTOR_TTL_SECONDS environment variable or 1 minute if unset/invalid.
 func defaultTTL() time.Duration {
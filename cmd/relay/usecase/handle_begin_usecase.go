@@ -1,9 +1,12 @@
 package usecase
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 
 	"ikedadada/go-ptor/shared/domain/entity"
 	"ikedadada/go-ptor/shared/domain/repository"
@@ -15,37 +18,63 @@ import (
 type HandleBeginUseCase interface {
 	// Begin starts a new stream
 	Begin(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, ensureServeDown func(*entity.ConnState)) error
+	// BeginAck adds our encryption layer to a BEGIN_ACK from downstream
+	// and passes it on towards the client.
+	BeginAck(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell) error
 }
 
+// errExitPolicy is returned for a target the exit policy refuses.
+var errExitPolicy = errors.New("rejected by exit policy")
+
 type handleBeginUseCaseImpl struct {
-	csRepo repository.ConnStateRepository
+	csRepo repository.RelayConnStateRepository
 	cSvc   service.CryptoService
 	csSvc  service.CellSenderService
 	peSvc  service.PayloadEncodingService
+	policy vo.ExitPolicy
 }
 
-// NewHandleBeginUseCase creates a new begin use case
-func NewHandleBeginUseCase(csRepo repository.ConnStateRepository, cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService) HandleBeginUseCase {
+// NewHandleBeginUseCase creates a new begin use case. Streams are opened
+// only to targets policy accepts.
+func NewHandleBeginUseCase(csRepo repository.RelayConnStateRepository, cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService, policy vo.ExitPolicy) HandleBeginUseCase {
 	return &handleBeginUseCaseImpl{
 		csRepo: csRepo,
 		cSvc:   cSvc,
 		csSvc:  csSvc,
 		peSvc:  peSvc,
+		policy: policy,
 	}
 }
 
 func (uc *handleBeginUseCaseImpl) Begin(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, ensureServeDown func(*entity.ConnState)) error {
 	nonce := st.BeginNonce()
-	log.Printf("begin decrypt cid=%s nonce=%x key=%x payloadLen=%d", cid.String(), nonce, st.Key(), len(cell.Payload))
-	dec, err := uc.cSvc.AESOpen(st.Key(), nonce, cell.Payload)
+	log.Printf("begin decrypt cid=%s nonce=%x key=%x payloadLen=%d", cid.String(), nonce, st.Key(vo.DirectionForward), len(cell.Payload))
+	dec, err := uc.cSvc.AESCTR(st.Key(vo.DirectionForward), nonce, cell.Payload)
 	if err != nil {
-		log.Printf("AESOpen begin failed cid=%s nonce=%x error=%v", cid.String(), nonce, err)
-		return fmt.Errorf("AESOpen begin cid=%s: %w", cid.String(), err)
+		log.Printf("AESCTR begin failed cid=%s nonce=%x error=%v", cid.String(), nonce, err)
+		return fmt.Errorf("AESCTR begin cid=%s: %w", cid.String(), err)
+	}
+	body, digest, recognized := uc.cSvc.OpenRelayBody(st.Key(vo.DirectionForward), vo.DirectionForward, st.Digest(vo.DirectionForward), dec)
+	if !recognized {
+		// not for us: forward the remaining layers downstream
+		if st.Down() == nil || st.IsHidden() {
+			return fmt.Errorf("unrecognized begin cell at last hop cid=%s", cid.String())
+		}
+		ensureServeDown(st)
+		c := &entity.Cell{Cmd: vo.CmdBegin, Version: entity.LinkVersion(st.Down()), Payload: dec}
+		out, err := uc.csRepo.OutboundID(cid)
+		if err != nil {
+			return err
+		}
+		return uc.csSvc.ForwardCell(st.Down(), out, c)
 	}
-	log.Printf("begin decrypt success cid=%s decryptedLen=%d", cid.String(), len(dec))
+	st.SetDigest(vo.DirectionForward, digest)
+	log.Printf("begin recognized cid=%s bodyLen=%d", cid.String(), len(body))
 
+	// BEGIN payloads are end-to-end: they follow the version agreed with
+	// the client when the hop was created, not the link.
 	if st.IsHidden() {
-		p, err := uc.peSvc.DecodeBeginPayload(dec)
+		p, err := uc.peSvc.ForVersion(st.PayloadVersion()).DecodeBeginPayload(body)
 		if err != nil {
 			return err
 		}
@@ -53,17 +82,12 @@ func (uc *handleBeginUseCaseImpl) Begin(st *entity.ConnState, cid vo.CircuitID,
 		if err != nil {
 			return err
 		}
+		st.OpenStreamWindow(sid)
 		go uc.forwardUpstream(st, cid, sid, st.Down())
-		return uc.csSvc.SendAck(st.Up(), cid)
+		return uc.sendBeginAck(st, cid, sid, nil)
 	}
 
-	if st.Down() != nil {
-		ensureServeDown(st)
-		c := &entity.Cell{Cmd: vo.CmdBegin, Version: vo.ProtocolV1, Payload: dec}
-		return uc.csSvc.ForwardCell(st.Down(), cid, c)
-	}
-
-	p, err := uc.peSvc.DecodeBeginPayload(dec)
+	p, err := uc.peSvc.ForVersion(st.PayloadVersion()).DecodeBeginPayload(body)
 	if err != nil {
 		return err
 	}
@@ -71,53 +95,171 @@ func (uc *handleBeginUseCaseImpl) Begin(st *entity.ConnState, cid vo.CircuitID,
 	if err != nil {
 		return err
 	}
-	down, err := net.Dial("tcp", p.Target)
+	down, err := dialAllowed(uc.policy, p.Target)
 	if err != nil {
-		c := &entity.Cell{Cmd: vo.CmdDestroy, Version: vo.ProtocolV1}
-		_ = uc.csSvc.ForwardCell(st.Up(), cid, c)
-		log.Printf("dial begin target cid=%s addr=%s err=%v", cid.String(), p.Target, err)
-		return err
+		// refuse only this stream and tell the client why
+		reason := endReasonFor(err)
+		log.Printf("dial begin target cid=%s addr=%s reason=%s err=%v", cid.String(), p.Target, reason, err)
+		return sendEnd(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, reason, err.Error())
 	}
 	if err := uc.csRepo.AddStream(cid, sid, down); err != nil {
 		down.Close()
 		return err
 	}
-	ack := &entity.Cell{Cmd: vo.CmdBeginAck, Version: vo.ProtocolV1}
-	if err := uc.csSvc.ForwardCell(st.Up(), cid, ack); err != nil {
+	st.OpenStreamWindow(sid)
+	var bound []byte
+	if addr, ok := down.RemoteAddr().(*net.TCPAddr); ok {
+		bound = vo.BoundAddrBytes(addr)
+	}
+	if err := uc.sendBeginAck(st, cid, sid, bound); err != nil {
 		return err
 	}
 	go uc.forwardUpstream(st, cid, sid, down)
 	return nil
 }
 
+// dialAllowed connects to target, a host:port, if the policy allows it.
+// Host names are resolved first and the connection goes to an address that
+// was checked, so a name cannot lead the exit to an address the policy
+// refuses.
+func dialAllowed(policy vo.ExitPolicy, target string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	ips, err := allowedAddrs(policy, host, port)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = net.Dial("tcp", net.JoinHostPort(ip.String(), portStr)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// allowedAddrs returns the addresses of host that the policy lets streams
+// reach on port, or errExitPolicy if there are none.
+func allowedAddrs(policy vo.ExitPolicy, host string, port int) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if !policy.Allows(ip, port) {
+			return nil, fmt.Errorf("%w: %s", errExitPolicy, net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+		return []net.IP{ip}, nil
+	}
+	// no need to look the name up if no address would do
+	if !policy.AllowsPort(port) {
+		return nil, fmt.Errorf("%w: port %d", errExitPolicy, port)
+	}
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	var allowed []net.IP
+	for _, ip := range ips {
+		if policy.Allows(ip, port) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("%w: %s", errExitPolicy, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return allowed, nil
+}
+
+// sendBeginAck tells the client that stream sid is connected, and to which
+// address if bound is set. The ack is sealed like DATA, so relays on the
+// path can neither read the address nor change it.
+func (uc *handleBeginUseCaseImpl) sendBeginAck(st *entity.ConnState, cid vo.CircuitID, sid vo.StreamID, bound []byte) error {
+	return sendUpstream(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, vo.CmdBeginAck, bound)
+}
+
+func (uc *handleBeginUseCaseImpl) BeginAck(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell) error {
+	p, err := uc.peSvc.ForVersion(cell.Version).DecodeDataPayload(cell.Payload)
+	if err != nil {
+		return err
+	}
+	return forwardBackward(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, vo.CmdBeginAck, p)
+}
+
 func (uc *handleBeginUseCaseImpl) forwardUpstream(st *entity.ConnState, cid vo.CircuitID, sid vo.StreamID, down net.Conn) {
 	defer down.Close()
-	buf := make([]byte, entity.MaxPayloadSize)
+	buf := make([]byte, service.MaxRelayDataSize)
 	for {
 		n, err := down.Read(buf)
 		if n > 0 {
-			// Use upstream-specific nonce for upstream data encryption
-			nonce := st.UpstreamDataNonce()
-			log.Printf("upstream encrypt cid=%s nonce=%x", cid.String(), nonce)
-			enc, err2 := uc.cSvc.AESSeal(st.Key(), nonce, buf[:n])
-			if err2 == nil {
-				payload, err3 := uc.peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: sid.UInt16(), Data: enc})
-				if err3 == nil {
-					c := &entity.Cell{Cmd: vo.CmdData, Version: vo.ProtocolV1, Payload: payload}
-					_ = uc.csSvc.ForwardCell(st.Up(), cid, c)
-				}
+			// Hold the data until the client has acknowledged enough
+			// earlier cells. While we wait nothing more is read from the
+			// stream, so the backpressure reaches the sender.
+			if werr := packageCell(st, sid); werr != nil {
+				log.Printf("stop upstream cid=%s sid=%d: %v", cid.String(), sid.UInt16(), werr)
+				return
 			}
+			_ = sendUpstream(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, vo.CmdData, buf[:n])
 		}
 		if err != nil {
 			if sid != 0 {
 				_ = uc.csRepo.RemoveStream(cid, sid)
 			}
-			endPayload := []byte{}
-			if sid != 0 {
-				endPayload, _ = uc.peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: sid.UInt16()})
+			reason := endReasonFor(err)
+			log.Printf("upstream closed cid=%s sid=%d reason=%s", cid.String(), sid.UInt16(), reason)
+			detail := ""
+			if reason != vo.EndReasonDone {
+				detail = err.Error()
 			}
-			_ = uc.csSvc.ForwardCell(st.Up(), cid, &entity.Cell{Cmd: vo.CmdEnd, Version: vo.ProtocolV1, Payload: endPayload})
+			_ = sendEnd(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, reason, detail)
 			return
 		}
 	}
 }
+
+// sendUpstream seals data for the client, adds our encryption layer and
+// sends it back as a cmd cell of stream sid.
+func sendUpstream(cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService, st *entity.ConnState, cid vo.CircuitID, sid vo.StreamID, cmd vo.CellCommand, data []byte) error {
+	st.LockSend()
+	defer st.UnlockSend()
+	body, digest, err := cSvc.SealRelayBody(st.Key(vo.DirectionBackward), vo.DirectionBackward, st.Digest(vo.DirectionBackward), data)
+	if err != nil {
+		return err
+	}
+	st.SetDigest(vo.DirectionBackward, digest)
+	// Use upstream-specific nonce for upstream data encryption
+	nonce := st.UpstreamDataNonce()
+	log.Printf("upstream encrypt cid=%s nonce=%x", cid.String(), nonce)
+	enc, err := cSvc.AESCTR(st.Key(vo.DirectionBackward), nonce, body)
+	if err != nil {
+		return err
+	}
+	linkVer := entity.LinkVersion(st.Up())
+	payload, err := peSvc.ForVersion(linkVer).EncodeDataPayload(&service.DataPayloadDTO{StreamID: sid.UInt16(), Data: enc})
+	if err != nil {
+		return err
+	}
+	return csSvc.ForwardCell(st.Up(), cid, &entity.Cell{Cmd: cmd, Version: linkVer, Payload: payload})
+}
+
+// sendToClient passes cell up the circuit towards the client. The send lock
+// keeps it from slipping in between the nonce, digest and write of a cell
+// another stream is sending.
+func sendToClient(csSvc service.CellSenderService, st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell) error {
+	st.LockSend()
+	defer st.UnlockSend()
+	return csSvc.ForwardCell(st.Up(), cid, cell)
+}
+
+// packageCell takes one cell from the stream and circuit package windows,
+// blocking until SENDME cells from the client open them.
+func packageCell(st *entity.ConnState, sid vo.StreamID) error {
+	if w, ok := st.StreamWindow(sid); ok {
+		if err := w.Package(); err != nil {
+			return err
+		}
+	}
+	return st.Window().Package()
+}
@@ -2,8 +2,11 @@ package usecase_test
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,7 +22,7 @@ func TestHandleBeginUseCase_BeginForward(t *testing.T) {
 	cSvc := service.NewCryptoService()
 	csSvc := service.NewCellSenderService()
 	peSvc := service.NewPayloadEncodingService()
-	uc := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc)
+	uc := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc, vo.ExitPolicy{})
 
 	key, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
@@ -27,8 +30,10 @@ func TestHandleBeginUseCase_BeginForward(t *testing.T) {
 	up1, _ := net.Pipe()
 	down1, down2 := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, down1)
+	st := entity.NewConnState(key, key, nonce, up1, down1)
 	csRepo.Add(cid, st)
+	out := vo.NewCircuitID()
+	csRepo.AddOutbound(cid, out)
 
 	// Mock ensureServeDown function
 	serveDownCalled := false
@@ -37,7 +42,7 @@ func TestHandleBeginUseCase_BeginForward(t *testing.T) {
 	}
 
 	plain, _ := peSvc.EncodeBeginPayload(&service.BeginPayloadDTO{StreamID: 1, Target: "example.com:80"})
-	enc, _ := cSvc.AESSeal(key, nonce, plain)
+	enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceBegin, 0), plain)
 	cell := &entity.Cell{Cmd: vo.CmdBegin, Version: vo.ProtocolV1, Payload: enc}
 
 	errCh := make(chan error, 1)
@@ -76,14 +81,14 @@ func TestHandleBeginUseCase_BeginExit(t *testing.T) {
 	cSvc := service.NewCryptoService()
 	csSvc := service.NewCellSenderService()
 	peSvc := service.NewPayloadEncodingService()
-	uc := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc)
+	uc := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc, vo.ExitPolicy{})
 
 	key, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
 	cid := vo.NewCircuitID()
 	up1, up2 := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, nil)
+	st := entity.NewConnState(key, key, nonce, up1, nil)
 	csRepo.Add(cid, st)
 
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
@@ -106,7 +111,8 @@ func TestHandleBeginUseCase_BeginExit(t *testing.T) {
 	target := ln.Addr().String()
 	t.Logf("Target address: %s", target)
 	plain, _ := peSvc.EncodeBeginPayload(&service.BeginPayloadDTO{StreamID: 1, Target: target})
-	enc, _ := cSvc.AESSeal(key, nonce, plain)
+	body, _, _ := cSvc.SealRelayBody(key, vo.DirectionForward, [32]byte{}, plain)
+	enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceBegin, 0), body)
 	cell := &entity.Cell{Cmd: vo.CmdBegin, Version: vo.ProtocolV1, Payload: enc}
 
 	errCh := make(chan error, 1)
@@ -117,9 +123,22 @@ func TestHandleBeginUseCase_BeginExit(t *testing.T) {
 	if _, err := io.ReadFull(up2, buf); err != nil {
 		t.Fatalf("read ack: %v", err)
 	}
-	if vo.CellCommand(buf[16]) != vo.CmdBeginAck {
+	ack, err := entity.Decode(buf[16:])
+	if err != nil || ack.Cmd != vo.CmdBeginAck {
 		t.Fatalf("ack cmd %d", buf[16])
 	}
+	p, err := peSvc.DecodeDataPayload(ack.Payload)
+	if err != nil || p.StreamID != 1 {
+		t.Fatalf("ack does not name stream 1: %v", err)
+	}
+	dec, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceUpstream, 0), p.Data)
+	data, _, ok := cSvc.OpenRelayBody(key, vo.DirectionBackward, [32]byte{}, dec)
+	if !ok {
+		t.Fatal("ack not sealed for the client")
+	}
+	if bound, ok := vo.BoundAddrFrom(data); !ok || bound.String() != target {
+		t.Errorf("ack bound address = %v, want %s", bound, target)
+	}
 
 	// Wait for Begin operation to complete first
 	if err := <-errCh; err != nil {
@@ -143,12 +162,122 @@ func TestHandleBeginUseCase_BeginExit(t *testing.T) {
 	csRepo.DestroyAllStreams(cid)
 }
 
+func TestHandleBeginUseCase_DialFailureSendsEndReason(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Second)
+	cSvc := service.NewCryptoService()
+	peSvc := service.NewPayloadEncodingService()
+	crSvc := service.NewCellReaderService()
+	uc := usecase.NewHandleBeginUseCase(csRepo, cSvc, service.NewCellSenderService(), peSvc, vo.ExitPolicy{})
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, up2 := net.Pipe()
+	defer up2.Close()
+	st := entity.NewConnState(key, key, nonce, up1, nil)
+	csRepo.Add(cid, st)
+
+	// nothing listens on a port that was just released
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	target := ln.Addr().String()
+	ln.Close()
+
+	plain, _ := peSvc.EncodeBeginPayload(&service.BeginPayloadDTO{StreamID: 9, Target: target})
+	body, _, _ := cSvc.SealRelayBody(key, vo.DirectionForward, [32]byte{}, plain)
+	enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceBegin, 0), body)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- uc.Begin(st, cid, &entity.Cell{Cmd: vo.CmdBegin, Version: vo.ProtocolV1, Payload: enc}, func(*entity.ConnState) {})
+	}()
+
+	_, cell, err := crSvc.ReadCell(up2)
+	if err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if cell.Cmd != vo.CmdEnd {
+		t.Fatalf("reply cmd = %s, want END", cell.Cmd)
+	}
+	sid, data := openUpstream(t, cSvc, peSvc, entity.NewConnState(key, key, nonce, nil, nil), cell)
+	if sid != 9 || vo.EndReasonFrom(data) != vo.EndReasonConnectRefused {
+		t.Errorf("END sid=%d reason=%s, want sid=9 reason=%s", sid, vo.EndReasonFrom(data), vo.EndReasonConnectRefused)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("begin: %v", err)
+	}
+}
+
+func TestHandleBeginUseCase_RefusedByExitPolicy(t *testing.T) {
+	// a listening target the default policy keeps clients away from
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan struct{}, 2)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			c.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	for _, target := range []string{ln.Addr().String(), net.JoinHostPort("localhost", strconv.Itoa(port))} {
+		t.Run(target, func(t *testing.T) {
+			csRepo := repository.NewConnStateRepository(time.Second)
+			cSvc := service.NewCryptoService()
+			peSvc := service.NewPayloadEncodingService()
+			uc := usecase.NewHandleBeginUseCase(csRepo, cSvc, service.NewCellSenderService(), peSvc, vo.DefaultExitPolicy())
+
+			key, _ := vo.NewAESKey()
+			nonce, _ := vo.NewNonce()
+			cid := vo.NewCircuitID()
+			up1, up2 := net.Pipe()
+			defer up2.Close()
+			st := entity.NewConnState(key, key, nonce, up1, nil)
+			csRepo.Add(cid, st)
+
+			plain, _ := peSvc.EncodeBeginPayload(&service.BeginPayloadDTO{StreamID: 3, Target: target})
+			body, _, _ := cSvc.SealRelayBody(key, vo.DirectionForward, [32]byte{}, plain)
+			enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceBegin, 0), body)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- uc.Begin(st, cid, &entity.Cell{Cmd: vo.CmdBegin, Version: vo.ProtocolV1, Payload: enc}, func(*entity.ConnState) {})
+			}()
+
+			_, cell, err := service.NewCellReaderService().ReadCell(up2)
+			if err != nil {
+				t.Fatalf("read reply: %v", err)
+			}
+			sid, data := openUpstream(t, cSvc, peSvc, entity.NewConnState(key, key, nonce, nil, nil), cell)
+			if cell.Cmd != vo.CmdEnd || sid != 3 || vo.EndReasonFrom(data) != vo.EndReasonExitPolicy {
+				t.Errorf("got %s sid=%d reason=%s, want END EXITPOLICY for stream 3", cell.Cmd, sid, vo.EndReasonFrom(data))
+			}
+			if err := <-errCh; err != nil {
+				t.Errorf("begin: %v", err)
+			}
+			select {
+			case <-accepted:
+				t.Error("exit dialed a target its policy rejects")
+			default:
+			}
+		})
+	}
+}
+
 func TestHandleBeginUseCase_BeginHidden(t *testing.T) {
 	csRepo := repository.NewConnStateRepository(time.Second)
 	cSvc := service.NewCryptoService()
 	csSvc := service.NewCellSenderService()
 	peSvc := service.NewPayloadEncodingService()
-	uc := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc)
+	uc := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc, vo.ExitPolicy{})
 
 	key, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
@@ -156,7 +285,7 @@ func TestHandleBeginUseCase_BeginHidden(t *testing.T) {
 	up1, up2 := net.Pipe()
 	down1, down2 := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, down1)
+	st := entity.NewConnState(key, key, nonce, up1, down1)
 	st.SetHidden(true)
 	csRepo.Add(cid, st)
 
@@ -164,7 +293,8 @@ func TestHandleBeginUseCase_BeginHidden(t *testing.T) {
 	ensureServeDown := func(st *entity.ConnState) {}
 
 	plain, _ := peSvc.EncodeBeginPayload(&service.BeginPayloadDTO{StreamID: 1, Target: "svc"})
-	enc, _ := cSvc.AESSeal(key, nonce, plain)
+	body, _, _ := cSvc.SealRelayBody(key, vo.DirectionForward, [32]byte{}, plain)
+	enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceBegin, 0), body)
 	cell := &entity.Cell{Cmd: vo.CmdBegin, Version: vo.ProtocolV1, Payload: enc}
 
 	go uc.Begin(st, cid, cell, ensureServeDown)
@@ -191,3 +321,179 @@ func TestHandleBeginUseCase_BeginHidden(t *testing.T) {
 	down1.Close()
 	down2.Close()
 }
+
+// A client that stops sending SENDME cells must stop the exit from reading
+// the stream, so the backpressure reaches whoever is writing to it.
+func TestHandleBeginUseCase_StalledClientThrottlesStream(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Second)
+	cSvc := service.NewCryptoService()
+	csSvc := service.NewCellSenderService()
+	crSvc := service.NewCellReaderService()
+	peSvc := service.NewPayloadEncodingService()
+	uc := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc, vo.ExitPolicy{})
+	sendmeUC := usecase.NewHandleSendmeUseCase(csRepo, cSvc, csSvc, peSvc)
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, up2 := net.Pipe()
+	down1, down2 := net.Pipe()
+	defer up2.Close()
+	defer down2.Close()
+
+	st := entity.NewConnState(key, key, nonce, up1, down1)
+	st.SetHidden(true)
+	csRepo.Add(cid, st)
+	defer csRepo.Delete(cid)
+
+	plain, _ := peSvc.EncodeBeginPayload(&service.BeginPayloadDTO{StreamID: 1, Target: "svc"})
+	body, digest, _ := cSvc.SealRelayBody(key, vo.DirectionForward, [32]byte{}, plain)
+	enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceBegin, 0), body)
+	go uc.Begin(st, cid, &entity.Cell{Cmd: vo.CmdBegin, Version: vo.ProtocolV1, Payload: enc}, func(*entity.ConnState) {})
+	if _, cell, err := crSvc.ReadCell(up2); err != nil || cell.Cmd != vo.CmdBeginAck {
+		t.Fatalf("read ack: %v", err)
+	}
+	client := entity.NewConnState(key, key, nonce, nil, nil)
+	client.SetDigest(vo.DirectionForward, digest)
+
+	// the service writes as fast as the exit reads
+	var writes atomic.Int64
+	go func() {
+		chunk := bytes.Repeat([]byte{'a'}, 100)
+		for {
+			if _, err := down2.Write(chunk); err != nil {
+				return
+			}
+			writes.Add(1)
+		}
+	}()
+
+	// countData reads DATA cells until the exit goes quiet
+	countData := func() int {
+		n := 0
+		for {
+			up2.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, cell, err := crSvc.ReadCell(up2)
+			if err != nil {
+				return n
+			}
+			if cell.Cmd == vo.CmdData {
+				n++
+			}
+		}
+	}
+
+	if n := countData(); n != entity.StreamWindowStart {
+		t.Fatalf("DATA cells before SENDME = %d, want %d", n, entity.StreamWindowStart)
+	}
+	// one chunk is held by the exit while it waits; nothing more is read
+	if w := writes.Load(); w > entity.StreamWindowStart+1 {
+		t.Errorf("service wrote %d chunks with the window closed", w)
+	}
+
+	if err := sendmeUC.Sendme(st, cid, sendmeCell(t, client, 1), vo.DirectionForward, func(*entity.ConnState) {}); err != nil {
+		t.Fatalf("sendme: %v", err)
+	}
+	if n := countData(); n != entity.StreamWindowIncrement {
+		t.Errorf("DATA cells after SENDME = %d, want %d", n, entity.StreamWindowIncrement)
+	}
+}
+
+// Streams of one circuit send from their own goroutines. Each cell must
+// consume the next nonce and digest and reach the client in that order, or
+// the client recognizes none of the cells after the first mix-up.
+func TestHandleBeginUseCase_ConcurrentStreams(t *testing.T) {
+	const streams = 8
+	const size = 40000
+	csRepo := repository.NewConnStateRepository(time.Minute)
+	cSvc := service.NewCryptoService()
+	crSvc := service.NewCellReaderService()
+	peSvc := service.NewPayloadEncodingService()
+	uc := usecase.NewHandleBeginUseCase(csRepo, cSvc, service.NewCellSenderService(), peSvc, vo.ExitPolicy{})
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, up2 := net.Pipe()
+	defer up2.Close()
+	st := entity.NewConnState(key, key, nonce, up1, nil)
+	csRepo.Add(cid, st)
+	defer csRepo.Delete(cid)
+	client := entity.NewConnState(key, key, nonce, nil, nil)
+
+	// every connection gets size bytes of its own letter
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for i := 0; ; i++ {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn, b byte) {
+				defer c.Close()
+				_, _ = c.Write(bytes.Repeat([]byte{b}, size))
+			}(c, byte('a'+i))
+		}
+	}()
+
+	type result struct {
+		data map[uint16][]byte
+		err  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		data := map[uint16][]byte{}
+		ended := 0
+		for ended < streams {
+			up2.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, cell, err := crSvc.ReadCell(up2)
+			if err != nil {
+				resCh <- result{err: err}
+				return
+			}
+			p, _ := peSvc.DecodeDataPayload(cell.Payload)
+			switch cell.Cmd {
+			case vo.CmdData, vo.CmdBeginAck, vo.CmdEnd:
+				dec, _ := cSvc.AESCTR(client.Key(vo.DirectionBackward), client.UpstreamDataNonce(), p.Data)
+				body, digest, ok := cSvc.OpenRelayBody(client.Key(vo.DirectionBackward), vo.DirectionBackward, client.Digest(vo.DirectionBackward), dec)
+				if !ok {
+					resCh <- result{err: errors.New(cell.Cmd.String() + " cell not recognized")}
+					return
+				}
+				client.SetDigest(vo.DirectionBackward, digest)
+				switch cell.Cmd {
+				case vo.CmdData:
+					data[p.StreamID] = append(data[p.StreamID], body...)
+				case vo.CmdEnd:
+					ended++
+				}
+			}
+		}
+		resCh <- result{data: data}
+	}()
+
+	for sid := uint16(1); sid <= streams; sid++ {
+		plain, _ := peSvc.EncodeBeginPayload(&service.BeginPayloadDTO{StreamID: sid, Target: ln.Addr().String()})
+		body, digest, _ := cSvc.SealRelayBody(key, vo.DirectionForward, client.Digest(vo.DirectionForward), plain)
+		client.SetDigest(vo.DirectionForward, digest)
+		enc, _ := cSvc.AESCTR(key, client.BeginNonce(), body)
+		if err := uc.Begin(st, cid, &entity.Cell{Cmd: vo.CmdBegin, Version: vo.ProtocolV1, Payload: enc}, func(*entity.ConnState) {}); err != nil {
+			t.Fatalf("begin stream %d: %v", sid, err)
+		}
+	}
+
+	res := <-resCh
+	if res.err != nil {
+		t.Fatalf("read replies: %v", res.err)
+	}
+	for sid := uint16(1); sid <= streams; sid++ {
+		d := res.data[sid]
+		if len(d) != size || !bytes.Equal(d, bytes.Repeat(d[:1], size)) {
+			t.Errorf("stream %d got %d bytes, want %d of one letter", sid, len(d), size)
+		}
+	}
+}
@@ -19,14 +19,14 @@ type HandleConnectUseCase interface {
 }
 
 type handleConnectUseCaseImpl struct {
-	csRepo repository.ConnStateRepository
+	csRepo repository.RelayConnStateRepository
 	cSvc   service.CryptoService
 	csSvc  service.CellSenderService
 	peSvc  service.PayloadEncodingService
 }
 
 // NewHandleConnectUseCase creates a new connect use case
-func NewHandleConnectUseCase(csRepo repository.ConnStateRepository, cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService) HandleConnectUseCase {
+func NewHandleConnectUseCase(csRepo repository.RelayConnStateRepository, cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService) HandleConnectUseCase {
 	return &handleConnectUseCaseImpl{
 		csRepo: csRepo,
 		cSvc:   cSvc,
@@ -36,26 +36,29 @@ func NewHandleConnectUseCase(csRepo repository.ConnStateRepository, cSvc service
 }
 
 func (uc *handleConnectUseCaseImpl) Connect(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, ensureServeDown func(*entity.ConnState)) error {
-	// middle relay: peel one layer and forward the remaining ciphertext
-	if st.Down() != nil {
+	nonce := st.BeginNonce()
+	log.Printf("connect decrypt cid=%s nonce=%x", cid.String(), nonce)
+	dec, err := uc.cSvc.AESCTR(st.Key(vo.DirectionForward), nonce, cell.Payload)
+	if err != nil {
+		return fmt.Errorf("AESCTR connect cid=%s: %w", cid.String(), err)
+	}
+	body, digest, recognized := uc.cSvc.OpenRelayBody(st.Key(vo.DirectionForward), vo.DirectionForward, st.Digest(vo.DirectionForward), dec)
+	if !recognized {
+		// middle relay: forward the remaining ciphertext
+		if st.Down() == nil || st.IsHidden() {
+			return fmt.Errorf("unrecognized connect cell at last hop cid=%s", cid.String())
+		}
 		ensureServeDown(st)
-		nonce := st.BeginNonce()
-		log.Printf("connect decrypt cid=%s nonce=%x", cid.String(), nonce)
-		dec, err := uc.cSvc.AESOpen(st.Key(), nonce, cell.Payload)
+		c := &entity.Cell{Cmd: vo.CmdConnect, Version: entity.LinkVersion(st.Down()), Payload: dec}
+		out, err := uc.csRepo.OutboundID(cid)
 		if err != nil {
-			return fmt.Errorf("AESOpen connect cid=%s: %w", cid.String(), err)
+			return err
 		}
-		c := &entity.Cell{Cmd: vo.CmdConnect, Version: vo.ProtocolV1, Payload: dec}
-		return uc.csSvc.ForwardCell(st.Down(), cid, c)
+		return uc.csSvc.ForwardCell(st.Down(), out, c)
 	}
+	st.SetDigest(vo.DirectionForward, digest)
 
 	// exit relay: decode final payload and connect to the hidden service
-	nonce := st.BeginNonce()
-	log.Printf("connect exit decrypt cid=%s nonce=%x", cid.String(), nonce)
-	dec, err := uc.cSvc.AESOpen(st.Key(), nonce, cell.Payload)
-	if err != nil {
-		return fmt.Errorf("AESOpen connect cid=%s: %w", cid.String(), err)
-	}
 	addr := os.Getenv("PTOR_HIDDEN_ADDR")
 	if addr == "" {
 		addr = os.Getenv("HIDDEN_ADDR")
@@ -63,8 +66,8 @@ func (uc *handleConnectUseCaseImpl) Connect(st *entity.ConnState, cid vo.Circuit
 	if addr == "" {
 		addr = "hidden:5000"
 	}
-	if len(dec) > 0 {
-		p, err := uc.peSvc.DecodeConnectPayload(dec)
+	if len(body) > 0 {
+		p, err := uc.peSvc.ForVersion(st.PayloadVersion()).DecodeConnectPayload(body)
 		if err != nil {
 			return err
 		}
@@ -82,14 +85,15 @@ func (uc *handleConnectUseCaseImpl) Connect(st *entity.ConnState, cid vo.Circuit
 		st.Down().Close()
 	}
 	beginCounter, dataCounter := st.GetCounters()
-	newSt := entity.NewConnStateWithCounters(st.Key(), st.Nonce(), st.Up(), down, beginCounter, dataCounter)
+	newSt := entity.NewConnStateWithCounters(st.Key(vo.DirectionForward), st.Key(vo.DirectionBackward), st.Nonce(), st.Up(), down, beginCounter, dataCounter)
 	newSt.SetHidden(true)
+	newSt.SetPayloadVersion(st.PayloadVersion())
+	newSt.SetDigest(vo.DirectionForward, st.Digest(vo.DirectionForward))
+	newSt.SetDigest(vo.DirectionBackward, st.Digest(vo.DirectionBackward))
 	if err := uc.csRepo.Add(cid, newSt); err != nil {
 		down.Close()
 		return err
 	}
-	if err := uc.csSvc.SendAck(newSt.Up(), cid); err != nil {
-		return err
-	}
-	return nil
+	// the ack names no stream, but is sealed so no relay can fake it
+	return sendUpstream(uc.cSvc, uc.csSvc, uc.peSvc, newSt, cid, 0, vo.CmdBeginAck, nil)
 }
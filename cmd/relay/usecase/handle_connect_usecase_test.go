@@ -27,8 +27,10 @@ func TestHandleConnectUseCase_ConnectMiddle(t *testing.T) {
 	up1, _ := net.Pipe()
 	down1, down2 := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, down1)
+	st := entity.NewConnState(key, key, nonce, up1, down1)
 	repo.Add(cid, st)
+	out := vo.NewCircuitID()
+	repo.AddOutbound(cid, out)
 
 	// Mock ensureServeDown function
 	serveDownCalled := false
@@ -38,7 +40,7 @@ func TestHandleConnectUseCase_ConnectMiddle(t *testing.T) {
 
 	// Create connect payload
 	payload, _ := p.EncodeConnectPayload(&service.ConnectPayloadDTO{Target: "example.com:80"})
-	enc, _ := crypto.AESSeal(key, nonce, payload)
+	enc, _ := crypto.AESCTR(key, nonce.Sequence(vo.NonceSpaceBegin, 0), payload)
 	cell := &entity.Cell{Cmd: vo.CmdConnect, Version: vo.ProtocolV1, Payload: enc}
 
 	errCh := make(chan error, 1)
@@ -81,7 +83,7 @@ func TestHandleConnectUseCase_ConnectExit(t *testing.T) {
 	cid := vo.NewCircuitID()
 	up1, up2 := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, nil)
+	st := entity.NewConnState(key, key, nonce, up1, nil)
 	repo.Add(cid, st)
 
 	// Setup mock hidden service
@@ -95,7 +97,8 @@ func TestHandleConnectUseCase_ConnectExit(t *testing.T) {
 
 	// Create connect payload with target
 	payload, _ := p.EncodeConnectPayload(&service.ConnectPayloadDTO{Target: ln.Addr().String()})
-	enc, _ := crypto.AESSeal(key, nonce, payload)
+	body, _, _ := crypto.SealRelayBody(key, vo.DirectionForward, [32]byte{}, payload)
+	enc, _ := crypto.AESCTR(key, nonce.Sequence(vo.NonceSpaceBegin, 0), body)
 	cell := &entity.Cell{Cmd: vo.CmdConnect, Version: vo.ProtocolV1, Payload: enc}
 
 	go uc.Connect(st, cid, cell, ensureServeDown)
@@ -144,7 +147,7 @@ func TestHandleConnectUseCase_ConnectExitWithEnvAddr(t *testing.T) {
 	cid := vo.NewCircuitID()
 	up1, up2 := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, nil)
+	st := entity.NewConnState(key, key, nonce, up1, nil)
 	repo.Add(cid, st)
 
 	// Setup mock hidden service
@@ -161,7 +164,8 @@ func TestHandleConnectUseCase_ConnectExitWithEnvAddr(t *testing.T) {
 	ensureServeDown := func(st *entity.ConnState) {}
 
 	// Create connect payload with empty payload (should use env var)
-	enc, _ := crypto.AESSeal(key, nonce, []byte{})
+	body, _, _ := crypto.SealRelayBody(key, vo.DirectionForward, [32]byte{}, nil)
+	enc, _ := crypto.AESCTR(key, nonce.Sequence(vo.NonceSpaceBegin, 0), body)
 	cell := &entity.Cell{Cmd: vo.CmdConnect, Version: vo.ProtocolV1, Payload: enc}
 
 	go uc.Connect(st, cid, cell, ensureServeDown)
@@ -210,7 +214,7 @@ func TestHandleConnectUseCase_ConnectExitDialFail(t *testing.T) {
 	cid := vo.NewCircuitID()
 	up1, _ := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, nil)
+	st := entity.NewConnState(key, key, nonce, up1, nil)
 	repo.Add(cid, st)
 
 	// Mock ensureServeDown function
@@ -218,7 +222,8 @@ func TestHandleConnectUseCase_ConnectExitDialFail(t *testing.T) {
 
 	// Create connect payload with invalid target
 	payload, _ := p.EncodeConnectPayload(&service.ConnectPayloadDTO{Target: "127.0.0.1:1"})
-	enc, _ := crypto.AESSeal(key, nonce, payload)
+	body, _, _ := crypto.SealRelayBody(key, vo.DirectionForward, [32]byte{}, payload)
+	enc, _ := crypto.AESCTR(key, nonce.Sequence(vo.NonceSpaceBegin, 0), body)
 	cell := &entity.Cell{Cmd: vo.CmdConnect, Version: vo.ProtocolV1, Payload: enc}
 
 	// Should return error when dial fails
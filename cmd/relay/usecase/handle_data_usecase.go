@@ -12,19 +12,19 @@ import (
 
 // HandleDataUseCase handles data transfer operations
 type HandleDataUseCase interface {
-	// Data processes data transfer cells
-	Data(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, ensureServeDown func(*entity.ConnState)) error
+	// Data processes a DATA cell travelling in dir
+	Data(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, dir vo.Direction, ensureServeDown func(*entity.ConnState)) error
 }
 
 type handleDataUseCaseImpl struct {
-	csRepo repository.ConnStateRepository
+	csRepo repository.RelayConnStateRepository
 	cSvc   service.CryptoService
 	csSvc  service.CellSenderService
 	peSvc  service.PayloadEncodingService
 }
 
 // NewHandleDataUseCase creates a new data use case
-func NewHandleDataUseCase(csRepo repository.ConnStateRepository, cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService) HandleDataUseCase {
+func NewHandleDataUseCase(csRepo repository.RelayConnStateRepository, cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService) HandleDataUseCase {
 	return &handleDataUseCaseImpl{
 		csRepo: csRepo,
 		cSvc:   cSvc,
@@ -33,8 +33,8 @@ func NewHandleDataUseCase(csRepo repository.ConnStateRepository, cSvc service.Cr
 	}
 }
 
-func (uc *handleDataUseCaseImpl) Data(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, ensureServeDown func(*entity.ConnState)) error {
-	p, err := uc.peSvc.DecodeDataPayload(cell.Payload)
+func (uc *handleDataUseCaseImpl) Data(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, dir vo.Direction, ensureServeDown func(*entity.ConnState)) error {
+	p, err := uc.peSvc.ForVersion(cell.Version).DecodeDataPayload(cell.Payload)
 	if err != nil {
 		return err
 	}
@@ -43,64 +43,107 @@ func (uc *handleDataUseCaseImpl) Data(st *entity.ConnState, cid vo.CircuitID, ce
 		return err
 	}
 
-	// Try to decrypt the data for downstream flow
+	if dir == vo.DirectionBackward {
+		return uc.backward(st, cid, p)
+	}
+
+	// forward: peel our layer and check whether the cell is addressed to us
 	nonce := st.DataNonce()
-	log.Printf("data decrypt cid=%s nonce=%x key=%x dataLen=%d", cid.String(), nonce, st.Key(), len(p.Data))
-	dec, err := uc.cSvc.AESOpen(st.Key(), nonce, p.Data)
+	log.Printf("data decrypt cid=%s nonce=%x key=%x dataLen=%d", cid.String(), nonce, st.Key(vo.DirectionForward), len(p.Data))
+	dec, err := uc.cSvc.AESCTR(st.Key(vo.DirectionForward), nonce, p.Data)
 	if err != nil {
-		// If decryption fails and this is a middle relay, it might be upstream data
-		// Add our encryption layer and forward upstream
-		if st.Down() != nil {
-			log.Printf("data decrypt failed, treating as upstream data cid=%s", cid.String())
-			// Add encryption layer for upstream flow
-			upstreamNonce := st.UpstreamDataNonce()
-			log.Printf("upstream encrypt layer cid=%s nonce=%x", cid.String(), upstreamNonce)
-			enc, err2 := uc.cSvc.AESSeal(st.Key(), upstreamNonce, p.Data)
-			if err2 != nil {
-				log.Printf("upstream encryption failed cid=%s error=%v", cid.String(), err2)
-				return err2
-			}
-			// Forward with additional encryption layer
-			upstreamPayload, err3 := uc.peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: p.StreamID, Data: enc})
-			if err3 != nil {
-				return err3
-			}
-			upstreamCell := &entity.Cell{Cmd: vo.CmdData, Version: vo.ProtocolV1, Payload: upstreamPayload}
-			return uc.csSvc.ForwardCell(st.Up(), cid, upstreamCell)
+		log.Printf("AESCTR data failed cid=%s nonce=%x error=%v", cid.String(), nonce, err)
+		return fmt.Errorf("AESCTR data cid=%s: %w", cid.String(), err)
+	}
+	data, digest, recognized := uc.cSvc.OpenRelayBody(st.Key(vo.DirectionForward), vo.DirectionForward, st.Digest(vo.DirectionForward), dec)
+	if !recognized {
+		// not for us: forward downstream with one layer removed
+		if st.Down() == nil || st.IsHidden() {
+			return fmt.Errorf("unrecognized data cell at last hop cid=%s", cid.String())
 		}
-		log.Printf("AESOpen data failed cid=%s nonce=%x error=%v", cid.String(), nonce, err)
-		return fmt.Errorf("AESOpen data cid=%s: %w", cid.String(), err)
+		ensureServeDown(st)
+		payload, err := uc.peSvc.ForVersion(entity.LinkVersion(st.Down())).EncodeDataPayload(&service.DataPayloadDTO{StreamID: p.StreamID, Data: dec})
+		if err != nil {
+			return err
+		}
+		c := &entity.Cell{Cmd: vo.CmdData, Version: entity.LinkVersion(st.Down()), Payload: payload}
+		out, err := uc.csRepo.OutboundID(cid)
+		if err != nil {
+			return err
+		}
+		return uc.csSvc.ForwardCell(st.Down(), out, c)
 	}
-	log.Printf("data decrypt success cid=%s decryptedLen=%d", cid.String(), len(dec))
+	st.SetDigest(vo.DirectionForward, digest)
+	log.Printf("data recognized cid=%s dataLen=%d", cid.String(), len(data))
 
 	if st.IsHidden() {
-		_, err := st.Down().Write(dec)
-		return err
-	}
-
-	// middle relay: forward downstream with one layer removed
-	if st.Down() != nil {
-		ensureServeDown(st)
-		payload, err := uc.peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: p.StreamID, Data: dec})
-		if err != nil {
+		if _, err := st.Down().Write(data); err != nil {
 			return err
 		}
-		c := &entity.Cell{Cmd: vo.CmdData, Version: vo.ProtocolV1, Payload: payload}
-		return uc.csSvc.ForwardCell(st.Down(), cid, c)
+		return uc.acknowledge(st, cid, sid)
 	}
 
 	// exit relay: write plaintext to the local stream
 	conn, err := uc.csRepo.GetStream(cid, sid)
 	if err != nil {
-		c := &entity.Cell{Cmd: vo.CmdDestroy, Version: vo.ProtocolV1}
-		_ = uc.csSvc.ForwardCell(st.Up(), cid, c)
-		return nil
+		// the stream may have closed while this cell was in flight
+		return sendEnd(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, vo.EndReasonProtocol, "unknown stream")
 	}
-	if _, err := conn.Write(dec); err != nil {
+	if _, err := conn.Write(data); err != nil {
 		_ = uc.csRepo.RemoveStream(cid, sid)
-		c := &entity.Cell{Cmd: vo.CmdDestroy, Version: vo.ProtocolV1}
-		_ = uc.csSvc.ForwardCell(st.Up(), cid, c)
+		_ = sendEnd(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, endReasonFor(err), err.Error())
 		return err
 	}
+	return uc.acknowledge(st, cid, sid)
+}
+
+// acknowledge counts a DATA cell handed to the stream and sends SENDME cells
+// back to the client when a window is due. It runs after the write, so a
+// target that stops reading also stops the client.
+func (uc *handleDataUseCaseImpl) acknowledge(st *entity.ConnState, cid vo.CircuitID, sid vo.StreamID) error {
+	if w, ok := st.StreamWindow(sid); ok {
+		due, err := w.Deliver()
+		if err != nil {
+			return fmt.Errorf("stream window cid=%s sid=%d: %w", cid.String(), sid.UInt16(), err)
+		}
+		if due {
+			if err := sendSendme(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid); err != nil {
+				return err
+			}
+		}
+	}
+	due, err := st.Window().Deliver()
+	if err != nil {
+		return fmt.Errorf("circuit window cid=%s: %w", cid.String(), err)
+	}
+	if due {
+		return sendSendme(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, 0)
+	}
 	return nil
 }
+
+// backward adds our encryption layer to a cell heading back to the client.
+// Only the client can open it, so relays never try to decrypt it.
+func (uc *handleDataUseCaseImpl) backward(st *entity.ConnState, cid vo.CircuitID, p *service.DataPayloadDTO) error {
+	return forwardBackward(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, vo.CmdData, p)
+}
+
+// forwardBackward adds our encryption layer to the payload of a cmd cell
+// from downstream and passes it on towards the client.
+func forwardBackward(cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService, st *entity.ConnState, cid vo.CircuitID, cmd vo.CellCommand, p *service.DataPayloadDTO) error {
+	st.LockSend()
+	defer st.UnlockSend()
+	nonce := st.UpstreamDataNonce()
+	log.Printf("upstream encrypt layer cid=%s nonce=%x", cid.String(), nonce)
+	enc, err := cSvc.AESCTR(st.Key(vo.DirectionBackward), nonce, p.Data)
+	if err != nil {
+		log.Printf("upstream encryption failed cid=%s error=%v", cid.String(), err)
+		return err
+	}
+	linkVer := entity.LinkVersion(st.Up())
+	payload, err := peSvc.ForVersion(linkVer).EncodeDataPayload(&service.DataPayloadDTO{StreamID: p.StreamID, Data: enc})
+	if err != nil {
+		return err
+	}
+	return csSvc.ForwardCell(st.Up(), cid, &entity.Cell{Cmd: cmd, Version: linkVer, Payload: payload})
+}
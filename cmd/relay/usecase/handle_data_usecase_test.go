@@ -27,8 +27,10 @@ func TestHandleDataUseCase_DataForwardMiddle(t *testing.T) {
 	up1, _ := net.Pipe()
 	down1, down2 := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, down1)
+	st := entity.NewConnState(key, key, nonce, up1, down1)
 	csRepo.Add(cid, st)
+	out := vo.NewCircuitID()
+	csRepo.AddOutbound(cid, out)
 
 	// Mock ensureServeDown function
 	serveDownCalled := false
@@ -36,20 +38,26 @@ func TestHandleDataUseCase_DataForwardMiddle(t *testing.T) {
 		serveDownCalled = true
 	}
 
-	// Create data with one layer of encryption
-	plain := []byte("hello")
-	enc, _ := cSvc.AESSeal(key, nonce, plain)
+	// Create a cell addressed to the next hop, wrapped in our layer
+	nextKey, _ := vo.NewAESKey()
+	nextNonce, _ := vo.NewNonce()
+	body, _, _ := cSvc.SealRelayBody(nextKey, vo.DirectionForward, [32]byte{}, []byte("hello"))
+	plain, _ := cSvc.AESCTR(nextKey, nextNonce, body)
+	enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceData, 0), plain)
 	payload, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: 1, Data: enc})
 	cell := &entity.Cell{Cmd: vo.CmdData, Version: vo.ProtocolV1, Payload: payload}
 
 	errCh := make(chan error, 1)
-	go func() { errCh <- uc.Data(st, cid, cell, ensureServeDown) }()
+	go func() { errCh <- uc.Data(st, cid, cell, vo.DirectionForward, ensureServeDown) }()
 
-	// Should forward decrypted data downstream
+	// Should forward the next hop's ciphertext downstream
 	buf := make([]byte, 528)
 	if _, err := io.ReadFull(down2, buf); err != nil {
 		t.Fatalf("read forward: %v", err)
 	}
+	if !bytes.Equal(buf[:16], out.Bytes()) {
+		t.Errorf("forwarded with circuit ID %x, want downstream ID %s", buf[:16], out)
+	}
 	fwd, err := entity.Decode(buf[16:])
 	if err != nil {
 		t.Fatalf("decode forward: %v", err)
@@ -73,6 +81,9 @@ func TestHandleDataUseCase_DataForwardMiddle(t *testing.T) {
 	if err := <-errCh; err != nil {
 		t.Fatalf("data error: %v", err)
 	}
+	if st.Digest(vo.DirectionForward) != [32]byte{} {
+		t.Errorf("digest advanced for a cell addressed to another hop")
+	}
 
 	st.Up().Close()
 	st.Down().Close()
@@ -90,7 +101,7 @@ func TestHandleDataUseCase_DataExit(t *testing.T) {
 	cid := vo.NewCircuitID()
 	up1, _ := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, nil)
+	st := entity.NewConnState(key, key, nonce, up1, nil)
 	csRepo.Add(cid, st)
 
 	// Add stream connection
@@ -103,12 +114,13 @@ func TestHandleDataUseCase_DataExit(t *testing.T) {
 
 	// Create encrypted data
 	plain := []byte("hello")
-	enc, _ := cSvc.AESSeal(key, nonce, plain)
+	body, digest, _ := cSvc.SealRelayBody(key, vo.DirectionForward, [32]byte{}, plain)
+	enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceData, 0), body)
 	payload, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: sid.UInt16(), Data: enc})
 	cell := &entity.Cell{Cmd: vo.CmdData, Version: vo.ProtocolV1, Payload: payload}
 
 	errCh := make(chan error, 1)
-	go func() { errCh <- uc.Data(st, cid, cell, ensureServeDown) }()
+	go func() { errCh <- uc.Data(st, cid, cell, vo.DirectionForward, ensureServeDown) }()
 
 	// Should write decrypted data to local stream
 	out := make([]byte, len(plain))
@@ -122,6 +134,9 @@ func TestHandleDataUseCase_DataExit(t *testing.T) {
 	if err := <-errCh; err != nil {
 		t.Fatalf("data error: %v", err)
 	}
+	if st.Digest(vo.DirectionForward) != digest {
+		t.Errorf("forward digest not advanced")
+	}
 
 	st.Up().Close()
 	local1.Close()
@@ -141,7 +156,7 @@ func TestHandleDataUseCase_DataHidden(t *testing.T) {
 	up1, _ := net.Pipe()
 	down1, down2 := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, down1)
+	st := entity.NewConnState(key, key, nonce, up1, down1)
 	st.SetHidden(true)
 	csRepo.Add(cid, st)
 
@@ -150,12 +165,13 @@ func TestHandleDataUseCase_DataHidden(t *testing.T) {
 
 	// Create encrypted data
 	data := []byte("hello")
-	enc, _ := cSvc.AESSeal(key, nonce, data)
+	body, _, _ := cSvc.SealRelayBody(key, vo.DirectionForward, [32]byte{}, data)
+	enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceData, 0), body)
 	payload, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: 1, Data: enc})
 	cell := &entity.Cell{Cmd: vo.CmdData, Version: vo.ProtocolV1, Payload: payload}
 
 	errCh := make(chan error, 1)
-	go func() { errCh <- uc.Data(st, cid, cell, ensureServeDown) }()
+	go func() { errCh <- uc.Data(st, cid, cell, vo.DirectionForward, ensureServeDown) }()
 
 	// Should write decrypted data to downstream connection
 	out := make([]byte, len(data))
@@ -175,7 +191,7 @@ func TestHandleDataUseCase_DataHidden(t *testing.T) {
 	down2.Close()
 }
 
-func TestHandleDataUseCase_DataUpstream(t *testing.T) {
+func TestHandleDataUseCase_DataBackward(t *testing.T) {
 	csRepo := repository.NewConnStateRepository(time.Second)
 	cSvc := service.NewCryptoService()
 	csSvc := service.NewCellSenderService()
@@ -188,19 +204,19 @@ func TestHandleDataUseCase_DataUpstream(t *testing.T) {
 	up1, up2 := net.Pipe()
 	down1, _ := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, down1)
+	st := entity.NewConnState(key, key, nonce, up1, down1)
 	csRepo.Add(cid, st)
 
 	// Mock ensureServeDown function
 	ensureServeDown := func(st *entity.ConnState) {}
 
-	// Create data that fails decryption (simulating upstream data)
-	invalidData := []byte("invalid encrypted data")
-	payload, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: 1, Data: invalidData})
+	// Ciphertext from the exit; the middle relay must not try to open it
+	exitData := []byte("sealed by the exit")
+	payload, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: 1, Data: exitData})
 	cell := &entity.Cell{Cmd: vo.CmdData, Version: vo.ProtocolV1, Payload: payload}
 
 	errCh := make(chan error, 1)
-	go func() { errCh <- uc.Data(st, cid, cell, ensureServeDown) }()
+	go func() { errCh <- uc.Data(st, cid, cell, vo.DirectionBackward, ensureServeDown) }()
 
 	// Should add encryption layer and forward upstream
 	buf := make([]byte, 16+entity.MaxCellSize)
@@ -215,11 +231,162 @@ func TestHandleDataUseCase_DataUpstream(t *testing.T) {
 	if fwd.Cmd != vo.CmdData {
 		t.Fatalf("cmd %d", fwd.Cmd)
 	}
+	dp, err := peSvc.DecodeDataPayload(fwd.Payload)
+	if err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	inner, err := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceUpstream, 0), dp.Data)
+	if err != nil || !bytes.Equal(inner, exitData) {
+		t.Fatalf("layer mismatch: %q, %v", inner, err)
+	}
 
 	if err := <-errCh; err != nil {
 		t.Fatalf("data error: %v", err)
 	}
+	if _, dataCounter := st.GetCounters(); dataCounter != 0 {
+		t.Errorf("backward cell consumed a forward nonce: counter=%d", dataCounter)
+	}
 
 	st.Up().Close()
 	st.Down().Close()
 }
+
+func TestHandleDataUseCase_DataUnrecognizedAtExit(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Second)
+	cSvc := service.NewCryptoService()
+	csSvc := service.NewCellSenderService()
+	peSvc := service.NewPayloadEncodingService()
+	uc := usecase.NewHandleDataUseCase(csRepo, cSvc, csSvc, peSvc)
+
+	key, _ := vo.NewAESKey()
+	otherKey, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, _ := net.Pipe()
+	defer up1.Close()
+
+	st := entity.NewConnState(key, key, nonce, up1, nil)
+	csRepo.Add(cid, st)
+
+	// The body is addressed to another hop, so the exit cannot recognize it
+	body, _, _ := cSvc.SealRelayBody(otherKey, vo.DirectionForward, [32]byte{}, []byte("hello"))
+	enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceData, 0), body)
+	payload, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: 1, Data: enc})
+	cell := &entity.Cell{Cmd: vo.CmdData, Version: vo.ProtocolV1, Payload: payload}
+
+	if err := uc.Data(st, cid, cell, vo.DirectionForward, func(*entity.ConnState) {}); err == nil {
+		t.Fatal("expected error for unrecognized cell at last hop")
+	}
+}
+
+func TestHandleDataUseCase_ExitSendsSendme(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Second)
+	cSvc := service.NewCryptoService()
+	csSvc := service.NewCellSenderService()
+	crSvc := service.NewCellReaderService()
+	peSvc := service.NewPayloadEncodingService()
+	uc := usecase.NewHandleDataUseCase(csRepo, cSvc, csSvc, peSvc)
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, up2 := net.Pipe()
+	defer up2.Close()
+
+	st := entity.NewConnState(key, key, nonce, up1, nil)
+	csRepo.Add(cid, st)
+	sid, _ := vo.StreamIDFrom(1)
+	local1, local2 := net.Pipe()
+	defer local2.Close()
+	csRepo.AddStream(cid, sid, local1)
+	st.OpenStreamWindow(sid)
+	go io.Copy(io.Discard, local2)
+
+	sendmes := make(chan uint16, 8)
+	go func() {
+		for {
+			_, cell, err := crSvc.ReadCell(up2)
+			if err != nil {
+				close(sendmes)
+				return
+			}
+			if cell.Cmd != vo.CmdSendme {
+				continue
+			}
+			p, err := peSvc.DecodeDataPayload(cell.Payload)
+			if err == nil {
+				sendmes <- p.StreamID
+			}
+		}
+	}()
+
+	// the client side of the hop, to produce matching nonces and digests
+	client := entity.NewConnState(key, key, nonce, nil, nil)
+	var digest [32]byte
+	for i := 0; i < entity.CircuitWindowIncrement; i++ {
+		body, d, _ := cSvc.SealRelayBody(key, vo.DirectionForward, digest, []byte("x"))
+		digest = d
+		enc, _ := cSvc.AESCTR(key, client.DataNonce(), body)
+		payload, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: sid.UInt16(), Data: enc})
+		cell := &entity.Cell{Cmd: vo.CmdData, Version: vo.ProtocolV1, Payload: payload}
+		if err := uc.Data(st, cid, cell, vo.DirectionForward, func(*entity.ConnState) {}); err != nil {
+			t.Fatalf("data %d: %v", i, err)
+		}
+	}
+	up1.Close()
+
+	var got []uint16
+	for s := range sendmes {
+		got = append(got, s)
+	}
+	want := []uint16{1, 1, 0} // stream SENDME every 50 cells, circuit SENDME after 100
+	if len(got) != len(want) {
+		t.Fatalf("sendmes = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("sendmes = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestHandleDataUseCase_UnknownStreamSendsEnd(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Second)
+	cSvc := service.NewCryptoService()
+	peSvc := service.NewPayloadEncodingService()
+	uc := usecase.NewHandleDataUseCase(csRepo, cSvc, service.NewCellSenderService(), peSvc)
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, up2 := net.Pipe()
+	defer up2.Close()
+	st := entity.NewConnState(key, key, nonce, up1, nil)
+	csRepo.Add(cid, st)
+
+	body, _, _ := cSvc.SealRelayBody(key, vo.DirectionForward, [32]byte{}, []byte("late"))
+	enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceData, 0), body)
+	payload, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: 4, Data: enc})
+	cell := &entity.Cell{Cmd: vo.CmdData, Version: vo.ProtocolV1, Payload: payload}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- uc.Data(st, cid, cell, vo.DirectionForward, func(*entity.ConnState) {}) }()
+
+	_, reply, err := service.NewCellReaderService().ReadCell(up2)
+	if err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply.Cmd != vo.CmdEnd {
+		t.Fatalf("reply cmd = %s, want END", reply.Cmd)
+	}
+	sid, data := openUpstream(t, cSvc, peSvc, entity.NewConnState(key, key, nonce, nil, nil), reply)
+	if sid != 4 || vo.EndReasonFrom(data) != vo.EndReasonProtocol {
+		t.Errorf("END sid=%d reason=%s, want sid=4 reason=%s", sid, vo.EndReasonFrom(data), vo.EndReasonProtocol)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("data: %v", err)
+	}
+	if _, err := csRepo.Find(cid); err != nil {
+		t.Errorf("circuit torn down for an unknown stream: %v", err)
+	}
+}
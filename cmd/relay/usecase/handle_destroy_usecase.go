@@ -1,6 +1,9 @@
 package usecase
 
 import (
+	"log"
+	"net"
+
 	"ikedadada/go-ptor/shared/domain/entity"
 	"ikedadada/go-ptor/shared/domain/repository"
 	vo "ikedadada/go-ptor/shared/domain/value_object"
@@ -9,28 +12,41 @@ import (
 
 // HandleDestroyUseCase handles circuit destruction operations
 type HandleDestroyUseCase interface {
-	// Destroy destroys a circuit
-	Destroy(st *entity.ConnState, cid vo.CircuitID) error
+	// Destroy destroys a circuit and passes the DESTROY on in dir. The
+	// cell's reason and detail travel with it unchanged.
+	Destroy(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, dir vo.Direction) error
 }
 
 type handleDestroyUseCaseImpl struct {
-	csRepo repository.ConnStateRepository
+	csRepo repository.RelayConnStateRepository
 	csSvc  service.CellSenderService
 }
 
 // NewHandleDestroyUseCase creates a new destroy use case
-func NewHandleDestroyUseCase(csRepo repository.ConnStateRepository, csSvc service.CellSenderService) HandleDestroyUseCase {
+func NewHandleDestroyUseCase(csRepo repository.RelayConnStateRepository, csSvc service.CellSenderService) HandleDestroyUseCase {
 	return &handleDestroyUseCaseImpl{
 		csRepo: csRepo,
 		csSvc:  csSvc,
 	}
 }
 
-func (uc *handleDestroyUseCaseImpl) Destroy(st *entity.ConnState, cid vo.CircuitID) error {
-	if st.Down() != nil {
-		c := &entity.Cell{Cmd: vo.CmdDestroy, Version: vo.ProtocolV1}
-		_ = uc.csSvc.ForwardCell(st.Down(), cid, c)
+func (uc *handleDestroyUseCaseImpl) Destroy(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, dir vo.Direction) error {
+	log.Printf("destroy cid=%s reason=%s detail=%q", cid.String(), vo.EndReasonFrom(cell.Payload), vo.EndDetailFrom(cell.Payload))
+	if dir == vo.DirectionBackward {
+		c := &entity.Cell{Cmd: vo.CmdDestroy, Version: entity.LinkVersion(st.Up()), Payload: cell.Payload}
+		_ = sendToClient(uc.csSvc, st, cid, c)
+	} else if out, err := uc.csRepo.OutboundID(cid); err == nil && st.Down() != nil && !st.IsHidden() {
+		// the downstream side of a hidden exit is the service, not a relay
+		c := &entity.Cell{Cmd: vo.CmdDestroy, Version: entity.LinkVersion(st.Down()), Payload: cell.Payload}
+		_ = uc.csSvc.ForwardCell(st.Down(), out, c)
 	}
 	_ = uc.csRepo.Delete(cid)
 	return nil
 }
+
+// sendDestroy tears down the circuit on conn. Unlike END, DESTROY is never
+// onion encrypted, so the reason and detail are the whole payload.
+func sendDestroy(csSvc service.CellSenderService, conn net.Conn, cid vo.CircuitID, reason vo.EndReason, detail string) error {
+	c := &entity.Cell{Cmd: vo.CmdDestroy, Version: entity.LinkVersion(conn), Payload: reason.WithDetail(detail)}
+	return csSvc.ForwardCell(conn, cid, c)
+}
@@ -23,10 +23,11 @@ func TestHandleDestroyUseCase_Destroy(t *testing.T) {
 	cid := vo.NewCircuitID()
 	up1, _ := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, nil)
+	st := entity.NewConnState(key, key, nonce, up1, nil)
 	csRepo.Add(cid, st)
 
-	if err := uc.Destroy(st, cid); err != nil {
+	cell := &entity.Cell{Cmd: vo.CmdDestroy, Version: vo.ProtocolV1}
+	if err := uc.Destroy(st, cid, cell, vo.DirectionForward); err != nil {
 		t.Fatalf("destroy error: %v", err)
 	}
 
@@ -49,11 +50,15 @@ func TestHandleDestroyUseCase_DestroyWithDownstream(t *testing.T) {
 	up1, _ := net.Pipe()
 	down1, down2 := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, down1)
+	st := entity.NewConnState(key, key, nonce, up1, down1)
 	csRepo.Add(cid, st)
+	out := vo.NewCircuitID()
+	csRepo.AddOutbound(cid, out)
 
+	reason := vo.EndReasonInternal.WithDetail("shutting down")
+	cell := &entity.Cell{Cmd: vo.CmdDestroy, Version: vo.ProtocolV1, Payload: reason}
 	errCh := make(chan error, 1)
-	go func() { errCh <- uc.Destroy(st, cid) }()
+	go func() { errCh <- uc.Destroy(st, cid, cell, vo.DirectionForward) }()
 
 	// Should forward destroy cell downstream
 	buf := make([]byte, 528)
@@ -67,6 +72,9 @@ func TestHandleDestroyUseCase_DestroyWithDownstream(t *testing.T) {
 	if fwd.Cmd != vo.CmdDestroy {
 		t.Fatalf("cmd %d", fwd.Cmd)
 	}
+	if string(fwd.Payload) != string(reason) {
+		t.Errorf("forwarded payload %q, want %q", fwd.Payload, reason)
+	}
 
 	if err := <-errCh; err != nil {
 		t.Fatalf("destroy error: %v", err)
@@ -80,3 +88,45 @@ func TestHandleDestroyUseCase_DestroyWithDownstream(t *testing.T) {
 	st.Up().Close()
 	st.Down().Close()
 }
+
+func TestHandleDestroyUseCase_DestroyFromDownstream(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Second)
+	csSvc := service.NewCellSenderService()
+	uc := usecase.NewHandleDestroyUseCase(csRepo, csSvc)
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, up2 := net.Pipe()
+	down1, _ := net.Pipe()
+
+	st := entity.NewConnState(key, key, nonce, up1, down1)
+	csRepo.Add(cid, st)
+
+	cell := &entity.Cell{Cmd: vo.CmdDestroy, Version: vo.ProtocolV1, Payload: vo.EndReasonConnectRefused.Bytes()}
+	errCh := make(chan error, 1)
+	go func() { errCh <- uc.Destroy(st, cid, cell, vo.DirectionBackward) }()
+
+	// Should pass the destroy cell back towards the client
+	buf := make([]byte, 528)
+	if _, err := io.ReadFull(up2, buf); err != nil {
+		t.Fatalf("read upstream: %v", err)
+	}
+	fwd, err := entity.Decode(buf[16:])
+	if err != nil {
+		t.Fatalf("decode upstream: %v", err)
+	}
+	if fwd.Cmd != vo.CmdDestroy {
+		t.Fatalf("cmd %d", fwd.Cmd)
+	}
+	if got := vo.EndReasonFrom(fwd.Payload); got != vo.EndReasonConnectRefused {
+		t.Errorf("forwarded reason %s, want %s", got, vo.EndReasonConnectRefused)
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("destroy error: %v", err)
+	}
+	if _, err := csRepo.Find(cid); err == nil {
+		t.Errorf("circuit not deleted")
+	}
+}
@@ -1,6 +1,12 @@
 package usecase
 
 import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"syscall"
+
 	"ikedadada/go-ptor/shared/domain/entity"
 	"ikedadada/go-ptor/shared/domain/repository"
 	vo "ikedadada/go-ptor/shared/domain/value_object"
@@ -9,41 +15,54 @@ import (
 
 // HandleEndStreamUseCase handles stream termination operations
 type HandleEndStreamUseCase interface {
-	// EndStream terminates a stream
-	EndStream(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, ensureServeDown func(*entity.ConnState)) error
+	// EndStream terminates a stream. END cells travelling backward get our
+	// encryption layer and are passed on towards the client.
+	EndStream(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, dir vo.Direction, ensureServeDown func(*entity.ConnState)) error
 }
 
 type handleEndStreamUseCaseImpl struct {
-	csRepo repository.ConnStateRepository
+	csRepo repository.RelayConnStateRepository
+	cSvc   service.CryptoService
 	csSvc  service.CellSenderService
 	peSvc  service.PayloadEncodingService
 }
 
 // NewHandleEndStreamUseCase creates a new end stream use case
-func NewHandleEndStreamUseCase(csRepo repository.ConnStateRepository, csSvc service.CellSenderService, peSvc service.PayloadEncodingService) HandleEndStreamUseCase {
+func NewHandleEndStreamUseCase(csRepo repository.RelayConnStateRepository, cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService) HandleEndStreamUseCase {
 	return &handleEndStreamUseCaseImpl{
 		csRepo: csRepo,
+		cSvc:   cSvc,
 		csSvc:  csSvc,
 		peSvc:  peSvc,
 	}
 }
 
-func (uc *handleEndStreamUseCaseImpl) EndStream(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, ensureServeDown func(*entity.ConnState)) error {
+func (uc *handleEndStreamUseCaseImpl) EndStream(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, dir vo.Direction, ensureServeDown func(*entity.ConnState)) error {
+	if dir == vo.DirectionBackward {
+		p, err := uc.peSvc.ForVersion(cell.Version).DecodeDataPayload(cell.Payload)
+		if err != nil {
+			return err
+		}
+		return forwardBackward(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, vo.CmdEnd, p)
+	}
 	var p *service.DataPayloadDTO
 	var err error
 	if len(cell.Payload) > 0 {
-		p, err = uc.peSvc.DecodeDataPayload(cell.Payload)
+		p, err = uc.peSvc.ForVersion(cell.Version).DecodeDataPayload(cell.Payload)
 		if err != nil {
 			return err
 		}
 	} else {
 		p = &service.DataPayloadDTO{}
 	}
+	log.Printf("end cid=%s sid=%d reason=%s", cid.String(), p.StreamID, vo.EndReasonFrom(p.Data))
+	out, err := uc.csRepo.OutboundID(cid)
+	hasNext := err == nil && st.Down() != nil && !st.IsHidden()
 	if p.StreamID == 0 {
 		uc.csRepo.DestroyAllStreams(cid)
-		if st.Down() != nil {
+		if hasNext {
 			ensureServeDown(st)
-			_ = uc.csSvc.ForwardCell(st.Down(), cid, cell)
+			_ = uc.csSvc.ForwardCell(st.Down(), out, cell)
 		}
 		_ = uc.csRepo.Delete(cid)
 		return nil
@@ -53,9 +72,41 @@ func (uc *handleEndStreamUseCaseImpl) EndStream(st *entity.ConnState, cid vo.Cir
 		return err
 	}
 	_ = uc.csRepo.RemoveStream(cid, sid)
-	if st.Down() != nil {
+	if hasNext {
 		ensureServeDown(st)
-		return uc.csSvc.ForwardCell(st.Down(), cid, cell)
+		return uc.csSvc.ForwardCell(st.Down(), out, cell)
 	}
 	return nil
 }
+
+// sendEnd tells the client that stream sid ended and why. Stream ID zero
+// ends the whole circuit. The END is sealed like DATA, so the detail is
+// for the client only and no relay on the path can change the reason.
+func sendEnd(cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService, st *entity.ConnState, cid vo.CircuitID, sid vo.StreamID, reason vo.EndReason, detail string) error {
+	return sendUpstream(cSvc, csSvc, peSvc, st, cid, sid, vo.CmdEnd, reason.WithDetail(detail))
+}
+
+// endReasonFor classifies an error from checking a stream's target against
+// the exit policy, or from dialing, reading or writing its connection.
+func endReasonFor(err error) vo.EndReason {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF):
+		return vo.EndReasonDone
+	case errors.Is(err, errExitPolicy):
+		return vo.EndReasonExitPolicy
+	case errors.As(err, &dnsErr):
+		return vo.EndReasonResolveFailed
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return vo.EndReasonTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return vo.EndReasonConnectRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return vo.EndReasonConnReset
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return vo.EndReasonNoRoute
+	default:
+		return vo.EndReasonMisc
+	}
+}
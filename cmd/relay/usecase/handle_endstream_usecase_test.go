@@ -1,6 +1,7 @@
 package usecase_test
 
 import (
+	"bytes"
 	"io"
 	"net"
 	"testing"
@@ -13,18 +14,35 @@ import (
 	"ikedadada/go-ptor/shared/service"
 )
 
+// openUpstream opens a cell the relay sent back towards the client as the
+// client with the hop state client would.
+func openUpstream(t *testing.T, cSvc service.CryptoService, peSvc service.PayloadEncodingService, client *entity.ConnState, cell *entity.Cell) (uint16, []byte) {
+	t.Helper()
+	p, err := peSvc.DecodeDataPayload(cell.Payload)
+	if err != nil {
+		t.Fatalf("decode %s payload: %v", cell.Cmd, err)
+	}
+	dec, _ := cSvc.AESCTR(client.Key(vo.DirectionBackward), client.UpstreamDataNonce(), p.Data)
+	data, digest, ok := cSvc.OpenRelayBody(client.Key(vo.DirectionBackward), vo.DirectionBackward, client.Digest(vo.DirectionBackward), dec)
+	if !ok {
+		t.Fatalf("%s not sealed for the client", cell.Cmd)
+	}
+	client.SetDigest(vo.DirectionBackward, digest)
+	return p.StreamID, data
+}
+
 func TestHandleEndStreamUseCase_EndStreamSpecific(t *testing.T) {
 	csRepo := repository.NewConnStateRepository(time.Second)
 	csSvc := service.NewCellSenderService()
 	peSvc := service.NewPayloadEncodingService()
-	uc := usecase.NewHandleEndStreamUseCase(csRepo, csSvc, peSvc)
+	uc := usecase.NewHandleEndStreamUseCase(csRepo, service.NewCryptoService(), csSvc, peSvc)
 
 	key, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
 	cid := vo.NewCircuitID()
 	up1, _ := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, nil)
+	st := entity.NewConnState(key, key, nonce, up1, nil)
 	csRepo.Add(cid, st)
 
 	// Add a stream
@@ -39,7 +57,7 @@ func TestHandleEndStreamUseCase_EndStreamSpecific(t *testing.T) {
 	payload, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: sid.UInt16()})
 	cell := &entity.Cell{Cmd: vo.CmdEnd, Version: vo.ProtocolV1, Payload: payload}
 
-	if err := uc.EndStream(st, cid, cell, ensureServeDown); err != nil {
+	if err := uc.EndStream(st, cid, cell, vo.DirectionForward, ensureServeDown); err != nil {
 		t.Fatalf("end stream error: %v", err)
 	}
 
@@ -61,14 +79,14 @@ func TestHandleEndStreamUseCase_EndAllStreams(t *testing.T) {
 	csRepo := repository.NewConnStateRepository(time.Second)
 	csSvc := service.NewCellSenderService()
 	peSvc := service.NewPayloadEncodingService()
-	uc := usecase.NewHandleEndStreamUseCase(csRepo, csSvc, peSvc)
+	uc := usecase.NewHandleEndStreamUseCase(csRepo, service.NewCryptoService(), csSvc, peSvc)
 
 	key, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
 	cid := vo.NewCircuitID()
 	up1, _ := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, nil)
+	st := entity.NewConnState(key, key, nonce, up1, nil)
 	csRepo.Add(cid, st)
 
 	// Add multiple streams
@@ -85,7 +103,7 @@ func TestHandleEndStreamUseCase_EndAllStreams(t *testing.T) {
 	// End all streams (StreamID = 0)
 	cell := &entity.Cell{Cmd: vo.CmdEnd, Version: vo.ProtocolV1, Payload: []byte{}}
 
-	if err := uc.EndStream(st, cid, cell, ensureServeDown); err != nil {
+	if err := uc.EndStream(st, cid, cell, vo.DirectionForward, ensureServeDown); err != nil {
 		t.Fatalf("end stream error: %v", err)
 	}
 
@@ -107,7 +125,7 @@ func TestHandleEndStreamUseCase_EndStreamWithForward(t *testing.T) {
 	csRepo := repository.NewConnStateRepository(time.Second)
 	csSvc := service.NewCellSenderService()
 	peSvc := service.NewPayloadEncodingService()
-	uc := usecase.NewHandleEndStreamUseCase(csRepo, csSvc, peSvc)
+	uc := usecase.NewHandleEndStreamUseCase(csRepo, service.NewCryptoService(), csSvc, peSvc)
 
 	key, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
@@ -115,8 +133,10 @@ func TestHandleEndStreamUseCase_EndStreamWithForward(t *testing.T) {
 	up1, _ := net.Pipe()
 	down1, down2 := net.Pipe()
 
-	st := entity.NewConnState(key, nonce, up1, down1)
+	st := entity.NewConnState(key, key, nonce, up1, down1)
 	csRepo.Add(cid, st)
+	out := vo.NewCircuitID()
+	csRepo.AddOutbound(cid, out)
 
 	// Mock ensureServeDown function
 	serveDownCalled := false
@@ -130,7 +150,7 @@ func TestHandleEndStreamUseCase_EndStreamWithForward(t *testing.T) {
 	cell := &entity.Cell{Cmd: vo.CmdEnd, Version: vo.ProtocolV1, Payload: payload}
 
 	errCh := make(chan error, 1)
-	go func() { errCh <- uc.EndStream(st, cid, cell, ensureServeDown) }()
+	go func() { errCh <- uc.EndStream(st, cid, cell, vo.DirectionForward, ensureServeDown) }()
 
 	// Should forward cell downstream
 	buf := make([]byte, 528)
@@ -156,3 +176,61 @@ func TestHandleEndStreamUseCase_EndStreamWithForward(t *testing.T) {
 	st.Up().Close()
 	st.Down().Close()
 }
+
+func TestHandleEndStreamUseCase_EndStreamFromDownstream(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Second)
+	csSvc := service.NewCellSenderService()
+	peSvc := service.NewPayloadEncodingService()
+	uc := usecase.NewHandleEndStreamUseCase(csRepo, service.NewCryptoService(), csSvc, peSvc)
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, up2 := net.Pipe()
+	down1, _ := net.Pipe()
+
+	st := entity.NewConnState(key, key, nonce, up1, down1)
+	csRepo.Add(cid, st)
+
+	// END sent by the exit must go back towards the client with our layer
+	sealed := bytes.Repeat([]byte{0x5a}, service.RelayPayloadSize)
+	payload, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: 1, Data: sealed})
+	cell := &entity.Cell{Cmd: vo.CmdEnd, Version: vo.ProtocolV1, Payload: payload}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- uc.EndStream(st, cid, cell, vo.DirectionBackward, func(*entity.ConnState) {
+			t.Errorf("ensureServeDown called for backward END")
+		})
+	}()
+
+	buf := make([]byte, 528)
+	if _, err := io.ReadFull(up2, buf); err != nil {
+		t.Fatalf("read upstream: %v", err)
+	}
+	fwd, err := entity.Decode(buf[16:])
+	if err != nil {
+		t.Fatalf("decode upstream: %v", err)
+	}
+	if fwd.Cmd != vo.CmdEnd {
+		t.Fatalf("cmd %d", fwd.Cmd)
+	}
+	p, err := peSvc.DecodeDataPayload(fwd.Payload)
+	if err != nil {
+		t.Fatalf("decode end payload: %v", err)
+	}
+	want, _ := service.NewCryptoService().AESCTR(key, nonce.Sequence(vo.NonceSpaceUpstream, 0), sealed)
+	if p.StreamID != 1 || !bytes.Equal(p.Data, want) {
+		t.Errorf("END not passed on with our layer")
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("end stream error: %v", err)
+	}
+	if _, err := csRepo.Find(cid); err != nil {
+		t.Errorf("circuit state removed by backward END")
+	}
+
+	st.Up().Close()
+	st.Down().Close()
+}
@@ -1,9 +1,7 @@
 package usecase
 
 import (
-	"encoding/binary"
 	"errors"
-	"io"
 	"log"
 	"net"
 
@@ -17,31 +15,34 @@ import (
 type HandleExtendUseCase interface {
 	// Extend creates a new circuit hop
 	Extend(up net.Conn, cid vo.CircuitID, cell *entity.Cell) error
-	// ForwardExtend forwards extension to the next hop
-	ForwardExtend(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell) error
+	// ForwardExtend forwards extension to the next hop. The CREATED reply
+	// arrives on the downstream link and is relayed by its receive loop.
+	ForwardExtend(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, ensureServeDown func(*entity.ConnState)) error
 }
 
 type handleExtendUseCaseImpl struct {
 	priv   vo.PrivateKey
-	csRepo repository.ConnStateRepository
+	csRepo repository.RelayConnStateRepository
 	cSvc   service.CryptoService
 	csSvc  service.CellSenderService
 	peSvc  service.PayloadEncodingService
+	vnSvc  service.VersionNegotiationService
 }
 
 // NewHandleExtendUseCase creates a new extend use case
-func NewHandleExtendUseCase(priv vo.PrivateKey, csRepo repository.ConnStateRepository, cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService) HandleExtendUseCase {
+func NewHandleExtendUseCase(priv vo.PrivateKey, csRepo repository.RelayConnStateRepository, cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService, vnSvc service.VersionNegotiationService) HandleExtendUseCase {
 	return &handleExtendUseCaseImpl{
 		priv:   priv,
 		csRepo: csRepo,
 		cSvc:   cSvc,
 		csSvc:  csSvc,
 		peSvc:  peSvc,
+		vnSvc:  vnSvc,
 	}
 }
 
 func (uc *handleExtendUseCaseImpl) Extend(up net.Conn, cid vo.CircuitID, cell *entity.Cell) error {
-	p, err := uc.peSvc.DecodeExtendPayload(cell.Payload)
+	p, err := uc.peSvc.ForVersion(cell.Version).DecodeExtendPayload(cell.Payload)
 	if err != nil {
 		log.Printf("decode extend payload cid=%s err=%v", cid.String(), err)
 		return err
@@ -54,53 +55,65 @@ func (uc *handleExtendUseCaseImpl) Extend(up net.Conn, cid vo.CircuitID, cell *e
 	if err != nil {
 		return err
 	}
-	key, nonce, err := uc.cSvc.DeriveKeyNonce(secret)
+	fwdKey, bwdKey, nonce, err := uc.cSvc.DeriveHopKeys(secret)
 	if err != nil {
 		return err
 	}
+	auth, err := uc.cSvc.HandshakeAuth(uc.priv, p.ClientPub[:], relayPub)
+	if err != nil {
+		log.Printf("handshake auth cid=%s err=%v", cid.String(), err)
+		return err
+	}
 	var down net.Conn
 	if p.NextHop != "" {
-		down, err = net.Dial("tcp", p.NextHop)
+		down, err = uc.vnSvc.Dial(p.NextHop)
 		if err != nil {
 			log.Printf("dial next hop cid=%s hop=%s err=%v", cid.String(), p.NextHop, err)
+			_ = sendDestroy(uc.csSvc, up, cid, endReasonFor(err), err.Error())
 			return err
 		}
 	}
-	st := entity.NewConnState(key, nonce, up, down)
+	st := entity.NewConnState(fwdKey, bwdKey, nonce, up, down)
+	// the client encodes BEGIN and CONNECT for us in the version both of
+	// our advertisements lead to
+	st.SetPayloadVersion(vo.EndToEndVersion(p.MaxVersion))
 	if err := uc.csRepo.Add(cid, st); err != nil {
 		return err
 	}
 	if down != nil {
-		// ServeConn will be started when the next downstream-forwarding command arrives
+		// The next hop sees a fresh ID, so relays on either side of us
+		// cannot match the circuit by its ID. ServeConn will be started
+		// when the next downstream-forwarding command arrives.
+		if err := uc.csRepo.AddOutbound(cid, vo.NewCircuitID()); err != nil {
+			_ = uc.csRepo.Delete(cid)
+			return err
+		}
 	}
-	createdPayload, err := uc.peSvc.EncodeCreatedPayload(&service.CreatedPayloadDTO{RelayPub: to32(relayPub)})
+	createdPayload, err := uc.peSvc.ForVersion(entity.LinkVersion(up)).EncodeCreatedPayload(&service.CreatedPayloadDTO{
+		RelayPub:   to32(relayPub),
+		Auth:       auth,
+		MaxVersion: vo.ProtocolLatest,
+	})
 	if err != nil {
 		return err
 	}
 	return uc.csSvc.SendCreated(up, cid, createdPayload)
 }
 
-func (uc *handleExtendUseCaseImpl) ForwardExtend(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell) error {
+func (uc *handleExtendUseCaseImpl) ForwardExtend(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, ensureServeDown func(*entity.ConnState)) error {
 	if st.Down() == nil {
 		return errors.New("no downstream connection")
 	}
-	if err := uc.csSvc.ForwardCell(st.Down(), cid, cell); err != nil {
-		log.Printf("forward extend cid=%s err=%v", cid.String(), err)
-		return err
-	}
-	var hdr [20]byte
-	if _, err := io.ReadFull(st.Down(), hdr[:]); err != nil {
+	out, err := uc.csRepo.OutboundID(cid)
+	if err != nil {
 		return err
 	}
-	l := binary.BigEndian.Uint16(hdr[18:20])
-	if l == 0 {
-		return errors.New("malformed created payload")
-	}
-	payload := make([]byte, l)
-	if _, err := io.ReadFull(st.Down(), payload); err != nil {
+	ensureServeDown(st)
+	if err := uc.csSvc.ForwardCell(st.Down(), out, cell); err != nil {
+		log.Printf("forward extend cid=%s err=%v", cid.String(), err)
 		return err
 	}
-	return uc.csSvc.SendCreated(st.Up(), cid, payload)
+	return nil
 }
 
 func to32(b []byte) [32]byte {
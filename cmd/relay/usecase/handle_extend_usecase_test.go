@@ -3,7 +3,6 @@ package usecase_test
 import (
 	"crypto/rand"
 	"crypto/rsa"
-	"encoding/binary"
 	"io"
 	"net"
 	"testing"
@@ -23,13 +22,25 @@ func TestHandleExtendUseCase_Extend(t *testing.T) {
 	cSvc := service.NewCryptoService()
 	csSvc := service.NewCellSenderService()
 	peSvc := service.NewPayloadEncodingService()
-	uc := usecase.NewHandleExtendUseCase(priv, csRepo, cSvc, csSvc, peSvc)
+	uc := usecase.NewHandleExtendUseCase(priv, csRepo, cSvc, csSvc, peSvc, service.NewVersionNegotiationService())
 
 	// prepare extend cell
 	_, pub, _ := cSvc.X25519Generate()
 	ln, _ := net.Listen("tcp", "127.0.0.1:0")
 	defer ln.Close()
-	go func() { ln.Accept() }()
+	nextLink := make(chan *entity.Link, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, versions, err := service.NewCellReaderService().ReadCell(c)
+		if err != nil {
+			return
+		}
+		link, _ := service.NewVersionNegotiationService().Respond(c, versions)
+		nextLink <- link
+	}()
 	var pubArr [32]byte
 	copy(pubArr[:], pub)
 	payload, _ := peSvc.EncodeExtendPayload(&service.ExtendPayloadDTO{NextHop: ln.Addr().String(), ClientPub: pubArr})
@@ -40,26 +51,30 @@ func TestHandleExtendUseCase_Extend(t *testing.T) {
 	errCh := make(chan error, 1)
 	go func() { errCh <- uc.Extend(up1, cid, cell) }()
 
-	// Read created response
-	hdr := make([]byte, 20)
-	if _, err := io.ReadFull(up2, hdr); err != nil {
-		t.Fatalf("read header: %v", err)
+	// Read created response as a regular cell
+	gotCID, resp, err := service.NewCellReaderService().ReadCell(up2)
+	if err != nil {
+		t.Fatalf("read created: %v", err)
+	}
+	if !gotCID.Equal(cid) {
+		t.Fatalf("created cid %s, want %s", gotCID, cid)
 	}
-	if vo.CellCommand(hdr[16]) != vo.CmdCreated {
-		t.Fatalf("created cmd %d", hdr[16])
+	if resp.Cmd != vo.CmdCreated {
+		t.Fatalf("created cmd %d", resp.Cmd)
 	}
-	if hdr[17] != byte(vo.ProtocolV1) {
-		t.Fatalf("created version %d", hdr[17])
+	if resp.Version != vo.ProtocolV1 {
+		t.Fatalf("created version %d", resp.Version)
 	}
-	l := binary.BigEndian.Uint16(hdr[18:20])
-	body := make([]byte, l)
-	if _, err := io.ReadFull(up2, body); err != nil {
-		t.Fatalf("read body: %v", err)
+	created, err := peSvc.DecodeCreatedPayload(resp.Payload)
+	if err != nil {
+		t.Fatalf("decode created: %v", err)
+	}
+	if err := cSvc.VerifyHandshakeAuth(priv.PublicKey().(vo.RSAPubKey), pub, created.RelayPub[:], created.Auth); err != nil {
+		t.Fatalf("created auth does not verify against relay identity: %v", err)
 	}
 
 	// ensure entry created with retry
 	var st *entity.ConnState
-	var err error
 	timeout := time.After(100 * time.Millisecond)
 	ticker := time.NewTicker(5 * time.Millisecond)
 	defer ticker.Stop()
@@ -76,6 +91,22 @@ func TestHandleExtendUseCase_Extend(t *testing.T) {
 		}
 	}
 found:
+	out, err := csRepo.OutboundID(cid)
+	if err != nil {
+		t.Fatalf("no downstream circuit ID: %v", err)
+	}
+	if out.Equal(cid) {
+		t.Error("downstream link reuses the upstream circuit ID")
+	}
+	if in, err := csRepo.InboundID(st.Down(), out); err != nil || !in.Equal(cid) {
+		t.Errorf("InboundID(%s) = %s, %v; want %s", out, in, err, cid)
+	}
+	if entity.LinkVersion(st.Down()) != vo.ProtocolLatest {
+		t.Errorf("downstream link version = %v, want %v", entity.LinkVersion(st.Down()), vo.ProtocolLatest)
+	}
+	if link := <-nextLink; link == nil || link.Version() != vo.ProtocolLatest {
+		t.Errorf("next hop did not negotiate %v", vo.ProtocolLatest)
+	}
 	if st.Down() != nil {
 		st.Down().Close()
 	}
@@ -93,16 +124,21 @@ func TestHandleExtendUseCase_ForwardExtend(t *testing.T) {
 	cSvc := service.NewCryptoService()
 	csSvc := service.NewCellSenderService()
 	peSvc := service.NewPayloadEncodingService()
-	uc := usecase.NewHandleExtendUseCase(priv, csRepo, cSvc, csSvc, peSvc)
+	uc := usecase.NewHandleExtendUseCase(priv, csRepo, cSvc, csSvc, peSvc, service.NewVersionNegotiationService())
 
 	key, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
 	cid := vo.NewCircuitID()
 	up1, up2 := net.Pipe()
 	down1, down2 := net.Pipe()
+	defer up1.Close()
+	defer up2.Close()
+	defer down1.Close()
 
-	st := entity.NewConnState(key, nonce, up1, down1)
+	st := entity.NewConnState(key, key, nonce, up1, down1)
 	csRepo.Add(cid, st)
+	out := vo.NewCircuitID()
+	csRepo.AddOutbound(cid, out)
 
 	_, pub, _ := cSvc.X25519Generate()
 	var pubArr [32]byte
@@ -110,8 +146,11 @@ func TestHandleExtendUseCase_ForwardExtend(t *testing.T) {
 	payload, _ := peSvc.EncodeExtendPayload(&service.ExtendPayloadDTO{ClientPub: pubArr})
 	cell := &entity.Cell{Cmd: vo.CmdExtend, Version: vo.ProtocolV1, Payload: payload}
 
+	served := false
 	errCh := make(chan error, 1)
-	go func() { errCh <- uc.ForwardExtend(st, cid, cell) }()
+	go func() {
+		errCh <- uc.ForwardExtend(st, cid, cell, func(*entity.ConnState) { served = true })
+	}()
 
 	// Should forward the extend cell downstream
 	fwd := make([]byte, 528)
@@ -122,35 +161,164 @@ func TestHandleExtendUseCase_ForwardExtend(t *testing.T) {
 		t.Fatalf("forwarded cmd %d", fwd[16])
 	}
 
-	// Send back created response
-	created, _ := peSvc.EncodeCreatedPayload(&service.CreatedPayloadDTO{RelayPub: pubArr})
-	var hdr [20]byte
-	copy(hdr[:16], cid.Bytes())
-	binary.BigEndian.PutUint16(hdr[18:20], uint16(len(created)))
-	down2.Write(hdr[:])
-	down2.Write(created)
+	// ForwardExtend must not wait for CREATED on the downstream link
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("forward extend error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ForwardExtend blocked waiting for CREATED")
+	}
+	if !served {
+		t.Error("downstream receive loop was not started")
+	}
+	down2.Close()
+}
 
-	// Should forward created response upstream
-	var respHdr [20]byte
-	if _, err := io.ReadFull(up2, respHdr[:]); err != nil {
-		t.Fatalf("read created hdr: %v", err)
+func TestHandleExtendUseCase_ForwardExtend_MixedVersions(t *testing.T) {
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	priv := vo.NewRSAPrivKey(rawKey)
+	csRepo := repository.NewConnStateRepository(time.Second)
+	cSvc := service.NewCryptoService()
+	csSvc := service.NewCellSenderService()
+	peSvc := service.NewPayloadEncodingService()
+	uc := usecase.NewHandleExtendUseCase(priv, csRepo, cSvc, csSvc, peSvc, service.NewVersionNegotiationService())
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, _ := net.Pipe()
+	down1, down2 := net.Pipe()
+	defer up1.Close()
+	defer down1.Close()
+
+	// legacy client upstream, v2 relay downstream
+	st := entity.NewConnState(key, key, nonce, up1, entity.NewLink(down1, vo.ProtocolV2))
+	csRepo.Add(cid, st)
+	out := vo.NewCircuitID()
+	csRepo.AddOutbound(cid, out)
+
+	ext := &service.ExtendPayloadDTO{NextHop: "relay3:5000", ClientPub: [32]byte{7}, MaxVersion: vo.ProtocolV2}
+	payload, _ := peSvc.EncodeExtendPayload(ext)
+	cell := &entity.Cell{Cmd: vo.CmdExtend, Version: vo.ProtocolV1, Payload: payload}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- uc.ForwardExtend(st, cid, cell, func(*entity.ConnState) {}) }()
+
+	fcid, fc, err := service.NewCellReaderService().ReadCell(down2)
+	if err != nil {
+		t.Fatalf("read forward: %v", err)
 	}
-	if vo.CellCommand(respHdr[16]) != vo.CmdCreated {
-		t.Fatalf("created cmd %d", respHdr[16])
+	if fcid != out {
+		t.Errorf("forwarded with circuit ID %s, want downstream ID %s", fcid, out)
 	}
-	if respHdr[17] != byte(vo.ProtocolV1) {
-		t.Fatalf("created version %d", respHdr[17])
+	if fc.Version != vo.ProtocolV2 {
+		t.Fatalf("forwarded version %v, want v2", fc.Version)
 	}
-	l := binary.BigEndian.Uint16(respHdr[18:20])
-	resp := make([]byte, l)
-	if _, err := io.ReadFull(up2, resp); err != nil {
-		t.Fatalf("read created body: %v", err)
+	got, err := peSvc.ForVersion(vo.ProtocolV2).DecodeExtendPayload(fc.Payload)
+	if err != nil || *got != *ext {
+		t.Fatalf("forwarded extend = %+v, %v", got, err)
 	}
-
 	if err := <-errCh; err != nil {
 		t.Fatalf("forward extend error: %v", err)
 	}
+}
 
-	st.Up().Close()
-	st.Down().Close()
+func TestHandleExtendUseCase_Extend_PayloadVersion(t *testing.T) {
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	cSvc := service.NewCryptoService()
+	peSvc := service.NewPayloadEncodingService()
+
+	tests := []struct {
+		name   string
+		client vo.ProtocolVersion
+		want   vo.ProtocolVersion
+	}{
+		{"client predating MaxVersion", 0, vo.ProtocolV1},
+		{"v1 client", vo.ProtocolV1, vo.ProtocolV1},
+		{"v2 client", vo.ProtocolV2, vo.ProtocolV2},
+		{"newer client", 0x07, vo.ProtocolLatest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csRepo := repository.NewConnStateRepository(time.Second)
+			uc := usecase.NewHandleExtendUseCase(vo.NewRSAPrivKey(rawKey), csRepo, cSvc, service.NewCellSenderService(), peSvc, service.NewVersionNegotiationService())
+			_, pub, _ := cSvc.X25519Generate()
+			var pubArr [32]byte
+			copy(pubArr[:], pub)
+			payload, _ := peSvc.EncodeExtendPayload(&service.ExtendPayloadDTO{ClientPub: pubArr, MaxVersion: tt.client})
+			cid := vo.NewCircuitID()
+
+			up1, up2 := net.Pipe()
+			defer up2.Close()
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- uc.Extend(up1, cid, &entity.Cell{Cmd: vo.CmdExtend, Version: vo.ProtocolV1, Payload: payload})
+			}()
+			_, resp, err := service.NewCellReaderService().ReadCell(up2)
+			if err != nil {
+				t.Fatalf("read created: %v", err)
+			}
+			if created, err := peSvc.DecodeCreatedPayload(resp.Payload); err != nil || created.MaxVersion != vo.ProtocolLatest {
+				t.Fatalf("created = %+v, %v; want MaxVersion %v", created, err, vo.ProtocolLatest)
+			}
+			if err := <-errCh; err != nil {
+				t.Fatalf("extend: %v", err)
+			}
+			st, err := csRepo.Find(cid)
+			if err != nil {
+				t.Fatalf("find: %v", err)
+			}
+			if got := st.PayloadVersion(); got != tt.want {
+				t.Errorf("payload version = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleExtendUseCase_DialFailureSendsDestroy(t *testing.T) {
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	csRepo := repository.NewConnStateRepository(time.Second)
+	cSvc := service.NewCryptoService()
+	peSvc := service.NewPayloadEncodingService()
+	uc := usecase.NewHandleExtendUseCase(vo.NewRSAPrivKey(rawKey), csRepo, cSvc, service.NewCellSenderService(), peSvc, service.NewVersionNegotiationService())
+
+	// nothing listens on a port that was just released
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	hop := ln.Addr().String()
+	ln.Close()
+
+	_, pub, _ := cSvc.X25519Generate()
+	var pubArr [32]byte
+	copy(pubArr[:], pub)
+	payload, _ := peSvc.EncodeExtendPayload(&service.ExtendPayloadDTO{NextHop: hop, ClientPub: pubArr})
+	cid := vo.NewCircuitID()
+
+	up1, up2 := net.Pipe()
+	defer up2.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- uc.Extend(up1, cid, &entity.Cell{Cmd: vo.CmdExtend, Version: vo.ProtocolV1, Payload: payload})
+	}()
+
+	_, reply, err := service.NewCellReaderService().ReadCell(up2)
+	if err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply.Cmd != vo.CmdDestroy {
+		t.Fatalf("reply cmd = %s, want DESTROY", reply.Cmd)
+	}
+	if got := vo.EndReasonFrom(reply.Payload); got != vo.EndReasonConnectRefused {
+		t.Errorf("destroy reason = %s, want %s", got, vo.EndReasonConnectRefused)
+	}
+	if vo.EndDetailFrom(reply.Payload) == "" {
+		t.Error("destroy carries no detail")
+	}
+	if err := <-errCh; err == nil {
+		t.Error("expected dial error")
+	}
 }
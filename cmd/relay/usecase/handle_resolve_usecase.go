@@ -0,0 +1,122 @@
+package usecase
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	"ikedadada/go-ptor/shared/domain/repository"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+// HandleResolveUseCase handles host name lookups the client asks the exit
+// for, so names are resolved at the exit without opening a stream.
+type HandleResolveUseCase interface {
+	// Resolve looks up the host name of a RESOLVE cell and answers with
+	// RESOLVED, or with END RESOLVEFAILED if it has no address.
+	Resolve(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, ensureServeDown func(*entity.ConnState)) error
+	// Resolved passes a RESOLVED cell from downstream on towards the client
+	Resolved(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell) error
+}
+
+type handleResolveUseCaseImpl struct {
+	csRepo    repository.RelayConnStateRepository
+	cacheRepo repository.ResolveCacheRepository
+	cSvc      service.CryptoService
+	csSvc     service.CellSenderService
+	peSvc     service.PayloadEncodingService
+	rSvc      service.DNSResolverService
+}
+
+// NewHandleResolveUseCase creates a new resolve use case. Answers are kept
+// in cacheRepo for as long as their TTLs allow.
+func NewHandleResolveUseCase(csRepo repository.RelayConnStateRepository, cacheRepo repository.ResolveCacheRepository, cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService, rSvc service.DNSResolverService) HandleResolveUseCase {
+	return &handleResolveUseCaseImpl{
+		csRepo:    csRepo,
+		cacheRepo: cacheRepo,
+		cSvc:      cSvc,
+		csSvc:     csSvc,
+		peSvc:     peSvc,
+		rSvc:      rSvc,
+	}
+}
+
+func (uc *handleResolveUseCaseImpl) Resolve(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, ensureServeDown func(*entity.ConnState)) error {
+	// RESOLVE is encrypted like BEGIN
+	dec, err := uc.cSvc.AESCTR(st.Key(vo.DirectionForward), st.BeginNonce(), cell.Payload)
+	if err != nil {
+		return fmt.Errorf("AESCTR resolve cid=%s: %w", cid.String(), err)
+	}
+	body, digest, recognized := uc.cSvc.OpenRelayBody(st.Key(vo.DirectionForward), vo.DirectionForward, st.Digest(vo.DirectionForward), dec)
+	if !recognized {
+		// not for us: forward the remaining layers downstream
+		if st.Down() == nil || st.IsHidden() {
+			return fmt.Errorf("unrecognized resolve cell at last hop cid=%s", cid.String())
+		}
+		ensureServeDown(st)
+		c := &entity.Cell{Cmd: vo.CmdResolve, Version: entity.LinkVersion(st.Down()), Payload: dec}
+		out, err := uc.csRepo.OutboundID(cid)
+		if err != nil {
+			return err
+		}
+		return uc.csSvc.ForwardCell(st.Down(), out, c)
+	}
+	st.SetDigest(vo.DirectionForward, digest)
+
+	p, err := uc.peSvc.ForVersion(st.PayloadVersion()).DecodeBeginPayload(body)
+	if err != nil {
+		return err
+	}
+	sid, err := vo.StreamIDFrom(p.StreamID)
+	if err != nil {
+		return err
+	}
+	if st.IsHidden() {
+		return sendEnd(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, vo.EndReasonExitPolicy, "hidden services do not resolve")
+	}
+	// the lookup may take a while; keep serving the circuit meanwhile
+	go uc.answer(st, cid, sid, p.Target)
+	return nil
+}
+
+// answer looks host up, from the cache if it can, and sends the result back
+// to the client.
+func (uc *handleResolveUseCaseImpl) answer(st *entity.ConnState, cid vo.CircuitID, sid vo.StreamID, host string) {
+	answers, err := uc.lookup(host)
+	if err != nil {
+		log.Printf("resolve cid=%s sid=%d host=%q: %v", cid.String(), sid.UInt16(), host, err)
+		// the error names the host; sendEnd seals it for the client alone
+		_ = sendEnd(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, vo.EndReasonResolveFailed, err.Error())
+		return
+	}
+	log.Printf("resolved cid=%s sid=%d host=%q answers=%d", cid.String(), sid.UInt16(), host, len(answers))
+	data := vo.ResolvedBytes(answers, service.MaxRelayDataSize)
+	if err := sendUpstream(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, vo.CmdResolved, data); err != nil {
+		log.Printf("send resolved cid=%s sid=%d: %v", cid.String(), sid.UInt16(), err)
+	}
+}
+
+func (uc *handleResolveUseCaseImpl) lookup(host string) ([]vo.ResolvedAnswer, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []vo.ResolvedAnswer{{IP: ip}}, nil
+	}
+	if answers, ok := uc.cacheRepo.Get(host); ok {
+		return answers, nil
+	}
+	answers, err := uc.rSvc.Resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	uc.cacheRepo.Put(host, answers)
+	return answers, nil
+}
+
+func (uc *handleResolveUseCaseImpl) Resolved(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell) error {
+	p, err := uc.peSvc.ForVersion(cell.Version).DecodeDataPayload(cell.Payload)
+	if err != nil {
+		return err
+	}
+	return forwardBackward(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, vo.CmdResolved, p)
+}
@@ -0,0 +1,150 @@
+package usecase_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"ikedadada/go-ptor/cmd/relay/infrastructure/repository"
+	"ikedadada/go-ptor/cmd/relay/usecase"
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+type mockDNSResolverService struct {
+	answers []vo.ResolvedAnswer
+	err     error
+	calls   int
+}
+
+func (m *mockDNSResolverService) Resolve(host string) ([]vo.ResolvedAnswer, error) {
+	m.calls++
+	return m.answers, m.err
+}
+
+// resolveCell returns a RESOLVE cell for host as the client with the hop
+// state client would send it.
+func resolveCell(t *testing.T, cSvc service.CryptoService, peSvc service.PayloadEncodingService, client *entity.ConnState, sid uint16, host string) *entity.Cell {
+	t.Helper()
+	plain, _ := peSvc.EncodeBeginPayload(&service.BeginPayloadDTO{StreamID: sid, Target: host})
+	body, digest, err := cSvc.SealRelayBody(client.Key(vo.DirectionForward), vo.DirectionForward, client.Digest(vo.DirectionForward), plain)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	client.SetDigest(vo.DirectionForward, digest)
+	enc, _ := cSvc.AESCTR(client.Key(vo.DirectionForward), client.BeginNonce(), body)
+	return &entity.Cell{Cmd: vo.CmdResolve, Version: vo.ProtocolV1, Payload: enc}
+}
+
+// readResolved reads the answer to a RESOLVE from up and opens it as the
+// client would.
+func readResolved(t *testing.T, cSvc service.CryptoService, peSvc service.PayloadEncodingService, client *entity.ConnState, up net.Conn) (vo.CellCommand, uint16, []byte) {
+	t.Helper()
+	_, cell, err := service.NewCellReaderService().ReadCell(up)
+	if err != nil {
+		t.Fatalf("read answer: %v", err)
+	}
+	sid, data := openUpstream(t, cSvc, peSvc, client, cell)
+	return cell.Cmd, sid, data
+}
+
+func TestHandleResolveUseCase_AnswersFromCache(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Minute)
+	cSvc := service.NewCryptoService()
+	peSvc := service.NewPayloadEncodingService()
+	rSvc := &mockDNSResolverService{answers: []vo.ResolvedAnswer{{IP: net.IPv4(192, 0, 2, 1), TTL: time.Hour}}}
+	uc := usecase.NewHandleResolveUseCase(csRepo, repository.NewResolveCacheRepository(16), cSvc, service.NewCellSenderService(), peSvc, rSvc)
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, up2 := net.Pipe()
+	defer up2.Close()
+	st := entity.NewConnState(key, key, nonce, up1, nil)
+	csRepo.Add(cid, st)
+	client := entity.NewConnState(key, key, nonce, nil, nil)
+
+	for sid := uint16(1); sid <= 2; sid++ {
+		if err := uc.Resolve(st, cid, resolveCell(t, cSvc, peSvc, client, sid, "Example.com"), func(*entity.ConnState) {}); err != nil {
+			t.Fatalf("resolve: %v", err)
+		}
+		cmd, gotSID, data := readResolved(t, cSvc, peSvc, client, up2)
+		if cmd != vo.CmdResolved || gotSID != sid {
+			t.Fatalf("got %s for stream %d, want RESOLVED for stream %d", cmd, gotSID, sid)
+		}
+		answers, err := vo.ResolvedFrom(data)
+		if err != nil || len(answers) != 1 || !answers[0].IP.Equal(net.IPv4(192, 0, 2, 1)) {
+			t.Fatalf("answers = %v (%v)", answers, err)
+		}
+		if answers[0].TTL <= 0 || answers[0].TTL > time.Hour {
+			t.Errorf("TTL = %v, want up to an hour", answers[0].TTL)
+		}
+	}
+	if rSvc.calls != 1 {
+		t.Errorf("resolver asked %d times, want 1", rSvc.calls)
+	}
+}
+
+func TestHandleResolveUseCase_FailureSendsEnd(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Minute)
+	cSvc := service.NewCryptoService()
+	peSvc := service.NewPayloadEncodingService()
+	rSvc := &mockDNSResolverService{err: &net.DNSError{Err: "no such host", Name: "nowhere.example", IsNotFound: true}}
+	uc := usecase.NewHandleResolveUseCase(csRepo, repository.NewResolveCacheRepository(16), cSvc, service.NewCellSenderService(), peSvc, rSvc)
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, up2 := net.Pipe()
+	defer up2.Close()
+	st := entity.NewConnState(key, key, nonce, up1, nil)
+	csRepo.Add(cid, st)
+	client := entity.NewConnState(key, key, nonce, nil, nil)
+
+	if err := uc.Resolve(st, cid, resolveCell(t, cSvc, peSvc, client, 3, "nowhere.example"), func(*entity.ConnState) {}); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	_, cell, err := service.NewCellReaderService().ReadCell(up2)
+	if err != nil {
+		t.Fatalf("read answer: %v", err)
+	}
+	// relays on the path see the END but must not learn the name
+	if bytes.Contains(cell.Payload, []byte("nowhere.example")) {
+		t.Errorf("END payload names the host: %q", cell.Payload)
+	}
+	sid, data := openUpstream(t, cSvc, peSvc, client, cell)
+	if cell.Cmd != vo.CmdEnd || sid != 3 || vo.EndReasonFrom(data) != vo.EndReasonResolveFailed {
+		t.Errorf("got %s sid=%d reason=%s, want END RESOLVEFAILED for stream 3", cell.Cmd, sid, vo.EndReasonFrom(data))
+	}
+}
+
+func TestHandleResolveUseCase_IPLiteral(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Minute)
+	cSvc := service.NewCryptoService()
+	peSvc := service.NewPayloadEncodingService()
+	rSvc := &mockDNSResolverService{}
+	uc := usecase.NewHandleResolveUseCase(csRepo, repository.NewResolveCacheRepository(16), cSvc, service.NewCellSenderService(), peSvc, rSvc)
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, up2 := net.Pipe()
+	defer up2.Close()
+	st := entity.NewConnState(key, key, nonce, up1, nil)
+	csRepo.Add(cid, st)
+	client := entity.NewConnState(key, key, nonce, nil, nil)
+
+	if err := uc.Resolve(st, cid, resolveCell(t, cSvc, peSvc, client, 1, "2001:db8::5"), func(*entity.ConnState) {}); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	_, _, data := readResolved(t, cSvc, peSvc, client, up2)
+	answers, _ := vo.ResolvedFrom(data)
+	if len(answers) != 1 || !answers[0].IP.Equal(net.ParseIP("2001:db8::5")) {
+		t.Errorf("answers = %v, want the literal itself", answers)
+	}
+	if rSvc.calls != 0 {
+		t.Error("resolver asked for an IP literal")
+	}
+}
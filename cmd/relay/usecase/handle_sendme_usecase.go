@@ -0,0 +1,95 @@
+package usecase
+
+import (
+	"fmt"
+	"log"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	"ikedadada/go-ptor/shared/domain/repository"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+// HandleSendmeUseCase handles SENDME flow control cells
+type HandleSendmeUseCase interface {
+	// Sendme relays a SENDME towards the endpoint it is meant for. At the
+	// exit it opens the package window of the stream or, for stream ID
+	// zero, of the circuit. SENDMEs are onion encrypted relay bodies like
+	// DATA, so only a cell the client sealed for this hop is acted on.
+	Sendme(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, dir vo.Direction, ensureServeDown func(*entity.ConnState)) error
+}
+
+type handleSendmeUseCaseImpl struct {
+	csRepo repository.RelayConnStateRepository
+	cSvc   service.CryptoService
+	csSvc  service.CellSenderService
+	peSvc  service.PayloadEncodingService
+}
+
+// NewHandleSendmeUseCase creates a new sendme use case
+func NewHandleSendmeUseCase(csRepo repository.RelayConnStateRepository, cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService) HandleSendmeUseCase {
+	return &handleSendmeUseCaseImpl{
+		csRepo: csRepo,
+		cSvc:   cSvc,
+		csSvc:  csSvc,
+		peSvc:  peSvc,
+	}
+}
+
+func (uc *handleSendmeUseCaseImpl) Sendme(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, dir vo.Direction, ensureServeDown func(*entity.ConnState)) error {
+	p, err := uc.peSvc.ForVersion(cell.Version).DecodeDataPayload(cell.Payload)
+	if err != nil {
+		return err
+	}
+	if dir == vo.DirectionBackward {
+		return forwardBackward(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, vo.CmdSendme, p)
+	}
+
+	// forward: SENDMEs share the DATA nonces, as the client sends them in
+	// the same sequence
+	dec, err := uc.cSvc.AESCTR(st.Key(vo.DirectionForward), st.DataNonce(), p.Data)
+	if err != nil {
+		return fmt.Errorf("AESCTR sendme cid=%s: %w", cid.String(), err)
+	}
+	_, digest, recognized := uc.cSvc.OpenRelayBody(st.Key(vo.DirectionForward), vo.DirectionForward, st.Digest(vo.DirectionForward), dec)
+	if !recognized {
+		// not for us: forward downstream with one layer removed
+		if st.Down() == nil || st.IsHidden() {
+			return fmt.Errorf("unrecognized sendme cell at last hop cid=%s", cid.String())
+		}
+		ensureServeDown(st)
+		linkVer := entity.LinkVersion(st.Down())
+		payload, err := uc.peSvc.ForVersion(linkVer).EncodeDataPayload(&service.DataPayloadDTO{StreamID: p.StreamID, Data: dec})
+		if err != nil {
+			return err
+		}
+		out, err := uc.csRepo.OutboundID(cid)
+		if err != nil {
+			return err
+		}
+		return uc.csSvc.ForwardCell(st.Down(), out, &entity.Cell{Cmd: vo.CmdSendme, Version: linkVer, Payload: payload})
+	}
+	st.SetDigest(vo.DirectionForward, digest)
+	log.Printf("sendme recognized cid=%s sid=%d", cid.String(), p.StreamID)
+
+	if p.StreamID == 0 {
+		if err := st.Window().Acknowledge(); err != nil {
+			return fmt.Errorf("circuit sendme cid=%s: %w", cid.String(), err)
+		}
+		return nil
+	}
+	// a SENDME for a stream that already ended is harmless
+	if w, ok := st.StreamWindow(vo.StreamID(p.StreamID)); ok {
+		if err := w.Acknowledge(); err != nil {
+			return fmt.Errorf("stream sendme cid=%s sid=%d: %w", cid.String(), p.StreamID, err)
+		}
+	}
+	return nil
+}
+
+// sendSendme acknowledges delivered DATA cells to the client. Stream ID
+// zero acknowledges the circuit window. The SENDME is sealed like DATA, so
+// no relay in between can forge or replay one.
+func sendSendme(cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService, st *entity.ConnState, cid vo.CircuitID, sid vo.StreamID) error {
+	return sendUpstream(cSvc, csSvc, peSvc, st, cid, sid, vo.CmdSendme, nil)
+}
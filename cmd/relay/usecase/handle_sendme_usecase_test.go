@@ -0,0 +1,192 @@
+package usecase_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"ikedadada/go-ptor/cmd/relay/infrastructure/repository"
+	"ikedadada/go-ptor/cmd/relay/usecase"
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+// sendmeCell seals a SENDME for the hop client mirrors, the way the client
+// does, and advances the mirror's digest and nonce.
+func sendmeCell(t *testing.T, client *entity.ConnState, sid uint16) *entity.Cell {
+	t.Helper()
+	cSvc := service.NewCryptoService()
+	body, digest, err := cSvc.SealRelayBody(client.Key(vo.DirectionForward), vo.DirectionForward, client.Digest(vo.DirectionForward), nil)
+	if err != nil {
+		t.Fatalf("seal sendme: %v", err)
+	}
+	client.SetDigest(vo.DirectionForward, digest)
+	enc, err := cSvc.AESCTR(client.Key(vo.DirectionForward), client.DataNonce(), body)
+	if err != nil {
+		t.Fatalf("encrypt sendme: %v", err)
+	}
+	payload, err := service.NewPayloadEncodingService().EncodeDataPayload(&service.DataPayloadDTO{StreamID: sid, Data: enc})
+	if err != nil {
+		t.Fatalf("encode sendme: %v", err)
+	}
+	return &entity.Cell{Cmd: vo.CmdSendme, Version: vo.ProtocolV1, Payload: payload}
+}
+
+func TestHandleSendmeUseCase_Relays(t *testing.T) {
+	crSvc := service.NewCellReaderService()
+	cSvc := service.NewCryptoService()
+	peSvc := service.NewPayloadEncodingService()
+	tests := []struct {
+		name string
+		dir  vo.Direction
+	}{
+		{"forward to next hop", vo.DirectionForward},
+		{"backward to previous hop", vo.DirectionBackward},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csRepo := repository.NewConnStateRepository(time.Second)
+			uc := usecase.NewHandleSendmeUseCase(csRepo, cSvc, service.NewCellSenderService(), peSvc)
+
+			key, _ := vo.NewAESKey()
+			nonce, _ := vo.NewNonce()
+			cid := vo.NewCircuitID()
+			up1, up2 := net.Pipe()
+			down1, down2 := net.Pipe()
+			defer up2.Close()
+			defer down2.Close()
+
+			st := entity.NewConnState(key, key, nonce, up1, down1)
+			csRepo.Add(cid, st)
+			defer csRepo.Delete(cid)
+			out := vo.NewCircuitID()
+			csRepo.AddOutbound(cid, out)
+
+			// a SENDME sealed for the next hop, wrapped in our layer
+			nextKey, _ := vo.NewAESKey()
+			nextNonce, _ := vo.NewNonce()
+			inner := sendmeCell(t, entity.NewConnState(nextKey, nextKey, nextNonce, nil, nil), 0)
+			p, _ := peSvc.DecodeDataPayload(inner.Payload)
+			enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceData, 0), p.Data)
+			payload, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: 0, Data: enc})
+			cell := &entity.Cell{Cmd: vo.CmdSendme, Version: vo.ProtocolV1, Payload: payload}
+
+			peer, wantID := down2, out
+			if tt.dir == vo.DirectionBackward {
+				peer, wantID = up2, cid
+			}
+			errCh := make(chan error, 1)
+			go func() { errCh <- uc.Sendme(st, cid, cell, tt.dir, func(*entity.ConnState) {}) }()
+
+			gotID, relayed, err := crSvc.ReadCell(peer)
+			if err != nil {
+				t.Fatalf("read relayed sendme: %v", err)
+			}
+			if relayed.Cmd != vo.CmdSendme || gotID != wantID {
+				t.Errorf("relayed %s with cid=%s, want SENDME with cid=%s", relayed.Cmd, gotID, wantID)
+			}
+			if err := <-errCh; err != nil {
+				t.Fatalf("sendme: %v", err)
+			}
+			if tt.dir == vo.DirectionForward {
+				// our layer is gone: the next hop recognizes what is left
+				rp, _ := peSvc.DecodeDataPayload(relayed.Payload)
+				dec, _ := cSvc.AESCTR(nextKey, nextNonce.Sequence(vo.NonceSpaceData, 0), rp.Data)
+				if _, _, ok := cSvc.OpenRelayBody(nextKey, vo.DirectionForward, [32]byte{}, dec); !ok {
+					t.Error("forwarded sendme not recognized by the next hop")
+				}
+			}
+			if got := st.Window().PackageWindow(); got != entity.CircuitWindowStart {
+				t.Errorf("relaying hop changed its window to %d", got)
+			}
+		})
+	}
+}
+
+func TestHandleSendmeUseCase_ExitOpensWindow(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Second)
+	uc := usecase.NewHandleSendmeUseCase(csRepo, service.NewCryptoService(), service.NewCellSenderService(), service.NewPayloadEncodingService())
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	st := entity.NewConnState(key, key, nonce, nil, nil)
+	client := entity.NewConnState(key, key, nonce, nil, nil)
+	csRepo.Add(cid, st)
+	sid, _ := vo.StreamIDFrom(7)
+	sw := st.OpenStreamWindow(sid)
+	for i := 0; i < entity.CircuitWindowIncrement; i++ {
+		_ = sw.Package()
+		_ = st.Window().Package()
+	}
+	noop := func(*entity.ConnState) {}
+
+	if err := uc.Sendme(st, cid, sendmeCell(t, client, 0), vo.DirectionForward, noop); err != nil {
+		t.Fatalf("circuit sendme: %v", err)
+	}
+	if got := st.Window().PackageWindow(); got != entity.CircuitWindowStart {
+		t.Errorf("circuit window = %d, want %d", got, entity.CircuitWindowStart)
+	}
+	if err := uc.Sendme(st, cid, sendmeCell(t, client, sid.UInt16()), vo.DirectionForward, noop); err != nil {
+		t.Fatalf("stream sendme: %v", err)
+	}
+	want := entity.StreamWindowStart - entity.CircuitWindowIncrement + entity.StreamWindowIncrement
+	if got := sw.PackageWindow(); got != want {
+		t.Errorf("stream window = %d, want %d", got, want)
+	}
+
+	// acknowledging cells that were never sent is a protocol violation
+	if err := uc.Sendme(st, cid, sendmeCell(t, client, 0), vo.DirectionForward, noop); err == nil {
+		t.Error("expected error for circuit SENDME beyond the window")
+	}
+	// streams that already ended ignore late SENDMEs
+	if err := uc.Sendme(st, cid, sendmeCell(t, client, 99), vo.DirectionForward, noop); err != nil {
+		t.Errorf("sendme for unknown stream: %v", err)
+	}
+}
+
+func TestHandleSendmeUseCase_RejectsBadDigest(t *testing.T) {
+	cSvc := service.NewCryptoService()
+	peSvc := service.NewPayloadEncodingService()
+	csRepo := repository.NewConnStateRepository(time.Second)
+	uc := usecase.NewHandleSendmeUseCase(csRepo, cSvc, service.NewCellSenderService(), peSvc)
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	st := entity.NewConnState(key, key, nonce, nil, nil)
+	csRepo.Add(cid, st)
+	for i := 0; i < entity.CircuitWindowIncrement; i++ {
+		_ = st.Window().Package()
+	}
+	want := st.Window().PackageWindow()
+
+	body, _, _ := cSvc.SealRelayBody(key, vo.DirectionForward, [32]byte{}, nil)
+	body[2] ^= 0xff
+	enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceData, 0), body)
+	forged, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{Data: enc})
+	bare, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{})
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"digest does not match", forged},
+		{"bare unsealed sendme", bare},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cell := &entity.Cell{Cmd: vo.CmdSendme, Version: vo.ProtocolV1, Payload: tt.payload}
+			if err := uc.Sendme(st, cid, cell, vo.DirectionForward, func(*entity.ConnState) {}); err == nil {
+				t.Error("expected forged SENDME to be rejected")
+			}
+			if got := st.Window().PackageWindow(); got != want {
+				t.Errorf("forged SENDME moved the circuit window to %d, want %d", got, want)
+			}
+			if st.Digest(vo.DirectionForward) != [32]byte{} {
+				t.Error("forged SENDME advanced the forward digest")
+			}
+		})
+	}
+}
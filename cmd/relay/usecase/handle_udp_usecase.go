@@ -0,0 +1,224 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	"ikedadada/go-ptor/shared/domain/repository"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+// maxDatagramSize is the largest UDP datagram the exit reads from its
+// sockets. Datagrams that do not fit one relay body are dropped.
+const maxDatagramSize = 64 * 1024
+
+// HandleUDPUseCase handles UDP associations, which carry datagrams the
+// client's applications sent through SOCKS5 UDP ASSOCIATE.
+type HandleUDPUseCase interface {
+	// BeginUDP opens a UDP association: at the exit a UDP socket that
+	// lives until the client ends the stream or it sits idle too long.
+	BeginUDP(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, ensureServeDown func(*entity.ConnState)) error
+	// Datagram processes a DATAGRAM cell travelling in dir
+	Datagram(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, dir vo.Direction, ensureServeDown func(*entity.ConnState)) error
+}
+
+type handleUDPUseCaseImpl struct {
+	csRepo      repository.RelayConnStateRepository
+	cSvc        service.CryptoService
+	csSvc       service.CellSenderService
+	peSvc       service.PayloadEncodingService
+	policy      vo.ExitPolicy
+	idleTimeout time.Duration
+}
+
+// NewHandleUDPUseCase creates a new UDP use case. Associations are opened
+// only if policy allows UDP and are closed after idleTimeout without a
+// datagram in either direction.
+func NewHandleUDPUseCase(csRepo repository.RelayConnStateRepository, cSvc service.CryptoService, csSvc service.CellSenderService, peSvc service.PayloadEncodingService, policy vo.ExitPolicy, idleTimeout time.Duration) HandleUDPUseCase {
+	return &handleUDPUseCaseImpl{
+		csRepo:      csRepo,
+		cSvc:        cSvc,
+		csSvc:       csSvc,
+		peSvc:       peSvc,
+		policy:      policy,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// udpAssociation is the exit's socket for one association. It is kept in
+// the stream table like the connection of a TCP stream.
+type udpAssociation struct {
+	*net.UDPConn
+	idleTimeout time.Duration
+}
+
+// touch pushes the idle deadline back after a datagram passed.
+func (a *udpAssociation) touch() {
+	_ = a.SetReadDeadline(time.Now().Add(a.idleTimeout))
+}
+
+func (uc *handleUDPUseCaseImpl) BeginUDP(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, ensureServeDown func(*entity.ConnState)) error {
+	nonce := st.BeginNonce()
+	dec, err := uc.cSvc.AESCTR(st.Key(vo.DirectionForward), nonce, cell.Payload)
+	if err != nil {
+		return fmt.Errorf("AESCTR begin udp cid=%s: %w", cid.String(), err)
+	}
+	body, digest, recognized := uc.cSvc.OpenRelayBody(st.Key(vo.DirectionForward), vo.DirectionForward, st.Digest(vo.DirectionForward), dec)
+	if !recognized {
+		// not for us: forward the remaining layers downstream
+		if st.Down() == nil || st.IsHidden() {
+			return fmt.Errorf("unrecognized begin udp cell at last hop cid=%s", cid.String())
+		}
+		ensureServeDown(st)
+		c := &entity.Cell{Cmd: vo.CmdBeginUDP, Version: entity.LinkVersion(st.Down()), Payload: dec}
+		out, err := uc.csRepo.OutboundID(cid)
+		if err != nil {
+			return err
+		}
+		return uc.csSvc.ForwardCell(st.Down(), out, c)
+	}
+	st.SetDigest(vo.DirectionForward, digest)
+
+	p, err := uc.peSvc.ForVersion(st.PayloadVersion()).DecodeBeginPayload(body)
+	if err != nil {
+		return err
+	}
+	sid, err := vo.StreamIDFrom(p.StreamID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case st.IsHidden():
+		return sendEnd(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, vo.EndReasonExitPolicy, "hidden services do not take udp")
+	case !uc.policy.AllowUDP:
+		log.Printf("refuse udp cid=%s sid=%d: exit policy", cid.String(), sid.UInt16())
+		return sendEnd(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, vo.EndReasonExitPolicy, "udp not allowed")
+	}
+
+	sock, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return sendEnd(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, vo.EndReasonResourceLimit, err.Error())
+	}
+	assoc := &udpAssociation{UDPConn: sock, idleTimeout: uc.idleTimeout}
+	if err := uc.csRepo.AddStream(cid, sid, assoc); err != nil {
+		sock.Close()
+		return err
+	}
+	log.Printf("udp association cid=%s sid=%d local=%s", cid.String(), sid.UInt16(), sock.LocalAddr())
+	if err := sendUpstream(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, vo.CmdBeginAck, nil); err != nil {
+		return err
+	}
+	assoc.touch()
+	go uc.forwardDatagrams(st, cid, sid, assoc)
+	return nil
+}
+
+func (uc *handleUDPUseCaseImpl) Datagram(st *entity.ConnState, cid vo.CircuitID, cell *entity.Cell, dir vo.Direction, ensureServeDown func(*entity.ConnState)) error {
+	p, err := uc.peSvc.ForVersion(cell.Version).DecodeDataPayload(cell.Payload)
+	if err != nil {
+		return err
+	}
+	sid, err := vo.StreamIDFrom(p.StreamID)
+	if err != nil {
+		return err
+	}
+
+	if dir == vo.DirectionBackward {
+		// add our layer; only the client can open the cell
+		return forwardBackward(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, vo.CmdDatagram, p)
+	}
+
+	// Datagrams share the data nonce sequence with DATA cells, since the
+	// client encrypts both alike.
+	dec, err := uc.cSvc.AESCTR(st.Key(vo.DirectionForward), st.DataNonce(), p.Data)
+	if err != nil {
+		return fmt.Errorf("AESCTR datagram cid=%s: %w", cid.String(), err)
+	}
+	data, digest, recognized := uc.cSvc.OpenRelayBody(st.Key(vo.DirectionForward), vo.DirectionForward, st.Digest(vo.DirectionForward), dec)
+	if !recognized {
+		if st.Down() == nil || st.IsHidden() {
+			return fmt.Errorf("unrecognized datagram cell at last hop cid=%s", cid.String())
+		}
+		ensureServeDown(st)
+		payload, err := uc.peSvc.ForVersion(entity.LinkVersion(st.Down())).EncodeDataPayload(&service.DataPayloadDTO{StreamID: p.StreamID, Data: dec})
+		if err != nil {
+			return err
+		}
+		out, err := uc.csRepo.OutboundID(cid)
+		if err != nil {
+			return err
+		}
+		return uc.csSvc.ForwardCell(st.Down(), out, &entity.Cell{Cmd: vo.CmdDatagram, Version: entity.LinkVersion(st.Down()), Payload: payload})
+	}
+	st.SetDigest(vo.DirectionForward, digest)
+
+	conn, err := uc.csRepo.GetStream(cid, sid)
+	if err != nil {
+		return sendEnd(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, vo.EndReasonProtocol, "unknown stream")
+	}
+	assoc, ok := conn.(*udpAssociation)
+	if !ok {
+		return sendEnd(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, vo.EndReasonProtocol, "not a udp stream")
+	}
+	d, err := vo.DatagramFrom(data)
+	if err != nil {
+		return fmt.Errorf("datagram cid=%s sid=%d: %w", cid.String(), sid.UInt16(), err)
+	}
+	// UDP is lossy anyway: a datagram that cannot be delivered, or that
+	// the policy refuses, is dropped and the association stays open
+	ips, err := allowedAddrs(uc.policy, d.Host, d.Port)
+	if err != nil {
+		log.Printf("drop datagram cid=%s sid=%d: %v", cid.String(), sid.UInt16(), err)
+		return nil
+	}
+	if _, err := assoc.WriteToUDP(d.Data, &net.UDPAddr{IP: ips[0], Port: d.Port}); err != nil {
+		log.Printf("drop datagram cid=%s sid=%d: %v", cid.String(), sid.UInt16(), err)
+		return nil
+	}
+	assoc.touch()
+	return nil
+}
+
+// forwardDatagrams sends the datagrams arriving at the association's socket
+// back to the client, each with its source address, until the association
+// is idle for too long or closed.
+func (uc *handleUDPUseCaseImpl) forwardDatagrams(st *entity.ConnState, cid vo.CircuitID, sid vo.StreamID, assoc *udpAssociation) {
+	defer assoc.Close()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := assoc.ReadFromUDP(buf)
+		if err != nil {
+			_ = uc.csRepo.RemoveStream(cid, sid)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Printf("udp association idle cid=%s sid=%d", cid.String(), sid.UInt16())
+				_ = sendEnd(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, vo.EndReasonDone, "idle")
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				// the client ended the stream
+				return
+			}
+			_ = sendEnd(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, endReasonFor(err), err.Error())
+			return
+		}
+		assoc.touch()
+		data, err := vo.Datagram{Host: from.IP.String(), Port: from.Port, Data: buf[:n]}.Bytes()
+		if err != nil {
+			log.Printf("drop datagram from %s cid=%s sid=%d: %v", from, cid.String(), sid.UInt16(), err)
+			continue
+		}
+		if len(data) > service.MaxRelayDataSize {
+			log.Printf("drop datagram from %s cid=%s sid=%d: %d bytes with address, a cell holds %d", from, cid.String(), sid.UInt16(), len(data), service.MaxRelayDataSize)
+			continue
+		}
+		if err := sendUpstream(uc.cSvc, uc.csSvc, uc.peSvc, st, cid, sid, vo.CmdDatagram, data); err != nil {
+			log.Printf("send datagram cid=%s sid=%d: %v", cid.String(), sid.UInt16(), err)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package usecase_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"ikedadada/go-ptor/cmd/relay/infrastructure/repository"
+	"ikedadada/go-ptor/cmd/relay/usecase"
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"ikedadada/go-ptor/shared/service"
+)
+
+// beginUDPCell returns a BEGIN_UDP cell for stream sid addressed to the
+// hop with key and nonce, and the forward digest after it.
+func beginUDPCell(t *testing.T, cSvc service.CryptoService, peSvc service.PayloadEncodingService, key vo.AESKey, nonce vo.Nonce, sid uint16) (*entity.Cell, [32]byte) {
+	t.Helper()
+	plain, _ := peSvc.EncodeBeginPayload(&service.BeginPayloadDTO{StreamID: sid})
+	body, digest, err := cSvc.SealRelayBody(key, vo.DirectionForward, [32]byte{}, plain)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceBegin, 0), body)
+	return &entity.Cell{Cmd: vo.CmdBeginUDP, Version: vo.ProtocolV1, Payload: enc}, digest
+}
+
+func TestHandleUDPUseCase_RefusedByExitPolicy(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Second)
+	cSvc := service.NewCryptoService()
+	peSvc := service.NewPayloadEncodingService()
+	uc := usecase.NewHandleUDPUseCase(csRepo, cSvc, service.NewCellSenderService(), peSvc, vo.DefaultExitPolicy(), time.Minute)
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, up2 := net.Pipe()
+	defer up2.Close()
+	st := entity.NewConnState(key, key, nonce, up1, nil)
+	csRepo.Add(cid, st)
+
+	cell, _ := beginUDPCell(t, cSvc, peSvc, key, nonce, 1)
+	errCh := make(chan error, 1)
+	go func() { errCh <- uc.BeginUDP(st, cid, cell, func(*entity.ConnState) {}) }()
+
+	_, end, err := service.NewCellReaderService().ReadCell(up2)
+	if err != nil {
+		t.Fatalf("read end: %v", err)
+	}
+	if end.Cmd != vo.CmdEnd {
+		t.Fatalf("cmd = %s, want END", end.Cmd)
+	}
+	gotSID, data := openUpstream(t, cSvc, peSvc, entity.NewConnState(key, key, nonce, nil, nil), end)
+	if gotSID != 1 || vo.EndReasonFrom(data) != vo.EndReasonExitPolicy {
+		t.Errorf("end sid=%d reason=%s, want stream 1 refused by exit policy", gotSID, vo.EndReasonFrom(data))
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("begin udp: %v", err)
+	}
+	sid, _ := vo.StreamIDFrom(1)
+	if _, err := csRepo.GetStream(cid, sid); err == nil {
+		t.Error("refused association stored")
+	}
+}
+
+func TestHandleUDPUseCase_RoundTrip(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Minute)
+	cSvc := service.NewCryptoService()
+	crSvc := service.NewCellReaderService()
+	peSvc := service.NewPayloadEncodingService()
+	uc := usecase.NewHandleUDPUseCase(csRepo, cSvc, service.NewCellSenderService(), peSvc, vo.ExitPolicy{AllowUDP: true}, time.Minute)
+
+	// a UDP echo server as the target
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := target.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			target.WriteToUDP(bytes.ToUpper(buf[:n]), from)
+		}
+	}()
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, up2 := net.Pipe()
+	defer up2.Close()
+	st := entity.NewConnState(key, key, nonce, up1, nil)
+	csRepo.Add(cid, st)
+	defer csRepo.DestroyAllStreams(cid)
+
+	cell, digest := beginUDPCell(t, cSvc, peSvc, key, nonce, 1)
+	errCh := make(chan error, 1)
+	go func() { errCh <- uc.BeginUDP(st, cid, cell, func(*entity.ConnState) {}) }()
+	_, ack, err := crSvc.ReadCell(up2)
+	if err != nil || ack.Cmd != vo.CmdBeginAck {
+		t.Fatalf("expected BEGIN_ACK: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("begin udp: %v", err)
+	}
+	ap, _ := peSvc.DecodeDataPayload(ack.Payload)
+	ackDec, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceUpstream, 0), ap.Data)
+	_, ackDigest, ok := cSvc.OpenRelayBody(key, vo.DirectionBackward, [32]byte{}, ackDec)
+	if !ok {
+		t.Fatal("ack not sealed for the client")
+	}
+
+	// the first datagram uses the first data nonce, which is the base one
+	tAddr := target.LocalAddr().(*net.UDPAddr)
+	dg, _ := vo.Datagram{Host: "127.0.0.1", Port: tAddr.Port, Data: []byte("ping")}.Bytes()
+	body, _, _ := cSvc.SealRelayBody(key, vo.DirectionForward, digest, dg)
+	enc, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceData, 0), body)
+	payload, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: 1, Data: enc})
+	if err := uc.Datagram(st, cid, &entity.Cell{Cmd: vo.CmdDatagram, Version: vo.ProtocolV1, Payload: payload}, vo.DirectionForward, func(*entity.ConnState) {}); err != nil {
+		t.Fatalf("datagram: %v", err)
+	}
+
+	_, back, err := crSvc.ReadCell(up2)
+	if err != nil {
+		t.Fatalf("read datagram: %v", err)
+	}
+	if back.Cmd != vo.CmdDatagram {
+		t.Fatalf("cmd = %s, want DATAGRAM", back.Cmd)
+	}
+	p, _ := peSvc.DecodeDataPayload(back.Payload)
+	// the reply follows the ack in the backward sequence
+	dec, _ := cSvc.AESCTR(key, nonce.Sequence(vo.NonceSpaceUpstream, 1), p.Data)
+	data, _, ok := cSvc.OpenRelayBody(key, vo.DirectionBackward, ackDigest, dec)
+	if !ok {
+		t.Fatal("reply not sealed for the client")
+	}
+	got, err := vo.DatagramFrom(data)
+	if err != nil {
+		t.Fatalf("decode datagram: %v", err)
+	}
+	if got.Addr() != net.JoinHostPort("127.0.0.1", strconv.Itoa(tAddr.Port)) || string(got.Data) != "PING" {
+		t.Errorf("got %q from %s", got.Data, got.Addr())
+	}
+}
+
+func TestHandleUDPUseCase_IdleTimeout(t *testing.T) {
+	csRepo := repository.NewConnStateRepository(time.Minute)
+	cSvc := service.NewCryptoService()
+	crSvc := service.NewCellReaderService()
+	peSvc := service.NewPayloadEncodingService()
+	uc := usecase.NewHandleUDPUseCase(csRepo, cSvc, service.NewCellSenderService(), peSvc, vo.ExitPolicy{AllowUDP: true}, 20*time.Millisecond)
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, up2 := net.Pipe()
+	defer up2.Close()
+	st := entity.NewConnState(key, key, nonce, up1, nil)
+	csRepo.Add(cid, st)
+
+	client := entity.NewConnState(key, key, nonce, nil, nil)
+
+	cell, _ := beginUDPCell(t, cSvc, peSvc, key, nonce, 1)
+	go uc.BeginUDP(st, cid, cell, func(*entity.ConnState) {})
+	_, ack, err := crSvc.ReadCell(up2)
+	if err != nil || ack.Cmd != vo.CmdBeginAck {
+		t.Fatalf("expected BEGIN_ACK: %v", err)
+	}
+	openUpstream(t, cSvc, peSvc, client, ack)
+
+	_, end, err := crSvc.ReadCell(up2)
+	if err != nil {
+		t.Fatalf("read end: %v", err)
+	}
+	gotSID, data := openUpstream(t, cSvc, peSvc, client, end)
+	if end.Cmd != vo.CmdEnd || gotSID != 1 || vo.EndReasonFrom(data) != vo.EndReasonDone {
+		t.Fatalf("got %s sid=%d reason=%s, want END DONE for stream 1", end.Cmd, gotSID, vo.EndReasonFrom(data))
+	}
+	sid, _ := vo.StreamIDFrom(1)
+	if _, err := csRepo.GetStream(cid, sid); err == nil {
+		t.Error("idle association still stored")
+	}
+}
+
+// Replies to datagrams go out from their own goroutine while a TCP stream
+// of the same circuit sends DATA. Both must take nonces and digests under
+// the circuit's send lock, or the client stops recognizing the cells.
+func TestHandleUDPUseCase_SharesCircuitWithTCPStream(t *testing.T) {
+	const size = 150000
+	const datagrams = 200
+	csRepo := repository.NewConnStateRepository(time.Minute)
+	cSvc := service.NewCryptoService()
+	csSvc := service.NewCellSenderService()
+	crSvc := service.NewCellReaderService()
+	peSvc := service.NewPayloadEncodingService()
+	udpUC := usecase.NewHandleUDPUseCase(csRepo, cSvc, csSvc, peSvc, vo.ExitPolicy{AllowUDP: true}, time.Minute)
+	beginUC := usecase.NewHandleBeginUseCase(csRepo, cSvc, csSvc, peSvc, vo.ExitPolicy{})
+
+	// a UDP echo server and a TCP server that sends size bytes
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = c.Write(bytes.Repeat([]byte{'t'}, size))
+	}()
+
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cid := vo.NewCircuitID()
+	up1, up2 := net.Pipe()
+	defer up2.Close()
+	st := entity.NewConnState(key, key, nonce, up1, nil)
+	csRepo.Add(cid, st)
+	defer csRepo.DestroyAllStreams(cid)
+	// the client's view of the hop: one side sends, the other receives
+	sender := entity.NewConnState(key, key, nonce, nil, nil)
+	receiver := entity.NewConnState(key, key, nonce, nil, nil)
+
+	type result struct {
+		tcp     int
+		replies int
+		err     error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		var res result
+		tcpDone := false
+		for !tcpDone || res.replies < datagrams {
+			// datagrams may be lost; stop waiting once the stream is done
+			wait := 5 * time.Second
+			if tcpDone {
+				wait = time.Second
+			}
+			up2.SetReadDeadline(time.Now().Add(wait))
+			_, cell, err := crSvc.ReadCell(up2)
+			if err != nil {
+				if !tcpDone {
+					res.err = err
+				}
+				resCh <- res
+				return
+			}
+			p, _ := peSvc.DecodeDataPayload(cell.Payload)
+			switch cell.Cmd {
+			case vo.CmdData, vo.CmdDatagram, vo.CmdBeginAck, vo.CmdEnd:
+				dec, _ := cSvc.AESCTR(key, receiver.UpstreamDataNonce(), p.Data)
+				body, digest, ok := cSvc.OpenRelayBody(key, vo.DirectionBackward, receiver.Digest(vo.DirectionBackward), dec)
+				if !ok {
+					res.err = errors.New(cell.Cmd.String() + " cell not recognized")
+					resCh <- res
+					return
+				}
+				receiver.SetDigest(vo.DirectionBackward, digest)
+				switch cell.Cmd {
+				case vo.CmdData:
+					res.tcp += len(body)
+				case vo.CmdDatagram:
+					res.replies++
+				case vo.CmdEnd:
+					tcpDone = tcpDone || p.StreamID == 2
+				}
+			}
+		}
+		resCh <- res
+	}()
+
+	begin := func(cmd vo.CellCommand, sid uint16, target string) *entity.Cell {
+		plain, _ := peSvc.EncodeBeginPayload(&service.BeginPayloadDTO{StreamID: sid, Target: target})
+		body, digest, _ := cSvc.SealRelayBody(key, vo.DirectionForward, sender.Digest(vo.DirectionForward), plain)
+		sender.SetDigest(vo.DirectionForward, digest)
+		enc, _ := cSvc.AESCTR(key, sender.BeginNonce(), body)
+		return &entity.Cell{Cmd: cmd, Version: vo.ProtocolV1, Payload: enc}
+	}
+	noop := func(*entity.ConnState) {}
+	if err := udpUC.BeginUDP(st, cid, begin(vo.CmdBeginUDP, 1, ""), noop); err != nil {
+		t.Fatalf("begin udp: %v", err)
+	}
+	if err := beginUC.Begin(st, cid, begin(vo.CmdBegin, 2, ln.Addr().String()), noop); err != nil {
+		t.Fatalf("begin tcp: %v", err)
+	}
+
+	port := echo.LocalAddr().(*net.UDPAddr).Port
+	for i := 0; i < datagrams; i++ {
+		dg, _ := vo.Datagram{Host: "127.0.0.1", Port: port, Data: []byte(strconv.Itoa(i))}.Bytes()
+		body, digest, _ := cSvc.SealRelayBody(key, vo.DirectionForward, sender.Digest(vo.DirectionForward), dg)
+		sender.SetDigest(vo.DirectionForward, digest)
+		enc, _ := cSvc.AESCTR(key, sender.DataNonce(), body)
+		payload, _ := peSvc.EncodeDataPayload(&service.DataPayloadDTO{StreamID: 1, Data: enc})
+		if err := udpUC.Datagram(st, cid, &entity.Cell{Cmd: vo.CmdDatagram, Version: vo.ProtocolV1, Payload: payload}, vo.DirectionForward, noop); err != nil {
+			t.Fatalf("datagram %d: %v", i, err)
+		}
+	}
+
+	res := <-resCh
+	if res.err != nil {
+		t.Fatalf("read replies: %v", res.err)
+	}
+	if res.tcp != size {
+		t.Errorf("TCP stream delivered %d bytes, want %d", res.tcp, size)
+	}
+	if res.replies == 0 {
+		t.Error("no datagram reply reached the client")
+	}
+}
@@ -78,6 +78,17 @@ func (rc *RelayCell) MarkEnd() {
 	rc.end = true
 }
 
+// Version returns the protocol version the cell is encoded with
+func (rc *RelayCell) Version() vo.ProtocolVersion {
+	return rc.cell.Version
+}
+
+// SetVersion sets the protocol version of the underlying cell. The payload
+// must already be encoded for that version.
+func (rc *RelayCell) SetVersion(v vo.ProtocolVersion) {
+	rc.cell.Version = v
+}
+
 // Command returns the cell command
 func (rc *RelayCell) Command() vo.CellCommand {
 	return rc.cell.Cmd
@@ -90,7 +101,7 @@ func (rc *RelayCell) Encode() ([]byte, error) {
 
 // IsDataCell returns true if this is a data-carrying cell
 func (rc *RelayCell) IsDataCell() bool {
-	return rc.cell.Cmd == vo.CmdData
+	return rc.cell.Cmd == vo.CmdData || rc.cell.Cmd == vo.CmdDatagram
 }
 
 // IsControlCell returns true if this is a control cell
@@ -98,7 +109,7 @@ func (rc *RelayCell) IsControlCell() bool {
 	switch rc.cell.Cmd {
 	case vo.CmdBegin, vo.CmdEnd, vo.CmdConnect,
 		vo.CmdExtend, vo.CmdDestroy, vo.CmdCreated,
-		vo.CmdBeginAck:
+		vo.CmdBeginAck, vo.CmdBeginUDP, vo.CmdResolve, vo.CmdResolved:
 		return true
 	default:
 		return false
@@ -111,6 +111,7 @@ func TestRelayCell_IsDataCell(t *testing.T) {
 		expected bool
 	}{
 		{"Data cell", vo.CmdData, true},
+		{"Datagram cell", vo.CmdDatagram, true},
 		{"Begin cell", vo.CmdBegin, false},
 		{"End cell", vo.CmdEnd, false},
 		{"Connect cell", vo.CmdConnect, false},
@@ -147,6 +148,9 @@ func TestRelayCell_IsControlCell(t *testing.T) {
 		{"Destroy cell", vo.CmdDestroy, true},
 		{"Created cell", vo.CmdCreated, true},
 		{"BeginAck cell", vo.CmdBeginAck, true},
+		{"BeginUDP cell", vo.CmdBeginUDP, true},
+		{"Resolve cell", vo.CmdResolve, true},
+		{"Resolved cell", vo.CmdResolved, true},
 		{"Data cell", vo.CmdData, false},
 	}
 
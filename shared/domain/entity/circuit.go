@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	vo "ikedadada/go-ptor/shared/domain/value_object"
 )
@@ -25,6 +26,35 @@ type StreamState struct {
 	ID     vo.StreamID
 	Closed bool
 	// 追加情報が欲しければここに (bytesSent/recv など)
+	window  *FlowWindow
+	begun   chan struct{}       // closed once the exit answers BEGIN or RESOLVE
+	reason  vo.EndReason        // why the exit refused the stream; zero if it connected
+	bound   *net.TCPAddr        // where the exit connected the stream, if it said
+	answers []vo.ResolvedAnswer // the addresses the exit found for a RESOLVE
+}
+
+// settle records the exit's answer to BEGIN. Later answers are ignored.
+// The caller must hold the circuit's stream lock.
+func (s *StreamState) settle(reason vo.EndReason) {
+	select {
+	case <-s.begun:
+	default:
+		s.reason = reason
+		close(s.begun)
+	}
+}
+
+// ErrBeginTimeout indicates that the exit did not answer BEGIN in time.
+var ErrBeginTimeout = errors.New("timed out waiting for BEGIN_ACK")
+
+// StreamRefusedError reports that the exit ended a stream before it was
+// connected.
+type StreamRefusedError struct {
+	Reason vo.EndReason
+}
+
+func (e *StreamRefusedError) Error() string {
+	return "stream refused: " + e.Reason.String()
 }
 
 // ---- Circuit --------------------------------------------------------------
@@ -33,34 +63,52 @@ type Circuit struct {
 	id   vo.CircuitID
 	hops []vo.RelayID
 
-	keys                map[int]vo.AESKey // per-hop AES key
+	forwardKeys         map[int]vo.AESKey // per-hop key of cells towards the exit
+	backwardKeys        map[int]vo.AESKey // per-hop key of cells towards the client
 	baseNonces          map[int]vo.Nonce  // per-hop base Nonce
 	beginCounter        map[int]uint64    // per-hop BEGIN counter
 	dataCounter         map[int]uint64    // per-hop DATA counter (downstream)
 	upstreamDataCounter map[int]uint64    // per-hop upstream DATA counter
+	forwardDigest       map[int][32]byte  // per-hop running digest of cells sent
+	backwardDigest      map[int][32]byte  // per-hop running digest of cells received
 	priv                vo.PrivateKey
 	conns               []net.Conn
+	payloadVersion      vo.ProtocolVersion // encoding of payloads read by the exit
+	exitPolicy          vo.ExitPolicy      // policy the exit published
+	window              *FlowWindow        // circuit-level SENDME window shared with the exit
+	sendMu              sync.Mutex         // serializes cells put on the circuit
 	strmMu              sync.RWMutex
 	stream              map[vo.StreamID]*StreamState
+	lastStreamID        vo.StreamID // last stream ID handed out on this circuit
+	builtAt             time.Time   // when the circuit was created
+	dirtiedAt           time.Time   // when the first stream was opened
+	streamsOpened       int         // streams opened over the circuit's lifetime
+	retired             bool        // takes no new streams
+	receiving           bool        // a receive loop reads the circuit's cells
+	exitPinned          bool        // exit chosen by the caller rather than at random
+	isolationKey        string      // isolation key of the first stream
 }
 
 // NewCircuit は 3 ホップ分の RelayID と鍵束を受け取って生成。
+// forwardKeys と backwardKeys はホップごとの往路・復路の鍵。
 func NewCircuit(id vo.CircuitID, relays []vo.RelayID,
-	keys []vo.AESKey, nonces []vo.Nonce, priv vo.PrivateKey) (*Circuit, error) {
+	forwardKeys, backwardKeys []vo.AESKey, nonces []vo.Nonce, priv vo.PrivateKey) (*Circuit, error) {
 
-	if len(relays) == 0 || len(relays) != len(keys) || len(keys) != len(nonces) {
+	if len(relays) == 0 || len(relays) != len(forwardKeys) || len(forwardKeys) != len(backwardKeys) || len(forwardKeys) != len(nonces) {
 		return nil, errors.New("hops / keys / nonces length mismatch")
 	}
 	if priv == nil {
 		return nil, errors.New("rsa key required")
 	}
-	keyMap := make(map[int]vo.AESKey, len(keys))
+	fwdMap := make(map[int]vo.AESKey, len(forwardKeys))
+	bwdMap := make(map[int]vo.AESKey, len(backwardKeys))
 	ncMap := make(map[int]vo.Nonce, len(nonces))
 	beginCounterMap := make(map[int]uint64, len(nonces))
 	dataCounterMap := make(map[int]uint64, len(nonces))
 	upstreamDataCounterMap := make(map[int]uint64, len(nonces))
-	for i := range keys {
-		keyMap[i] = keys[i]
+	for i := range forwardKeys {
+		fwdMap[i] = forwardKeys[i]
+		bwdMap[i] = backwardKeys[i]
 		ncMap[i] = nonces[i]
 		beginCounterMap[i] = 0
 		dataCounterMap[i] = 0
@@ -69,14 +117,19 @@ func NewCircuit(id vo.CircuitID, relays []vo.RelayID,
 	return &Circuit{
 		id:                  id,
 		hops:                relays,
-		keys:                keyMap,
+		forwardKeys:         fwdMap,
+		backwardKeys:        bwdMap,
 		baseNonces:          ncMap,
 		beginCounter:        beginCounterMap,
 		dataCounter:         dataCounterMap,
 		upstreamDataCounter: upstreamDataCounterMap,
+		forwardDigest:       make(map[int][32]byte, len(relays)),
+		backwardDigest:      make(map[int][32]byte, len(relays)),
 		priv:                priv,
 		conns:               make([]net.Conn, len(relays)),
+		window:              NewCircuitWindow(),
 		stream:              make(map[vo.StreamID]*StreamState),
+		builtAt:             time.Now(),
 	}, nil
 }
 
@@ -87,94 +140,68 @@ func (c *Circuit) ID() vo.CircuitID { return c.id }
 func (c *Circuit) Hops() []vo.RelayID {
 	return append([]vo.RelayID(nil), c.hops...)
 }
-func (c *Circuit) HopKey(idx int) vo.AESKey      { return c.keys[idx] }
+
+// HopKey returns the key shared with hop idx for cells travelling in dir.
+func (c *Circuit) HopKey(idx int, dir vo.Direction) vo.AESKey {
+	if dir == vo.DirectionBackward {
+		return c.backwardKeys[idx]
+	}
+	return c.forwardKeys[idx]
+}
+
 func (c *Circuit) HopBaseNonce(idx int) vo.Nonce { return c.baseNonces[idx] }
 
 // HopBeginNonce generates the next unique nonce for BEGIN commands at hop idx
 func (c *Circuit) HopBeginNonce(idx int) vo.Nonce {
-	nonce := c.baseNonces[idx]
-
-	// XOR begin counter into last 8 bytes
-	counter := c.beginCounter[idx]
-	for i := 0; i < 8; i++ {
-		nonce[11-i] ^= byte(counter)
-		counter >>= 8
-	}
-
+	nonce := c.baseNonces[idx].Sequence(vo.NonceSpaceBegin, c.beginCounter[idx])
 	c.beginCounter[idx]++
 	return nonce
 }
 
 // HopBeginNoncePeek returns the next nonce without incrementing counter
 func (c *Circuit) HopBeginNoncePeek(idx int) vo.Nonce {
-	nonce := c.baseNonces[idx]
-
-	// XOR begin counter into last 8 bytes
-	counter := c.beginCounter[idx]
-	for i := 0; i < 8; i++ {
-		nonce[11-i] ^= byte(counter)
-		counter >>= 8
-	}
-
-	return nonce
+	return c.baseNonces[idx].Sequence(vo.NonceSpaceBegin, c.beginCounter[idx])
 }
 
 // HopDataNonce generates the next unique nonce for DATA commands at hop idx
 func (c *Circuit) HopDataNonce(idx int) vo.Nonce {
-	nonce := c.baseNonces[idx]
-
-	// XOR data counter into last 8 bytes
-	counter := c.dataCounter[idx]
-	for i := 0; i < 8; i++ {
-		nonce[11-i] ^= byte(counter)
-		counter >>= 8
-	}
-
+	nonce := c.baseNonces[idx].Sequence(vo.NonceSpaceData, c.dataCounter[idx])
 	c.dataCounter[idx]++
 	return nonce
 }
 
 // HopDataNoncePeek returns the next nonce without incrementing counter
 func (c *Circuit) HopDataNoncePeek(idx int) vo.Nonce {
-	nonce := c.baseNonces[idx]
-
-	// XOR data counter into last 8 bytes
-	counter := c.dataCounter[idx]
-	for i := 0; i < 8; i++ {
-		nonce[11-i] ^= byte(counter)
-		counter >>= 8
-	}
-
-	return nonce
+	return c.baseNonces[idx].Sequence(vo.NonceSpaceData, c.dataCounter[idx])
 }
 
 // HopUpstreamDataNonce generates the next unique nonce for upstream DATA commands at hop idx
 func (c *Circuit) HopUpstreamDataNonce(idx int) vo.Nonce {
-	nonce := c.baseNonces[idx]
-
-	// XOR upstream data counter into last 8 bytes
-	counter := c.upstreamDataCounter[idx]
-	for i := 0; i < 8; i++ {
-		nonce[11-i] ^= byte(counter)
-		counter >>= 8
-	}
-
+	nonce := c.baseNonces[idx].Sequence(vo.NonceSpaceUpstream, c.upstreamDataCounter[idx])
 	c.upstreamDataCounter[idx]++
 	return nonce
 }
 
 // HopUpstreamDataNoncePeek returns the next upstream nonce without incrementing counter
 func (c *Circuit) HopUpstreamDataNoncePeek(idx int) vo.Nonce {
-	nonce := c.baseNonces[idx]
+	return c.baseNonces[idx].Sequence(vo.NonceSpaceUpstream, c.upstreamDataCounter[idx])
+}
 
-	// XOR upstream data counter into last 8 bytes
-	counter := c.upstreamDataCounter[idx]
-	for i := 0; i < 8; i++ {
-		nonce[11-i] ^= byte(counter)
-		counter >>= 8
+// HopDigest returns the running relay digest shared with hop idx for dir.
+func (c *Circuit) HopDigest(idx int, dir vo.Direction) [32]byte {
+	if dir == vo.DirectionBackward {
+		return c.backwardDigest[idx]
 	}
+	return c.forwardDigest[idx]
+}
 
-	return nonce
+// SetHopDigest stores the running relay digest shared with hop idx for dir.
+func (c *Circuit) SetHopDigest(idx int, dir vo.Direction, d [32]byte) {
+	if dir == vo.DirectionBackward {
+		c.backwardDigest[idx] = d
+		return
+	}
+	c.forwardDigest[idx] = d
 }
 
 func (c *Circuit) RSAPrivate() vo.PrivateKey { return c.priv }
@@ -187,8 +214,9 @@ func (c *Circuit) RSAPublic() vo.PublicKey {
 
 // WipeKeys zeroes all symmetric keys and forgets the RSA private key.
 func (c *Circuit) WipeKeys() {
-	for i := range c.keys {
-		c.keys[i] = vo.AESKey{}
+	for i := range c.forwardKeys {
+		c.forwardKeys[i] = vo.AESKey{}
+		c.backwardKeys[i] = vo.AESKey{}
 	}
 	for i := range c.baseNonces {
 		c.baseNonces[i] = vo.Nonce{}
@@ -199,24 +227,251 @@ func (c *Circuit) WipeKeys() {
 // ----------------------------------------------------------------------------
 // ストリーム管理
 
+// ErrStreamIsolated indicates that a stream's isolation key differs from
+// the key of the streams the circuit already carried.
+var ErrStreamIsolated = errors.New("circuit isolated for other streams")
+
+// OpenStream opens a stream without an isolation key.
 func (c *Circuit) OpenStream() (*StreamState, error) {
+	return c.OpenIsolatedStream("")
+}
+
+// OpenIsolatedStream opens a stream with isolation key key. The first
+// stream fixes the key of the circuit; later streams with another key are
+// refused with ErrStreamIsolated.
+func (c *Circuit) OpenIsolatedStream(key string) (*StreamState, error) {
 	c.strmMu.Lock()
 	defer c.strmMu.Unlock()
 
-	sid := vo.NewStreamIDAuto()
-	state := &StreamState{ID: sid}
+	if c.streamsOpened > 0 && c.isolationKey != key {
+		return nil, ErrStreamIsolated
+	}
+	sid, err := c.nextStreamID()
+	if err != nil {
+		return nil, err
+	}
+	state := &StreamState{ID: sid, window: NewStreamWindow(), begun: make(chan struct{})}
 	c.stream[sid] = state
+	if c.streamsOpened == 0 {
+		c.dirtiedAt = time.Now()
+		c.isolationKey = key
+	}
+	c.streamsOpened++
 	return state, nil
 }
 
+// nextStreamID returns the next stream ID not held by an open stream.
+// IDs only need to be unique within the circuit; they wrap around after
+// 65535 and skip zero, which addresses the circuit itself. The caller must
+// hold the stream lock.
+func (c *Circuit) nextStreamID() (vo.StreamID, error) {
+	for i := 0; i < 0xFFFF; i++ {
+		c.lastStreamID++
+		if c.lastStreamID == 0 {
+			c.lastStreamID = 1
+		}
+		if st, ok := c.stream[c.lastStreamID]; !ok || st.Closed {
+			return c.lastStreamID, nil
+		}
+	}
+	return 0, errors.New("no free stream id")
+}
+
 func (c *Circuit) CloseStream(id vo.StreamID) {
 	c.strmMu.Lock()
 	defer c.strmMu.Unlock()
 	if st, ok := c.stream[id]; ok {
 		st.Closed = true
+		st.window.Close()
+		st.settle(vo.EndReasonDestroy)
+	}
+}
+
+// AcceptStream records the BEGIN_ACK for a stream along with the address
+// the exit connected it to, which is nil if the exit did not say.
+func (c *Circuit) AcceptStream(id vo.StreamID, bound *net.TCPAddr) {
+	c.strmMu.Lock()
+	defer c.strmMu.Unlock()
+	if st, ok := c.stream[id]; ok {
+		select {
+		case <-st.begun:
+		default:
+			st.bound = bound
+		}
+		st.settle(0)
+	}
+}
+
+// StreamBoundAddr returns the address the exit connected a stream to, or
+// nil if it is unknown.
+func (c *Circuit) StreamBoundAddr(id vo.StreamID) *net.TCPAddr {
+	c.strmMu.RLock()
+	defer c.strmMu.RUnlock()
+	if st, ok := c.stream[id]; ok {
+		return st.bound
+	}
+	return nil
+}
+
+// ResolveStream records the RESOLVED answer to a RESOLVE sent on a stream.
+func (c *Circuit) ResolveStream(id vo.StreamID, answers []vo.ResolvedAnswer) {
+	c.strmMu.Lock()
+	defer c.strmMu.Unlock()
+	if st, ok := c.stream[id]; ok {
+		select {
+		case <-st.begun:
+		default:
+			st.answers = answers
+		}
+		st.settle(0)
+	}
+}
+
+// StreamAnswers returns the addresses the exit found for the RESOLVE sent
+// on a stream.
+func (c *Circuit) StreamAnswers(id vo.StreamID) []vo.ResolvedAnswer {
+	c.strmMu.RLock()
+	defer c.strmMu.RUnlock()
+	if st, ok := c.stream[id]; ok {
+		return st.answers
+	}
+	return nil
+}
+
+// RefuseStream records an END that arrived before the stream was accepted.
+// It has no effect on a stream that is already connected.
+func (c *Circuit) RefuseStream(id vo.StreamID, reason vo.EndReason) {
+	c.strmMu.Lock()
+	defer c.strmMu.Unlock()
+	if st, ok := c.stream[id]; ok {
+		st.settle(reason)
+	}
+}
+
+// AwaitStream blocks until the exit answers the BEGIN of a stream. It
+// returns a *StreamRefusedError if the exit ended the stream instead and
+// ErrBeginTimeout if no answer arrived within timeout.
+func (c *Circuit) AwaitStream(id vo.StreamID, timeout time.Duration) error {
+	c.strmMu.RLock()
+	st, ok := c.stream[id]
+	c.strmMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("stream %d not found", id.UInt16())
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-st.begun:
+	case <-timer.C:
+		return ErrBeginTimeout
+	}
+
+	c.strmMu.RLock()
+	defer c.strmMu.RUnlock()
+	if st.reason != 0 {
+		return &StreamRefusedError{Reason: st.reason}
 	}
+	return nil
+}
+
+// StreamWindow returns the flow control window of an open stream.
+func (c *Circuit) StreamWindow(id vo.StreamID) (*FlowWindow, bool) {
+	c.strmMu.RLock()
+	defer c.strmMu.RUnlock()
+	st, ok := c.stream[id]
+	if !ok || st.Closed {
+		return nil, false
+	}
+	return st.window, true
+}
+
+// BuiltAt returns when the circuit was created.
+func (c *Circuit) BuiltAt() time.Time { return c.builtAt }
+
+// Exit returns the relay at the last hop.
+func (c *Circuit) Exit() vo.RelayID { return c.hops[len(c.hops)-1] }
+
+// PinExit marks the exit as chosen by the caller, such as the relay of a
+// hidden service. Such circuits only serve streams to that exit.
+func (c *Circuit) PinExit() {
+	c.strmMu.Lock()
+	defer c.strmMu.Unlock()
+	c.exitPinned = true
 }
 
+// ExitPinned reports whether the exit was chosen by the caller.
+func (c *Circuit) ExitPinned() bool {
+	c.strmMu.RLock()
+	defer c.strmMu.RUnlock()
+	return c.exitPinned
+}
+
+// Admits reports whether a stream with isolation key key may use the
+// circuit: no stream used it yet, or its streams had the same key.
+func (c *Circuit) Admits(key string) bool {
+	c.strmMu.RLock()
+	defer c.strmMu.RUnlock()
+	return c.streamsOpened == 0 || c.isolationKey == key
+}
+
+// DirtiedAt returns when the first stream was opened on the circuit, or the
+// zero time if it has not carried any stream yet.
+func (c *Circuit) DirtiedAt() time.Time {
+	c.strmMu.RLock()
+	defer c.strmMu.RUnlock()
+	return c.dirtiedAt
+}
+
+// StreamsOpened returns how many streams were opened over the lifetime of
+// the circuit, including closed ones.
+func (c *Circuit) StreamsOpened() int {
+	c.strmMu.RLock()
+	defer c.strmMu.RUnlock()
+	return c.streamsOpened
+}
+
+// Retire stops the circuit from being chosen for new streams. It reports
+// whether the circuit was still in service before the call.
+func (c *Circuit) Retire() bool {
+	c.strmMu.Lock()
+	defer c.strmMu.Unlock()
+	if c.retired {
+		return false
+	}
+	c.retired = true
+	return true
+}
+
+// Retired reports whether the circuit takes no new streams.
+func (c *Circuit) Retired() bool {
+	c.strmMu.RLock()
+	defer c.strmMu.RUnlock()
+	return c.retired
+}
+
+// ClaimReceiver reports whether the caller is the first to ask, and so the
+// one to start the loop that receives the circuit's cells.
+func (c *Circuit) ClaimReceiver() bool {
+	c.strmMu.Lock()
+	defer c.strmMu.Unlock()
+	if c.receiving {
+		return false
+	}
+	c.receiving = true
+	return true
+}
+
+// LockSend gives the caller exclusive use of the forward direction, so the
+// nonces and digests a cell consumes match the order cells reach the wire.
+func (c *Circuit) LockSend() { c.sendMu.Lock() }
+
+// UnlockSend releases the forward direction taken by LockSend.
+func (c *Circuit) UnlockSend() { c.sendMu.Unlock() }
+
+// Window returns the circuit-level flow control window.
+func (c *Circuit) Window() *FlowWindow { return c.window }
+
 func (c *Circuit) ActiveStreams() []vo.StreamID {
 	c.strmMu.RLock()
 	defer c.strmMu.RUnlock()
@@ -244,6 +499,29 @@ func (c *Circuit) SetConn(i int, cconn net.Conn) {
 	}
 }
 
+// PayloadVersion returns the encoding used for end-to-end payloads such as
+// BEGIN and CONNECT, which only the exit decodes. Defaults to ProtocolV1.
+func (c *Circuit) PayloadVersion() vo.ProtocolVersion {
+	if !c.payloadVersion.IsSupported() {
+		return vo.ProtocolV1
+	}
+	return c.payloadVersion
+}
+
+// SetPayloadVersion records the end-to-end payload encoding the exit understands.
+func (c *Circuit) SetPayloadVersion(v vo.ProtocolVersion) {
+	c.payloadVersion = v
+}
+
+// ExitPolicy returns the policy the exit published. A circuit built
+// without one accepts every port.
+func (c *Circuit) ExitPolicy() vo.ExitPolicy { return c.exitPolicy }
+
+// SetExitPolicy records the policy the exit published.
+func (c *Circuit) SetExitPolicy(p vo.ExitPolicy) {
+	c.exitPolicy = p
+}
+
 // ----------------------------------------------------------------------------
 // デバッグ表現
 
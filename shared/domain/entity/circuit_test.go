@@ -3,7 +3,9 @@ package entity_test
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"testing"
+	"time"
 
 	"ikedadada/go-ptor/shared/domain/entity"
 	vo "ikedadada/go-ptor/shared/domain/value_object"
@@ -41,7 +43,7 @@ func TestNewCircuit_Table(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c, err := entity.NewCircuit(id, tt.relays, tt.keys, tt.nonces, priv)
+			c, err := entity.NewCircuit(id, tt.relays, tt.keys, tt.keys, tt.nonces, priv)
 			if tt.expectsErr && err == nil {
 				t.Errorf("expected error")
 			}
@@ -81,7 +83,7 @@ func TestCircuit_StreamManagement(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
 			priv := vo.NewRSAPrivKey(rawKey)
-			c, err := entity.NewCircuit(id, []vo.RelayID{relayID, relayID, relayID}, []vo.AESKey{key, key, key}, []vo.Nonce{nonce, nonce, nonce}, priv)
+			c, err := entity.NewCircuit(id, []vo.RelayID{relayID, relayID, relayID}, []vo.AESKey{key, key, key}, []vo.AESKey{key, key, key}, []vo.Nonce{nonce, nonce, nonce}, priv)
 			if err != nil {
 				t.Fatalf("NewCircuit: %v", err)
 			}
@@ -102,3 +104,168 @@ func TestCircuit_StreamManagement(t *testing.T) {
 		})
 	}
 }
+
+func TestCircuit_AwaitStream(t *testing.T) {
+	relayID, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	priv := vo.NewRSAPrivKey(rawKey)
+
+	tests := []struct {
+		name       string
+		answer     func(c *entity.Circuit, sid vo.StreamID)
+		wantReason vo.EndReason
+		wantErr    error
+	}{
+		{"accepted", func(c *entity.Circuit, sid vo.StreamID) { c.AcceptStream(sid, nil) }, 0, nil},
+		{"refused", func(c *entity.Circuit, sid vo.StreamID) { c.RefuseStream(sid, vo.EndReasonConnectRefused) }, vo.EndReasonConnectRefused, nil},
+		{"end after accept", func(c *entity.Circuit, sid vo.StreamID) {
+			c.AcceptStream(sid, nil)
+			c.RefuseStream(sid, vo.EndReasonDone)
+		}, 0, nil},
+		{"resolved", func(c *entity.Circuit, sid vo.StreamID) { c.ResolveStream(sid, nil) }, 0, nil},
+		{"circuit closed", func(c *entity.Circuit, sid vo.StreamID) { c.CloseStream(sid) }, vo.EndReasonDestroy, nil},
+		{"no answer", func(*entity.Circuit, vo.StreamID) {}, 0, entity.ErrBeginTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := entity.NewCircuit(vo.NewCircuitID(), []vo.RelayID{relayID}, []vo.AESKey{key}, []vo.AESKey{key}, []vo.Nonce{nonce}, priv)
+			if err != nil {
+				t.Fatalf("NewCircuit: %v", err)
+			}
+			st, _ := c.OpenStream()
+			go tt.answer(c, st.ID)
+
+			err = c.AwaitStream(st.ID, 100*time.Millisecond)
+			var refused *entity.StreamRefusedError
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantReason != 0:
+				if !errors.As(err, &refused) || refused.Reason != tt.wantReason {
+					t.Errorf("err = %v, want refusal with %s", err, tt.wantReason)
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCircuit_Reuse(t *testing.T) {
+	relayID, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	c, err := entity.NewCircuit(vo.NewCircuitID(), []vo.RelayID{relayID}, []vo.AESKey{key}, []vo.AESKey{key}, []vo.Nonce{nonce}, vo.NewRSAPrivKey(rawKey))
+	if err != nil {
+		t.Fatalf("NewCircuit: %v", err)
+	}
+	if !c.DirtiedAt().IsZero() || c.StreamsOpened() != 0 {
+		t.Fatalf("unused circuit is dirty")
+	}
+
+	before := time.Now()
+	st, _ := c.OpenStream()
+	dirty := c.DirtiedAt()
+	if dirty.Before(before) {
+		t.Errorf("DirtiedAt = %v, want after %v", dirty, before)
+	}
+	c.CloseStream(st.ID)
+	c.OpenStream()
+	if c.StreamsOpened() != 2 {
+		t.Errorf("StreamsOpened = %d, want 2", c.StreamsOpened())
+	}
+	if !c.DirtiedAt().Equal(dirty) {
+		t.Errorf("second stream moved DirtiedAt")
+	}
+
+	if c.Retired() {
+		t.Fatalf("new circuit retired")
+	}
+	if !c.Retire() || !c.Retired() {
+		t.Errorf("Retire did not take the circuit out of service")
+	}
+	if c.Retire() {
+		t.Errorf("second Retire reported a circuit in service")
+	}
+	if !c.ClaimReceiver() {
+		t.Errorf("first ClaimReceiver refused")
+	}
+	if c.ClaimReceiver() {
+		t.Errorf("second ClaimReceiver granted")
+	}
+}
+
+func TestCircuit_StreamIDsPerCircuit(t *testing.T) {
+	relayID, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newCircuit := func() *entity.Circuit {
+		c, err := entity.NewCircuit(vo.NewCircuitID(), []vo.RelayID{relayID}, []vo.AESKey{key}, []vo.AESKey{key}, []vo.Nonce{nonce}, vo.NewRSAPrivKey(rawKey))
+		if err != nil {
+			t.Fatalf("NewCircuit: %v", err)
+		}
+		return c
+	}
+
+	a, b := newCircuit(), newCircuit()
+	a1, _ := a.OpenStream()
+	b1, _ := b.OpenStream()
+	a2, _ := a.OpenStream()
+	if a1.ID.UInt16() != 1 || b1.ID.UInt16() != 1 || a2.ID.UInt16() != 2 {
+		t.Errorf("stream IDs = %d, %d, %d, want 1, 1, 2", a1.ID, b1.ID, a2.ID)
+	}
+
+	// after wrapping around, IDs of open streams are skipped and IDs of
+	// closed ones are used again
+	a.CloseStream(a2.ID)
+	for i := 3; i <= 0xFFFF; i++ {
+		st, err := a.OpenStream()
+		if err != nil {
+			t.Fatalf("OpenStream %d: %v", i, err)
+		}
+		a.CloseStream(st.ID)
+	}
+	st, err := a.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	if st.ID.UInt16() != 2 {
+		t.Errorf("stream ID after wrap = %d, want 2", st.ID)
+	}
+}
+
+func TestCircuit_Isolation(t *testing.T) {
+	relayID, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	c, err := entity.NewCircuit(vo.NewCircuitID(), []vo.RelayID{relayID}, []vo.AESKey{key}, []vo.AESKey{key}, []vo.Nonce{nonce}, vo.NewRSAPrivKey(rawKey))
+	if err != nil {
+		t.Fatalf("NewCircuit: %v", err)
+	}
+	if !c.Admits("alice") || !c.Admits("bob") {
+		t.Fatalf("clean circuit refuses a key")
+	}
+
+	if _, err := c.OpenIsolatedStream("alice"); err != nil {
+		t.Fatalf("OpenIsolatedStream: %v", err)
+	}
+	if c.Admits("bob") || !c.Admits("alice") {
+		t.Errorf("first stream did not fix the isolation key")
+	}
+	if _, err := c.OpenIsolatedStream("bob"); !errors.Is(err, entity.ErrStreamIsolated) {
+		t.Errorf("stream with another key: err = %v, want ErrStreamIsolated", err)
+	}
+	if _, err := c.OpenStream(); !errors.Is(err, entity.ErrStreamIsolated) {
+		t.Errorf("stream without key: err = %v, want ErrStreamIsolated", err)
+	}
+	if _, err := c.OpenIsolatedStream("alice"); err != nil {
+		t.Errorf("stream with the same key: %v", err)
+	}
+}
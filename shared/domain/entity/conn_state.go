@@ -2,6 +2,7 @@ package entity
 
 import (
 	"net"
+	"sync"
 	"time"
 
 	vo "ikedadada/go-ptor/shared/domain/value_object"
@@ -11,30 +12,46 @@ import (
 
 // ConnState represents per-circuit connection information held by a relay.
 type ConnState struct {
-	key                 vo.AESKey
+	forwardKey          vo.AESKey // layer and digest key of cells towards the exit
+	backwardKey         vo.AESKey // layer and digest key of cells towards the client
 	baseNonce           vo.Nonce
 	beginCounter        uint64 // Counter for BEGIN commands
 	dataCounter         uint64 // Counter for DATA commands (downstream)
 	upstreamDataCounter uint64 // Counter for upstream DATA commands
+	forwardDigest       [32]byte
+	backwardDigest      [32]byte
 	up                  net.Conn
 	down                net.Conn
 	last                time.Time
 	hidden              bool
 	served              bool
+	payloadVersion      vo.ProtocolVersion // encoding of end-to-end payloads agreed with the client
+	sendMu              sync.Mutex         // serializes cells sent towards the client
+	window              *FlowWindow
+	winMu               sync.Mutex
+	streamWindows       map[vo.StreamID]*FlowWindow
 }
 
-// NewConnState returns a new ConnState instance.
-func NewConnState(key vo.AESKey, nonce vo.Nonce, up, down net.Conn) *ConnState {
-	return &ConnState{key: key, baseNonce: nonce, beginCounter: 0, dataCounter: 0, upstreamDataCounter: 0, up: up, down: down, last: time.Now(), hidden: false, served: false}
+// NewConnState returns a new ConnState instance. forwardKey and backwardKey
+// are the hop keys of either direction.
+func NewConnState(forwardKey, backwardKey vo.AESKey, nonce vo.Nonce, up, down net.Conn) *ConnState {
+	return NewConnStateWithCounters(forwardKey, backwardKey, nonce, up, down, 0, 0)
 }
 
 // NewConnStateWithCounters returns a new ConnState instance preserving counter values.
-func NewConnStateWithCounters(key vo.AESKey, nonce vo.Nonce, up, down net.Conn, beginCounter, dataCounter uint64) *ConnState {
-	return &ConnState{key: key, baseNonce: nonce, beginCounter: beginCounter, dataCounter: dataCounter, upstreamDataCounter: 0, up: up, down: down, last: time.Now(), hidden: false, served: false}
+func NewConnStateWithCounters(forwardKey, backwardKey vo.AESKey, nonce vo.Nonce, up, down net.Conn, beginCounter, dataCounter uint64) *ConnState {
+	return &ConnState{forwardKey: forwardKey, backwardKey: backwardKey, baseNonce: nonce, beginCounter: beginCounter, dataCounter: dataCounter, upstreamDataCounter: 0, up: up, down: down, last: time.Now(), hidden: false, served: false,
+		window: NewCircuitWindow(), streamWindows: make(map[vo.StreamID]*FlowWindow)}
+}
+
+// Key returns the symmetric key this hop uses for cells travelling in dir.
+func (s *ConnState) Key(dir vo.Direction) vo.AESKey {
+	if dir == vo.DirectionBackward {
+		return s.backwardKey
+	}
+	return s.forwardKey
 }
 
-// Key returns the symmetric key for this circuit hop.
-func (s *ConnState) Key() vo.AESKey  { return s.key }
 func (s *ConnState) Nonce() vo.Nonce { return s.baseNonce }
 
 // GetCounters returns the current counter values
@@ -44,47 +61,51 @@ func (s *ConnState) GetCounters() (beginCounter, dataCounter uint64) {
 
 // BeginNonce generates the next unique nonce for BEGIN commands
 func (s *ConnState) BeginNonce() vo.Nonce {
-	nonce := s.baseNonce
-
-	// XOR begin counter into last 8 bytes
-	counter := s.beginCounter
-	for i := 0; i < 8; i++ {
-		nonce[11-i] ^= byte(counter)
-		counter >>= 8
-	}
-
+	nonce := s.baseNonce.Sequence(vo.NonceSpaceBegin, s.beginCounter)
 	s.beginCounter++
 	return nonce
 }
 
 // DataNonce generates the next unique nonce for DATA commands
 func (s *ConnState) DataNonce() vo.Nonce {
-	nonce := s.baseNonce
-
-	// XOR data counter into last 8 bytes
-	counter := s.dataCounter
-	for i := 0; i < 8; i++ {
-		nonce[11-i] ^= byte(counter)
-		counter >>= 8
-	}
-
+	nonce := s.baseNonce.Sequence(vo.NonceSpaceData, s.dataCounter)
 	s.dataCounter++
 	return nonce
 }
 
 // UpstreamDataNonce generates the next unique nonce for upstream DATA commands
 func (s *ConnState) UpstreamDataNonce() vo.Nonce {
-	nonce := s.baseNonce
+	nonce := s.baseNonce.Sequence(vo.NonceSpaceUpstream, s.upstreamDataCounter)
+	s.upstreamDataCounter++
+	return nonce
+}
 
-	// XOR upstream data counter into last 8 bytes
-	counter := s.upstreamDataCounter
-	for i := 0; i < 8; i++ {
-		nonce[11-i] ^= byte(counter)
-		counter >>= 8
+// Digest returns the running relay digest for cells travelling in dir.
+func (s *ConnState) Digest(dir vo.Direction) [32]byte {
+	if dir == vo.DirectionBackward {
+		return s.backwardDigest
 	}
+	return s.forwardDigest
+}
 
-	s.upstreamDataCounter++
-	return nonce
+// SetDigest stores the running relay digest for dir after a cell was
+// recognized or originated by this hop.
+func (s *ConnState) SetDigest(dir vo.Direction, d [32]byte) {
+	if dir == vo.DirectionBackward {
+		s.backwardDigest = d
+		return
+	}
+	s.forwardDigest = d
+}
+
+// DirectionFrom reports which way a cell that arrived on conn is travelling.
+// Cells from the downstream link head back to the client; everything else
+// comes from upstream.
+func (s *ConnState) DirectionFrom(conn net.Conn) vo.Direction {
+	if s.down != nil && conn == s.down {
+		return vo.DirectionBackward
+	}
+	return vo.DirectionForward
 }
 
 // Up returns the upstream connection.
@@ -111,8 +132,67 @@ func (s *ConnState) MarkServed() { s.served = true }
 // IsServed reports whether the downstream ServeConn loop has started.
 func (s *ConnState) IsServed() bool { return s.served }
 
-// Close closes both sides of the connection.
+// PayloadVersion returns the encoding of end-to-end payloads such as BEGIN
+// and CONNECT, agreed with the client when the hop was created. Defaults to
+// ProtocolV1.
+func (s *ConnState) PayloadVersion() vo.ProtocolVersion {
+	if !s.payloadVersion.IsSupported() {
+		return vo.ProtocolV1
+	}
+	return s.payloadVersion
+}
+
+// SetPayloadVersion records the end-to-end payload encoding agreed with the client.
+func (s *ConnState) SetPayloadVersion(v vo.ProtocolVersion) { s.payloadVersion = v }
+
+// LockSend gives the caller exclusive use of the backward direction, so the
+// nonces and digests a cell consumes match the order cells reach the client.
+// Every stream of the circuit sends from its own goroutine.
+func (s *ConnState) LockSend() { s.sendMu.Lock() }
+
+// UnlockSend releases the backward direction taken by LockSend.
+func (s *ConnState) UnlockSend() { s.sendMu.Unlock() }
+
+// Window returns the circuit-level flow control window shared with the client.
+func (s *ConnState) Window() *FlowWindow { return s.window }
+
+// OpenStreamWindow creates the flow control window for a new stream.
+func (s *ConnState) OpenStreamWindow(sid vo.StreamID) *FlowWindow {
+	s.winMu.Lock()
+	defer s.winMu.Unlock()
+	w := NewStreamWindow()
+	s.streamWindows[sid] = w
+	return w
+}
+
+// StreamWindow returns the flow control window of stream sid.
+func (s *ConnState) StreamWindow(sid vo.StreamID) (*FlowWindow, bool) {
+	s.winMu.Lock()
+	defer s.winMu.Unlock()
+	w, ok := s.streamWindows[sid]
+	return w, ok
+}
+
+// CloseStreamWindow closes and forgets the window of stream sid, waking any
+// sender blocked on it.
+func (s *ConnState) CloseStreamWindow(sid vo.StreamID) {
+	s.winMu.Lock()
+	defer s.winMu.Unlock()
+	if w, ok := s.streamWindows[sid]; ok {
+		w.Close()
+		delete(s.streamWindows, sid)
+	}
+}
+
+// Close closes both sides of the connection and all flow control windows.
 func (s *ConnState) Close() {
+	s.window.Close()
+	s.winMu.Lock()
+	for sid, w := range s.streamWindows {
+		w.Close()
+		delete(s.streamWindows, sid)
+	}
+	s.winMu.Unlock()
 	if s.up != nil {
 		s.up.Close()
 	}
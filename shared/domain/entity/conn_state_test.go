@@ -1,6 +1,8 @@
 package entity
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
 	"net"
 	"testing"
 	"time"
@@ -31,15 +33,19 @@ func (c *connStateTestConn) SetReadDeadline(t time.Time) error  { return nil }
 func (c *connStateTestConn) SetWriteDeadline(t time.Time) error { return nil }
 
 func TestNewConnState(t *testing.T) {
-	key, _ := vo.NewAESKey()
+	fwdKey, _ := vo.NewAESKey()
+	bwdKey, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
 	upConn := newConnStateTestConn("up")
 	downConn := newConnStateTestConn("down")
 
-	cs := NewConnState(key, nonce, upConn, downConn)
+	cs := NewConnState(fwdKey, bwdKey, nonce, upConn, downConn)
 
-	if cs.Key() != key {
-		t.Errorf("Key mismatch: got %v, want %v", cs.Key(), key)
+	if cs.Key(vo.DirectionForward) != fwdKey {
+		t.Errorf("Forward key mismatch: got %v, want %v", cs.Key(vo.DirectionForward), fwdKey)
+	}
+	if cs.Key(vo.DirectionBackward) != bwdKey {
+		t.Errorf("Backward key mismatch: got %v, want %v", cs.Key(vo.DirectionBackward), bwdKey)
 	}
 	if cs.Nonce() != nonce {
 		t.Errorf("Nonce mismatch: got %v, want %v", cs.Nonce(), nonce)
@@ -77,7 +83,7 @@ func TestNewConnStateWithCounters(t *testing.T) {
 	beginCounter := uint64(5)
 	dataCounter := uint64(10)
 
-	cs := NewConnStateWithCounters(key, nonce, upConn, downConn, beginCounter, dataCounter)
+	cs := NewConnStateWithCounters(key, key, nonce, upConn, downConn, beginCounter, dataCounter)
 
 	// Check preserved counter values
 	gotBeginCounter, gotDataCounter := cs.GetCounters()
@@ -92,7 +98,7 @@ func TestNewConnStateWithCounters(t *testing.T) {
 func TestConnState_BeginNonce(t *testing.T) {
 	key, _ := vo.NewAESKey()
 	baseNonce, _ := vo.NewNonce()
-	cs := NewConnState(key, baseNonce, nil, nil)
+	cs := NewConnState(key, key, baseNonce, nil, nil)
 
 	// Generate first nonce
 	nonce1 := cs.BeginNonce()
@@ -133,7 +139,7 @@ func TestConnState_BeginNonce(t *testing.T) {
 func TestConnState_DataNonce(t *testing.T) {
 	key, _ := vo.NewAESKey()
 	baseNonce, _ := vo.NewNonce()
-	cs := NewConnState(key, baseNonce, nil, nil)
+	cs := NewConnState(key, key, baseNonce, nil, nil)
 
 	// Generate first nonce
 	nonce1 := cs.DataNonce()
@@ -162,7 +168,7 @@ func TestConnState_DataNonce(t *testing.T) {
 func TestConnState_UpstreamDataNonce(t *testing.T) {
 	key, _ := vo.NewAESKey()
 	baseNonce, _ := vo.NewNonce()
-	cs := NewConnState(key, baseNonce, nil, nil)
+	cs := NewConnState(key, key, baseNonce, nil, nil)
 
 	// Generate upstream nonces
 	nonce1 := cs.UpstreamDataNonce()
@@ -177,7 +183,7 @@ func TestConnState_UpstreamDataNonce(t *testing.T) {
 func TestConnState_Touch(t *testing.T) {
 	key, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
-	cs := NewConnState(key, nonce, nil, nil)
+	cs := NewConnState(key, key, nonce, nil, nil)
 
 	initialTime := cs.LastUsed()
 
@@ -194,7 +200,7 @@ func TestConnState_Touch(t *testing.T) {
 func TestConnState_HiddenFlag(t *testing.T) {
 	key, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
-	cs := NewConnState(key, nonce, nil, nil)
+	cs := NewConnState(key, key, nonce, nil, nil)
 
 	// Initially should be false
 	if cs.IsHidden() {
@@ -217,7 +223,7 @@ func TestConnState_HiddenFlag(t *testing.T) {
 func TestConnState_ServedFlag(t *testing.T) {
 	key, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
-	cs := NewConnState(key, nonce, nil, nil)
+	cs := NewConnState(key, key, nonce, nil, nil)
 
 	// Initially should be false
 	if cs.IsServed() {
@@ -231,12 +237,55 @@ func TestConnState_ServedFlag(t *testing.T) {
 	}
 }
 
+func TestConnState_DirectionFrom(t *testing.T) {
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	upConn := newConnStateTestConn("up")
+	downConn := newConnStateTestConn("down")
+
+	tests := []struct {
+		name     string
+		state    *ConnState
+		arrival  net.Conn
+		expected vo.Direction
+	}{
+		{"from upstream", NewConnState(key, key, nonce, upConn, downConn), upConn, vo.DirectionForward},
+		{"from downstream", NewConnState(key, key, nonce, upConn, downConn), downConn, vo.DirectionBackward},
+		{"exit without downstream", NewConnState(key, key, nonce, upConn, nil), upConn, vo.DirectionForward},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.state.DirectionFrom(tt.arrival); got != tt.expected {
+				t.Errorf("DirectionFrom() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestConnState_Digest(t *testing.T) {
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cs := NewConnState(key, key, nonce, nil, nil)
+
+	if cs.Digest(vo.DirectionForward) != [32]byte{} || cs.Digest(vo.DirectionBackward) != [32]byte{} {
+		t.Fatal("digests should start zeroed")
+	}
+	cs.SetDigest(vo.DirectionForward, [32]byte{1})
+	cs.SetDigest(vo.DirectionBackward, [32]byte{2})
+	if cs.Digest(vo.DirectionForward) != [32]byte{1} {
+		t.Error("forward digest not stored")
+	}
+	if cs.Digest(vo.DirectionBackward) != [32]byte{2} {
+		t.Error("backward digest not stored")
+	}
+}
+
 func TestConnState_Close(t *testing.T) {
 	key, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
 	upConn := newConnStateTestConn("up")
 	downConn := newConnStateTestConn("down")
-	cs := NewConnState(key, nonce, upConn, downConn)
+	cs := NewConnState(key, key, nonce, upConn, downConn)
 
 	// Close the connections
 	cs.Close()
@@ -253,7 +302,7 @@ func TestConnState_Close(t *testing.T) {
 func TestConnState_CloseWithNilConnections(t *testing.T) {
 	key, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
-	cs := NewConnState(key, nonce, nil, nil)
+	cs := NewConnState(key, key, nonce, nil, nil)
 
 	// Should not panic when closing nil connections
 	cs.Close()
@@ -262,7 +311,7 @@ func TestConnState_CloseWithNilConnections(t *testing.T) {
 func TestConnState_GetMessageTypeNonce(t *testing.T) {
 	key, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
-	cs := NewConnState(key, nonce, nil, nil)
+	cs := NewConnState(key, key, nonce, nil, nil)
 
 	// Test that consecutive calls to the same message type return different nonces
 	beginNonce1 := cs.GetMessageTypeNonce(MessageTypeBegin)
@@ -295,7 +344,7 @@ func TestConnState_GetMessageTypeNonce(t *testing.T) {
 func TestConnState_IncrementCounter(t *testing.T) {
 	key, _ := vo.NewAESKey()
 	nonce, _ := vo.NewNonce()
-	cs := NewConnState(key, nonce, nil, nil)
+	cs := NewConnState(key, key, nonce, nil, nil)
 
 	// Test incrementing different counter types
 	cs.IncrementCounter(MessageTypeBegin)
@@ -320,7 +369,7 @@ func TestConnState_IncrementCounter(t *testing.T) {
 func TestConnState_NonceUniqueness(t *testing.T) {
 	key, _ := vo.NewAESKey()
 	baseNonce, _ := vo.NewNonce()
-	cs := NewConnState(key, baseNonce, nil, nil)
+	cs := NewConnState(key, key, baseNonce, nil, nil)
 
 	// Generate multiple nonces and ensure they're all unique
 	const numNonces = 100
@@ -334,3 +383,35 @@ func TestConnState_NonceUniqueness(t *testing.T) {
 		seenNonces[nonce] = true
 	}
 }
+
+func TestConnState_NonceSpaces(t *testing.T) {
+	key, _ := vo.NewAESKey()
+	nonce, _ := vo.NewNonce()
+	cs := NewConnState(key, key, nonce, nil, nil)
+
+	// the first cell of every counter must not share a keystream
+	first := map[vo.Nonce]string{}
+	for name, n := range map[string]vo.Nonce{
+		"begin":    cs.BeginNonce(),
+		"data":     cs.DataNonce(),
+		"upstream": cs.UpstreamDataNonce(),
+	} {
+		if other, ok := first[n]; ok {
+			t.Errorf("first %s nonce equals first %s nonce", name, other)
+		}
+		first[n] = name
+		if n == nonce {
+			t.Errorf("first %s nonce is the bare base nonce", name)
+		}
+	}
+
+	// the client numbers its cells the same way
+	rawKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	cir, err := NewCircuit(vo.NewCircuitID(), []vo.RelayID{{}}, []vo.AESKey{key}, []vo.AESKey{key}, []vo.Nonce{nonce}, vo.NewRSAPrivKey(rawKey))
+	if err != nil {
+		t.Fatalf("NewCircuit: %v", err)
+	}
+	if cir.HopBeginNonce(0) != nonce.Sequence(vo.NonceSpaceBegin, 0) || cir.HopDataNonce(0) != nonce.Sequence(vo.NonceSpaceData, 0) || cir.HopUpstreamDataNonce(0) != nonce.Sequence(vo.NonceSpaceUpstream, 0) {
+		t.Error("client and relay nonces differ")
+	}
+}
@@ -0,0 +1,121 @@
+package entity
+
+import (
+	"errors"
+	"sync"
+)
+
+// Window sizes in cells, as in Tor. The package window limits how many DATA
+// cells an endpoint may send before the other end acknowledges them with a
+// SENDME; every SENDME opens the window by one increment.
+const (
+	CircuitWindowStart     = 1000
+	CircuitWindowIncrement = 100
+	StreamWindowStart      = 500
+	StreamWindowIncrement  = 50
+)
+
+var (
+	// ErrWindowClosed is returned to senders waiting on a window whose
+	// stream or circuit has gone away.
+	ErrWindowClosed = errors.New("flow window closed")
+	// ErrWindowViolation is returned when the peer sends more DATA than the
+	// window allows or acknowledges cells that were never sent.
+	ErrWindowViolation = errors.New("flow window violation")
+)
+
+// FlowWindow tracks SENDME flow control for one circuit or stream. It keeps
+// a package window for cells we send and a deliver window for cells the
+// peer sends us.
+type FlowWindow struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	start     int
+	increment int
+	pkg       int
+	deliver   int
+	closed    bool
+}
+
+// NewFlowWindow returns a window that starts at start cells and grows by
+// increment cells per SENDME.
+func NewFlowWindow(start, increment int) *FlowWindow {
+	w := &FlowWindow{start: start, increment: increment, pkg: start, deliver: start}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// NewCircuitWindow returns a window for circuit-level flow control.
+func NewCircuitWindow() *FlowWindow {
+	return NewFlowWindow(CircuitWindowStart, CircuitWindowIncrement)
+}
+
+// NewStreamWindow returns a window for stream-level flow control.
+func NewStreamWindow() *FlowWindow {
+	return NewFlowWindow(StreamWindowStart, StreamWindowIncrement)
+}
+
+// Package takes one cell from the package window, blocking until a SENDME
+// opens the window or the window is closed.
+func (w *FlowWindow) Package() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.pkg == 0 && !w.closed {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return ErrWindowClosed
+	}
+	w.pkg--
+	return nil
+}
+
+// Acknowledge handles a SENDME from the peer and wakes blocked senders.
+func (w *FlowWindow) Acknowledge() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pkg+w.increment > w.start {
+		return ErrWindowViolation
+	}
+	w.pkg += w.increment
+	w.cond.Broadcast()
+	return nil
+}
+
+// Deliver records one DATA cell handed to the application. It reports
+// whether a SENDME is now due; the caller must send it.
+func (w *FlowWindow) Deliver() (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.deliver == 0 {
+		return false, ErrWindowViolation
+	}
+	w.deliver--
+	if w.deliver <= w.start-w.increment {
+		w.deliver += w.increment
+		return true, nil
+	}
+	return false, nil
+}
+
+// PackageWindow returns how many cells may be sent before the next SENDME.
+func (w *FlowWindow) PackageWindow() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pkg
+}
+
+// DeliverWindow returns how many cells the peer may still send us.
+func (w *FlowWindow) DeliverWindow() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.deliver
+}
+
+// Close fails all current and future Package calls.
+func (w *FlowWindow) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	w.cond.Broadcast()
+}
@@ -0,0 +1,96 @@
+package entity_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+)
+
+func TestFlowWindow_PackageBlocksUntilSendme(t *testing.T) {
+	w := entity.NewFlowWindow(4, 2)
+	for i := 0; i < 4; i++ {
+		if err := w.Package(); err != nil {
+			t.Fatalf("package %d: %v", i, err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- w.Package() }()
+	select {
+	case <-done:
+		t.Fatal("Package returned with an empty window")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if err := w.Acknowledge(); err != nil {
+		t.Fatalf("acknowledge: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("package after sendme: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Package still blocked after SENDME")
+	}
+	if got := w.PackageWindow(); got != 1 {
+		t.Errorf("PackageWindow = %d, want 1", got)
+	}
+}
+
+func TestFlowWindow_CloseWakesSender(t *testing.T) {
+	w := entity.NewFlowWindow(1, 1)
+	_ = w.Package()
+
+	done := make(chan error, 1)
+	go func() { done <- w.Package() }()
+	w.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, entity.ErrWindowClosed) {
+			t.Errorf("err = %v, want ErrWindowClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not wake the sender")
+	}
+}
+
+func TestFlowWindow_AcknowledgeOverflow(t *testing.T) {
+	w := entity.NewStreamWindow()
+	if err := w.Acknowledge(); !errors.Is(err, entity.ErrWindowViolation) {
+		t.Errorf("SENDME for unsent cells: err = %v, want ErrWindowViolation", err)
+	}
+}
+
+func TestFlowWindow_Deliver(t *testing.T) {
+	tests := []struct {
+		name      string
+		window    *entity.FlowWindow
+		increment int
+	}{
+		{"circuit", entity.NewCircuitWindow(), entity.CircuitWindowIncrement},
+		{"stream", entity.NewStreamWindow(), entity.StreamWindowIncrement},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sendmes := 0
+			for i := 1; i <= 3*tt.increment; i++ {
+				due, err := tt.window.Deliver()
+				if err != nil {
+					t.Fatalf("deliver %d: %v", i, err)
+				}
+				if due {
+					sendmes++
+					if i%tt.increment != 0 {
+						t.Errorf("SENDME due after %d cells", i)
+					}
+				}
+			}
+			if sendmes != 3 {
+				t.Errorf("sendmes = %d, want 3", sendmes)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package entity
+
+import (
+	"time"
+
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// Guard is a relay the client sampled to be the first hop of its circuits.
+// Keeping the same few entries for months, instead of a fresh one per
+// circuit, makes it unlikely that an adversary's relay ever sees the
+// client's address.
+type Guard struct {
+	relayID     vo.RelayID
+	sampledAt   time.Time // when the relay joined the guard set
+	confirmedAt time.Time // when a circuit last reached it; zero if never
+	failedAt    time.Time // when a circuit last failed to reach it
+	failures    int       // consecutive failures to reach it
+}
+
+// NewGuard returns a guard for relay id sampled at now.
+func NewGuard(id vo.RelayID, now time.Time) *Guard {
+	return &Guard{relayID: id, sampledAt: now}
+}
+
+// RestoreGuard rebuilds a guard from saved state.
+func RestoreGuard(id vo.RelayID, sampledAt, confirmedAt, failedAt time.Time, failures int) *Guard {
+	return &Guard{relayID: id, sampledAt: sampledAt, confirmedAt: confirmedAt, failedAt: failedAt, failures: failures}
+}
+
+func (g *Guard) RelayID() vo.RelayID    { return g.relayID }
+func (g *Guard) SampledAt() time.Time   { return g.sampledAt }
+func (g *Guard) ConfirmedAt() time.Time { return g.confirmedAt }
+func (g *Guard) FailedAt() time.Time    { return g.failedAt }
+func (g *Guard) Failures() int          { return g.failures }
+
+// Confirm records that a circuit reached the guard at now.
+func (g *Guard) Confirm(now time.Time) {
+	g.confirmedAt = now
+	g.failures = 0
+}
+
+// Fail records that a circuit could not reach the guard at now.
+func (g *Guard) Fail(now time.Time) {
+	g.failedAt = now
+	g.failures++
+}
+
+// Expired reports whether the guard has been in the set for lifetime and
+// is due to be replaced.
+func (g *Guard) Expired(now time.Time, lifetime time.Duration) bool {
+	return !now.Before(g.sampledAt.Add(lifetime))
+}
+
+// Usable reports whether circuits may go through the guard at now. After
+// maxFailures consecutive failures it is left alone for retryAfter, then
+// gets one more chance.
+func (g *Guard) Usable(now time.Time, maxFailures int, retryAfter time.Duration) bool {
+	return g.failures < maxFailures || !now.Before(g.failedAt.Add(retryAfter))
+}
@@ -0,0 +1,44 @@
+package entity_test
+
+import (
+	"testing"
+	"time"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+func TestGuard_Lifecycle(t *testing.T) {
+	id, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	g := entity.NewGuard(id, start)
+
+	if g.Expired(start.Add(59*24*time.Hour), 60*24*time.Hour) {
+		t.Error("guard expired before its lifetime")
+	}
+	if !g.Expired(start.Add(60*24*time.Hour), 60*24*time.Hour) {
+		t.Error("guard not expired after its lifetime")
+	}
+
+	now := start.Add(time.Hour)
+	g.Fail(now)
+	g.Fail(now)
+	if !g.Usable(now, 3, time.Hour) {
+		t.Error("guard unusable below the failure limit")
+	}
+	g.Fail(now)
+	if g.Usable(now.Add(59*time.Minute), 3, time.Hour) {
+		t.Error("failing guard usable before the retry interval")
+	}
+	if !g.Usable(now.Add(time.Hour), 3, time.Hour) {
+		t.Error("failing guard not retried after the retry interval")
+	}
+
+	g.Confirm(now.Add(2 * time.Hour))
+	if g.Failures() != 0 || !g.ConfirmedAt().Equal(now.Add(2*time.Hour)) {
+		t.Errorf("confirm: failures %d, confirmed at %v", g.Failures(), g.ConfirmedAt())
+	}
+	if !g.Usable(now.Add(2*time.Hour), 3, time.Hour) {
+		t.Error("confirmed guard unusable")
+	}
+}
@@ -0,0 +1,31 @@
+package entity
+
+import (
+	"net"
+
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// Link is a connection between two nodes annotated with the protocol
+// version both ends agreed to speak on it.
+type Link struct {
+	net.Conn
+	version vo.ProtocolVersion
+}
+
+// NewLink wraps conn so that cells sent over it use the given version.
+func NewLink(conn net.Conn, version vo.ProtocolVersion) *Link {
+	return &Link{Conn: conn, version: version}
+}
+
+// Version returns the protocol version negotiated on this link.
+func (l *Link) Version() vo.ProtocolVersion { return l.version }
+
+// LinkVersion returns the protocol version used on conn. Plain connections
+// that never negotiated a version speak ProtocolV1.
+func LinkVersion(conn net.Conn) vo.ProtocolVersion {
+	if l, ok := conn.(*Link); ok && l.version.IsSupported() {
+		return l.version
+	}
+	return vo.ProtocolV1
+}
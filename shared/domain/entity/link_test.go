@@ -0,0 +1,34 @@
+package entity_test
+
+import (
+	"net"
+	"testing"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+func TestLinkVersion(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	tests := []struct {
+		name string
+		conn net.Conn
+		want vo.ProtocolVersion
+	}{
+		{"plain conn", a, vo.ProtocolV1},
+		{"v1 link", entity.NewLink(a, vo.ProtocolV1), vo.ProtocolV1},
+		{"v2 link", entity.NewLink(a, vo.ProtocolV2), vo.ProtocolV2},
+		{"unsupported version", entity.NewLink(a, vo.ProtocolVersion(0x7F)), vo.ProtocolV1},
+		{"nil conn", nil, vo.ProtocolV1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := entity.LinkVersion(tt.conn); got != tt.want {
+				t.Errorf("LinkVersion = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package entity
 
 import (
+	"slices"
 	"sync/atomic"
 	"time"
 
@@ -19,6 +20,10 @@ type Relay struct {
 	id       vo.RelayID
 	endpoint vo.Endpoint
 	pubKey   vo.RSAPubKey
+	policy   vo.ExitPolicy // ディレクトリで公開された出口ポリシー
+	bw       vo.Bandwidth  // ディレクトリで公開された帯域
+	flags    vo.RelayFlags // ディレクトリで付与されたフラグ
+	family   []vo.RelayID  // 同じ運営者のリレーとして申告された ID
 
 	status  atomic.Uint32 // RelayStatus
 	success atomic.Uint64 // セル転送成功数
@@ -42,6 +47,37 @@ func (r *Relay) ID() vo.RelayID        { return r.id }
 func (r *Relay) Endpoint() vo.Endpoint { return r.endpoint }
 func (r *Relay) PubKey() vo.RSAPubKey  { return r.pubKey }
 
+// ExitPolicy returns the exit policy the relay published.
+func (r *Relay) ExitPolicy() vo.ExitPolicy { return r.policy }
+
+// SetExitPolicy records the exit policy from the relay's directory entry.
+func (r *Relay) SetExitPolicy(p vo.ExitPolicy) { r.policy = p }
+
+// Bandwidth returns the bandwidth the relay's directory entry gives.
+func (r *Relay) Bandwidth() vo.Bandwidth { return r.bw }
+
+// SetBandwidth records the bandwidth from the relay's directory entry.
+func (r *Relay) SetBandwidth(bw vo.Bandwidth) { r.bw = bw }
+
+// Flags returns the flags the directory gave the relay.
+func (r *Relay) Flags() vo.RelayFlags { return r.flags }
+
+// SetFlags records the flags from the relay's directory entry.
+func (r *Relay) SetFlags(f vo.RelayFlags) { r.flags = f }
+
+// Family returns the relays the relay declared as run by the same operator.
+func (r *Relay) Family() []vo.RelayID { return r.family }
+
+// SetFamily records the family from the relay's directory entry.
+func (r *Relay) SetFamily(ids []vo.RelayID) { r.family = ids }
+
+// InFamily reports whether r and other declared each other as family. A
+// declaration only counts when it is mutual, so a relay cannot keep others
+// out of its circuits by naming them.
+func (r *Relay) InFamily(other *Relay) bool {
+	return slices.ContainsFunc(r.family, other.id.Equal) && slices.ContainsFunc(other.family, r.id.Equal)
+}
+
 // 状態系
 func (r *Relay) Status() RelayStatus { return RelayStatus(r.status.Load()) }
 func (r *Relay) LastUpdated() time.Time {
@@ -89,3 +89,20 @@ func TestRelay_Stats(t *testing.T) {
 		})
 	}
 }
+
+func TestRelay_InFamily(t *testing.T) {
+	ep, _ := vo.NewEndpoint("127.0.0.1", 5000)
+	a, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	b, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440001")
+	ra := entity.NewRelay(a, ep, vo.RSAPubKey{})
+	rb := entity.NewRelay(b, ep, vo.RSAPubKey{})
+
+	ra.SetFamily([]vo.RelayID{b})
+	if ra.InFamily(rb) || rb.InFamily(ra) {
+		t.Errorf("one-sided declaration counts as family")
+	}
+	rb.SetFamily([]vo.RelayID{a})
+	if !ra.InFamily(rb) || !rb.InFamily(ra) {
+		t.Errorf("mutual declaration does not count as family")
+	}
+}
@@ -0,0 +1,13 @@
+package repository
+
+import "net"
+
+// AddressMapRepository hands out virtual IP addresses that stand for host
+// names only the client can resolve, such as hidden service addresses.
+type AddressMapRepository interface {
+	// Map returns the virtual address of host, an IPv6 one if ipv6,
+	// assigning it on first use.
+	Map(host string, ipv6 bool) (net.IP, error)
+	// Lookup returns the host name a virtual address stands for.
+	Lookup(ip net.IP) (string, bool)
+}
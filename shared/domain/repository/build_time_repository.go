@@ -0,0 +1,12 @@
+package repository
+
+import vo "ikedadada/go-ptor/shared/domain/value_object"
+
+// BuildTimeRepository keeps the build times of the client's recent
+// circuits, across restarts if it is backed by a file.
+type BuildTimeRepository interface {
+	// All returns the build times, oldest first.
+	All() ([]vo.BuildTime, error)
+	// Save replaces the build times with times.
+	Save(times []vo.BuildTime) error
+}
@@ -19,3 +19,19 @@ type ConnStateRepository interface {
 	RemoveStream(circuitID vo.CircuitID, streamID vo.StreamID) error
 	DestroyAllStreams(circuitID vo.CircuitID)
 }
+
+// RelayConnStateRepository is the ConnStateRepository of a relay that also
+// extends circuits. Circuit IDs are chosen per link: a circuit is stored
+// under the ID used on its upstream link, and AddOutbound records the ID
+// used on its downstream link.
+type RelayConnStateRepository interface {
+	ConnStateRepository
+
+	// AddOutbound records out as the ID of circuit in on its downstream link.
+	AddOutbound(in, out vo.CircuitID) error
+	// OutboundID returns the downstream ID of the circuit known upstream as in.
+	OutboundID(in vo.CircuitID) (vo.CircuitID, error)
+	// InboundID returns the upstream ID of the circuit known as out on the
+	// downstream link down. The same ID on another link matches nothing.
+	InboundID(down net.Conn, out vo.CircuitID) (vo.CircuitID, error)
+}
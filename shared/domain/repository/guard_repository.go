@@ -0,0 +1,17 @@
+package repository
+
+import (
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// GuardRepository keeps the client's entry guards, across restarts if it
+// is backed by a file.
+type GuardRepository interface {
+	// All returns the guards in the order they were sampled.
+	All() ([]*entity.Guard, error)
+	// Save adds g or records its new state.
+	Save(g *entity.Guard) error
+	// Delete drops the guard for relay id from the set.
+	Delete(id vo.RelayID) error
+}
@@ -0,0 +1,12 @@
+package repository
+
+import vo "ikedadada/go-ptor/shared/domain/value_object"
+
+// ResolveCacheRepository keeps the answers of recent host name lookups for
+// as long as their TTLs allow.
+type ResolveCacheRepository interface {
+	// Get returns the cached answers for host, with the TTLs that remain.
+	Get(host string) ([]vo.ResolvedAnswer, bool)
+	// Put caches answers for host until the shortest of their TTLs runs out.
+	Put(host string, answers []vo.ResolvedAnswer)
+}
@@ -0,0 +1,24 @@
+package value_object
+
+// UnmeasuredBandwidthCap bounds the weight of a relay the directory has not
+// measured yet, in KB/s, so a relay cannot draw traffic by advertising a
+// large bandwidth it does not have.
+const UnmeasuredBandwidthCap = 20
+
+// Bandwidth is a relay's capacity in KB/s: Advertised is what the relay
+// reports about itself, Measured what the directory observed. Zero means
+// unknown.
+type Bandwidth struct {
+	Advertised uint32
+	Measured   uint32
+}
+
+// Weight returns the bandwidth path selection weighs the relay by: the
+// measured one if known, the advertised one up to UnmeasuredBandwidthCap
+// otherwise.
+func (b Bandwidth) Weight() uint64 {
+	if b.Measured > 0 {
+		return uint64(b.Measured)
+	}
+	return uint64(min(b.Advertised, UnmeasuredBandwidthCap))
+}
@@ -0,0 +1,21 @@
+package value_object
+
+import "testing"
+
+func TestBandwidth_Weight(t *testing.T) {
+	tests := []struct {
+		bw   Bandwidth
+		want uint64
+	}{
+		{Bandwidth{}, 0},
+		{Bandwidth{Advertised: 5}, 5},
+		{Bandwidth{Advertised: 10000}, UnmeasuredBandwidthCap},
+		{Bandwidth{Advertised: 10000, Measured: 3000}, 3000},
+		{Bandwidth{Measured: 700}, 700},
+	}
+	for _, tt := range tests {
+		if got := tt.bw.Weight(); got != tt.want {
+			t.Errorf("%+v Weight() = %d, want %d", tt.bw, got, tt.want)
+		}
+	}
+}
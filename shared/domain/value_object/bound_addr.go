@@ -0,0 +1,35 @@
+package value_object
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// BoundAddrBytes encodes the address an exit connected a stream to, which
+// BEGIN_ACK carries as its data: the IP, 4 bytes for IPv4 and 16 for IPv6,
+// followed by the port in network byte order. Like Tor's RELAY_CONNECTED
+// it lets the client tell the application where the stream ended up.
+func BoundAddrBytes(addr *net.TCPAddr) []byte {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	if ip == nil {
+		return nil
+	}
+	return binary.BigEndian.AppendUint16(append([]byte(nil), ip...), uint16(addr.Port))
+}
+
+// BoundAddrFrom reads the address from the data of a BEGIN_ACK. It reports
+// false if the data holds none, as is the case for hidden services and
+// older exits.
+func BoundAddrFrom(data []byte) (*net.TCPAddr, bool) {
+	if len(data) != net.IPv4len+2 && len(data) != net.IPv6len+2 {
+		return nil, false
+	}
+	n := len(data) - 2
+	return &net.TCPAddr{
+		IP:   append(net.IP(nil), data[:n]...),
+		Port: int(binary.BigEndian.Uint16(data[n:])),
+	}, true
+}
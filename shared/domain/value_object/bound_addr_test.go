@@ -0,0 +1,40 @@
+package value_object
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBoundAddr_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    *net.TCPAddr
+		wantLen int
+	}{
+		{"ipv4", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}, 6},
+		{"ipv6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, 18},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := BoundAddrBytes(tt.addr)
+			if len(data) != tt.wantLen {
+				t.Fatalf("encoded %d bytes, want %d", len(data), tt.wantLen)
+			}
+			got, ok := BoundAddrFrom(data)
+			if !ok {
+				t.Fatal("BoundAddrFrom rejected its own encoding")
+			}
+			if !got.IP.Equal(tt.addr.IP) || got.Port != tt.addr.Port {
+				t.Errorf("got %v, want %v", got, tt.addr)
+			}
+		})
+	}
+}
+
+func TestBoundAddrFrom_NoAddress(t *testing.T) {
+	for _, data := range [][]byte{nil, {1, 2, 3}, make([]byte, 10)} {
+		if _, ok := BoundAddrFrom(data); ok {
+			t.Errorf("BoundAddrFrom(%x) found an address", data)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package value_object
+
+import "time"
+
+// BuildTime is how long the client took to build a circuit of Hops hops.
+// A build that ran into its timeout has TimedOut set and Elapsed the
+// timeout it was given; it only says the build would have taken longer.
+type BuildTime struct {
+	Hops     int
+	Elapsed  time.Duration
+	TimedOut bool
+}
@@ -15,6 +15,12 @@ const (
 	CmdBegin    CellCommand = 0x06
 	CmdBeginAck CellCommand = 0x07
 	CmdCreated  CellCommand = 0x08
+	CmdVersions CellCommand = 0x09
+	CmdSendme   CellCommand = 0x0A
+	CmdBeginUDP CellCommand = 0x0B
+	CmdDatagram CellCommand = 0x0C
+	CmdResolve  CellCommand = 0x0D
+	CmdResolved CellCommand = 0x0E
 )
 
 // String returns the string representation of the cell command
@@ -36,6 +42,18 @@ func (c CellCommand) String() string {
 		return "BEGIN_ACK"
 	case CmdCreated:
 		return "CREATED"
+	case CmdVersions:
+		return "VERSIONS"
+	case CmdSendme:
+		return "SENDME"
+	case CmdBeginUDP:
+		return "BEGIN_UDP"
+	case CmdDatagram:
+		return "DATAGRAM"
+	case CmdResolve:
+		return "RESOLVE"
+	case CmdResolved:
+		return "RESOLVED"
 	default:
 		return fmt.Sprintf("UNKNOWN(%d)", byte(c))
 	}
@@ -44,7 +62,7 @@ func (c CellCommand) String() string {
 // IsValid checks if the command is a valid cell command
 func (c CellCommand) IsValid() bool {
 	switch c {
-	case CmdExtend, CmdConnect, CmdData, CmdEnd, CmdDestroy, CmdBegin, CmdBeginAck, CmdCreated:
+	case CmdExtend, CmdConnect, CmdData, CmdEnd, CmdDestroy, CmdBegin, CmdBeginAck, CmdCreated, CmdVersions, CmdSendme, CmdBeginUDP, CmdDatagram, CmdResolve, CmdResolved:
 		return true
 	default:
 		return false
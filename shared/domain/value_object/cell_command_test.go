@@ -17,6 +17,12 @@ func TestCellCommand_String(t *testing.T) {
 		{CmdBegin, "BEGIN"},
 		{CmdBeginAck, "BEGIN_ACK"},
 		{CmdCreated, "CREATED"},
+		{CmdVersions, "VERSIONS"},
+		{CmdSendme, "SENDME"},
+		{CmdBeginUDP, "BEGIN_UDP"},
+		{CmdDatagram, "DATAGRAM"},
+		{CmdResolve, "RESOLVE"},
+		{CmdResolved, "RESOLVED"},
 	}
 
 	for _, test := range tests {
@@ -50,6 +56,12 @@ func TestCellCommand_IsValid(t *testing.T) {
 		{"CmdBegin", CmdBegin},
 		{"CmdBeginAck", CmdBeginAck},
 		{"CmdCreated", CmdCreated},
+		{"CmdVersions", CmdVersions},
+		{"CmdSendme", CmdSendme},
+		{"CmdBeginUDP", CmdBeginUDP},
+		{"CmdDatagram", CmdDatagram},
+		{"CmdResolve", CmdResolve},
+		{"CmdResolved", CmdResolved},
 	}
 
 	for _, test := range tests {
@@ -67,7 +79,7 @@ func TestCellCommand_IsValid_Invalid(t *testing.T) {
 		cmd  CellCommand
 	}{
 		{"Zero value", CellCommand(0x00)},
-		{"Undefined 9", CellCommand(0x09)},
+		{"Undefined 15", CellCommand(0x0F)},
 		{"Undefined 16", CellCommand(0x10)},
 		{"Maximum byte", CellCommand(0xFF)},
 	}
@@ -95,6 +107,12 @@ func TestCellCommand_Constants(t *testing.T) {
 		{"CmdBegin", CmdBegin, 0x06},
 		{"CmdBeginAck", CmdBeginAck, 0x07},
 		{"CmdCreated", CmdCreated, 0x08},
+		{"CmdVersions", CmdVersions, 0x09},
+		{"CmdSendme", CmdSendme, 0x0A},
+		{"CmdBeginUDP", CmdBeginUDP, 0x0B},
+		{"CmdDatagram", CmdDatagram, 0x0C},
+		{"CmdResolve", CmdResolve, 0x0D},
+		{"CmdResolved", CmdResolved, 0x0E},
 	}
 
 	for _, test := range tests {
@@ -117,6 +135,12 @@ func TestCellCommand_Coverage(t *testing.T) {
 		CmdBegin,
 		CmdBeginAck,
 		CmdCreated,
+		CmdVersions,
+		CmdSendme,
+		CmdBeginUDP,
+		CmdDatagram,
+		CmdResolve,
+		CmdResolved,
 	}
 
 	for _, cmd := range allValidCommands {
@@ -0,0 +1,86 @@
+package value_object
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Datagram is a UDP datagram together with the address of the far end:
+// where it goes on the way to the exit, where it came from on the way
+// back. DATAGRAM cells carry it in the layout of a SOCKS5 UDP request
+// without the RSV and FRAG fields: [ATYP][ADDR][PORT][DATA], so the client
+// converts between the two by adding or removing three bytes.
+type Datagram struct {
+	Host string // IP literal or host name
+	Port int
+	Data []byte
+}
+
+// ErrShortDatagram is returned for data too short to hold the address its
+// type announces.
+var ErrShortDatagram = errors.New("datagram too short")
+
+// Bytes encodes the datagram. IP literals use the IPv4 or IPv6 address
+// type, anything else is sent as a host name for the exit to resolve.
+func (d Datagram) Bytes() ([]byte, error) {
+	var out []byte
+	if ip := net.ParseIP(d.Host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			out = append([]byte{SOCKS5AddrIPv4}, ip4...)
+		} else {
+			out = append([]byte{SOCKS5AddrIPv6}, ip.To16()...)
+		}
+	} else {
+		if d.Host == "" || len(d.Host) > 255 {
+			return nil, fmt.Errorf("invalid datagram host %q", d.Host)
+		}
+		out = append([]byte{SOCKS5AddrDomain, byte(len(d.Host))}, d.Host...)
+	}
+	if d.Port < 0 || d.Port > 0xFFFF {
+		return nil, fmt.Errorf("invalid datagram port %d", d.Port)
+	}
+	out = binary.BigEndian.AppendUint16(out, uint16(d.Port))
+	return append(out, d.Data...), nil
+}
+
+// DatagramFrom decodes a datagram encoded by Bytes. The data aliases b.
+func DatagramFrom(b []byte) (Datagram, error) {
+	if len(b) < 1 {
+		return Datagram{}, ErrShortDatagram
+	}
+	var d Datagram
+	var rest []byte
+	switch b[0] {
+	case SOCKS5AddrIPv4:
+		if len(b) < 1+net.IPv4len+2 {
+			return Datagram{}, ErrShortDatagram
+		}
+		d.Host = net.IP(b[1 : 1+net.IPv4len]).String()
+		rest = b[1+net.IPv4len:]
+	case SOCKS5AddrIPv6:
+		if len(b) < 1+net.IPv6len+2 {
+			return Datagram{}, ErrShortDatagram
+		}
+		d.Host = net.IP(b[1 : 1+net.IPv6len]).String()
+		rest = b[1+net.IPv6len:]
+	case SOCKS5AddrDomain:
+		if len(b) < 2 || len(b) < 2+int(b[1])+2 {
+			return Datagram{}, ErrShortDatagram
+		}
+		d.Host = string(b[2 : 2+int(b[1])])
+		rest = b[2+int(b[1]):]
+	default:
+		return Datagram{}, fmt.Errorf("unsupported datagram address type %d", b[0])
+	}
+	d.Port = int(binary.BigEndian.Uint16(rest))
+	d.Data = rest[2:]
+	return d, nil
+}
+
+// Addr returns the address in the host:port form net.ResolveUDPAddr takes.
+func (d Datagram) Addr() string {
+	return net.JoinHostPort(d.Host, strconv.Itoa(d.Port))
+}
@@ -0,0 +1,69 @@
+package value_object
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDatagram_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		d     Datagram
+		wantT byte
+	}{
+		{"ipv4", Datagram{Host: "192.0.2.1", Port: 53, Data: []byte("query")}, SOCKS5AddrIPv4},
+		{"ipv6", Datagram{Host: "2001:db8::1", Port: 443, Data: []byte("quic")}, SOCKS5AddrIPv6},
+		{"domain", Datagram{Host: "example.com", Port: 5353, Data: []byte{}}, SOCKS5AddrDomain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.d.Bytes()
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if b[0] != tt.wantT {
+				t.Errorf("address type = %d, want %d", b[0], tt.wantT)
+			}
+			got, err := DatagramFrom(b)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if got.Host != tt.d.Host || got.Port != tt.d.Port || !bytes.Equal(got.Data, tt.d.Data) {
+				t.Errorf("got %+v, want %+v", got, tt.d)
+			}
+		})
+	}
+}
+
+func TestDatagramFrom_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		short bool
+	}{
+		{"empty", nil, true},
+		{"short ipv4", []byte{SOCKS5AddrIPv4, 10, 0, 0, 1, 0}, true},
+		{"short domain", []byte{SOCKS5AddrDomain, 5, 'a', 'b'}, true},
+		{"unknown type", []byte{9, 0, 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DatagramFrom(tt.data)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if errors.Is(err, ErrShortDatagram) != tt.short {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestDatagram_BytesInvalid(t *testing.T) {
+	for _, d := range []Datagram{{Host: "", Port: 53}, {Host: "10.0.0.1", Port: 70000}} {
+		if _, err := d.Bytes(); err == nil {
+			t.Errorf("%+v encoded without error", d)
+		}
+	}
+}
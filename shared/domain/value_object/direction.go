@@ -0,0 +1,25 @@
+package value_object
+
+import "fmt"
+
+// Direction tells which way a cell travels along a circuit.
+type Direction uint8
+
+const (
+	// DirectionForward cells travel from the client towards the exit.
+	DirectionForward Direction = iota
+	// DirectionBackward cells travel from the exit back to the client.
+	DirectionBackward
+)
+
+// String returns the string representation of the direction
+func (d Direction) String() string {
+	switch d {
+	case DirectionForward:
+		return "forward"
+	case DirectionBackward:
+		return "backward"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(d))
+	}
+}
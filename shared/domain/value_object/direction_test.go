@@ -0,0 +1,20 @@
+package value_object
+
+import "testing"
+
+func TestDirection_String(t *testing.T) {
+	tests := []struct {
+		dir      Direction
+		expected string
+	}{
+		{DirectionForward, "forward"},
+		{DirectionBackward, "backward"},
+		{Direction(7), "unknown(7)"},
+	}
+
+	for _, test := range tests {
+		if got := test.dir.String(); got != test.expected {
+			t.Errorf("Direction(%d).String() = %s, want %s", test.dir, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package value_object
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DNS record types and classes the network deals with.
+const (
+	DNSTypeA     uint16 = 1
+	DNSTypeCNAME uint16 = 5
+	DNSTypeAAAA  uint16 = 28
+	DNSClassINET uint16 = 1
+)
+
+// DNS response codes (RFC 1035 section 4.1.1).
+const (
+	DNSRCodeSuccess        uint8 = 0
+	DNSRCodeFormatError    uint8 = 1
+	DNSRCodeServerFailure  uint8 = 2
+	DNSRCodeNameError      uint8 = 3
+	DNSRCodeNotImplemented uint8 = 4
+	DNSRCodeRefused        uint8 = 5
+)
+
+// dnsHeaderSize is the size of the fixed header of a DNS message.
+const dnsHeaderSize = 12
+
+// maxDNSNameLen bounds the length of a domain name on the wire.
+const maxDNSNameLen = 255
+
+// ErrShortDNSMessage is returned for a DNS message that ends early.
+var ErrShortDNSMessage = errors.New("dns message too short")
+
+// DNSQuestion is an entry of the question section.
+type DNSQuestion struct {
+	Name  string // without the trailing dot
+	Type  uint16
+	Class uint16
+}
+
+// DNSRecord is a resource record of the answer section. Data is the raw
+// RDATA: 4 bytes for A, 16 for AAAA.
+type DNSRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32 // seconds
+	Data  []byte
+}
+
+// DNSMessage is the part of a DNS message (RFC 1035) that stub resolvers
+// need: the header, the questions and the answers. The authority and
+// additional sections are ignored when reading and left empty when
+// writing.
+type DNSMessage struct {
+	ID                 uint16
+	Response           bool
+	Opcode             uint8
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	RCode              uint8
+	Questions          []DNSQuestion
+	Answers            []DNSRecord
+}
+
+// Bytes encodes the message. Names are written without compression.
+func (m *DNSMessage) Bytes() ([]byte, error) {
+	var flags uint16
+	if m.Response {
+		flags |= 1 << 15
+	}
+	flags |= uint16(m.Opcode&0x0F) << 11
+	if m.Authoritative {
+		flags |= 1 << 10
+	}
+	if m.Truncated {
+		flags |= 1 << 9
+	}
+	if m.RecursionDesired {
+		flags |= 1 << 8
+	}
+	if m.RecursionAvailable {
+		flags |= 1 << 7
+	}
+	flags |= uint16(m.RCode & 0x0F)
+
+	out := make([]byte, dnsHeaderSize, 512)
+	binary.BigEndian.PutUint16(out[0:], m.ID)
+	binary.BigEndian.PutUint16(out[2:], flags)
+	binary.BigEndian.PutUint16(out[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(out[6:], uint16(len(m.Answers)))
+
+	var err error
+	for _, q := range m.Questions {
+		if out, err = appendDNSName(out, q.Name); err != nil {
+			return nil, err
+		}
+		out = binary.BigEndian.AppendUint16(out, q.Type)
+		out = binary.BigEndian.AppendUint16(out, q.Class)
+	}
+	for _, r := range m.Answers {
+		if len(r.Data) > 0xFFFF {
+			return nil, fmt.Errorf("dns record data too long: %d bytes", len(r.Data))
+		}
+		if out, err = appendDNSName(out, r.Name); err != nil {
+			return nil, err
+		}
+		out = binary.BigEndian.AppendUint16(out, r.Type)
+		out = binary.BigEndian.AppendUint16(out, r.Class)
+		out = binary.BigEndian.AppendUint32(out, r.TTL)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(r.Data)))
+		out = append(out, r.Data...)
+	}
+	return out, nil
+}
+
+// DNSMessageFrom decodes a DNS message, following compression pointers in
+// names. Record data aliases b.
+func DNSMessageFrom(b []byte) (*DNSMessage, error) {
+	if len(b) < dnsHeaderSize {
+		return nil, ErrShortDNSMessage
+	}
+	flags := binary.BigEndian.Uint16(b[2:])
+	m := &DNSMessage{
+		ID:                 binary.BigEndian.Uint16(b[0:]),
+		Response:           flags&(1<<15) != 0,
+		Opcode:             uint8(flags>>11) & 0x0F,
+		Authoritative:      flags&(1<<10) != 0,
+		Truncated:          flags&(1<<9) != 0,
+		RecursionDesired:   flags&(1<<8) != 0,
+		RecursionAvailable: flags&(1<<7) != 0,
+		RCode:              uint8(flags & 0x0F),
+	}
+	qd := int(binary.BigEndian.Uint16(b[4:]))
+	an := int(binary.BigEndian.Uint16(b[6:]))
+
+	off := dnsHeaderSize
+	for i := 0; i < qd; i++ {
+		name, next, err := readDNSName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < next+4 {
+			return nil, ErrShortDNSMessage
+		}
+		m.Questions = append(m.Questions, DNSQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next:]),
+			Class: binary.BigEndian.Uint16(b[next+2:]),
+		})
+		off = next + 4
+	}
+	for i := 0; i < an; i++ {
+		name, next, err := readDNSName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < next+10 {
+			return nil, ErrShortDNSMessage
+		}
+		n := int(binary.BigEndian.Uint16(b[next+8:]))
+		if len(b) < next+10+n {
+			return nil, ErrShortDNSMessage
+		}
+		m.Answers = append(m.Answers, DNSRecord{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next:]),
+			Class: binary.BigEndian.Uint16(b[next+2:]),
+			TTL:   binary.BigEndian.Uint32(b[next+4:]),
+			Data:  b[next+10 : next+10+n],
+		})
+		off = next + 10 + n
+	}
+	return m, nil
+}
+
+// appendDNSName appends name as a sequence of labels.
+func appendDNSName(out []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name)+2 > maxDNSNameLen {
+		return nil, fmt.Errorf("dns name too long: %q", name)
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, fmt.Errorf("invalid dns name %q", name)
+			}
+			out = append(out, byte(len(label)))
+			out = append(out, label...)
+		}
+	}
+	return append(out, 0), nil
+}
+
+// readDNSName reads the name at off and returns it with the offset right
+// after it in the message.
+func readDNSName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1 // where the message continues once a pointer was followed
+	length := 0
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, ErrShortDNSMessage
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(b) {
+				return "", 0, ErrShortDNSMessage
+			}
+			if jumps++; jumps > maxDNSNameLen/2 {
+				return "", 0, errors.New("dns name compression loop")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+		case l&0xC0 != 0:
+			return "", 0, fmt.Errorf("unsupported dns label type %#x", l&0xC0)
+		default:
+			if off+1+l > len(b) {
+				return "", 0, ErrShortDNSMessage
+			}
+			if length += l + 1; length > maxDNSNameLen {
+				return "", 0, errors.New("dns name too long")
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
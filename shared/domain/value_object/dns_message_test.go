@@ -0,0 +1,90 @@
+package value_object
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDNSMessage_RoundTrip(t *testing.T) {
+	m := &DNSMessage{
+		ID:                 0xBEEF,
+		Response:           true,
+		RecursionDesired:   true,
+		RecursionAvailable: true,
+		RCode:              DNSRCodeNameError,
+		Questions:          []DNSQuestion{{Name: "example.com", Type: DNSTypeAAAA, Class: DNSClassINET}},
+		Answers: []DNSRecord{
+			{Name: "example.com", Type: DNSTypeA, Class: DNSClassINET, TTL: 300, Data: []byte{192, 0, 2, 1}},
+		},
+	}
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	got, err := DNSMessageFrom(b)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.ID != m.ID || !got.Response || !got.RecursionDesired || !got.RecursionAvailable || got.Truncated || got.RCode != m.RCode {
+		t.Errorf("header = %+v", got)
+	}
+	if len(got.Questions) != 1 || got.Questions[0] != m.Questions[0] {
+		t.Errorf("questions = %+v", got.Questions)
+	}
+	if len(got.Answers) != 1 {
+		t.Fatalf("answers = %+v", got.Answers)
+	}
+	a := got.Answers[0]
+	if a.Name != "example.com" || a.Type != DNSTypeA || a.TTL != 300 || !bytes.Equal(a.Data, []byte{192, 0, 2, 1}) {
+		t.Errorf("answer = %+v", a)
+	}
+}
+
+func TestDNSMessageFrom_Compression(t *testing.T) {
+	// a response whose answer names the question through a pointer to
+	// offset 12, as servers usually write it
+	b := []byte{
+		0x00, 0x01, 0x81, 0x80, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+		3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		0x00, 0x01, 0x00, 0x01,
+		0xC0, 12, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3C, 0x00, 0x04, 10, 0, 0, 1,
+	}
+	m, err := DNSMessageFrom(b)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(m.Answers) != 1 || m.Answers[0].Name != "www.example.com" || m.Answers[0].TTL != 60 {
+		t.Errorf("answers = %+v", m.Answers)
+	}
+}
+
+func TestDNSMessageFrom_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		short bool
+	}{
+		{"short header", []byte{0, 1, 0}, true},
+		{"short question", []byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 3, 'c', 'o'}, true},
+		{"pointer loop", []byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 12, 0, 1, 0, 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DNSMessageFrom(tt.data)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if errors.Is(err, ErrShortDNSMessage) != tt.short {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestDNSMessage_InvalidName(t *testing.T) {
+	m := &DNSMessage{Questions: []DNSQuestion{{Name: "bad..name", Type: DNSTypeA, Class: DNSClassINET}}}
+	if _, err := m.Bytes(); err == nil {
+		t.Error("expected error for empty label")
+	}
+}
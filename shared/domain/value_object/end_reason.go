@@ -0,0 +1,118 @@
+package value_object
+
+import "fmt"
+
+// EndReason tells why a stream or circuit was ended. END and DESTROY cells
+// carry it as their first data byte, optionally followed by a short
+// human-readable detail. The values follow the reasons Tor carries in
+// RELAY_END cells.
+type EndReason byte
+
+// MaxEndDetail is the longest detail an END or DESTROY cell carries.
+const MaxEndDetail = 64
+
+const (
+	EndReasonMisc           EndReason = 1  // no specific reason
+	EndReasonResolveFailed  EndReason = 2  // the target host name did not resolve
+	EndReasonConnectRefused EndReason = 3  // the target refused the connection
+	EndReasonExitPolicy     EndReason = 4  // the exit does not allow the target
+	EndReasonDestroy        EndReason = 5  // the circuit was torn down
+	EndReasonDone           EndReason = 6  // the connection closed normally
+	EndReasonTimeout        EndReason = 7  // connecting to the target timed out
+	EndReasonNoRoute        EndReason = 8  // the target network is unreachable
+	EndReasonHibernating    EndReason = 9  // the relay is shutting down
+	EndReasonInternal       EndReason = 10 // the relay hit an internal error
+	EndReasonResourceLimit  EndReason = 11 // the relay ran out of resources
+	EndReasonConnReset      EndReason = 12 // the target reset the connection
+	EndReasonProtocol       EndReason = 13 // a peer broke the protocol
+)
+
+// EndReasonFrom reads the reason from the data of an END or DESTROY cell.
+// Cells without a reason report EndReasonMisc.
+func EndReasonFrom(data []byte) EndReason {
+	if len(data) == 0 || data[0] == 0 {
+		return EndReasonMisc
+	}
+	return EndReason(data[0])
+}
+
+// EndDetailFrom reads the detail that follows the reason, if any.
+func EndDetailFrom(data []byte) string {
+	if len(data) <= 1 {
+		return ""
+	}
+	return string(data[1:])
+}
+
+// Bytes returns the reason as the data of an END or DESTROY cell.
+func (r EndReason) Bytes() []byte { return []byte{byte(r)} }
+
+// WithDetail returns the reason followed by detail, cut to MaxEndDetail bytes.
+func (r EndReason) WithDetail(detail string) []byte {
+	if len(detail) > MaxEndDetail {
+		detail = detail[:MaxEndDetail]
+	}
+	return append(r.Bytes(), detail...)
+}
+
+// Retryable reports whether the same request may succeed on another
+// circuit. Failures caused by the target itself are final.
+func (r EndReason) Retryable() bool {
+	switch r {
+	case EndReasonResolveFailed, EndReasonConnectRefused, EndReasonDone, EndReasonConnReset, EndReasonProtocol:
+		return false
+	default:
+		return true
+	}
+}
+
+// String returns the string representation of the reason
+func (r EndReason) String() string {
+	switch r {
+	case EndReasonMisc:
+		return "misc"
+	case EndReasonResolveFailed:
+		return "resolve failed"
+	case EndReasonConnectRefused:
+		return "connection refused"
+	case EndReasonExitPolicy:
+		return "exit policy"
+	case EndReasonDestroy:
+		return "circuit destroyed"
+	case EndReasonDone:
+		return "done"
+	case EndReasonTimeout:
+		return "timeout"
+	case EndReasonNoRoute:
+		return "no route"
+	case EndReasonHibernating:
+		return "relay shutting down"
+	case EndReasonInternal:
+		return "internal error"
+	case EndReasonResourceLimit:
+		return "resource limit"
+	case EndReasonConnReset:
+		return "connection reset"
+	case EndReasonProtocol:
+		return "protocol error"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(r))
+	}
+}
+
+// SOCKS5Reply maps the reason to the SOCKS5 reply code a client reports
+// when the stream failed to open.
+func (r EndReason) SOCKS5Reply() byte {
+	switch r {
+	case EndReasonResolveFailed, EndReasonNoRoute:
+		return SOCKS5RespHostUnreach
+	case EndReasonConnectRefused, EndReasonConnReset:
+		return SOCKS5RespConnRefused
+	case EndReasonExitPolicy:
+		return SOCKS5RespNotAllowed
+	case EndReasonTimeout:
+		return SOCKS5RespTTLExpired
+	default:
+		return SOCKS5RespGeneralError
+	}
+}
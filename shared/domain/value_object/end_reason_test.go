@@ -0,0 +1,97 @@
+package value_object
+
+import "testing"
+
+func TestEndReasonFrom(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want EndReason
+	}{
+		{"empty", nil, EndReasonMisc},
+		{"zero", []byte{0}, EndReasonMisc},
+		{"refused", EndReasonConnectRefused.Bytes(), EndReasonConnectRefused},
+		{"trailing detail", []byte{byte(EndReasonTimeout), 'x'}, EndReasonTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EndReasonFrom(tt.data); got != tt.want {
+				t.Errorf("EndReasonFrom(%v) = %s, want %s", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEndReason_WithDetail(t *testing.T) {
+	data := EndReasonTimeout.WithDetail("dial 10.0.0.1:80")
+	if got := EndReasonFrom(data); got != EndReasonTimeout {
+		t.Errorf("reason = %s, want %s", got, EndReasonTimeout)
+	}
+	if got := EndDetailFrom(data); got != "dial 10.0.0.1:80" {
+		t.Errorf("detail = %q", got)
+	}
+	if got := EndDetailFrom(EndReasonDone.Bytes()); got != "" {
+		t.Errorf("detail without one = %q", got)
+	}
+
+	long := EndReasonMisc.WithDetail(string(make([]byte, 2*MaxEndDetail)))
+	if len(long) != 1+MaxEndDetail {
+		t.Errorf("long detail kept %d bytes, want %d", len(long)-1, MaxEndDetail)
+	}
+}
+
+func TestEndReason_Retryable(t *testing.T) {
+	tests := []struct {
+		reason EndReason
+		want   bool
+	}{
+		{EndReasonExitPolicy, true},
+		{EndReasonTimeout, true},
+		{EndReasonDestroy, true},
+		{EndReasonHibernating, true},
+		{EndReasonConnectRefused, false},
+		{EndReasonResolveFailed, false},
+		{EndReasonDone, false},
+	}
+	for _, tt := range tests {
+		if got := tt.reason.Retryable(); got != tt.want {
+			t.Errorf("%s.Retryable() = %v, want %v", tt.reason, got, tt.want)
+		}
+	}
+}
+
+func TestEndReason_String(t *testing.T) {
+	tests := []struct {
+		reason   EndReason
+		expected string
+	}{
+		{EndReasonConnectRefused, "connection refused"},
+		{EndReasonExitPolicy, "exit policy"},
+		{EndReason(99), "unknown(99)"},
+	}
+	for _, test := range tests {
+		if got := test.reason.String(); got != test.expected {
+			t.Errorf("EndReason(%d).String() = %s, want %s", test.reason, got, test.expected)
+		}
+	}
+}
+
+func TestEndReason_SOCKS5Reply(t *testing.T) {
+	tests := []struct {
+		reason EndReason
+		want   byte
+	}{
+		{EndReasonResolveFailed, SOCKS5RespHostUnreach},
+		{EndReasonNoRoute, SOCKS5RespHostUnreach},
+		{EndReasonConnectRefused, SOCKS5RespConnRefused},
+		{EndReasonExitPolicy, SOCKS5RespNotAllowed},
+		{EndReasonTimeout, SOCKS5RespTTLExpired},
+		{EndReasonDestroy, SOCKS5RespGeneralError},
+		{EndReason(99), SOCKS5RespGeneralError},
+	}
+	for _, tt := range tests {
+		if got := tt.reason.SOCKS5Reply(); got != tt.want {
+			t.Errorf("%s.SOCKS5Reply() = %d, want %d", tt.reason, got, tt.want)
+		}
+	}
+}
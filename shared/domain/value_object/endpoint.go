@@ -21,4 +21,7 @@ func NewEndpoint(host string, port uint16) (Endpoint, error) {
 	return Endpoint{host, port}, nil
 }
 
+// Host はホスト名または IP アドレスを返す
+func (e Endpoint) Host() string { return e.host }
+
 func (e Endpoint) String() string { return fmt.Sprintf("%s:%d", e.host, e.port) }
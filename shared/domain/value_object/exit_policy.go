@@ -0,0 +1,253 @@
+package value_object
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ExitPolicy says which traffic an exit relay lets leave the network on
+// behalf of clients. TCP streams opened with BEGIN may reach the targets
+// the rules accept. UDP associations opened with BEGIN_UDP are allowed only
+// if AllowUDP is set, since relaying datagrams exposes the operator to a
+// different kind of abuse; their datagrams then follow the rules as well.
+type ExitPolicy struct {
+	AllowUDP bool
+	// Rules are checked in order and the first one matching a target
+	// decides. A target that no rule matches is accepted.
+	Rules []ExitPolicyRule
+}
+
+// ExitPolicyRule accepts or rejects the targets in Network on ports
+// MinPort through MaxPort. A nil Network matches every address.
+type ExitPolicyRule struct {
+	Accept  bool
+	Network *net.IPNet
+	MinPort uint16
+	MaxPort uint16
+}
+
+// DefaultExitPolicySpec is the policy of a relay that was not configured
+// otherwise: anything but private and loopback addresses.
+const DefaultExitPolicySpec = "reject private:*,accept *:*"
+
+// privateNetworks are the ranges the private keyword stands for: addresses
+// that are not reachable from the internet and often expose services that
+// trust local callers.
+var privateNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// DefaultExitPolicy returns the policy of a relay that was not configured
+// otherwise: TCP only, to anything but private and loopback addresses.
+func DefaultExitPolicy() ExitPolicy {
+	p, err := ParseExitPolicy(DefaultExitPolicySpec)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// ParseExitPolicy reads rules like Tor's ExitPolicy lines, separated by
+// commas or new lines: "accept|reject ADDR[/BITS]:PORT[-PORT]". ADDR is an
+// IPv4 address, an IPv6 address in brackets, "*" for any address or
+// "private" for the private ranges together with self, the relay's own
+// addresses. PORT "*" stands for all ports. Text after "#" is a comment.
+func ParseExitPolicy(spec string, self ...net.IP) (ExitPolicy, error) {
+	var p ExitPolicy
+	for _, line := range strings.Split(spec, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		for _, rule := range strings.Split(line, ",") {
+			rule = strings.TrimSpace(rule)
+			if rule == "" {
+				continue
+			}
+			rules, err := parseExitPolicyRule(rule, self)
+			if err != nil {
+				return ExitPolicy{}, fmt.Errorf("exit policy rule %q: %w", rule, err)
+			}
+			p.Rules = append(p.Rules, rules...)
+		}
+	}
+	return p, nil
+}
+
+// parseExitPolicyRule reads one rule, which the private keyword turns into
+// one per range.
+func parseExitPolicyRule(rule string, self []net.IP) ([]ExitPolicyRule, error) {
+	verb, pattern, ok := strings.Cut(rule, " ")
+	if !ok {
+		return nil, fmt.Errorf("want accept or reject followed by ADDR:PORT")
+	}
+	var accept bool
+	switch strings.ToLower(verb) {
+	case "accept":
+		accept = true
+	case "reject":
+	default:
+		return nil, fmt.Errorf("unknown action %q", verb)
+	}
+	pattern = strings.TrimSpace(pattern)
+	i := strings.LastIndex(pattern, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("missing port")
+	}
+	minPort, maxPort, err := parsePortRange(pattern[i+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	var networks []*net.IPNet
+	switch addr := pattern[:i]; addr {
+	case "*":
+		networks = []*net.IPNet{nil}
+	case "private":
+		for _, cidr := range privateNetworks {
+			_, n, _ := net.ParseCIDR(cidr)
+			networks = append(networks, n)
+		}
+		for _, ip := range self {
+			networks = append(networks, hostNetwork(ip))
+		}
+	default:
+		n, err := parseNetwork(addr)
+		if err != nil {
+			return nil, err
+		}
+		networks = []*net.IPNet{n}
+	}
+
+	rules := make([]ExitPolicyRule, len(networks))
+	for i, n := range networks {
+		rules[i] = ExitPolicyRule{Accept: accept, Network: n, MinPort: minPort, MaxPort: maxPort}
+	}
+	return rules, nil
+}
+
+// parseNetwork reads an address with an optional prefix length. IPv6
+// addresses are in brackets.
+func parseNetwork(s string) (*net.IPNet, error) {
+	addr, bits, hasBits := strings.Cut(s, "/")
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		addr = addr[1 : len(addr)-1]
+	} else if strings.Contains(addr, ":") {
+		return nil, fmt.Errorf("IPv6 address %q needs brackets", addr)
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", addr)
+	}
+	n := hostNetwork(ip)
+	if hasBits {
+		size, _ := n.Mask.Size()
+		ones, err := strconv.Atoi(bits)
+		if err != nil || ones < 0 || ones > size {
+			return nil, fmt.Errorf("invalid prefix length %q", bits)
+		}
+		n.Mask = net.CIDRMask(ones, size)
+		n.IP = n.IP.Mask(n.Mask)
+	}
+	return n, nil
+}
+
+// hostNetwork returns the network holding just ip.
+func hostNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+}
+
+// parsePortRange reads "*", a port or a "MIN-MAX" range.
+func parsePortRange(s string) (uint16, uint16, error) {
+	if s == "*" {
+		return 1, 65535, nil
+	}
+	lo, hi, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hi = lo
+	}
+	minPort, err1 := strconv.ParseUint(lo, 10, 16)
+	maxPort, err2 := strconv.ParseUint(hi, 10, 16)
+	if err1 != nil || err2 != nil || minPort == 0 || minPort > maxPort {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return uint16(minPort), uint16(maxPort), nil
+}
+
+func (r ExitPolicyRule) matchesPort(port int) bool {
+	return port >= int(r.MinPort) && port <= int(r.MaxPort)
+}
+
+// Allows reports whether the policy lets a stream reach ip on port.
+func (p ExitPolicy) Allows(ip net.IP, port int) bool {
+	for _, r := range p.Rules {
+		if r.matchesPort(port) && (r.Network == nil || r.Network.Contains(ip)) {
+			return r.Accept
+		}
+	}
+	return true
+}
+
+// AllowsPort reports whether the policy lets streams reach port on at
+// least some addresses. Clients pick exits with it, since they do not know
+// the address a host name resolves to at the exit.
+func (p ExitPolicy) AllowsPort(port int) bool {
+	for _, r := range p.Rules {
+		if !r.matchesPort(port) {
+			continue
+		}
+		if r.Accept {
+			return true
+		}
+		if r.Network == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the rules in the form ParseExitPolicy reads, with the
+// private keyword spelled out. Relays publish it in their directory entry.
+func (p ExitPolicy) String() string {
+	rules := make([]string, len(p.Rules))
+	for i, r := range p.Rules {
+		rules[i] = r.String()
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r ExitPolicyRule) String() string {
+	verb := "reject"
+	if r.Accept {
+		verb = "accept"
+	}
+	addr := "*"
+	if r.Network != nil {
+		ones, _ := r.Network.Mask.Size()
+		if r.Network.IP.To4() != nil {
+			addr = fmt.Sprintf("%s/%d", r.Network.IP, ones)
+		} else {
+			addr = fmt.Sprintf("[%s]/%d", r.Network.IP, ones)
+		}
+	}
+	ports := strconv.Itoa(int(r.MinPort))
+	switch {
+	case r.MinPort == 1 && r.MaxPort == 65535:
+		ports = "*"
+	case r.MinPort != r.MaxPort:
+		ports += "-" + strconv.Itoa(int(r.MaxPort))
+	}
+	return fmt.Sprintf("%s %s:%s", verb, addr, ports)
+}
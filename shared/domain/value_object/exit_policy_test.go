@@ -0,0 +1,113 @@
+package value_object
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseExitPolicy(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"accept *:*", "accept *:*", false},
+		{"accept 10.1.2.3/16:80-443, reject *:*", "accept 10.1.0.0/16:80-443,reject *:*", false},
+		{"reject 192.0.2.1:25\naccept *:* # the rest", "reject 192.0.2.1/32:25,accept *:*", false},
+		{"reject [2001:db8::1]/32:*", "reject [2001:db8::]/32:*", false},
+		{"ACCEPT *:22", "accept *:22", false},
+		{"allow *:*", "", true},
+		{"accept *", "", true},
+		{"accept *:0", "", true},
+		{"accept *:443-80", "", true},
+		{"accept 2001:db8::1:80", "", true},
+		{"accept 10.0.0.0/33:80", "", true},
+		{"accept example.com:80", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			p, err := ParseExitPolicy(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := p.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+			if again, err := ParseExitPolicy(p.String()); err != nil || again.String() != p.String() {
+				t.Errorf("%q does not parse back: %v", p.String(), err)
+			}
+		})
+	}
+}
+
+func TestExitPolicy_Allows(t *testing.T) {
+	self := net.ParseIP("203.0.113.5")
+	p, err := ParseExitPolicy("reject private:*, reject *:25, accept 198.51.100.0/24:8000-8999, reject 198.51.100.0/24:*, accept *:*", self)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	tests := []struct {
+		ip   string
+		port int
+		want bool
+	}{
+		{"127.0.0.1", 80, false},
+		{"10.20.30.40", 443, false},
+		{"192.168.1.1", 80, false},
+		{"::1", 80, false},
+		{"fd00::1", 80, false},
+		{"203.0.113.5", 5000, false}, // the relay itself
+		{"93.184.216.34", 25, false},
+		{"93.184.216.34", 443, true},
+		{"198.51.100.7", 8080, true},
+		{"198.51.100.7", 80, false},
+		{"2001:db8::1", 443, true},
+	}
+	for _, tt := range tests {
+		if got := p.Allows(net.ParseIP(tt.ip), tt.port); got != tt.want {
+			t.Errorf("Allows(%s, %d) = %v, want %v", tt.ip, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestExitPolicy_AllowsPort(t *testing.T) {
+	tests := []struct {
+		spec string
+		port int
+		want bool
+	}{
+		{DefaultExitPolicySpec, 80, true},
+		{"accept *:80,accept *:443,reject *:*", 443, true},
+		{"accept *:80,accept *:443,reject *:*", 22, false},
+		{"reject 10.0.0.0/8:*,reject *:*", 80, false},
+		{"accept 10.0.0.0/8:22,reject *:*", 22, true},
+		{"reject *:1-1024", 1024, false},
+		{"", 22, true},
+	}
+	for _, tt := range tests {
+		p, err := ParseExitPolicy(tt.spec)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tt.spec, err)
+		}
+		if got := p.AllowsPort(tt.port); got != tt.want {
+			t.Errorf("%q AllowsPort(%d) = %v, want %v", tt.spec, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultExitPolicy(t *testing.T) {
+	p := DefaultExitPolicy()
+	if p.AllowUDP {
+		t.Error("default policy allows UDP")
+	}
+	if p.Allows(net.IPv4(127, 0, 0, 1), 80) || p.Allows(net.IPv4(172, 17, 0, 2), 80) {
+		t.Error("default policy allows private addresses")
+	}
+	if !p.Allows(net.IPv4(93, 184, 216, 34), 80) {
+		t.Error("default policy rejects a public address")
+	}
+}
@@ -0,0 +1,97 @@
+package value_object
+
+import (
+	"fmt"
+	"strings"
+)
+
+// IsolationFlags choose which properties of a SOCKS request keep its
+// streams off circuits used by other requests, like the Isolate* options
+// of Tor's SocksPort. Requests that agree on every chosen property share
+// circuits; requests that differ in any of them never do.
+type IsolationFlags uint8
+
+const (
+	IsolateSOCKSAuth  IsolationFlags = 1 << iota // SOCKS username and password
+	IsolateDestAddr                              // target host as the application named it
+	IsolateDestPort                              // target port
+	IsolateClientAddr                            // source IP of the application
+)
+
+var isolationNames = []struct {
+	flag IsolationFlags
+	name string
+}{
+	{IsolateSOCKSAuth, "auth"},
+	{IsolateDestAddr, "addr"},
+	{IsolateDestPort, "port"},
+	{IsolateClientAddr, "client"},
+}
+
+// ParseIsolationFlags reads a comma separated list of auth, addr, port and
+// client. An empty string or "none" disables isolation.
+func ParseIsolationFlags(s string) (IsolationFlags, error) {
+	var f IsolationFlags
+	if s == "" || s == "none" {
+		return f, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		found := false
+		for _, n := range isolationNames {
+			if n.name == part {
+				f |= n.flag
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown isolation flag %q", part)
+		}
+	}
+	return f, nil
+}
+
+// String returns the flags in the form ParseIsolationFlags reads.
+func (f IsolationFlags) String() string {
+	var parts []string
+	for _, n := range isolationNames {
+		if f&n.flag != 0 {
+			parts = append(parts, n.name)
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ",")
+}
+
+// IsolationFields are the properties of a SOCKS request isolation can
+// depend on.
+type IsolationFields struct {
+	Username   string
+	Password   string
+	Host       string
+	Port       int
+	ClientAddr string // IP only; the source port changes per connection
+}
+
+// Key returns the isolation key of a request: the fields the flags choose,
+// quoted so that no two different choices encode alike. Requests may share
+// a circuit only if their keys are equal. Without flags the key is empty.
+func (f IsolationFlags) Key(in IsolationFields) string {
+	var b strings.Builder
+	if f&IsolateSOCKSAuth != 0 {
+		fmt.Fprintf(&b, "auth=%q:%q;", in.Username, in.Password)
+	}
+	if f&IsolateDestAddr != 0 {
+		fmt.Fprintf(&b, "addr=%q;", strings.ToLower(in.Host))
+	}
+	if f&IsolateDestPort != 0 {
+		fmt.Fprintf(&b, "port=%d;", in.Port)
+	}
+	if f&IsolateClientAddr != 0 {
+		fmt.Fprintf(&b, "client=%q;", in.ClientAddr)
+	}
+	return b.String()
+}
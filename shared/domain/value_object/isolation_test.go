@@ -0,0 +1,62 @@
+package value_object
+
+import "testing"
+
+func TestParseIsolationFlags(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    IsolationFlags
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"none", 0, false},
+		{"auth", IsolateSOCKSAuth, false},
+		{"auth, port", IsolateSOCKSAuth | IsolateDestPort, false},
+		{"addr,port,client,auth", IsolateSOCKSAuth | IsolateDestAddr | IsolateDestPort | IsolateClientAddr, false},
+		{"auth,proto", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseIsolationFlags(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("flags = %s, want %s", got, tt.want)
+			}
+			if !tt.wantErr {
+				if again, _ := ParseIsolationFlags(got.String()); again != got {
+					t.Errorf("%s does not parse back", got)
+				}
+			}
+		})
+	}
+}
+
+func TestIsolationFlags_Key(t *testing.T) {
+	base := IsolationFields{Username: "alice", Password: "pw", Host: "example.com", Port: 80, ClientAddr: "10.0.0.1"}
+	tests := []struct {
+		name  string
+		flags IsolationFlags
+		other IsolationFields
+		same  bool
+	}{
+		{"no isolation", 0, IsolationFields{Username: "bob", Host: "other.net", Port: 443}, true},
+		{"other user", IsolateSOCKSAuth, IsolationFields{Username: "bob", Password: "pw", Host: "example.com", Port: 80}, false},
+		{"other password", IsolateSOCKSAuth, IsolationFields{Username: "alice", Password: "pw2", Host: "example.com", Port: 80}, false},
+		{"split differently", IsolateSOCKSAuth, IsolationFields{Username: "alice:pw", Host: "example.com", Port: 80}, false},
+		{"auth ignores target", IsolateSOCKSAuth, IsolationFields{Username: "alice", Password: "pw", Host: "other.net", Port: 443}, true},
+		{"host case", IsolateDestAddr, IsolationFields{Host: "EXAMPLE.com"}, true},
+		{"other host", IsolateDestAddr, IsolationFields{Host: "other.net"}, false},
+		{"other port", IsolateDestPort, IsolationFields{Port: 443}, false},
+		{"other client", IsolateClientAddr, IsolationFields{ClientAddr: "10.0.0.2"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := tt.flags.Key(base), tt.flags.Key(tt.other)
+			if (a == b) != tt.same {
+				t.Errorf("keys %q and %q: equal = %v, want %v", a, b, a == b, tt.same)
+			}
+		})
+	}
+}
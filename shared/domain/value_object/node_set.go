@@ -0,0 +1,107 @@
+package value_object
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// NodeSet is a set of relays named the way Tor's EntryNodes, ExitNodes and
+// ExcludeNodes options name them: by relay ID, by identity key fingerprint
+// or by the addresses their endpoints are on. The zero value is empty.
+type NodeSet struct {
+	ids          []RelayID
+	fingerprints []string
+	prefixes     []netip.Prefix
+}
+
+// ParseNodeSet reads a comma separated list of relay IDs, fingerprints of
+// 40 hex digits, optionally with a leading "$", and addresses or CIDR
+// ranges such as 192.0.2.0/24.
+func ParseNodeSet(spec string) (NodeSet, error) {
+	var s NodeSet
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if fp, ok := parseFingerprint(item); ok {
+			s.fingerprints = append(s.fingerprints, fp)
+			continue
+		}
+		if id, err := NewRelayID(item); err == nil {
+			s.ids = append(s.ids, id)
+			continue
+		}
+		if p, err := netip.ParsePrefix(item); err == nil {
+			s.prefixes = append(s.prefixes, p.Masked())
+			continue
+		}
+		if a, err := netip.ParseAddr(item); err == nil {
+			a = a.Unmap()
+			s.prefixes = append(s.prefixes, netip.PrefixFrom(a, a.BitLen()))
+			continue
+		}
+		return NodeSet{}, fmt.Errorf("node %q is neither a relay id, a fingerprint nor an address", item)
+	}
+	return s, nil
+}
+
+// parseFingerprint returns fp in upper case if it is a fingerprint.
+func parseFingerprint(fp string) (string, bool) {
+	fp = strings.TrimPrefix(fp, "$")
+	if len(fp) != 40 {
+		return "", false
+	}
+	for _, c := range fp {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return "", false
+		}
+	}
+	return strings.ToUpper(fp), true
+}
+
+// Empty reports whether the set names no relay.
+func (s NodeSet) Empty() bool {
+	return len(s.ids) == 0 && len(s.fingerprints) == 0 && len(s.prefixes) == 0
+}
+
+// Contains reports whether the relay with id, identity key and endpoint ep
+// is in the set. Address ranges only match endpoints given as addresses.
+func (s NodeSet) Contains(id RelayID, key RSAPubKey, ep Endpoint) bool {
+	if slices.ContainsFunc(s.ids, id.Equal) {
+		return true
+	}
+	if len(s.fingerprints) > 0 && slices.Contains(s.fingerprints, key.Fingerprint()) {
+		return true
+	}
+	if len(s.prefixes) > 0 {
+		a, err := netip.ParseAddr(ep.Host())
+		if err != nil {
+			return false
+		}
+		a = a.Unmap().WithZone("")
+		for _, p := range s.prefixes {
+			if p.Contains(a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// String returns the set in the form ParseNodeSet reads.
+func (s NodeSet) String() string {
+	var items []string
+	for _, id := range s.ids {
+		items = append(items, id.String())
+	}
+	for _, fp := range s.fingerprints {
+		items = append(items, "$"+fp)
+	}
+	for _, p := range s.prefixes {
+		items = append(items, p.String())
+	}
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,77 @@
+package value_object_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+func TestParseNodeSet(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	pub := vo.RSAPubKey{PublicKey: &key.PublicKey}
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	otherPub := vo.RSAPubKey{PublicKey: &other.PublicKey}
+	id, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440000")
+	otherID, _ := vo.NewRelayID("550e8400-e29b-41d4-a716-446655440001")
+	ep := func(host string) vo.Endpoint {
+		e, err := vo.NewEndpoint(host, 5000)
+		if err != nil {
+			t.Fatalf("endpoint: %v", err)
+		}
+		return e
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		id   vo.RelayID
+		key  vo.RSAPubKey
+		ep   vo.Endpoint
+		want bool
+	}{
+		{"relay id", "550e8400-e29b-41d4-a716-446655440000", id, otherPub, ep("192.0.2.1"), true},
+		{"other relay id", "550e8400-e29b-41d4-a716-446655440000", otherID, otherPub, ep("192.0.2.1"), false},
+		{"fingerprint", "$" + pub.Fingerprint(), otherID, pub, ep("192.0.2.1"), true},
+		{"lower case fingerprint", " " + strings.ToLower(pub.Fingerprint()), otherID, pub, ep("192.0.2.1"), true},
+		{"other fingerprint", pub.Fingerprint(), otherID, otherPub, ep("192.0.2.1"), false},
+		{"cidr", "198.51.100.0/24, 192.0.2.0/24", otherID, otherPub, ep("192.0.2.77"), true},
+		{"outside cidr", "192.0.2.0/24", otherID, otherPub, ep("192.0.3.1"), false},
+		{"address", "192.0.2.1", otherID, otherPub, ep("::ffff:192.0.2.1"), true},
+		{"ipv6 cidr", "2001:db8::/32", otherID, otherPub, ep("2001:db8:1::1"), true},
+		{"host name", "0.0.0.0/0", otherID, otherPub, ep("relay1"), false},
+		{"empty", "", id, pub, ep("192.0.2.1"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := vo.ParseNodeSet(tt.spec)
+			if err != nil {
+				t.Fatalf("parse %q: %v", tt.spec, err)
+			}
+			if got := s.Contains(tt.id, tt.key, tt.ep); got != tt.want {
+				t.Errorf("Contains = %v, want %v", got, tt.want)
+			}
+			again, err := vo.ParseNodeSet(s.String())
+			if err != nil || again.String() != s.String() {
+				t.Errorf("round trip of %q gave %q, %v", s, again, err)
+			}
+		})
+	}
+
+	if s, _ := vo.ParseNodeSet(" , "); !s.Empty() {
+		t.Errorf("blank list is not empty")
+	}
+	for _, bad := range []string{"relay1", "192.0.2.0/33", "$1234"} {
+		if _, err := vo.ParseNodeSet(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
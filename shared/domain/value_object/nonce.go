@@ -21,3 +21,29 @@ func NonceFrom(b []byte) (Nonce, error) {
 	copy(n[:], b)
 	return n, nil
 }
+
+// NonceSpace separates the nonce counters that share one hop key. Without
+// it the first BEGIN and the first DATA cell of a hop would both be
+// encrypted under the base nonce and reuse one keystream.
+type NonceSpace uint8
+
+const (
+	// NonceSpaceBegin numbers BEGIN, BEGIN_UDP, RESOLVE and CONNECT cells.
+	NonceSpaceBegin NonceSpace = iota + 1
+	// NonceSpaceData numbers DATA and DATAGRAM cells towards the exit.
+	NonceSpaceData
+	// NonceSpaceUpstream numbers cells travelling back to the client.
+	NonceSpaceUpstream
+)
+
+// Sequence returns the nonce of cell seq in space. The sequence number is
+// XORed into the last 8 bytes of n and the space into the highest of them,
+// so two spaces never meet before a counter passes 2^56.
+func (n Nonce) Sequence(space NonceSpace, seq uint64) Nonce {
+	seq ^= uint64(space) << 56
+	for i := 0; i < 8; i++ {
+		n[11-i] ^= byte(seq)
+		seq >>= 8
+	}
+	return n
+}
@@ -1,6 +1,7 @@
 package value_object_test
 
 import (
+	"fmt"
 	vo "ikedadada/go-ptor/shared/domain/value_object"
 	"testing"
 )
@@ -27,3 +28,27 @@ func TestNonce_Table(t *testing.T) {
 		})
 	}
 }
+
+func TestNonce_Sequence(t *testing.T) {
+	base, err := vo.NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spaces := []vo.NonceSpace{vo.NonceSpaceBegin, vo.NonceSpaceData, vo.NonceSpaceUpstream}
+	seen := map[vo.Nonce]string{}
+	for _, space := range spaces {
+		for seq := uint64(0); seq < 4; seq++ {
+			n := base.Sequence(space, seq)
+			if prev, ok := seen[n]; ok {
+				t.Fatalf("space %d seq %d repeats the nonce of %s", space, seq, prev)
+			}
+			seen[n] = fmt.Sprintf("space %d seq %d", space, seq)
+			if [4]byte(n[:4]) != [4]byte(base[:4]) {
+				t.Errorf("space %d seq %d changed the nonce prefix", space, seq)
+			}
+		}
+	}
+	if base.Sequence(vo.NonceSpaceData, 7) != base.Sequence(vo.NonceSpaceData, 7) {
+		t.Error("Sequence is not deterministic")
+	}
+}
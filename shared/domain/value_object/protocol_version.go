@@ -7,7 +7,11 @@ type ProtocolVersion byte
 
 const (
 	// Protocol version constants
-	ProtocolV1 ProtocolVersion = 0x01
+	ProtocolV1 ProtocolVersion = 0x01 // gob-encoded payloads
+	ProtocolV2 ProtocolVersion = 0x02 // fixed length-prefixed binary payloads
+
+	// ProtocolLatest is the highest version this node can speak.
+	ProtocolLatest = ProtocolV2
 )
 
 // String returns the string representation of the protocol version
@@ -15,6 +19,8 @@ func (v ProtocolVersion) String() string {
 	switch v {
 	case ProtocolV1:
 		return "v1"
+	case ProtocolV2:
+		return "v2"
 	default:
 		return fmt.Sprintf("unknown(%d)", byte(v))
 	}
@@ -23,9 +29,44 @@ func (v ProtocolVersion) String() string {
 // IsSupported checks if the protocol version is supported
 func (v ProtocolVersion) IsSupported() bool {
 	switch v {
-	case ProtocolV1:
+	case ProtocolV1, ProtocolV2:
 		return true
 	default:
 		return false
 	}
 }
+
+// SupportedProtocolVersions lists the versions this node speaks, lowest first.
+func SupportedProtocolVersions() []ProtocolVersion {
+	return []ProtocolVersion{ProtocolV1, ProtocolV2}
+}
+
+// HighestCommonVersion returns the highest version that appears in both
+// lists and is supported by this node.
+func HighestCommonVersion(ours, theirs []ProtocolVersion) (ProtocolVersion, bool) {
+	var best ProtocolVersion
+	for _, a := range ours {
+		if !a.IsSupported() || a <= best {
+			continue
+		}
+		for _, b := range theirs {
+			if a == b {
+				best = a
+				break
+			}
+		}
+	}
+	return best, best != 0
+}
+
+// EndToEndVersion returns the payload version for end-to-end payloads
+// exchanged with a node whose highest version is theirs: the lower of
+// theirs and ProtocolLatest. Nodes that advertise no version get ProtocolV1.
+// Both ends of a circuit hop compute it from each other's advertisement, so
+// they agree without looking at the payloads.
+func EndToEndVersion(theirs ProtocolVersion) ProtocolVersion {
+	if theirs < ProtocolV1 {
+		return ProtocolV1
+	}
+	return min(theirs, ProtocolLatest)
+}
@@ -10,7 +10,8 @@ func TestProtocolVersion_String(t *testing.T) {
 		expected string
 	}{
 		{ProtocolV1, "v1"},
-		{ProtocolVersion(0x02), "unknown(2)"},
+		{ProtocolV2, "v2"},
+		{ProtocolVersion(0x03), "unknown(3)"},
 		{ProtocolVersion(0x00), "unknown(0)"},
 		{ProtocolVersion(0xFF), "unknown(255)"},
 	}
@@ -31,7 +32,8 @@ func TestProtocolVersion_IsSupported(t *testing.T) {
 		supported bool
 	}{
 		{ProtocolV1, true},
-		{ProtocolVersion(0x02), false},
+		{ProtocolV2, true},
+		{ProtocolVersion(0x03), false},
 		{ProtocolVersion(0x00), false},
 		{ProtocolVersion(0xFF), false},
 	}
@@ -51,6 +53,12 @@ func TestProtocolVersion_Constants(t *testing.T) {
 	if ProtocolV1 != 0x01 {
 		t.Errorf("ProtocolV1 = %d, want %d", ProtocolV1, 0x01)
 	}
+	if ProtocolV2 != 0x02 {
+		t.Errorf("ProtocolV2 = %d, want %d", ProtocolV2, 0x02)
+	}
+	if ProtocolLatest != ProtocolV2 {
+		t.Errorf("ProtocolLatest = %v, want %v", ProtocolLatest, ProtocolV2)
+	}
 }
 
 func TestProtocolVersion_ByteConversion(t *testing.T) {
@@ -74,6 +82,7 @@ func TestProtocolVersion_AllSupportedVersions(t *testing.T) {
 		version ProtocolVersion
 	}{
 		{"ProtocolV1", ProtocolV1},
+		{"ProtocolV2", ProtocolV2},
 	}
 
 	for _, test := range tests {
@@ -91,7 +100,7 @@ func TestProtocolVersion_UnsupportedVersions(t *testing.T) {
 		version ProtocolVersion
 	}{
 		{"Zero value", ProtocolVersion(0x00)},
-		{"Future version", ProtocolVersion(0x02)},
+		{"Future version", ProtocolVersion(0x03)},
 		{"Random version", ProtocolVersion(0x10)},
 		{"Maximum byte value", ProtocolVersion(0xFF)},
 	}
@@ -159,3 +168,46 @@ func TestProtocolVersion_EdgeCases(t *testing.T) {
 		})
 	}
 }
+
+func TestHighestCommonVersion(t *testing.T) {
+	tests := []struct {
+		name   string
+		ours   []ProtocolVersion
+		theirs []ProtocolVersion
+		want   ProtocolVersion
+		ok     bool
+	}{
+		{"both latest", SupportedProtocolVersions(), []ProtocolVersion{ProtocolV1, ProtocolV2}, ProtocolV2, true},
+		{"legacy peer", SupportedProtocolVersions(), []ProtocolVersion{ProtocolV1}, ProtocolV1, true},
+		{"peer lists newer unknown version", SupportedProtocolVersions(), []ProtocolVersion{ProtocolV2, 0x07}, ProtocolV2, true},
+		{"order does not matter", []ProtocolVersion{ProtocolV2, ProtocolV1}, []ProtocolVersion{ProtocolV2, ProtocolV1}, ProtocolV2, true},
+		{"unsupported ours ignored", []ProtocolVersion{0x07}, []ProtocolVersion{0x07}, 0, false},
+		{"nothing in common", []ProtocolVersion{ProtocolV2}, []ProtocolVersion{ProtocolV1}, 0, false},
+		{"empty peer list", SupportedProtocolVersions(), nil, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := HighestCommonVersion(tt.ours, tt.theirs)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("HighestCommonVersion() = %v, %v; want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestEndToEndVersion(t *testing.T) {
+	tests := []struct {
+		theirs ProtocolVersion
+		want   ProtocolVersion
+	}{
+		{0, ProtocolV1},
+		{ProtocolV1, ProtocolV1},
+		{ProtocolV2, ProtocolV2},
+		{0x07, ProtocolLatest},
+	}
+	for _, tt := range tests {
+		if got := EndToEndVersion(tt.theirs); got != tt.want {
+			t.Errorf("EndToEndVersion(%v) = %v, want %v", tt.theirs, got, tt.want)
+		}
+	}
+}
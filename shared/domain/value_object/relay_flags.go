@@ -0,0 +1,64 @@
+package value_object
+
+import "strings"
+
+// RelayFlags are the directory's verdicts on a relay, named like the flags
+// of Tor's consensus. Path selection uses them to decide which positions
+// of a circuit the relay may take.
+type RelayFlags uint8
+
+const (
+	RelayFlagGuard  RelayFlags = 1 << iota // suitable as the first hop
+	RelayFlagExit                          // lets traffic leave the network
+	RelayFlagStable                        // up long enough for long-lived streams
+	RelayFlagFast                          // fast enough for general circuits
+	RelayFlagHSDir                         // stores hidden service descriptors
+)
+
+var relayFlagNames = []struct {
+	flag RelayFlags
+	name string
+}{
+	{RelayFlagGuard, "Guard"},
+	{RelayFlagExit, "Exit"},
+	{RelayFlagStable, "Stable"},
+	{RelayFlagFast, "Fast"},
+	{RelayFlagHSDir, "HSDir"},
+}
+
+// ParseRelayFlags reads the flag names of a directory entry, ignoring case.
+// Names it does not know are skipped, so a directory can publish new flags
+// without breaking older clients.
+func ParseRelayFlags(names []string) RelayFlags {
+	var f RelayFlags
+	for _, name := range names {
+		for _, n := range relayFlagNames {
+			if strings.EqualFold(n.name, strings.TrimSpace(name)) {
+				f |= n.flag
+				break
+			}
+		}
+	}
+	return f
+}
+
+// Has reports whether all flags in want are set.
+func (f RelayFlags) Has(want RelayFlags) bool { return f&want == want }
+
+// Names returns the flags in the form ParseRelayFlags reads.
+func (f RelayFlags) Names() []string {
+	var names []string
+	for _, n := range relayFlagNames {
+		if f&n.flag != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
+
+func (f RelayFlags) String() string {
+	if f == 0 {
+		return "none"
+	}
+	return strings.Join(f.Names(), ",")
+}
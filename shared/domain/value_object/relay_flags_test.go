@@ -0,0 +1,44 @@
+package value_object
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseRelayFlags(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want RelayFlags
+	}{
+		{nil, 0},
+		{[]string{"Guard"}, RelayFlagGuard},
+		{[]string{"exit", " FAST "}, RelayFlagExit | RelayFlagFast},
+		{[]string{"Guard", "Exit", "Stable", "Fast", "HSDir"}, RelayFlagGuard | RelayFlagExit | RelayFlagStable | RelayFlagFast | RelayFlagHSDir},
+		{[]string{"Stable", "BadExit", "V2Dir"}, RelayFlagStable},
+	}
+	for _, tt := range tests {
+		got := ParseRelayFlags(tt.in)
+		if got != tt.want {
+			t.Errorf("ParseRelayFlags(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+		if again := ParseRelayFlags(got.Names()); again != got {
+			t.Errorf("%s does not parse back", got)
+		}
+	}
+}
+
+func TestRelayFlags_Has(t *testing.T) {
+	f := RelayFlagGuard | RelayFlagFast
+	if !f.Has(RelayFlagGuard) || !f.Has(RelayFlagGuard|RelayFlagFast) || !f.Has(0) {
+		t.Errorf("%s misses a flag it has", f)
+	}
+	if f.Has(RelayFlagExit) || f.Has(RelayFlagGuard|RelayFlagStable) {
+		t.Errorf("%s has a flag it lacks", f)
+	}
+	if got := f.Names(); !slices.Equal(got, []string{"Guard", "Fast"}) {
+		t.Errorf("Names() = %q", got)
+	}
+	if got := RelayFlags(0).String(); got != "none" {
+		t.Errorf("String() = %q, want none", got)
+	}
+}
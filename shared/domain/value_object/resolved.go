@@ -0,0 +1,80 @@
+package value_object
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Address types of RESOLVED answers, as in Tor's RELAY_RESOLVED.
+const (
+	ResolvedTypeIPv4 byte = 0x04
+	ResolvedTypeIPv6 byte = 0x06
+)
+
+// resolvedHeaderSize is the size of the TYPE and LEN fields of an answer,
+// resolvedTTLSize the size of the TTL that follows the address.
+const (
+	resolvedHeaderSize = 2
+	resolvedTTLSize    = 4
+)
+
+// ResolvedAnswer is one address the exit found for a host name, with how
+// long it may be cached.
+type ResolvedAnswer struct {
+	IP  net.IP
+	TTL time.Duration
+}
+
+// ErrShortResolved is returned for RESOLVED data that ends inside an answer.
+var ErrShortResolved = errors.New("resolved answer too short")
+
+// ResolvedBytes encodes answers as RESOLVED cells carry them, each as
+// [TYPE][LEN][ADDR][TTL] with the TTL in whole seconds. Answers beyond
+// maxSize bytes are left out.
+func ResolvedBytes(answers []ResolvedAnswer, maxSize int) []byte {
+	var out []byte
+	for _, a := range answers {
+		typ, ip := ResolvedTypeIPv4, a.IP.To4()
+		if ip == nil {
+			typ, ip = ResolvedTypeIPv6, a.IP.To16()
+		}
+		if ip == nil {
+			continue
+		}
+		if len(out)+resolvedHeaderSize+len(ip)+resolvedTTLSize > maxSize {
+			break
+		}
+		out = append(out, typ, byte(len(ip)))
+		out = append(out, ip...)
+		out = binary.BigEndian.AppendUint32(out, uint32(a.TTL/time.Second))
+	}
+	return out
+}
+
+// ResolvedFrom decodes the answers of a RESOLVED cell. Answers of unknown
+// types are skipped.
+func ResolvedFrom(b []byte) ([]ResolvedAnswer, error) {
+	var answers []ResolvedAnswer
+	for len(b) > 0 {
+		if len(b) < resolvedHeaderSize || len(b) < resolvedHeaderSize+int(b[1])+resolvedTTLSize {
+			return nil, ErrShortResolved
+		}
+		typ, n := b[0], int(b[1])
+		addr := b[resolvedHeaderSize : resolvedHeaderSize+n]
+		ttl := binary.BigEndian.Uint32(b[resolvedHeaderSize+n:])
+		b = b[resolvedHeaderSize+n+resolvedTTLSize:]
+		switch {
+		case typ == ResolvedTypeIPv4 && n == net.IPv4len, typ == ResolvedTypeIPv6 && n == net.IPv6len:
+			answers = append(answers, ResolvedAnswer{
+				IP:  append(net.IP(nil), addr...),
+				TTL: time.Duration(ttl) * time.Second,
+			})
+		case typ == ResolvedTypeIPv4 || typ == ResolvedTypeIPv6:
+			return nil, fmt.Errorf("resolved address type %d with length %d", typ, n)
+		}
+	}
+	return answers, nil
+}
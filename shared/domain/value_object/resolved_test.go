@@ -0,0 +1,76 @@
+package value_object
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResolved_RoundTrip(t *testing.T) {
+	answers := []ResolvedAnswer{
+		{IP: net.ParseIP("192.0.2.1"), TTL: 300 * time.Second},
+		{IP: net.ParseIP("2001:db8::1"), TTL: time.Minute},
+	}
+	got, err := ResolvedFrom(ResolvedBytes(answers, 498))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got) != len(answers) {
+		t.Fatalf("got %d answers, want %d", len(got), len(answers))
+	}
+	for i := range answers {
+		if !got[i].IP.Equal(answers[i].IP) || got[i].TTL != answers[i].TTL {
+			t.Errorf("answer %d = %v, want %v", i, got[i], answers[i])
+		}
+	}
+}
+
+func TestResolvedBytes_MaxSize(t *testing.T) {
+	answers := []ResolvedAnswer{
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("192.0.2.2")},
+	}
+	// one IPv4 answer takes 10 bytes
+	got, err := ResolvedFrom(ResolvedBytes(answers, 15))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got) != 1 || !got[0].IP.Equal(answers[0].IP) {
+		t.Errorf("got %v, want only the first answer", got)
+	}
+}
+
+func TestResolvedFrom_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		short bool
+	}{
+		{"short header", []byte{ResolvedTypeIPv4}, true},
+		{"short address", []byte{ResolvedTypeIPv4, 4, 10, 0}, true},
+		{"bad ipv4 length", []byte{ResolvedTypeIPv4, 2, 10, 0, 0, 0, 0, 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ResolvedFrom(tt.data)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if errors.Is(err, ErrShortResolved) != tt.short {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestResolvedFrom_SkipsUnknownTypes(t *testing.T) {
+	data := append([]byte{0x00, 3, 'a', 'b', 'c', 0, 0, 0, 0}, ResolvedBytes([]ResolvedAnswer{{IP: net.ParseIP("192.0.2.1")}}, 498)...)
+	got, err := ResolvedFrom(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got) != 1 {
+		t.Errorf("got %v, want the IPv4 answer only", got)
+	}
+}
@@ -2,9 +2,12 @@ package value_object
 
 import (
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
+	"strings"
 )
 
 type RSAPubKey struct{ *rsa.PublicKey }
@@ -32,3 +35,14 @@ func (k RSAPubKey) ToPEM() []byte {
 	b := x509.MarshalPKCS1PublicKey(k.PublicKey)
 	return pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: b})
 }
+
+// Fingerprint returns the relay identity fingerprint of the key as Tor
+// writes it: the SHA-1 digest of its PKCS #1 DER encoding in 40 upper case
+// hex digits. It is empty for a zero key.
+func (k RSAPubKey) Fingerprint() string {
+	if k.PublicKey == nil {
+		return ""
+	}
+	sum := sha1.Sum(x509.MarshalPKCS1PublicKey(k.PublicKey))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
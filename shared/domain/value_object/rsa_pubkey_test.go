@@ -6,6 +6,7 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	vo "ikedadada/go-ptor/shared/domain/value_object"
+	"strings"
 	"testing"
 )
 
@@ -40,3 +41,17 @@ func TestRSAPubKey_Table(t *testing.T) {
 		})
 	}
 }
+
+func TestRSAPubKey_Fingerprint(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	fp := vo.RSAPubKey{PublicKey: &key.PublicKey}.Fingerprint()
+	if len(fp) != 40 || fp != strings.ToUpper(fp) {
+		t.Errorf("fingerprint %q is not 40 upper case hex digits", fp)
+	}
+	if (vo.RSAPubKey{}).Fingerprint() != "" {
+		t.Errorf("zero key has a fingerprint")
+	}
+}
@@ -0,0 +1,37 @@
+package value_object
+
+import "net"
+
+// SOCKS4 and SOCKS4a protocol constants
+const (
+	SOCKS4Version    = 4
+	SOCKS4CmdConnect = 1
+	SOCKS4CmdBind    = 2
+
+	// Reply codes. Replies carry version 0 rather than SOCKS4Version.
+	SOCKS4ReplyVersion = 0
+	SOCKS4RespGranted  = 0x5A
+	SOCKS4RespRejected = 0x5B
+)
+
+// SOCKS4Reply returns a reply with the given code. SOCKS4 has no room for
+// IPv6, so bound is only sent if it is an IPv4 address.
+func SOCKS4Reply(code byte, bound *net.TCPAddr) []byte {
+	out := []byte{SOCKS4ReplyVersion, code, 0, 0, 0, 0, 0, 0}
+	if bound == nil {
+		return out
+	}
+	if ip4 := bound.IP.To4(); ip4 != nil {
+		out[2], out[3] = byte(bound.Port>>8), byte(bound.Port)
+		copy(out[4:], ip4)
+	}
+	return out
+}
+
+// SOCKS4aHost reports whether ip is one of the invalid addresses 0.0.0.x,
+// x not zero, with which a SOCKS4a request announces that a host name
+// follows the user ID.
+func SOCKS4aHost(ip net.IP) bool {
+	ip4 := ip.To4()
+	return ip4 != nil && ip4[0] == 0 && ip4[1] == 0 && ip4[2] == 0 && ip4[3] != 0
+}
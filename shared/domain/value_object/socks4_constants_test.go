@@ -0,0 +1,44 @@
+package value_object
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestSOCKS4Reply(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  byte
+		bound *net.TCPAddr
+		want  []byte
+	}{
+		{"rejected", SOCKS4RespRejected, nil, []byte{0, 0x5B, 0, 0, 0, 0, 0, 0}},
+		{"ipv4", SOCKS4RespGranted, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 8080}, []byte{0, 0x5A, 0x1f, 0x90, 192, 0, 2, 1}},
+		{"ipv6", SOCKS4RespGranted, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}, []byte{0, 0x5A, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SOCKS4Reply(tt.code, tt.bound); !bytes.Equal(got, tt.want) {
+				t.Errorf("reply = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSOCKS4aHost(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"0.0.0.1", true},
+		{"0.0.0.255", true},
+		{"0.0.0.0", false},
+		{"10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := SOCKS4aHost(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("SOCKS4aHost(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -1,26 +1,78 @@
 package value_object
 
+import "net"
+
 // SOCKS5 protocol constants
 const (
 	SOCKS5Version      = 5
 	SOCKS5MethodNoAuth = 0
 	SOCKS5CmdConnect   = 1
 
+	// Commands besides SOCKS5CmdConnect
+	SOCKS5CmdBind         = 2
+	SOCKS5CmdUDPAssociate = 3
+	SOCKS5CmdResolve      = 0xF0 // Tor extension: look a host name up at the exit
+
+	// Authentication methods besides SOCKS5MethodNoAuth
+	SOCKS5MethodUserPass     = 2
+	SOCKS5MethodNoAcceptable = 0xFF
+
+	// Username/password subnegotiation (RFC 1929)
+	SOCKS5UserPassVersion = 1
+	SOCKS5UserPassSuccess = 0
+	SOCKS5UserPassFailure = 1
+
 	// Address types
 	SOCKS5AddrIPv4   = 1
 	SOCKS5AddrDomain = 3
 	SOCKS5AddrIPv6   = 4
 
 	// Response codes
-	SOCKS5RespSuccess      = 0
-	SOCKS5RespGeneralError = 1
-	SOCKS5RespHostUnreach  = 4
+	SOCKS5RespSuccess         = 0
+	SOCKS5RespGeneralError    = 1
+	SOCKS5RespNotAllowed      = 2
+	SOCKS5RespNetUnreach      = 3
+	SOCKS5RespHostUnreach     = 4
+	SOCKS5RespConnRefused     = 5
+	SOCKS5RespTTLExpired      = 6
+	SOCKS5RespCmdUnsupported  = 7
+	SOCKS5RespAddrUnsupported = 8
 )
 
 // SOCKS5 response templates
 var (
 	SOCKS5HandshakeResp   = []byte{SOCKS5Version, SOCKS5MethodNoAuth}
+	SOCKS5UserPassResp    = []byte{SOCKS5Version, SOCKS5MethodUserPass}
+	SOCKS5NoMethodResp    = []byte{SOCKS5Version, SOCKS5MethodNoAcceptable}
+	SOCKS5UserPassOKResp  = []byte{SOCKS5UserPassVersion, SOCKS5UserPassSuccess}
+	SOCKS5UserPassBadResp = []byte{SOCKS5UserPassVersion, SOCKS5UserPassFailure}
 	SOCKS5SuccessResp     = []byte{SOCKS5Version, SOCKS5RespSuccess, 0, 1, 0, 0, 0, 0, 0, 0}
 	SOCKS5ErrorResp       = []byte{SOCKS5Version, SOCKS5RespGeneralError, 0, 1, 0, 0, 0, 0, 0, 0}
 	SOCKS5HostUnreachResp = []byte{SOCKS5Version, SOCKS5RespHostUnreach, 0, 1, 0, 0, 0, 0, 0, 0}
 )
+
+// SOCKS5Reply returns a reply with the given code and an empty IPv4 bound address.
+func SOCKS5Reply(code byte) []byte {
+	return []byte{SOCKS5Version, code, 0, 1, 0, 0, 0, 0, 0, 0}
+}
+
+// SOCKS5ReplyAddr returns a reply with the given code and bound address.
+// The address type follows the IP: IPv4 addresses, including IPv4-mapped
+// IPv6 ones, are sent as ATYP 1 and all others as ATYP 4. A nil address
+// yields the empty IPv4 address of SOCKS5Reply.
+func SOCKS5ReplyAddr(code byte, bound *net.TCPAddr) []byte {
+	if bound == nil {
+		return SOCKS5Reply(code)
+	}
+	out := []byte{SOCKS5Version, code, 0}
+	if ip4 := bound.IP.To4(); ip4 != nil {
+		out = append(append(out, SOCKS5AddrIPv4), ip4...)
+	} else {
+		ip6 := bound.IP.To16()
+		if ip6 == nil {
+			ip6 = net.IPv6zero
+		}
+		out = append(append(out, SOCKS5AddrIPv6), ip6...)
+	}
+	return append(out, byte(bound.Port>>8), byte(bound.Port))
+}
@@ -0,0 +1,27 @@
+package value_object
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestSOCKS5ReplyAddr(t *testing.T) {
+	tests := []struct {
+		name  string
+		bound *net.TCPAddr
+		want  []byte
+	}{
+		{"none", nil, []byte{5, 0, 0, SOCKS5AddrIPv4, 0, 0, 0, 0, 0, 0}},
+		{"ipv4", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 8080}, []byte{5, 0, 0, SOCKS5AddrIPv4, 192, 0, 2, 1, 0x1f, 0x90}},
+		{"ipv6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}, []byte{5, 0, 0, SOCKS5AddrIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80}},
+		{"ipv6 zero", &net.TCPAddr{IP: net.IPv6zero}, append([]byte{5, 0, 0, SOCKS5AddrIPv6}, make([]byte, 18)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SOCKS5ReplyAddr(SOCKS5RespSuccess, tt.bound); !bytes.Equal(got, tt.want) {
+				t.Errorf("reply = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
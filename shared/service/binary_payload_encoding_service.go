@@ -0,0 +1,220 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// ErrMalformedPayload is returned when a binary payload cannot be parsed.
+var ErrMalformedPayload = errors.New("malformed payload")
+
+// binaryPayloadEncodingServiceImpl encodes ProtocolV2 payloads.
+//
+// Every payload starts with [VER(1)][TYPE(1)], where TYPE is the cell command
+// the payload belongs to. Fields follow in declaration order: integers are
+// big-endian, fixed-size keys are written as-is and variable-length fields
+// are prefixed with a uint16 length.
+//
+//	EXTEND  : [NextHop] [ClientPub(32)] [MaxVersion(1)]
+//	CREATED : [RelayPub(32)] [MaxVersion(1)] [Auth]
+//	BEGIN   : [StreamID(2)] [Target]
+//	CONNECT : [Target]
+//	DATA    : [StreamID(2)] [Data]
+type binaryPayloadEncodingServiceImpl struct{}
+
+func (s *binaryPayloadEncodingServiceImpl) ForVersion(v vo.ProtocolVersion) PayloadEncodingService {
+	return payloadEncodingFor(v)
+}
+
+func (s *binaryPayloadEncodingServiceImpl) EncodeExtendPayload(p *ExtendPayloadDTO) ([]byte, error) {
+	w := newBinaryWriter(vo.CmdExtend)
+	if err := w.bytes16([]byte(p.NextHop)); err != nil {
+		return nil, err
+	}
+	w.raw(p.ClientPub[:])
+	w.raw([]byte{byte(p.MaxVersion)})
+	return w.buf, nil
+}
+
+func (s *binaryPayloadEncodingServiceImpl) DecodeExtendPayload(data []byte) (*ExtendPayloadDTO, error) {
+	r, err := newBinaryReader(data, vo.CmdExtend)
+	if err != nil {
+		return nil, err
+	}
+	var p ExtendPayloadDTO
+	p.NextHop = string(r.bytes16())
+	copy(p.ClientPub[:], r.raw(len(p.ClientPub)))
+	if b := r.raw(1); b != nil {
+		p.MaxVersion = vo.ProtocolVersion(b[0])
+	}
+	return &p, r.finish()
+}
+
+func (s *binaryPayloadEncodingServiceImpl) EncodeCreatedPayload(p *CreatedPayloadDTO) ([]byte, error) {
+	w := newBinaryWriter(vo.CmdCreated)
+	w.raw(p.RelayPub[:])
+	w.raw([]byte{byte(p.MaxVersion)})
+	if err := w.bytes16(p.Auth); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
+}
+
+func (s *binaryPayloadEncodingServiceImpl) DecodeCreatedPayload(data []byte) (*CreatedPayloadDTO, error) {
+	r, err := newBinaryReader(data, vo.CmdCreated)
+	if err != nil {
+		return nil, err
+	}
+	var p CreatedPayloadDTO
+	copy(p.RelayPub[:], r.raw(len(p.RelayPub)))
+	if b := r.raw(1); b != nil {
+		p.MaxVersion = vo.ProtocolVersion(b[0])
+	}
+	p.Auth = r.bytes16()
+	return &p, r.finish()
+}
+
+func (s *binaryPayloadEncodingServiceImpl) EncodeBeginPayload(p *BeginPayloadDTO) ([]byte, error) {
+	w := newBinaryWriter(vo.CmdBegin)
+	w.uint16(p.StreamID)
+	if err := w.bytes16([]byte(p.Target)); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
+}
+
+func (s *binaryPayloadEncodingServiceImpl) DecodeBeginPayload(data []byte) (*BeginPayloadDTO, error) {
+	r, err := newBinaryReader(data, vo.CmdBegin)
+	if err != nil {
+		return nil, err
+	}
+	var p BeginPayloadDTO
+	p.StreamID = r.uint16()
+	p.Target = string(r.bytes16())
+	return &p, r.finish()
+}
+
+func (s *binaryPayloadEncodingServiceImpl) EncodeConnectPayload(p *ConnectPayloadDTO) ([]byte, error) {
+	w := newBinaryWriter(vo.CmdConnect)
+	if err := w.bytes16([]byte(p.Target)); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
+}
+
+func (s *binaryPayloadEncodingServiceImpl) DecodeConnectPayload(data []byte) (*ConnectPayloadDTO, error) {
+	r, err := newBinaryReader(data, vo.CmdConnect)
+	if err != nil {
+		return nil, err
+	}
+	var p ConnectPayloadDTO
+	p.Target = string(r.bytes16())
+	return &p, r.finish()
+}
+
+func (s *binaryPayloadEncodingServiceImpl) EncodeDataPayload(p *DataPayloadDTO) ([]byte, error) {
+	w := newBinaryWriter(vo.CmdData)
+	w.uint16(p.StreamID)
+	if err := w.bytes16(p.Data); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
+}
+
+func (s *binaryPayloadEncodingServiceImpl) DecodeDataPayload(data []byte) (*DataPayloadDTO, error) {
+	r, err := newBinaryReader(data, vo.CmdData)
+	if err != nil {
+		return nil, err
+	}
+	var p DataPayloadDTO
+	p.StreamID = r.uint16()
+	p.Data = r.bytes16()
+	return &p, r.finish()
+}
+
+// binaryWriter appends ProtocolV2 fields to a buffer.
+type binaryWriter struct {
+	buf []byte
+}
+
+func newBinaryWriter(typ vo.CellCommand) *binaryWriter {
+	return &binaryWriter{buf: []byte{byte(vo.ProtocolV2), byte(typ)}}
+}
+
+func (w *binaryWriter) raw(b []byte) { w.buf = append(w.buf, b...) }
+
+func (w *binaryWriter) uint16(v uint16) { w.buf = binary.BigEndian.AppendUint16(w.buf, v) }
+
+func (w *binaryWriter) bytes16(b []byte) error {
+	if len(b) > math.MaxUint16 {
+		return fmt.Errorf("field too long: %d bytes", len(b))
+	}
+	w.uint16(uint16(len(b)))
+	w.raw(b)
+	return nil
+}
+
+// binaryReader consumes ProtocolV2 fields. The first short read is
+// remembered and reported by finish, so decoders can read all fields
+// before checking for errors.
+type binaryReader struct {
+	buf []byte
+	err error
+}
+
+func newBinaryReader(data []byte, typ vo.CellCommand) (*binaryReader, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("%w: short header", ErrMalformedPayload)
+	}
+	if vo.ProtocolVersion(data[0]) != vo.ProtocolV2 {
+		return nil, fmt.Errorf("%w: version %d", ErrMalformedPayload, data[0])
+	}
+	if vo.CellCommand(data[1]) != typ {
+		return nil, fmt.Errorf("%w: type %d, want %d", ErrMalformedPayload, data[1], typ)
+	}
+	return &binaryReader{buf: data[2:]}, nil
+}
+
+func (r *binaryReader) raw(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = fmt.Errorf("%w: need %d bytes, have %d", ErrMalformedPayload, n, len(r.buf))
+		return nil
+	}
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *binaryReader) uint16() uint16 {
+	b := r.raw(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *binaryReader) bytes16() []byte {
+	n := r.uint16()
+	b := r.raw(int(n))
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+func (r *binaryReader) finish() error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.buf) != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrMalformedPayload, len(r.buf))
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+func TestPayloadEncodingService_ForVersion(t *testing.T) {
+	svc := NewPayloadEncodingService()
+	tests := []struct {
+		version vo.ProtocolVersion
+		binary  bool
+	}{
+		{vo.ProtocolV1, false},
+		{vo.ProtocolV2, true},
+		{vo.ProtocolVersion(0), false},
+		{vo.ProtocolVersion(0xFF), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version.String(), func(t *testing.T) {
+			_, isBinary := svc.ForVersion(tt.version).(*binaryPayloadEncodingServiceImpl)
+			if isBinary != tt.binary {
+				t.Errorf("ForVersion(%v) binary = %v, want %v", tt.version, isBinary, tt.binary)
+			}
+		})
+	}
+}
+
+func TestBinaryPayloadEncoding_RoundTrip(t *testing.T) {
+	svc := NewPayloadEncodingService().ForVersion(vo.ProtocolV2)
+	auth := bytes.Repeat([]byte{0xAB}, 256)
+
+	tests := []struct {
+		name   string
+		in     any
+		encode func() ([]byte, error)
+		decode func([]byte) (any, error)
+	}{
+		{
+			name: "extend",
+			in:   &ExtendPayloadDTO{NextHop: "relay2:5000", ClientPub: [32]byte{1, 2, 3}, MaxVersion: vo.ProtocolV2},
+			encode: func() ([]byte, error) {
+				return svc.EncodeExtendPayload(&ExtendPayloadDTO{NextHop: "relay2:5000", ClientPub: [32]byte{1, 2, 3}, MaxVersion: vo.ProtocolV2})
+			},
+			decode: func(b []byte) (any, error) { return svc.DecodeExtendPayload(b) },
+		},
+		{
+			name: "extend to exit",
+			in:   &ExtendPayloadDTO{ClientPub: [32]byte{9}},
+			encode: func() ([]byte, error) {
+				return svc.EncodeExtendPayload(&ExtendPayloadDTO{ClientPub: [32]byte{9}})
+			},
+			decode: func(b []byte) (any, error) { return svc.DecodeExtendPayload(b) },
+		},
+		{
+			name: "created",
+			in:   &CreatedPayloadDTO{RelayPub: [32]byte{4, 5}, Auth: auth, MaxVersion: vo.ProtocolV2},
+			encode: func() ([]byte, error) {
+				return svc.EncodeCreatedPayload(&CreatedPayloadDTO{RelayPub: [32]byte{4, 5}, Auth: auth, MaxVersion: vo.ProtocolV2})
+			},
+			decode: func(b []byte) (any, error) { return svc.DecodeCreatedPayload(b) },
+		},
+		{
+			name: "begin",
+			in:   &BeginPayloadDTO{StreamID: 42, Target: "example.com:80"},
+			encode: func() ([]byte, error) {
+				return svc.EncodeBeginPayload(&BeginPayloadDTO{StreamID: 42, Target: "example.com:80"})
+			},
+			decode: func(b []byte) (any, error) { return svc.DecodeBeginPayload(b) },
+		},
+		{
+			name: "connect",
+			in:   &ConnectPayloadDTO{Target: "hidden:5000"},
+			encode: func() ([]byte, error) {
+				return svc.EncodeConnectPayload(&ConnectPayloadDTO{Target: "hidden:5000"})
+			},
+			decode: func(b []byte) (any, error) { return svc.DecodeConnectPayload(b) },
+		},
+		{
+			name: "data",
+			in:   &DataPayloadDTO{StreamID: 7, Data: []byte("hello")},
+			encode: func() ([]byte, error) {
+				return svc.EncodeDataPayload(&DataPayloadDTO{StreamID: 7, Data: []byte("hello")})
+			},
+			decode: func(b []byte) (any, error) { return svc.DecodeDataPayload(b) },
+		},
+		{
+			name: "end",
+			in:   &DataPayloadDTO{StreamID: 7},
+			encode: func() ([]byte, error) {
+				return svc.EncodeDataPayload(&DataPayloadDTO{StreamID: 7})
+			},
+			decode: func(b []byte) (any, error) { return svc.DecodeDataPayload(b) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, err := tt.encode()
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			got, err := tt.decode(enc)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.in) {
+				t.Errorf("round trip = %+v, want %+v", got, tt.in)
+			}
+		})
+	}
+}
+
+func TestBinaryPayloadEncoding_Layout(t *testing.T) {
+	svc := NewPayloadEncodingService().ForVersion(vo.ProtocolV2)
+	enc, err := svc.EncodeDataPayload(&DataPayloadDTO{StreamID: 0x0102, Data: []byte{0xAA, 0xBB}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x02, byte(vo.CmdData), 0x01, 0x02, 0x00, 0x02, 0xAA, 0xBB}
+	if !bytes.Equal(enc, want) {
+		t.Errorf("layout = %x, want %x", enc, want)
+	}
+}
+
+func TestBinaryPayloadEncoding_SmallerThanGob(t *testing.T) {
+	gobSvc := NewPayloadEncodingService()
+	binSvc := gobSvc.ForVersion(vo.ProtocolV2)
+	p := &DataPayloadDTO{StreamID: 1, Data: bytes.Repeat([]byte{0x55}, 400)}
+
+	g, err := gobSvc.EncodeDataPayload(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := binSvc.EncodeDataPayload(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overhead := len(b) - len(p.Data); overhead != 6 {
+		t.Errorf("binary overhead = %d, want 6", overhead)
+	}
+	if len(b) >= len(g) {
+		t.Errorf("binary %d bytes, gob %d bytes", len(b), len(g))
+	}
+}
+
+func TestBinaryPayloadEncoding_Malformed(t *testing.T) {
+	svc := NewPayloadEncodingService().ForVersion(vo.ProtocolV2)
+	valid, err := svc.EncodeDataPayload(&DataPayloadDTO{StreamID: 3, Data: []byte("abc")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin, err := svc.EncodeBeginPayload(&BeginPayloadDTO{StreamID: 3, Target: "a:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gobData, err := NewPayloadEncodingService().EncodeDataPayload(&DataPayloadDTO{StreamID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"header only", valid[:2]},
+		{"wrong type", begin},
+		{"gob payload", gobData},
+		{"truncated field", valid[:len(valid)-1]},
+		{"trailing bytes", append(append([]byte(nil), valid...), 0x00)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := svc.DecodeDataPayload(tt.data); !errors.Is(err, ErrMalformedPayload) {
+				t.Errorf("err = %v, want ErrMalformedPayload", err)
+			}
+		})
+	}
+}
+
+func TestTranscodePayload(t *testing.T) {
+	gobSvc := NewPayloadEncodingService()
+	binSvc := gobSvc.ForVersion(vo.ProtocolV2)
+	orig := &DataPayloadDTO{StreamID: 9, Data: []byte("payload")}
+	v1, err := gobSvc.EncodeDataPayload(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v2, err := TranscodePayload(vo.CmdData, v1, vo.ProtocolV1, vo.ProtocolV2)
+	if err != nil {
+		t.Fatalf("v1->v2: %v", err)
+	}
+	got, err := binSvc.DecodeDataPayload(v2)
+	if err != nil || !reflect.DeepEqual(got, orig) {
+		t.Fatalf("decode v2 = %+v, %v", got, err)
+	}
+
+	back, err := TranscodePayload(vo.CmdEnd, v2, vo.ProtocolV2, vo.ProtocolV1)
+	if err != nil {
+		t.Fatalf("v2->v1: %v", err)
+	}
+	if got, err := gobSvc.DecodeDataPayload(back); err != nil || !reflect.DeepEqual(got, orig) {
+		t.Fatalf("decode v1 = %+v, %v", got, err)
+	}
+
+	// onion ciphertext is passed through untouched
+	cipher := []byte{0xde, 0xad, 0xbe, 0xef}
+	out, err := TranscodePayload(vo.CmdBegin, cipher, vo.ProtocolV1, vo.ProtocolV2)
+	if err != nil || !bytes.Equal(out, cipher) {
+		t.Errorf("begin transcode = %x, %v", out, err)
+	}
+}
@@ -1,7 +1,6 @@
 package service
 
 import (
-	"encoding/binary"
 	"log"
 	"net"
 
@@ -11,13 +10,11 @@ import (
 
 // CellSenderService handles sending various types of cells over connections
 type CellSenderService interface {
-	// SendCreated sends a Created cell with the given payload
+	// SendCreated sends a CREATED cell with the given payload
 	SendCreated(w net.Conn, cid vo.CircuitID, payload []byte) error
 
-	// SendAck sends a BeginAck cell
-	SendAck(w net.Conn, cid vo.CircuitID) error
-
-	// ForwardCell sends any cell with the circuit ID prepended
+	// ForwardCell sends any cell with the circuit ID prepended, re-encoding
+	// its payload if the link speaks a different protocol version
 	ForwardCell(w net.Conn, cid vo.CircuitID, cell *entity.Cell) error
 }
 
@@ -29,43 +26,34 @@ func NewCellSenderService() CellSenderService {
 }
 
 func (s *cellSenderServiceImpl) SendCreated(w net.Conn, cid vo.CircuitID, payload []byte) error {
-	var hdr [20]byte
-	copy(hdr[:16], cid.Bytes())
-	hdr[16] = byte(vo.CmdCreated)
-	hdr[17] = byte(vo.ProtocolV1)
-	binary.BigEndian.PutUint16(hdr[18:20], uint16(len(payload)))
-	if _, err := w.Write(hdr[:]); err != nil {
-		return err
-	}
-	_, err := w.Write(payload)
-	if err != nil {
-		return err
-	}
-	log.Printf("response created cid=%s", cid.String())
-	return nil
-}
-
-func (s *cellSenderServiceImpl) SendAck(w net.Conn, cid vo.CircuitID) error {
-	c := &entity.Cell{Cmd: vo.CmdBeginAck, Version: vo.ProtocolV1}
+	c := &entity.Cell{Cmd: vo.CmdCreated, Version: entity.LinkVersion(w), Payload: payload}
 	if err := s.ForwardCell(w, cid, c); err != nil {
 		return err
 	}
-	log.Printf("response ack cid=%s", cid.String())
+	log.Printf("response created cid=%s", cid.String())
 	return nil
 }
 
 func (s *cellSenderServiceImpl) ForwardCell(w net.Conn, cid vo.CircuitID, cell *entity.Cell) error {
-	buf, err := entity.Encode(*cell)
+	out := *cell
+	if v := entity.LinkVersion(w); out.Version != v {
+		payload, err := TranscodePayload(out.Cmd, out.Payload, out.Version, v)
+		if err != nil {
+			log.Printf("forward transcode cid=%s %s->%s err=%v", cid.String(), out.Version, v, err)
+			return err
+		}
+		out.Version, out.Payload = v, payload
+	}
+	buf, err := entity.Encode(out)
 	if err != nil {
 		log.Printf("forward encode cid=%s err=%v", cid.String(), err)
 		return err
 	}
-	out := append(cid.Bytes(), buf...)
-	_, err = w.Write(out)
+	_, err = w.Write(append(cid.Bytes(), buf...))
 	if err != nil {
 		log.Printf("forward write cid=%s err=%v", cid.String(), err)
 		return err
 	}
-	log.Printf("response forward cid=%s cmd=%d len=%d", cid.String(), cell.Cmd, len(cell.Payload))
+	log.Printf("response forward cid=%s cmd=%d len=%d", cid.String(), out.Cmd, len(out.Payload))
 	return nil
 }
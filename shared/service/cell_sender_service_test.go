@@ -2,7 +2,6 @@ package service
 
 import (
 	"bytes"
-	"encoding/binary"
 	"net"
 	"testing"
 	"time"
@@ -46,53 +45,10 @@ func TestCellSenderService_SendCreated(t *testing.T) {
 		t.Fatalf("SendCreated failed: %v", err)
 	}
 
-	// Verify the written data
-	written := conn.buffer.Bytes()
-
-	// Check circuit ID (first 16 bytes)
-	if !bytes.Equal(written[:16], cid.Bytes()) {
-		t.Errorf("Circuit ID mismatch: got %x, want %x", written[:16], cid.Bytes())
-	}
-
-	// Check command (byte 16)
-	if written[16] != byte(vo.CmdCreated) {
-		t.Errorf("Command mismatch: got %d, want %d", written[16], vo.CmdCreated)
-	}
-
-	// Check version (byte 17)
-	if written[17] != byte(vo.ProtocolV1) {
-		t.Errorf("Version mismatch: got %d, want %d", written[17], vo.ProtocolV1)
-	}
-
-	// Check payload length (bytes 18-19)
-	payloadLen := binary.BigEndian.Uint16(written[18:20])
-	if payloadLen != uint16(len(payload)) {
-		t.Errorf("Payload length mismatch: got %d, want %d", payloadLen, len(payload))
-	}
-
-	// Check payload (bytes 20+)
-	if !bytes.Equal(written[20:], payload) {
-		t.Errorf("Payload mismatch: got %s, want %s", string(written[20:]), string(payload))
-	}
-}
-
-func TestCellSenderService_SendAck(t *testing.T) {
-	svc := NewCellSenderService()
-	conn := newCellSenderTestConn()
-	cid := vo.NewCircuitID()
-
-	err := svc.SendAck(conn, cid)
-	if err != nil {
-		t.Fatalf("SendAck failed: %v", err)
-	}
-
-	// Verify the written data
+	// CREATED is a regular fixed-size cell
 	written := conn.buffer.Bytes()
-
-	// Should be circuit ID + encoded cell
-	expectedSize := 16 + entity.MaxCellSize // Circuit ID + Cell
-	if len(written) != expectedSize {
-		t.Errorf("Written data length mismatch: got %d, want %d", len(written), expectedSize)
+	if len(written) != 16+entity.MaxCellSize {
+		t.Fatalf("Written data length mismatch: got %d, want %d", len(written), 16+entity.MaxCellSize)
 	}
 
 	// Check circuit ID (first 16 bytes)
@@ -100,19 +56,19 @@ func TestCellSenderService_SendAck(t *testing.T) {
 		t.Errorf("Circuit ID mismatch: got %x, want %x", written[:16], cid.Bytes())
 	}
 
-	// Decode the cell part
-	cellData := written[16:]
-	cell, err := entity.Decode(cellData)
+	cell, err := entity.Decode(written[16:])
 	if err != nil {
 		t.Fatalf("Failed to decode cell: %v", err)
 	}
-
-	if cell.Cmd != vo.CmdBeginAck {
-		t.Errorf("Command mismatch: got %d, want %d", cell.Cmd, vo.CmdBeginAck)
+	if cell.Cmd != vo.CmdCreated {
+		t.Errorf("Command mismatch: got %d, want %d", cell.Cmd, vo.CmdCreated)
 	}
 	if cell.Version != vo.ProtocolV1 {
 		t.Errorf("Version mismatch: got %d, want %d", cell.Version, vo.ProtocolV1)
 	}
+	if !bytes.Equal(cell.Payload, payload) {
+		t.Errorf("Payload mismatch: got %s, want %s", string(cell.Payload), string(payload))
+	}
 }
 
 func TestCellSenderService_ForwardCell(t *testing.T) {
@@ -199,15 +155,51 @@ func TestCellSenderService_SendCreated_EmptyPayload(t *testing.T) {
 
 	// Verify the written data
 	written := conn.buffer.Bytes()
-
-	// Should have 20 bytes total (16 for circuit ID + 4 for header)
-	if len(written) != 20 {
-		t.Errorf("Expected 20 bytes, got %d", len(written))
+	if len(written) != 16+entity.MaxCellSize {
+		t.Fatalf("Expected %d bytes, got %d", 16+entity.MaxCellSize, len(written))
 	}
 
 	// Check payload length is 0
-	payloadLen := binary.BigEndian.Uint16(written[18:20])
-	if payloadLen != 0 {
-		t.Errorf("Expected payload length 0, got %d", payloadLen)
+	cell, err := entity.Decode(written[16:])
+	if err != nil {
+		t.Fatalf("Failed to decode cell: %v", err)
+	}
+	if len(cell.Payload) != 0 {
+		t.Errorf("Expected payload length 0, got %d", len(cell.Payload))
+	}
+}
+
+func TestCellSenderService_ForwardCell_TranscodesForLink(t *testing.T) {
+	svc := NewCellSenderService()
+	raw := newCellSenderTestConn()
+	link := entity.NewLink(raw, vo.ProtocolV2)
+	cid := vo.NewCircuitID()
+
+	orig := &DataPayloadDTO{StreamID: 5, Data: []byte("hello")}
+	v1, err := NewPayloadEncodingService().EncodeDataPayload(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cell := &entity.Cell{Cmd: vo.CmdData, Version: vo.ProtocolV1, Payload: v1}
+	if err := svc.ForwardCell(link, cid, cell); err != nil {
+		t.Fatalf("ForwardCell failed: %v", err)
+	}
+
+	out, err := entity.Decode(raw.buffer.Bytes()[16:])
+	if err != nil {
+		t.Fatalf("decode cell: %v", err)
+	}
+	if out.Version != vo.ProtocolV2 {
+		t.Fatalf("Version = %v, want v2", out.Version)
+	}
+	got, err := NewPayloadEncodingService().ForVersion(out.Version).DecodeDataPayload(out.Payload)
+	if err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	if got.StreamID != orig.StreamID || !bytes.Equal(got.Data, orig.Data) {
+		t.Errorf("payload = %+v, want %+v", got, orig)
+	}
+	if cell.Version != vo.ProtocolV1 || !bytes.Equal(cell.Payload, v1) {
+		t.Error("ForwardCell modified the caller's cell")
 	}
 }
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+// CircuitPoolMetricsService counts how often a stream found a circuit ready
+// (a hit) and how often it waited for one to be built (a miss). Its String
+// method renders the counts as JSON, so it can be published with expvar.
+type CircuitPoolMetricsService interface {
+	Hit()
+	Miss()
+	Hits() uint64
+	Misses() uint64
+	String() string
+}
+
+type circuitPoolMetricsImpl struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// NewCircuitPoolMetricsService returns zeroed hit and miss counters.
+func NewCircuitPoolMetricsService() CircuitPoolMetricsService {
+	return &circuitPoolMetricsImpl{}
+}
+
+func (m *circuitPoolMetricsImpl) Hit()           { m.hits.Add(1) }
+func (m *circuitPoolMetricsImpl) Miss()          { m.misses.Add(1) }
+func (m *circuitPoolMetricsImpl) Hits() uint64   { return m.hits.Load() }
+func (m *circuitPoolMetricsImpl) Misses() uint64 { return m.misses.Load() }
+
+// String renders the counts as {"hit":3,"miss":1}.
+func (m *circuitPoolMetricsImpl) String() string {
+	b, _ := json.Marshal(map[string]uint64{"hit": m.Hits(), "miss": m.Misses()})
+	return string(b)
+}
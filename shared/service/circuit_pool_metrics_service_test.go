@@ -0,0 +1,25 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCircuitPoolMetricsService(t *testing.T) {
+	m := NewCircuitPoolMetricsService()
+	m.Hit()
+	m.Hit()
+	m.Miss()
+
+	if m.Hits() != 2 || m.Misses() != 1 {
+		t.Errorf("hits=%d misses=%d, want 2 and 1", m.Hits(), m.Misses())
+	}
+
+	var out map[string]uint64
+	if err := json.Unmarshal([]byte(m.String()), &out); err != nil {
+		t.Fatalf("String is not JSON: %v", err)
+	}
+	if out["hit"] != 2 || out["miss"] != 1 {
+		t.Errorf("unexpected JSON counts: %v", out)
+	}
+}
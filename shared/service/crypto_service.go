@@ -1,12 +1,18 @@
 package service
 
 import (
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdh"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -22,26 +28,73 @@ type CryptoService interface {
 	// New methods using value objects
 	RSAEncryptVO(pub vo.RSAPubKey, in []byte) ([]byte, error)
 	RSADecryptVO(priv vo.PrivateKey, in []byte) ([]byte, error)
-	AESSeal(key [32]byte, nonce [12]byte, plain []byte) ([]byte, error)
-	AESOpen(key [32]byte, nonce [12]byte, enc []byte) ([]byte, error)
-	// AESMultiSeal applies AESSeal repeatedly with the given keys and nonces
-	// from last to first, producing an onion-encrypted payload.
-	AESMultiSeal(keys [][32]byte, nonces [][12]byte, plain []byte) ([]byte, error)
-	// AESMultiOpen decrypts an onion-encrypted payload by sequentially
-	// applying AESOpen with each key and nonce in order.
-	AESMultiOpen(keys [][32]byte, nonces [][12]byte, enc []byte) ([]byte, error)
+	// AESCTR applies one AES-CTR layer keyed by key and nonce. Encrypting and
+	// decrypting are the same operation and the output is as long as data, so
+	// adding a layer never changes the cell size.
+	AESCTR(key [32]byte, nonce [12]byte, data []byte) ([]byte, error)
+	// AESMultiCTR applies AESCTR once per key and nonce pair. The layers
+	// commute, so the same call builds and peels an onion.
+	AESMultiCTR(keys [][32]byte, nonces [][12]byte, data []byte) ([]byte, error)
 
 	// X25519Generate returns a new private/public key pair for X25519.
 	X25519Generate() (priv, pub []byte, err error)
 	// X25519Shared derives a shared secret between priv and pub.
 	X25519Shared(priv, pub []byte) ([]byte, error)
-	// DeriveKeyNonce expands the shared secret into an AES key and nonce.
-	DeriveKeyNonce(secret []byte) ([32]byte, [12]byte, error)
+	// DeriveHopKeys expands the shared secret into the hop keys of either
+	// direction and the base nonce. Cells towards the exit and back to the
+	// client never share a key, so their keystreams cannot collide.
+	DeriveHopKeys(secret []byte) (forward, backward [32]byte, nonce [12]byte, err error)
+
+	// HandshakeAuth produces the auth tag a relay returns in CREATED. It binds
+	// both ephemeral X25519 keys to the relay's long-term identity key.
+	HandshakeAuth(identity vo.PrivateKey, clientPub, relayPub []byte) ([]byte, error)
+	// VerifyHandshakeAuth checks a CREATED auth tag against the identity key
+	// published in the directory. It returns ErrHandshakeAuth on mismatch.
+	VerifyHandshakeAuth(identity vo.RSAPubKey, clientPub, relayPub, auth []byte) error
+
+	// SealRelayBody frames data as a relay body addressed to the hop owning
+	// key, stamping it with that hop's running digest for dir. The body is
+	// padded to RelayPayloadSize. It returns the body and the digest state to
+	// store for the next cell.
+	SealRelayBody(key [32]byte, dir vo.Direction, digest [32]byte, data []byte) ([]byte, [32]byte, error)
+	// OpenRelayBody reports whether body is recognized by the hop owning key,
+	// i.e. its recognized field is zero and its digest matches. The digest is
+	// the only integrity check on relay data. On success it returns the
+	// carried data and the next digest state.
+	OpenRelayBody(key [32]byte, dir vo.Direction, digest [32]byte, body []byte) ([]byte, [32]byte, bool)
 
 	// ModifyNonceWithSequence creates a unique nonce by XORing sequence number into base nonce
 	ModifyNonceWithSequence(baseNonce [12]byte, sequence uint64) [12]byte
 }
 
+// ErrHandshakeAuth indicates that a relay could not prove possession of its identity key.
+var ErrHandshakeAuth = errors.New("handshake auth failed")
+
+// RelayBodyHeaderSize is the size of the header that SealRelayBody puts in
+// front of relay data: [RECOGNIZED(2)=0][DIGEST(4)][LEN(2)].
+const RelayBodyHeaderSize = 8
+
+// RelayPayloadSize is the size of every relay body, whatever the circuit
+// length. It leaves room for the DATA payload framing of both payload
+// encodings inside one cell.
+const RelayPayloadSize = 432
+
+// MaxRelayDataSize is the largest amount of data one relay body can carry.
+const MaxRelayDataSize = RelayPayloadSize - RelayBodyHeaderSize
+
+// relayDigestLabel domain-separates relay digests from other uses of the hop key.
+const relayDigestLabel = "go-ptor-relay-digest"
+
+// HKDF info labels of the values DeriveHopKeys expands the handshake secret into.
+const (
+	hopForwardKeyLabel  = "go-ptor forward key"
+	hopBackwardKeyLabel = "go-ptor backward key"
+	hopNonceLabel       = "go-ptor nonce"
+)
+
+// handshakeProtoID domain-separates handshake transcripts from any other use of the identity key.
+const handshakeProtoID = "go-ptor-ntor-v1"
+
 // CryptoServiceImpl implements service.CryptoService using the standard library.
 type cryptoServiceImpl struct{}
 
@@ -71,62 +124,33 @@ func (c *cryptoServiceImpl) RSADecryptVO(priv vo.PrivateKey, in []byte) ([]byte,
 	return c.RSADecrypt(key.RSAKey(), in)
 }
 
-func (*cryptoServiceImpl) AESSeal(key [32]byte, nonce [12]byte, plain []byte) ([]byte, error) {
+func (*cryptoServiceImpl) AESCTR(key [32]byte, nonce [12]byte, data []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key[:])
 	if err != nil {
 		return nil, err
 	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-	return gcm.Seal(nil, nonce[:], plain, nil), nil
-}
-
-func (*cryptoServiceImpl) AESOpen(key [32]byte, nonce [12]byte, enc []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key[:])
-	if err != nil {
-		return nil, err
-	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-	return gcm.Open(nil, nonce[:], enc, nil)
-}
-
-func (c *cryptoServiceImpl) AESMultiSeal(keys [][32]byte, nonces [][12]byte, plain []byte) ([]byte, error) {
-	if len(keys) != len(nonces) {
-		return nil, fmt.Errorf("keys/nonces length mismatch")
-	}
-	out := make([]byte, len(plain))
-	copy(out, plain)
-	var err error
-	for i := len(keys) - 1; i >= 0; i-- {
-		log.Printf("AESMultiSeal hop=%d nonce=%x key=%x", i, nonces[i], keys[i])
-		out, err = c.AESSeal(keys[i], nonces[i], out)
-		if err != nil {
-			return nil, err
-		}
-	}
+	// the nonce fills the first 12 bytes of the IV, the block counter the rest
+	var iv [aes.BlockSize]byte
+	copy(iv[:], nonce[:])
+	out := make([]byte, len(data))
+	cipher.NewCTR(block, iv[:]).XORKeyStream(out, data)
 	return out, nil
 }
 
-func (c *cryptoServiceImpl) AESMultiOpen(keys [][32]byte, nonces [][12]byte, enc []byte) ([]byte, error) {
+func (c *cryptoServiceImpl) AESMultiCTR(keys [][32]byte, nonces [][12]byte, data []byte) ([]byte, error) {
 	if len(keys) != len(nonces) {
 		return nil, fmt.Errorf("keys/nonces length mismatch")
 	}
-	out := enc
+	out := data
 	var err error
-	for i := 0; i < len(keys); i++ {
-		log.Printf("AESMultiOpen hop=%d nonce=%x key=%x", i, nonces[i], keys[i])
-		out, err = c.AESOpen(keys[i], nonces[i], out)
+	for i := range keys {
+		log.Printf("AESMultiCTR hop=%d nonce=%x key=%x", i, nonces[i], keys[i])
+		out, err = c.AESCTR(keys[i], nonces[i], out)
 		if err != nil {
-			log.Printf("AESMultiOpen hop=%d failed: %v", i, err)
 			return nil, err
 		}
 	}
-	return out, nil
+	return append([]byte(nil), out...), nil
 }
 
 func (*cryptoServiceImpl) X25519Generate() (priv, pub []byte, err error) {
@@ -151,18 +175,25 @@ func (*cryptoServiceImpl) X25519Shared(privBytes, pubBytes []byte) ([]byte, erro
 	return priv.ECDH(pub)
 }
 
-func (*cryptoServiceImpl) DeriveKeyNonce(secret []byte) ([32]byte, [12]byte, error) {
-	var key [32]byte
+func (*cryptoServiceImpl) DeriveHopKeys(secret []byte) ([32]byte, [32]byte, [12]byte, error) {
+	var forward, backward [32]byte
 	var nonce [12]byte
-	hk := hkdf.New(sha256.New, secret, nil, []byte("go-ptor"))
-	if _, err := io.ReadFull(hk, key[:]); err != nil {
-		return key, nonce, err
+	prk := hkdf.Extract(sha256.New, secret, nil)
+	outputs := []struct {
+		label string
+		out   []byte
+	}{
+		{hopForwardKeyLabel, forward[:]},
+		{hopBackwardKeyLabel, backward[:]},
+		// Derive base nonce from secret - will be modified per message
+		{hopNonceLabel, nonce[:]},
 	}
-	// Derive base nonce from secret - will be modified per message
-	if _, err := io.ReadFull(hk, nonce[:]); err != nil {
-		return key, nonce, err
+	for _, o := range outputs {
+		if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte(o.label)), o.out); err != nil {
+			return forward, backward, nonce, err
+		}
 	}
-	return key, nonce, nil
+	return forward, backward, nonce, nil
 }
 
 // ModifyNonceWithSequence creates a unique nonce by XORing sequence number into base nonce
@@ -177,3 +208,92 @@ func (*cryptoServiceImpl) ModifyNonceWithSequence(baseNonce [12]byte, sequence u
 
 	return nonce
 }
+
+func (*cryptoServiceImpl) HandshakeAuth(identity vo.PrivateKey, clientPub, relayPub []byte) ([]byte, error) {
+	key, ok := identity.(*vo.RSAPrivKey)
+	if !ok || key.RSAKey() == nil {
+		return nil, fmt.Errorf("handshake auth requires an RSA identity key")
+	}
+	digest, err := handshakeTranscript(&key.RSAKey().PublicKey, clientPub, relayPub)
+	if err != nil {
+		return nil, err
+	}
+	return rsa.SignPSS(rand.Reader, key.RSAKey(), crypto.SHA256, digest, nil)
+}
+
+func (*cryptoServiceImpl) VerifyHandshakeAuth(identity vo.RSAPubKey, clientPub, relayPub, auth []byte) error {
+	if identity.PublicKey == nil {
+		return fmt.Errorf("%w: no identity key", ErrHandshakeAuth)
+	}
+	if len(auth) == 0 {
+		return fmt.Errorf("%w: missing auth tag", ErrHandshakeAuth)
+	}
+	digest, err := handshakeTranscript(identity.PublicKey, clientPub, relayPub)
+	if err != nil {
+		return err
+	}
+	if err := rsa.VerifyPSS(identity.PublicKey, crypto.SHA256, digest, auth, nil); err != nil {
+		return fmt.Errorf("%w: %v", ErrHandshakeAuth, err)
+	}
+	return nil
+}
+
+// handshakeTranscript hashes everything both sides saw during the handshake.
+// Signing the relay's own identity alongside both ephemeral keys stops a
+// man-in-the-middle from replaying a CREATED reply issued for another client.
+func handshakeTranscript(identity *rsa.PublicKey, clientPub, relayPub []byte) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(identity)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write([]byte(handshakeProtoID))
+	h.Write(der)
+	h.Write(clientPub)
+	h.Write(relayPub)
+	return h.Sum(nil), nil
+}
+
+func (*cryptoServiceImpl) SealRelayBody(key [32]byte, dir vo.Direction, digest [32]byte, data []byte) ([]byte, [32]byte, error) {
+	if len(data) > MaxRelayDataSize {
+		return nil, digest, fmt.Errorf("relay data too long: %d bytes", len(data))
+	}
+	body := make([]byte, RelayPayloadSize)
+	binary.BigEndian.PutUint16(body[6:8], uint16(len(data)))
+	copy(body[RelayBodyHeaderSize:], data)
+	next := relayDigest(key, dir, digest, body)
+	copy(body[2:6], next[:4])
+	return body, next, nil
+}
+
+func (*cryptoServiceImpl) OpenRelayBody(key [32]byte, dir vo.Direction, digest [32]byte, body []byte) ([]byte, [32]byte, bool) {
+	if len(body) != RelayPayloadSize || body[0] != 0 || body[1] != 0 {
+		return nil, digest, false
+	}
+	n := int(binary.BigEndian.Uint16(body[6:8]))
+	if n > MaxRelayDataSize {
+		return nil, digest, false
+	}
+	zeroed := append([]byte(nil), body...)
+	clear(zeroed[2:6])
+	next := relayDigest(key, dir, digest, zeroed)
+	if subtle.ConstantTimeCompare(next[:4], body[2:6]) != 1 {
+		return nil, digest, false
+	}
+	return zeroed[RelayBodyHeaderSize : RelayBodyHeaderSize+n], next, true
+}
+
+// relayDigest chains body into the running digest of one hop and direction.
+// The digest field of body must be zero. Only the hop sharing key can
+// produce a matching value, so a relay that peels a layer and finds a match
+// knows the cell was meant for it rather than for a hop further along.
+func relayDigest(key [32]byte, dir vo.Direction, prev [32]byte, body []byte) [32]byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(relayDigestLabel))
+	mac.Write([]byte{byte(dir)})
+	mac.Write(prev[:])
+	mac.Write(body)
+	var out [32]byte
+	copy(out[:], mac.Sum(nil))
+	return out
+}
@@ -3,7 +3,12 @@ package service
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
+	"math"
 	"testing"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
 )
 
 func TestCryptoService_RSAEncryptDecrypt(t *testing.T) {
@@ -55,10 +60,9 @@ func TestCryptoService_RSADecrypt_InvalidInput(t *testing.T) {
 	}
 }
 
-func TestCryptoService_AESSealOpen(t *testing.T) {
+func TestCryptoService_AESCTR(t *testing.T) {
 	crypto := NewCryptoService()
 
-	// Test key and nonce
 	var key [32]byte
 	var nonce [12]byte
 	rand.Read(key[:])
@@ -66,44 +70,35 @@ func TestCryptoService_AESSealOpen(t *testing.T) {
 
 	testData := []byte("Hello, AES encryption!")
 
-	// Test sealing
-	sealed, err := crypto.AESSeal(key, nonce, testData)
+	enc, err := crypto.AESCTR(key, nonce, testData)
 	if err != nil {
-		t.Fatalf("AES seal failed: %v", err)
+		t.Fatalf("AES-CTR encrypt failed: %v", err)
 	}
-
-	if len(sealed) == 0 {
-		t.Error("Sealed data should not be empty")
+	if len(enc) != len(testData) {
+		t.Errorf("ciphertext length = %d, want %d", len(enc), len(testData))
+	}
+	if string(enc) == string(testData) {
+		t.Error("ciphertext equals plaintext")
 	}
 
-	// Test opening
-	opened, err := crypto.AESOpen(key, nonce, sealed)
+	dec, err := crypto.AESCTR(key, nonce, enc)
 	if err != nil {
-		t.Fatalf("AES open failed: %v", err)
+		t.Fatalf("AES-CTR decrypt failed: %v", err)
 	}
-
-	if string(opened) != string(testData) {
-		t.Errorf("Opened data mismatch. Expected: %s, Got: %s", testData, opened)
+	if string(dec) != string(testData) {
+		t.Errorf("Decrypted data mismatch. Expected: %s, Got: %s", testData, dec)
 	}
-}
 
-func TestCryptoService_AESOpen_InvalidInput(t *testing.T) {
-	crypto := NewCryptoService()
-
-	var key [32]byte
-	var nonce [12]byte
-	rand.Read(key[:])
-	rand.Read(nonce[:])
-
-	// Test with invalid encrypted data
-	invalidData := []byte("invalid encrypted data")
-	_, err := crypto.AESOpen(key, nonce, invalidData)
-	if err == nil {
-		t.Error("Expected AES open to fail with invalid input")
+	// a different nonce yields a different key stream
+	other := nonce
+	other[11] ^= 1
+	enc2, _ := crypto.AESCTR(key, other, testData)
+	if string(enc2) == string(enc) {
+		t.Error("different nonces produced the same ciphertext")
 	}
 }
 
-func TestCryptoService_AESMultiSeal_OnionEncryption(t *testing.T) {
+func TestCryptoService_AESMultiCTR_OnionEncryption(t *testing.T) {
 	crypto := NewCryptoService()
 
 	// Test 3-hop onion encryption
@@ -118,20 +113,17 @@ func TestCryptoService_AESMultiSeal_OnionEncryption(t *testing.T) {
 
 	testData := []byte("Onion routing message")
 
-	// Multi-layer encryption
-	encrypted, err := crypto.AESMultiSeal(keys, nonces, testData)
+	encrypted, err := crypto.AESMultiCTR(keys, nonces, testData)
 	if err != nil {
-		t.Fatalf("AES multi-seal failed: %v", err)
+		t.Fatalf("AES multi-layer encryption failed: %v", err)
 	}
-
-	if len(encrypted) == 0 {
-		t.Error("Multi-sealed data should not be empty")
+	if len(encrypted) != len(testData) {
+		t.Errorf("onion length = %d, want %d", len(encrypted), len(testData))
 	}
 
-	// Multi-layer decryption
-	decrypted, err := crypto.AESMultiOpen(keys, nonces, encrypted)
+	decrypted, err := crypto.AESMultiCTR(keys, nonces, encrypted)
 	if err != nil {
-		t.Fatalf("AES multi-open failed: %v", err)
+		t.Fatalf("AES multi-layer decryption failed: %v", err)
 	}
 
 	if string(decrypted) != string(testData) {
@@ -139,23 +131,15 @@ func TestCryptoService_AESMultiSeal_OnionEncryption(t *testing.T) {
 	}
 }
 
-func TestCryptoService_AESMultiSeal_MismatchedLengths(t *testing.T) {
+func TestCryptoService_AESMultiCTR_MismatchedLengths(t *testing.T) {
 	crypto := NewCryptoService()
 
 	// Mismatched keys and nonces lengths
 	keys := make([][32]byte, 2)
 	nonces := make([][12]byte, 3)
 
-	testData := []byte("test")
-
-	_, err := crypto.AESMultiSeal(keys, nonces, testData)
-	if err == nil {
-		t.Error("Expected AES multi-seal to fail with mismatched lengths")
-	}
-
-	_, err = crypto.AESMultiOpen(keys, nonces, testData)
-	if err == nil {
-		t.Error("Expected AES multi-open to fail with mismatched lengths")
+	if _, err := crypto.AESMultiCTR(keys, nonces, []byte("test")); err == nil {
+		t.Error("Expected AES multi-layer encryption to fail with mismatched lengths")
 	}
 }
 
@@ -231,39 +215,217 @@ func TestCryptoService_X25519Shared_InvalidInput(t *testing.T) {
 	}
 }
 
-func TestCryptoService_DeriveKeyNonce(t *testing.T) {
+func TestCryptoService_DeriveHopKeys(t *testing.T) {
 	crypto := NewCryptoService()
 
 	secret := []byte("shared secret for key derivation")
 
-	key, nonce, err := crypto.DeriveKeyNonce(secret)
+	forward, backward, nonce, err := crypto.DeriveHopKeys(secret)
 	if err != nil {
 		t.Fatalf("Key/nonce derivation failed: %v", err)
 	}
 
-	// Check key length
-	if len(key) != 32 {
-		t.Errorf("Key should be 32 bytes, got %d", len(key))
+	// The directions must never share a keystream
+	if forward == backward {
+		t.Error("Forward and backward keys should differ")
 	}
-
-	// Check nonce length
-	if len(nonce) != 12 {
-		t.Errorf("Nonce should be 12 bytes, got %d", len(nonce))
+	if forward == ([32]byte{}) || backward == ([32]byte{}) || nonce == ([12]byte{}) {
+		t.Error("Derived values should not be zero")
 	}
 
 	// Derivation should be deterministic
-	key2, nonce2, err := crypto.DeriveKeyNonce(secret)
+	forward2, backward2, nonce2, err := crypto.DeriveHopKeys(secret)
 	if err != nil {
 		t.Fatalf("Second key/nonce derivation failed: %v", err)
 	}
 
-	if key != key2 {
+	if forward != forward2 || backward != backward2 {
 		t.Error("Key derivation should be deterministic")
 	}
 
 	if nonce != nonce2 {
 		t.Error("Nonce derivation should be deterministic")
 	}
+
+	// Another secret gives other keys
+	other, _, _, err := crypto.DeriveHopKeys([]byte("another shared secret"))
+	if err != nil {
+		t.Fatalf("Derivation failed: %v", err)
+	}
+	if other == forward {
+		t.Error("Different secrets should give different keys")
+	}
+}
+
+func TestCryptoService_HandshakeAuth(t *testing.T) {
+	crypto := NewCryptoService()
+
+	raw, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	identity := vo.NewRSAPrivKey(raw)
+	pub := identity.PublicKey().(vo.RSAPubKey)
+	otherRaw, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+
+	_, clientPub, _ := crypto.X25519Generate()
+	_, relayPub, _ := crypto.X25519Generate()
+	_, otherPub, _ := crypto.X25519Generate()
+
+	auth, err := crypto.HandshakeAuth(identity, clientPub, relayPub)
+	if err != nil {
+		t.Fatalf("HandshakeAuth failed: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		identity  vo.RSAPubKey
+		clientPub []byte
+		relayPub  []byte
+		auth      []byte
+		wantErr   bool
+	}{
+		{"valid", pub, clientPub, relayPub, auth, false},
+		{"substituted relay key", pub, clientPub, otherPub, auth, true},
+		{"replayed for another client", pub, otherPub, relayPub, auth, true},
+		{"wrong identity", vo.RSAPubKey{PublicKey: &otherRaw.PublicKey}, clientPub, relayPub, auth, true},
+		{"missing identity", vo.RSAPubKey{}, clientPub, relayPub, auth, true},
+		{"missing auth", pub, clientPub, relayPub, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := crypto.VerifyHandshakeAuth(tt.identity, tt.clientPub, tt.relayPub, tt.auth)
+			if tt.wantErr && !errors.Is(err, ErrHandshakeAuth) {
+				t.Errorf("expected ErrHandshakeAuth, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCryptoService_HandshakeAuth_RequiresRSAIdentity(t *testing.T) {
+	crypto := NewCryptoService()
+	if _, err := crypto.HandshakeAuth(nil, nil, nil); err == nil {
+		t.Error("expected error without identity key")
+	}
+}
+
+func TestCryptoService_RelayBody(t *testing.T) {
+	crypto := NewCryptoService()
+	key := [32]byte{1, 2, 3}
+	otherKey := [32]byte{4, 5, 6}
+	data := []byte("relay data")
+
+	body, next, err := crypto.SealRelayBody(key, vo.DirectionForward, [32]byte{}, data)
+	if err != nil {
+		t.Fatalf("SealRelayBody failed: %v", err)
+	}
+	if len(body) != RelayPayloadSize || body[0] != 0 || body[1] != 0 {
+		t.Fatalf("unexpected body layout %x", body)
+	}
+
+	tests := []struct {
+		name   string
+		key    [32]byte
+		dir    vo.Direction
+		digest [32]byte
+		body   []byte
+		ok     bool
+	}{
+		{"recognized", key, vo.DirectionForward, [32]byte{}, body, true},
+		{"other hop", otherKey, vo.DirectionForward, [32]byte{}, body, false},
+		{"other direction", key, vo.DirectionBackward, [32]byte{}, body, false},
+		{"stale digest", key, vo.DirectionForward, next, body, false},
+		{"tampered data", key, vo.DirectionForward, [32]byte{}, append(append([]byte(nil), body[:len(body)-1]...), 'X'), false},
+		{"nonzero recognized", key, vo.DirectionForward, [32]byte{}, append([]byte{0, 1}, body[2:]...), false},
+		{"short", key, vo.DirectionForward, [32]byte{}, body[:4], false},
+		{"truncated padding", key, vo.DirectionForward, [32]byte{}, body[:RelayBodyHeaderSize+len(data)], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotNext, ok := crypto.OpenRelayBody(tt.key, tt.dir, tt.digest, tt.body)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				if gotNext != tt.digest {
+					t.Error("digest advanced for unrecognized body")
+				}
+				return
+			}
+			if string(got) != string(data) {
+				t.Errorf("data = %q, want %q", got, data)
+			}
+			if gotNext != next {
+				t.Error("sender and receiver digests diverged")
+			}
+		})
+	}
+}
+
+func TestCryptoService_RelayBody_FixedSize(t *testing.T) {
+	crypto := NewCryptoService()
+	key := [32]byte{9}
+
+	for _, n := range []int{0, 1, MaxRelayDataSize} {
+		body, _, err := crypto.SealRelayBody(key, vo.DirectionForward, [32]byte{}, make([]byte, n))
+		if err != nil {
+			t.Fatalf("seal %d bytes: %v", n, err)
+		}
+		if len(body) != RelayPayloadSize {
+			t.Errorf("body for %d bytes is %d bytes, want %d", n, len(body), RelayPayloadSize)
+		}
+	}
+	if _, _, err := crypto.SealRelayBody(key, vo.DirectionForward, [32]byte{}, make([]byte, MaxRelayDataSize+1)); err == nil {
+		t.Error("expected error for data larger than MaxRelayDataSize")
+	}
+
+	// a full relay body still fits in a DATA cell with either payload encoding
+	for _, v := range []vo.ProtocolVersion{vo.ProtocolV1, vo.ProtocolV2} {
+		payload, err := NewPayloadEncodingService().ForVersion(v).EncodeDataPayload(&DataPayloadDTO{StreamID: math.MaxUint16, Data: make([]byte, RelayPayloadSize)})
+		if err != nil {
+			t.Fatalf("encode v%d: %v", v, err)
+		}
+		if len(payload) > entity.MaxPayloadSize {
+			t.Errorf("v%d DATA payload is %d bytes, cell holds %d", v, len(payload), entity.MaxPayloadSize)
+		}
+	}
+}
+
+func TestCryptoService_RelayBody_RunningDigest(t *testing.T) {
+	crypto := NewCryptoService()
+	key := [32]byte{7}
+	var sendDigest, recvDigest [32]byte
+
+	// the same data sealed twice gets different digests, so a replayed
+	// cell is not recognized
+	var bodies [][]byte
+	for i := 0; i < 2; i++ {
+		body, next, err := crypto.SealRelayBody(key, vo.DirectionBackward, sendDigest, []byte("same"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sendDigest = next
+		bodies = append(bodies, body)
+	}
+	if string(bodies[0]) == string(bodies[1]) {
+		t.Fatal("running digest did not change between cells")
+	}
+	for i, body := range bodies {
+		_, next, ok := crypto.OpenRelayBody(key, vo.DirectionBackward, recvDigest, body)
+		if !ok {
+			t.Fatalf("cell %d not recognized", i)
+		}
+		recvDigest = next
+	}
+	if _, _, ok := crypto.OpenRelayBody(key, vo.DirectionBackward, recvDigest, bodies[0]); ok {
+		t.Error("replayed cell recognized")
+	}
 }
 
 func TestCryptoService_ModifyNonceWithSequence(t *testing.T) {
@@ -331,7 +493,7 @@ func TestCryptoService_Integration_CompleteOnionFlow(t *testing.T) {
 			t.Fatalf("Failed to compute shared secret for hop %d: %v", i, err)
 		}
 
-		key, nonce, err := crypto.DeriveKeyNonce(shared)
+		key, _, nonce, err := crypto.DeriveHopKeys(shared)
 		if err != nil {
 			t.Fatalf("Failed to derive key/nonce for hop %d: %v", i, err)
 		}
@@ -343,12 +505,12 @@ func TestCryptoService_Integration_CompleteOnionFlow(t *testing.T) {
 	// 4. Test onion encryption/decryption
 	originalMessage := []byte("Secret message through onion routing")
 
-	encrypted, err := crypto.AESMultiSeal(keys, nonces, originalMessage)
+	encrypted, err := crypto.AESMultiCTR(keys, nonces, originalMessage)
 	if err != nil {
 		t.Fatalf("Onion encryption failed: %v", err)
 	}
 
-	decrypted, err := crypto.AESMultiOpen(keys, nonces, encrypted)
+	decrypted, err := crypto.AESMultiCTR(keys, nonces, encrypted)
 	if err != nil {
 		t.Fatalf("Onion decryption failed: %v", err)
 	}
@@ -360,7 +522,7 @@ func TestCryptoService_Integration_CompleteOnionFlow(t *testing.T) {
 	// 5. Verify that hop-by-hop decryption works (relay simulation)
 	currentData := encrypted
 	for i := 0; i < hops; i++ {
-		currentData, err = crypto.AESOpen(keys[i], nonces[i], currentData)
+		currentData, err = crypto.AESCTR(keys[i], nonces[i], currentData)
 		if err != nil {
 			t.Fatalf("Hop %d decryption failed: %v", i, err)
 		}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// ErrNameNotFound is returned for host names without any address.
+var ErrNameNotFound = errors.New("name not found")
+
+// maxDNSMessageSize is the largest DNS message read from a server.
+const maxDNSMessageSize = 64 * 1024
+
+// DNSResolverService looks host names up by asking a DNS server directly,
+// which unlike the system resolver tells how long each address may be
+// cached.
+type DNSResolverService interface {
+	// Resolve returns the IPv4 and IPv6 addresses of host with their TTLs.
+	Resolve(host string) ([]vo.ResolvedAnswer, error)
+}
+
+type dnsResolverServiceImpl struct {
+	server  string
+	timeout time.Duration
+}
+
+// NewDNSResolverService returns a resolver that sends its queries to server,
+// a host:port, and waits up to timeout for each answer.
+func NewDNSResolverService(server string, timeout time.Duration) DNSResolverService {
+	return &dnsResolverServiceImpl{server: server, timeout: timeout}
+}
+
+// SystemDNSServer returns the first name server of /etc/resolv.conf, or the
+// local one if it names none.
+func SystemDNSServer() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1:53"
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+func (s *dnsResolverServiceImpl) Resolve(host string) ([]vo.ResolvedAnswer, error) {
+	var answers []vo.ResolvedAnswer
+	var firstErr error
+	for _, typ := range []uint16{vo.DNSTypeA, vo.DNSTypeAAAA} {
+		a, err := s.query(host, typ)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		answers = append(answers, a...)
+	}
+	if len(answers) > 0 {
+		return answers, nil
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNameNotFound, host)
+}
+
+// query asks the server for the records of type typ, over UDP first and
+// over TCP if the answer did not fit a datagram.
+func (s *dnsResolverServiceImpl) query(host string, typ uint16) ([]vo.ResolvedAnswer, error) {
+	q := &vo.DNSMessage{
+		ID:               uint16(rand.UintN(0x10000)),
+		RecursionDesired: true,
+		Questions:        []vo.DNSQuestion{{Name: host, Type: typ, Class: vo.DNSClassINET}},
+	}
+	req, err := q.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.exchange("udp", q, req)
+	if err == nil && resp.Truncated {
+		resp, err = s.exchange("tcp", q, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch resp.RCode {
+	case vo.DNSRCodeSuccess:
+	case vo.DNSRCodeNameError:
+		return nil, fmt.Errorf("%w: %s", ErrNameNotFound, host)
+	default:
+		return nil, fmt.Errorf("resolve %s: dns rcode %d", host, resp.RCode)
+	}
+
+	size := net.IPv4len
+	if typ == vo.DNSTypeAAAA {
+		size = net.IPv6len
+	}
+	var answers []vo.ResolvedAnswer
+	for _, r := range resp.Answers {
+		// CNAME records lead to the addresses; only the addresses matter
+		if r.Type != typ || r.Class != vo.DNSClassINET || len(r.Data) != size {
+			continue
+		}
+		answers = append(answers, vo.ResolvedAnswer{
+			IP:  append(net.IP(nil), r.Data...),
+			TTL: time.Duration(r.TTL) * time.Second,
+		})
+	}
+	return answers, nil
+}
+
+// exchange sends req over network and returns the answer to q. TCP messages
+// carry a two byte length prefix.
+func (s *dnsResolverServiceImpl) exchange(network string, q *vo.DNSMessage, req []byte) (*vo.DNSMessage, error) {
+	conn, err := net.DialTimeout(network, s.server, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(s.timeout))
+
+	tcp := network == "tcp"
+	if tcp {
+		req = append(binary.BigEndian.AppendUint16(nil, uint16(len(req))), req...)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDNSMessageSize)
+	for {
+		var n int
+		if tcp {
+			if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+				return nil, err
+			}
+			n = int(binary.BigEndian.Uint16(buf))
+			if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+				return nil, err
+			}
+		} else if n, err = conn.Read(buf); err != nil {
+			return nil, err
+		}
+		resp, err := vo.DNSMessageFrom(buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("dns answer from %s: %w", s.server, err)
+		}
+		// over UDP anyone may send us something; wait for the real answer
+		if !resp.Response || resp.ID != q.ID || len(resp.Questions) != 1 ||
+			!strings.EqualFold(resp.Questions[0].Name, q.Questions[0].Name) || resp.Questions[0].Type != q.Questions[0].Type {
+			if tcp {
+				return nil, fmt.Errorf("dns answer from %s does not match the query", s.server)
+			}
+			continue
+		}
+		return resp, nil
+	}
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// startDNSServer serves DNS over UDP and TCP on the same local port,
+// answering each query with what answer returns for it.
+func startDNSServer(t *testing.T, answer func(q *vo.DNSMessage, tcp bool) *vo.DNSMessage) string {
+	t.Helper()
+	var pc *net.UDPConn
+	var ln net.Listener
+	for i := 0; ln == nil; i++ {
+		var err error
+		if pc, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+			t.Fatalf("listen udp: %v", err)
+		}
+		port := pc.LocalAddr().(*net.UDPAddr).Port
+		if ln, err = net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err != nil {
+			pc.Close()
+			if i == 10 {
+				t.Fatalf("listen tcp: %v", err)
+			}
+		}
+	}
+	t.Cleanup(func() { pc.Close(); ln.Close() })
+
+	reply := func(b []byte, tcp bool) []byte {
+		q, err := vo.DNSMessageFrom(b)
+		if err != nil {
+			return nil
+		}
+		resp := answer(q, tcp)
+		resp.ID, resp.Response, resp.Questions = q.ID, true, q.Questions
+		out, _ := resp.Bytes()
+		return out
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteToUDP(reply(buf[:n], false), from)
+		}
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var l [2]byte
+			if _, err := io.ReadFull(c, l[:]); err == nil {
+				b := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(c, b); err == nil {
+					out := reply(b, true)
+					c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(out))), out...))
+				}
+			}
+			c.Close()
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestDNSResolverService_Resolve(t *testing.T) {
+	server := startDNSServer(t, func(q *vo.DNSMessage, tcp bool) *vo.DNSMessage {
+		resp := &vo.DNSMessage{}
+		if q.Questions[0].Type == vo.DNSTypeA {
+			resp.Answers = []vo.DNSRecord{
+				{Name: q.Questions[0].Name, Type: vo.DNSTypeCNAME, Class: vo.DNSClassINET, TTL: 600, Data: []byte{0}},
+				{Name: q.Questions[0].Name, Type: vo.DNSTypeA, Class: vo.DNSClassINET, TTL: 120, Data: []byte{192, 0, 2, 7}},
+			}
+		}
+		return resp
+	})
+	answers, err := NewDNSResolverService(server, time.Second).Resolve("example.com")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if len(answers) != 1 || !answers[0].IP.Equal(net.IPv4(192, 0, 2, 7)) || answers[0].TTL != 2*time.Minute {
+		t.Errorf("answers = %v, want 192.0.2.7 for 2m", answers)
+	}
+}
+
+func TestDNSResolverService_TruncatedFallsBackToTCP(t *testing.T) {
+	server := startDNSServer(t, func(q *vo.DNSMessage, tcp bool) *vo.DNSMessage {
+		if !tcp {
+			return &vo.DNSMessage{Truncated: true}
+		}
+		if q.Questions[0].Type != vo.DNSTypeAAAA {
+			return &vo.DNSMessage{}
+		}
+		return &vo.DNSMessage{Answers: []vo.DNSRecord{
+			{Name: q.Questions[0].Name, Type: vo.DNSTypeAAAA, Class: vo.DNSClassINET, TTL: 30, Data: net.ParseIP("2001:db8::7")},
+		}}
+	})
+	answers, err := NewDNSResolverService(server, time.Second).Resolve("example.com")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if len(answers) != 1 || !answers[0].IP.Equal(net.ParseIP("2001:db8::7")) {
+		t.Errorf("answers = %v, want 2001:db8::7", answers)
+	}
+}
+
+func TestDNSResolverService_NameNotFound(t *testing.T) {
+	tests := []struct {
+		name  string
+		rcode uint8
+	}{
+		{"nxdomain", vo.DNSRCodeNameError},
+		{"no addresses", vo.DNSRCodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startDNSServer(t, func(*vo.DNSMessage, bool) *vo.DNSMessage {
+				return &vo.DNSMessage{RCode: tt.rcode}
+			})
+			_, err := NewDNSResolverService(server, time.Second).Resolve("nowhere.example")
+			if !errors.Is(err, ErrNameNotFound) {
+				t.Errorf("err = %v, want ErrNameNotFound", err)
+			}
+		})
+	}
+}
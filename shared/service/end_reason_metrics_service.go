@@ -0,0 +1,61 @@
+package service
+
+import (
+	"encoding/json"
+	"sync"
+
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// EndReasonMetricsService counts END and DESTROY cells by reason. Its
+// String method renders the counts as JSON, so it can be published with
+// expvar.
+type EndReasonMetricsService interface {
+	Record(cmd vo.CellCommand, reason vo.EndReason)
+	Count(cmd vo.CellCommand, reason vo.EndReason) uint64
+	String() string
+}
+
+type endReasonKey struct {
+	cmd    vo.CellCommand
+	reason vo.EndReason
+}
+
+type endReasonMetricsImpl struct {
+	mu     sync.Mutex
+	counts map[endReasonKey]uint64
+}
+
+// NewEndReasonMetricsService returns an empty set of reason counters.
+func NewEndReasonMetricsService() EndReasonMetricsService {
+	return &endReasonMetricsImpl{counts: make(map[endReasonKey]uint64)}
+}
+
+func (m *endReasonMetricsImpl) Record(cmd vo.CellCommand, reason vo.EndReason) {
+	m.mu.Lock()
+	m.counts[endReasonKey{cmd, reason}]++
+	m.mu.Unlock()
+}
+
+func (m *endReasonMetricsImpl) Count(cmd vo.CellCommand, reason vo.EndReason) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[endReasonKey{cmd, reason}]
+}
+
+// String renders the counts as {"END":{"done":3},"DESTROY":{...}}.
+func (m *endReasonMetricsImpl) String() string {
+	m.mu.Lock()
+	out := make(map[string]map[string]uint64)
+	for k, n := range m.counts {
+		byReason, ok := out[k.cmd.String()]
+		if !ok {
+			byReason = make(map[string]uint64)
+			out[k.cmd.String()] = byReason
+		}
+		byReason[k.reason.String()] = n
+	}
+	m.mu.Unlock()
+	b, _ := json.Marshal(out)
+	return string(b)
+}
@@ -0,0 +1,30 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+func TestEndReasonMetricsService(t *testing.T) {
+	m := NewEndReasonMetricsService()
+	m.Record(vo.CmdEnd, vo.EndReasonDone)
+	m.Record(vo.CmdEnd, vo.EndReasonDone)
+	m.Record(vo.CmdDestroy, vo.EndReasonProtocol)
+
+	if got := m.Count(vo.CmdEnd, vo.EndReasonDone); got != 2 {
+		t.Errorf("END done = %d, want 2", got)
+	}
+	if got := m.Count(vo.CmdEnd, vo.EndReasonProtocol); got != 0 {
+		t.Errorf("END protocol = %d, want 0", got)
+	}
+
+	var out map[string]map[string]uint64
+	if err := json.Unmarshal([]byte(m.String()), &out); err != nil {
+		t.Fatalf("String is not JSON: %v", err)
+	}
+	if out["END"]["done"] != 2 || out["DESTROY"]["protocol error"] != 1 {
+		t.Errorf("unexpected JSON counts: %v", out)
+	}
+}
@@ -0,0 +1,343 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// ErrNoSuitableRelay is returned when no candidate may take a position of
+// the path.
+var ErrNoSuitableRelay = errors.New("no suitable relay")
+
+// ErrExcludedRelay is returned when a circuit must use a relay that the
+// restrictions exclude and StrictNodes forbids making an exception.
+var ErrExcludedRelay = errors.New("relay is excluded")
+
+// longLivedPorts are the ports of protocols whose streams tend to stay open
+// for hours, Tor's LongLivedPorts. Circuits for them use Stable relays only.
+var longLivedPorts = []int{21, 22, 706, 1863, 5050, 5190, 5222, 5223, 6523, 6667, 6697, 8300}
+
+// PathRestrictions limit the relays circuits are built through. The family
+// and subnet rules keep a single operator or network from seeing both ends
+// of a circuit; the node sets let the user pick or avoid relays, like Tor's
+// EntryNodes, ExitNodes, ExcludeNodes and StrictNodes.
+type PathRestrictions struct {
+	// Family keeps relays that declared each other as family apart.
+	Family bool
+	// IPv4Prefix and IPv6Prefix are the lengths of the subnets that hold
+	// at most one relay of a circuit, Tor's EnforceDistinctSubnets. Zero
+	// turns the rule off. Relays whose endpoint is a host name are not
+	// checked.
+	IPv4Prefix int
+	IPv6Prefix int
+	// EntryNodes and ExitNodes, when not empty, are the only relays that
+	// may take the first and the last hop, whatever their flags. ExitNodes
+	// does not apply to circuits whose exit is chosen by the caller, such
+	// as those to a hidden service.
+	EntryNodes vo.NodeSet
+	ExitNodes  vo.NodeSet
+	// ExcludeNodes are never picked for any hop. An exit chosen by the
+	// caller may still be one of them unless StrictNodes is set.
+	ExcludeNodes vo.NodeSet
+	StrictNodes  bool
+}
+
+// DefaultPathRestrictions returns the restrictions Tor applies: no two
+// relays of a family, an IPv4 /16 or an IPv6 /32.
+func DefaultPathRestrictions() PathRestrictions {
+	return PathRestrictions{Family: true, IPv4Prefix: 16, IPv6Prefix: 32}
+}
+
+// Validate checks that the prefix lengths fit their address families.
+func (p PathRestrictions) Validate() error {
+	if p.IPv4Prefix < 0 || p.IPv4Prefix > 32 {
+		return fmt.Errorf("invalid IPv4 prefix length %d", p.IPv4Prefix)
+	}
+	if p.IPv6Prefix < 0 || p.IPv6Prefix > 128 {
+		return fmt.Errorf("invalid IPv6 prefix length %d", p.IPv6Prefix)
+	}
+	return nil
+}
+
+// PathSelectionService picks the relays of a new circuit.
+type PathSelectionService interface {
+	// SelectPath returns hops relays from candidates, entry first, no two
+	// of which are Related. If exit is set it is the last hop as it is;
+	// otherwise the last hop is an exit whose policy allows port, any port
+	// if it is zero. Likewise a set entry is the first hop of a circuit
+	// with more than one hop.
+	SelectPath(candidates []*entity.Relay, hops int, entry, exit *entity.Relay, port int) ([]*entity.Relay, error)
+	// SelectGuard returns a relay from candidates that may be the entry of
+	// circuits, other than those in exclude.
+	SelectGuard(candidates []*entity.Relay, exclude []vo.RelayID) (*entity.Relay, error)
+	// MayEnter reports whether the restrictions let r take the first hop
+	// of a circuit, leaving its flags aside.
+	MayEnter(r *entity.Relay) bool
+	// Related reports whether a and b may not be in one circuit: they are
+	// the same relay, or the restrictions tie them together.
+	Related(a, b *entity.Relay) bool
+}
+
+type pathSelectionServiceImpl struct {
+	rules PathRestrictions
+}
+
+// NewPathSelectionService returns a PathSelectionService that picks each
+// position at random, weighted by bandwidth, among the relays whose flags
+// suit it:
+//
+//   - every hop must be Fast, and Stable too if port is a long-lived one
+//   - the exit must be an Exit whose policy allows port
+//   - the entry of a circuit with more than one hop must be a Guard, unless
+//     the caller names it
+//   - no relay may be related to another hop under rules
+//   - EntryNodes and ExitNodes, if set, replace the flag rules for their
+//     positions, and ExcludeNodes are left out
+//
+// The exit is chosen first since it is the most constrained position.
+func NewPathSelectionService(rules PathRestrictions) PathSelectionService {
+	return &pathSelectionServiceImpl{rules: rules}
+}
+
+// pathPosition is the position of a hop in a circuit.
+type pathPosition int
+
+const (
+	positionGuard pathPosition = iota
+	positionMiddle
+	positionExit
+)
+
+func (s *pathSelectionServiceImpl) SelectPath(candidates []*entity.Relay, hops int, entry, exit *entity.Relay, port int) ([]*entity.Relay, error) {
+	if hops <= 0 {
+		return nil, fmt.Errorf("invalid hop count %d", hops)
+	}
+	need := vo.RelayFlagFast
+	if slices.Contains(longLivedPorts, port) {
+		need |= vo.RelayFlagStable
+	}
+	weights := newBandwidthWeights(candidates)
+	path := make([]*entity.Relay, hops)
+	// taken reports whether r is related to a hop chosen already
+	taken := func(r *entity.Relay) bool {
+		return slices.ContainsFunc(path, func(hop *entity.Relay) bool { return hop != nil && s.Related(hop, r) })
+	}
+
+	choose := func(i int, pos pathPosition, ok func(*entity.Relay) bool) error {
+		var eligible []*entity.Relay
+		for _, r := range candidates {
+			if ok(r) && !s.excluded(r) && !taken(r) {
+				eligible = append(eligible, r)
+			}
+		}
+		r, err := pickWeighted(eligible, func(r *entity.Relay) float64 { return weights.weight(r, pos) })
+		if err != nil {
+			return err
+		}
+		path[i] = r
+		return nil
+	}
+
+	if exit != nil {
+		if s.rules.StrictNodes && s.excluded(exit) {
+			return nil, fmt.Errorf("exit %s: %w", exit.ID(), ErrExcludedRelay)
+		}
+		path[hops-1] = exit
+	}
+	if entry != nil && hops > 1 {
+		if taken(entry) {
+			return nil, fmt.Errorf("entry %s may not share a circuit with exit %s", entry.ID(), exit.ID())
+		}
+		path[0] = entry
+	}
+	if exit == nil {
+		mayExit := func(r *entity.Relay) bool {
+			if port != 0 && !r.ExitPolicy().AllowsPort(port) {
+				return false
+			}
+			if !s.rules.ExitNodes.Empty() {
+				return s.rules.ExitNodes.Contains(r.ID(), r.PubKey(), r.Endpoint())
+			}
+			return r.Flags().Has(need | vo.RelayFlagExit)
+		}
+		if err := choose(hops-1, positionExit, mayExit); err != nil {
+			if port == 0 {
+				return nil, fmt.Errorf("choose exit: %w", err)
+			}
+			return nil, fmt.Errorf("choose exit to port %d: %w", port, err)
+		}
+	}
+	if hops > 1 && entry == nil {
+		mayEnter := func(r *entity.Relay) bool {
+			return s.MayEnter(r) && (!s.rules.EntryNodes.Empty() || r.Flags().Has(need|vo.RelayFlagGuard))
+		}
+		if err := choose(0, positionGuard, mayEnter); err != nil {
+			return nil, fmt.Errorf("choose guard: %w", err)
+		}
+	}
+	mayRelay := func(r *entity.Relay) bool { return r.Flags().Has(need) }
+	for i := 1; i < hops-1; i++ {
+		if err := choose(i, positionMiddle, mayRelay); err != nil {
+			return nil, fmt.Errorf("choose middle hop %d: %w", i, err)
+		}
+	}
+	return path, nil
+}
+
+func (s *pathSelectionServiceImpl) SelectGuard(candidates []*entity.Relay, exclude []vo.RelayID) (*entity.Relay, error) {
+	weights := newBandwidthWeights(candidates)
+	var eligible []*entity.Relay
+	for _, r := range candidates {
+		if !s.MayEnter(r) || slices.ContainsFunc(exclude, r.ID().Equal) {
+			continue
+		}
+		if s.rules.EntryNodes.Empty() && !r.Flags().Has(vo.RelayFlagGuard|vo.RelayFlagFast) {
+			continue
+		}
+		eligible = append(eligible, r)
+	}
+	return pickWeighted(eligible, func(r *entity.Relay) float64 { return weights.weight(r, positionGuard) })
+}
+
+func (s *pathSelectionServiceImpl) MayEnter(r *entity.Relay) bool {
+	if s.excluded(r) {
+		return false
+	}
+	return s.rules.EntryNodes.Empty() || s.rules.EntryNodes.Contains(r.ID(), r.PubKey(), r.Endpoint())
+}
+
+// excluded reports whether r is in ExcludeNodes.
+func (s *pathSelectionServiceImpl) excluded(r *entity.Relay) bool {
+	return s.rules.ExcludeNodes.Contains(r.ID(), r.PubKey(), r.Endpoint())
+}
+
+func (s *pathSelectionServiceImpl) Related(a, b *entity.Relay) bool {
+	if a.ID().Equal(b.ID()) {
+		return true
+	}
+	if s.rules.Family && a.InFamily(b) {
+		return true
+	}
+	sa, ok := s.subnet(a)
+	if !ok {
+		return false
+	}
+	sb, ok := s.subnet(b)
+	return ok && sa == sb
+}
+
+// subnet returns the subnet of r's address that may hold one relay of a
+// circuit, or false if r has no address or its family is not restricted.
+func (s *pathSelectionServiceImpl) subnet(r *entity.Relay) (netip.Prefix, bool) {
+	addr, err := netip.ParseAddr(r.Endpoint().Host())
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap()
+	bits := s.rules.IPv6Prefix
+	if addr.Is4() {
+		bits = s.rules.IPv4Prefix
+	}
+	if bits == 0 {
+		return netip.Prefix{}, false
+	}
+	p, err := addr.WithZone("").Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return p, true
+}
+
+// bandwidthWeights are a simplified form of Tor's bandwidth weights. Every
+// position of a circuit carries the same traffic, so each should get a third
+// of the network's bandwidth. Guards and exits are the only relays that can
+// take their positions, so in the other positions they are weighed by the
+// share of their bandwidth that is left once their own third is set aside.
+type bandwidthWeights struct {
+	guardElsewhere float64
+	exitElsewhere  float64
+}
+
+func newBandwidthWeights(relays []*entity.Relay) bandwidthWeights {
+	var total, guards, exits float64
+	for _, r := range relays {
+		bw := float64(r.Bandwidth().Weight())
+		total += bw
+		if r.Flags().Has(vo.RelayFlagGuard) {
+			guards += bw
+		}
+		if r.Flags().Has(vo.RelayFlagExit) {
+			exits += bw
+		}
+	}
+	return bandwidthWeights{
+		guardElsewhere: spareShare(guards, total),
+		exitElsewhere:  spareShare(exits, total),
+	}
+}
+
+// spareShare returns the fraction of class left after a third of total.
+func spareShare(class, total float64) float64 {
+	if class == 0 {
+		return 0
+	}
+	return max(0, (class-total/3)/class)
+}
+
+// weight returns how much r counts when picking a relay for pos.
+func (w bandwidthWeights) weight(r *entity.Relay, pos pathPosition) float64 {
+	bw := float64(r.Bandwidth().Weight())
+	if pos != positionExit && r.Flags().Has(vo.RelayFlagExit) {
+		bw *= w.exitElsewhere
+	}
+	if pos == positionMiddle && r.Flags().Has(vo.RelayFlagGuard) {
+		bw *= w.guardElsewhere
+	}
+	return bw
+}
+
+// pickWeighted picks one of relays with a probability proportional to its
+// weight, or uniformly if none has a weight.
+func pickWeighted(relays []*entity.Relay, weight func(*entity.Relay) float64) (*entity.Relay, error) {
+	if len(relays) == 0 {
+		return nil, ErrNoSuitableRelay
+	}
+	ws := make([]float64, len(relays))
+	var total float64
+	for i, r := range relays {
+		ws[i] = weight(r)
+		total += ws[i]
+	}
+	if total == 0 {
+		for i := range ws {
+			ws[i] = 1
+		}
+		total = float64(len(ws))
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil { // crypto/rand
+		return nil, err
+	}
+	// 53 random bits give a float64 in [0, 1)
+	x := float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53) * total
+	last := 0
+	for i, w := range ws {
+		if w == 0 {
+			continue
+		}
+		if x < w {
+			return relays[i], nil
+		}
+		x -= w
+		last = i
+	}
+	// rounding left x just past the end
+	return relays[last], nil
+}
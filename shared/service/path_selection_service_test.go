@@ -0,0 +1,410 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// newPathTestRelay returns a relay with the given measured bandwidth and
+// flags, numbered n and alone in its /16.
+func newPathTestRelay(t *testing.T, n int, bw uint32, flags vo.RelayFlags) *entity.Relay {
+	t.Helper()
+	id, err := vo.NewRelayID(fmt.Sprintf("550e8400-e29b-41d4-a716-%012d", n))
+	if err != nil {
+		t.Fatalf("relay id: %v", err)
+	}
+	ep, _ := vo.NewEndpoint(fmt.Sprintf("10.%d.0.1", n), 9000)
+	r := entity.NewRelay(id, ep, vo.RSAPubKey{})
+	r.SetBandwidth(vo.Bandwidth{Measured: bw})
+	r.SetFlags(flags)
+	r.SetOnline()
+	return r
+}
+
+// checkDistribution fails unless each relay was picked about as often as
+// its share of want says. With n draws a count is off by more than five
+// standard deviations about once in two million runs.
+func checkDistribution(t *testing.T, what string, counts map[vo.RelayID]int, want map[vo.RelayID]float64, n int) {
+	t.Helper()
+	var total float64
+	for _, w := range want {
+		total += w
+	}
+	for id, w := range want {
+		p := w / total
+		exp := p * float64(n)
+		sd := math.Sqrt(float64(n) * p * (1 - p))
+		if got := float64(counts[id]); math.Abs(got-exp) > 5*sd+1 {
+			t.Errorf("%s: relay %s picked %.0f times, want about %.0f", what, id, got, exp)
+		}
+	}
+	for id, c := range counts {
+		if _, ok := want[id]; !ok {
+			t.Errorf("%s: relay %s picked %d times, want never", what, id, c)
+		}
+	}
+}
+
+func TestPathSelectionService_WeighsByBandwidth(t *testing.T) {
+	const fast = vo.RelayFlagFast
+	relays := []*entity.Relay{
+		newPathTestRelay(t, 1, 100, fast|vo.RelayFlagExit),
+		newPathTestRelay(t, 2, 300, fast|vo.RelayFlagExit),
+		newPathTestRelay(t, 3, 600, fast|vo.RelayFlagExit),
+		newPathTestRelay(t, 4, 5000, fast), // not an exit
+		newPathTestRelay(t, 5, 5000, vo.RelayFlagExit),
+	}
+	s := NewPathSelectionService(DefaultPathRestrictions())
+
+	const n = 20000
+	counts := make(map[vo.RelayID]int)
+	for i := 0; i < n; i++ {
+		path, err := s.SelectPath(relays, 1, nil, nil, 0)
+		if err != nil {
+			t.Fatalf("select: %v", err)
+		}
+		counts[path[0].ID()]++
+	}
+	checkDistribution(t, "exit", counts, map[vo.RelayID]float64{
+		relays[0].ID(): 100,
+		relays[1].ID(): 300,
+		relays[2].ID(): 600,
+	}, n)
+}
+
+func TestPathSelectionService_PositionWeights(t *testing.T) {
+	const fast = vo.RelayFlagFast
+	// 3000 KB/s in total: the exits have 1500, of which a third of the
+	// total, 1000, is kept for the exit position; the guards have 1000 and
+	// need all of it.
+	guard := newPathTestRelay(t, 1, 1000, fast|vo.RelayFlagGuard)
+	exitA := newPathTestRelay(t, 2, 1000, fast|vo.RelayFlagExit)
+	exitB := newPathTestRelay(t, 3, 500, fast|vo.RelayFlagExit)
+	middle := newPathTestRelay(t, 4, 500, fast)
+	relays := []*entity.Relay{guard, exitA, exitB, middle}
+	s := NewPathSelectionService(DefaultPathRestrictions())
+
+	const n = 20000
+	exits := make(map[vo.RelayID]int)
+	middles := make(map[vo.RelayID]int)
+	for i := 0; i < n; i++ {
+		path, err := s.SelectPath(relays, 3, nil, nil, 0)
+		if err != nil {
+			t.Fatalf("select: %v", err)
+		}
+		if path[0] != guard {
+			t.Fatalf("entry %s is not the guard", path[0].ID())
+		}
+		if path[0] == path[1] || path[1] == path[2] || path[0] == path[2] {
+			t.Fatalf("path uses a relay twice")
+		}
+		exits[path[2].ID()]++
+		middles[path[1].ID()]++
+	}
+	checkDistribution(t, "exit", exits, map[vo.RelayID]float64{exitA.ID(): 1000, exitB.ID(): 500}, n)
+
+	// The middle hop is whichever relay is left besides the exit, weighed
+	// with the exits' spare third: exit A counts 1000/3, exit B 500/3.
+	pA, pB := 1000.0/1500, 500.0/1500
+	checkDistribution(t, "middle", middles, map[vo.RelayID]float64{
+		exitA.ID():  pB * (1000.0 / 3) / (1000.0/3 + 500),
+		exitB.ID():  pA * (500.0 / 3) / (500.0/3 + 500),
+		middle.ID(): pB*500/(1000.0/3+500) + pA*500/(500.0/3+500),
+	}, n)
+}
+
+func TestPathSelectionService_Flags(t *testing.T) {
+	const fast = vo.RelayFlagFast
+	web, err := vo.ParseExitPolicy("accept *:80,accept *:443,reject *:*")
+	if err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+	guard := newPathTestRelay(t, 1, 100, fast|vo.RelayFlagGuard|vo.RelayFlagStable)
+	flakyGuard := newPathTestRelay(t, 2, 100, fast|vo.RelayFlagGuard)
+	webExit := newPathTestRelay(t, 3, 100, fast|vo.RelayFlagExit|vo.RelayFlagStable)
+	webExit.SetExitPolicy(web)
+	exit := newPathTestRelay(t, 4, 100, fast|vo.RelayFlagExit|vo.RelayFlagStable)
+	middle := newPathTestRelay(t, 5, 100, fast|vo.RelayFlagStable)
+	slow := newPathTestRelay(t, 6, 100000, vo.RelayFlagStable)
+	relays := []*entity.Relay{guard, flakyGuard, webExit, exit, middle, slow}
+	s := NewPathSelectionService(DefaultPathRestrictions())
+
+	for i := 0; i < 200; i++ {
+		// port 22 is long-lived: every hop must be Stable
+		path, err := s.SelectPath(relays, 3, nil, nil, 22)
+		if err != nil {
+			t.Fatalf("select: %v", err)
+		}
+		if path[0] != guard || path[2] != exit {
+			t.Fatalf("path %s, %s, %s breaks the flag rules", path[0].ID(), path[1].ID(), path[2].ID())
+		}
+		if path[1] == slow {
+			t.Fatalf("relay without Fast picked")
+		}
+		path, err = s.SelectPath(relays, 3, nil, nil, 443)
+		if err != nil {
+			t.Fatalf("select: %v", err)
+		}
+		if !path[0].Flags().Has(vo.RelayFlagGuard) || !path[2].Flags().Has(vo.RelayFlagExit) {
+			t.Fatalf("path %s, %s, %s breaks the flag rules", path[0].ID(), path[1].ID(), path[2].ID())
+		}
+	}
+
+	// a chosen exit is taken as it is
+	pinned := newPathTestRelay(t, 7, 0, 0)
+	path, err := s.SelectPath(relays, 2, nil, pinned, 0)
+	if err != nil {
+		t.Fatalf("select with pinned exit: %v", err)
+	}
+	if path[1] != pinned || !path[0].Flags().Has(vo.RelayFlagGuard) {
+		t.Errorf("pinned exit not last or entry not a guard")
+	}
+
+	if _, err := s.SelectPath([]*entity.Relay{guard, middle}, 2, nil, nil, 0); !errors.Is(err, ErrNoSuitableRelay) {
+		t.Errorf("no exit: err = %v, want ErrNoSuitableRelay", err)
+	}
+	if _, err := s.SelectPath([]*entity.Relay{webExit, middle}, 1, nil, nil, 25); !errors.Is(err, ErrNoSuitableRelay) {
+		t.Errorf("no exit for port: err = %v, want ErrNoSuitableRelay", err)
+	}
+	if _, err := s.SelectPath([]*entity.Relay{middle, exit}, 2, nil, nil, 0); !errors.Is(err, ErrNoSuitableRelay) {
+		t.Errorf("no guard: err = %v, want ErrNoSuitableRelay", err)
+	}
+}
+
+func TestPathSelectionService_Entry(t *testing.T) {
+	const fast = vo.RelayFlagFast
+	guard := newPathTestRelay(t, 1, 100, fast|vo.RelayFlagGuard)
+	exit := newPathTestRelay(t, 2, 100, fast|vo.RelayFlagExit)
+	middle := newPathTestRelay(t, 3, 100, fast)
+	// the entry is taken as it is, flags or not
+	entry := newPathTestRelay(t, 4, 0, 0)
+	relays := []*entity.Relay{guard, exit, middle, entry}
+	s := NewPathSelectionService(DefaultPathRestrictions())
+
+	path, err := s.SelectPath(relays, 3, entry, nil, 0)
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if path[0] != entry || path[2] != exit || path[1] == entry {
+		t.Errorf("path %s, %s, %s does not start at the entry", path[0].ID(), path[1].ID(), path[2].ID())
+	}
+	if _, err := s.SelectPath(relays, 2, exit, exit, 0); err == nil {
+		t.Error("expected error when the entry is the exit")
+	}
+	// a single hop is the exit only
+	if path, err := s.SelectPath(relays, 1, entry, nil, 0); err != nil || path[0] != exit {
+		t.Errorf("one hop path = %v, %v; want the exit", path, err)
+	}
+}
+
+func TestPathSelectionService_SelectGuard(t *testing.T) {
+	const fast = vo.RelayFlagFast
+	relays := []*entity.Relay{
+		newPathTestRelay(t, 1, 100, fast|vo.RelayFlagGuard),
+		newPathTestRelay(t, 2, 300, fast|vo.RelayFlagGuard),
+		newPathTestRelay(t, 3, 600, fast|vo.RelayFlagGuard),
+		newPathTestRelay(t, 4, 1000, fast),
+		newPathTestRelay(t, 5, 1000, vo.RelayFlagGuard),
+	}
+	s := NewPathSelectionService(DefaultPathRestrictions())
+
+	const n = 20000
+	counts := make(map[vo.RelayID]int)
+	for i := 0; i < n; i++ {
+		g, err := s.SelectGuard(relays, []vo.RelayID{relays[0].ID()})
+		if err != nil {
+			t.Fatalf("select guard: %v", err)
+		}
+		counts[g.ID()]++
+	}
+	checkDistribution(t, "guard", counts, map[vo.RelayID]float64{relays[1].ID(): 300, relays[2].ID(): 600}, n)
+
+	if _, err := s.SelectGuard(relays, []vo.RelayID{relays[0].ID(), relays[1].ID(), relays[2].ID()}); !errors.Is(err, ErrNoSuitableRelay) {
+		t.Errorf("all guards excluded: err = %v, want ErrNoSuitableRelay", err)
+	}
+}
+
+func TestPathSelectionService_Related(t *testing.T) {
+	at := func(n int, host string) *entity.Relay {
+		t.Helper()
+		id, err := vo.NewRelayID(fmt.Sprintf("550e8400-e29b-41d4-a716-%012d", n))
+		if err != nil {
+			t.Fatalf("relay id: %v", err)
+		}
+		ep, err := vo.NewEndpoint(host, 9000)
+		if err != nil {
+			t.Fatalf("endpoint: %v", err)
+		}
+		return entity.NewRelay(id, ep, vo.RSAPubKey{})
+	}
+	famA, famB := at(20, "10.20.0.1"), at(21, "10.21.0.1")
+	famA.SetFamily([]vo.RelayID{famB.ID()})
+	famB.SetFamily([]vo.RelayID{famA.ID()})
+	claims, claimed := at(22, "10.22.0.1"), at(23, "10.23.0.1")
+	claims.SetFamily([]vo.RelayID{claimed.ID()})
+
+	tests := []struct {
+		name  string
+		rules PathRestrictions
+		a, b  *entity.Relay
+		want  bool
+	}{
+		{"same relay", PathRestrictions{}, famA, famA, true},
+		{"ipv4 same /16", DefaultPathRestrictions(), at(1, "192.0.2.1"), at(2, "192.0.200.7"), true},
+		{"ipv4 other /16", DefaultPathRestrictions(), at(1, "192.0.2.1"), at(2, "192.1.2.1"), false},
+		{"ipv4 mapped", DefaultPathRestrictions(), at(1, "192.0.2.1"), at(2, "::ffff:192.0.3.1"), true},
+		{"ipv4 /24", PathRestrictions{IPv4Prefix: 24}, at(1, "192.0.2.1"), at(2, "192.0.3.1"), false},
+		{"ipv4 off", PathRestrictions{IPv6Prefix: 32}, at(1, "192.0.2.1"), at(2, "192.0.2.2"), false},
+		{"ipv6 same /32", DefaultPathRestrictions(), at(1, "2001:db8:1::1"), at(2, "2001:db8:2::1"), true},
+		{"ipv6 other /32", DefaultPathRestrictions(), at(1, "2001:db8::1"), at(2, "2001:db9::1"), false},
+		{"ipv4 and ipv6", DefaultPathRestrictions(), at(1, "192.0.2.1"), at(2, "2001:db8::1"), false},
+		{"host names", DefaultPathRestrictions(), at(1, "relay1"), at(2, "relay2"), false},
+		{"family", DefaultPathRestrictions(), famA, famB, true},
+		{"family off", PathRestrictions{IPv4Prefix: 16}, famA, famB, false},
+		{"one-sided family", DefaultPathRestrictions(), claims, claimed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewPathSelectionService(tt.rules)
+			if got := s.Related(tt.a, tt.b); got != tt.want {
+				t.Errorf("Related = %v, want %v", got, tt.want)
+			}
+			if got := s.Related(tt.b, tt.a); got != tt.want {
+				t.Errorf("Related reversed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if err := (PathRestrictions{IPv4Prefix: 33}).Validate(); err == nil {
+		t.Error("expected error for a /33 IPv4 prefix")
+	}
+	if err := DefaultPathRestrictions().Validate(); err != nil {
+		t.Errorf("default restrictions: %v", err)
+	}
+}
+
+func TestPathSelectionService_Restrictions(t *testing.T) {
+	const fast = vo.RelayFlagFast
+	guard := newPathTestRelay(t, 1, 100, fast|vo.RelayFlagGuard)
+	exit := newPathTestRelay(t, 2, 100, fast|vo.RelayFlagExit)
+	middle := newPathTestRelay(t, 3, 100, fast)
+	// in the guard's /16
+	neighbour := newPathTestRelay(t, 4, 100, fast|vo.RelayFlagExit)
+	ep, _ := vo.NewEndpoint("10.1.200.1", 9000)
+	neighbour = entity.NewRelay(neighbour.ID(), ep, vo.RSAPubKey{})
+	neighbour.SetBandwidth(vo.Bandwidth{Measured: 100000})
+	neighbour.SetFlags(fast | vo.RelayFlagExit)
+	// run by the exit's operator
+	sibling := newPathTestRelay(t, 5, 100000, fast)
+	sibling.SetFamily([]vo.RelayID{exit.ID()})
+	exit.SetFamily([]vo.RelayID{sibling.ID()})
+	relays := []*entity.Relay{guard, exit, middle, neighbour, sibling}
+
+	// the entry is given, as the client's entry guard is
+	s := NewPathSelectionService(DefaultPathRestrictions())
+	for i := 0; i < 200; i++ {
+		path, err := s.SelectPath(relays, 3, guard, nil, 0)
+		if err != nil {
+			t.Fatalf("select: %v", err)
+		}
+		if path[2] == neighbour {
+			t.Fatalf("exit in the guard's /16")
+		}
+		if path[2] == exit && path[1] == sibling {
+			t.Fatalf("middle hop in the exit's family")
+		}
+	}
+	if _, err := s.SelectPath(relays, 2, guard, neighbour, 0); err == nil {
+		t.Error("expected error for an entry in the exit's /16")
+	}
+
+	// without restrictions the heavy relays take most circuits
+	loose := NewPathSelectionService(PathRestrictions{})
+	var seen bool
+	for i := 0; i < 200 && !seen; i++ {
+		path, err := loose.SelectPath(relays, 3, guard, nil, 0)
+		if err != nil {
+			t.Fatalf("select: %v", err)
+		}
+		seen = path[2] == neighbour
+	}
+	if !seen {
+		t.Error("unrestricted selection never picked the guard's neighbour")
+	}
+}
+
+func TestPathSelectionService_NodeSets(t *testing.T) {
+	const fast = vo.RelayFlagFast
+	guardA := newPathTestRelay(t, 1, 100, fast|vo.RelayFlagGuard)
+	guardB := newPathTestRelay(t, 2, 100, fast|vo.RelayFlagGuard)
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	exitKey := vo.RSAPubKey{PublicKey: &key.PublicKey}
+	base := newPathTestRelay(t, 3, 0, 0)
+	exitA := entity.NewRelay(base.ID(), base.Endpoint(), exitKey)
+	exitA.SetBandwidth(vo.Bandwidth{Measured: 100})
+	exitA.SetFlags(fast | vo.RelayFlagExit)
+	exitB := newPathTestRelay(t, 4, 100, fast|vo.RelayFlagExit)
+	middleA := newPathTestRelay(t, 5, 100, fast)
+	middleB := newPathTestRelay(t, 6, 100, fast)
+	// no flags, but may be named as entry or exit
+	plain := newPathTestRelay(t, 7, 100, 0)
+	relays := []*entity.Relay{guardA, guardB, exitA, exitB, middleA, middleB, plain}
+	nodes := func(spec string) vo.NodeSet {
+		t.Helper()
+		s, err := vo.ParseNodeSet(spec)
+		if err != nil {
+			t.Fatalf("parse %q: %v", spec, err)
+		}
+		return s
+	}
+
+	rules := DefaultPathRestrictions()
+	rules.EntryNodes = nodes(guardB.ID().String())
+	rules.ExitNodes = nodes("10.7.0.0/16") // plain's subnet
+	rules.ExcludeNodes = nodes(middleA.ID().String())
+	s := NewPathSelectionService(rules)
+	for i := 0; i < 100; i++ {
+		path, err := s.SelectPath(relays, 3, nil, nil, 0)
+		if err != nil {
+			t.Fatalf("select: %v", err)
+		}
+		if path[0] != guardB || path[1] != middleB || path[2] != plain {
+			t.Fatalf("path %s, %s, %s ignores the node sets", path[0].ID(), path[1].ID(), path[2].ID())
+		}
+	}
+	if !s.MayEnter(guardB) || s.MayEnter(guardA) || s.MayEnter(middleA) {
+		t.Errorf("MayEnter does not follow the entry and exclude nodes")
+	}
+	if g, err := s.SelectGuard(relays, nil); err != nil || g != guardB {
+		t.Errorf("guard = %v, %v; want the entry node", g, err)
+	}
+
+	// named exits still need a policy that allows the port
+	reject, _ := vo.ParseExitPolicy("reject *:*")
+	plain.SetExitPolicy(reject)
+	if _, err := s.SelectPath(relays, 3, nil, nil, 443); !errors.Is(err, ErrNoSuitableRelay) {
+		t.Errorf("exit node rejecting the port: err = %v, want ErrNoSuitableRelay", err)
+	}
+	plain.SetExitPolicy(vo.ExitPolicy{})
+
+	// an excluded relay is used as a chosen exit unless StrictNodes is set
+	rules = DefaultPathRestrictions()
+	rules.ExcludeNodes = nodes("$" + exitKey.Fingerprint())
+	if _, err := NewPathSelectionService(rules).SelectPath(relays, 2, nil, exitA, 0); err != nil {
+		t.Errorf("excluded chosen exit without StrictNodes: %v", err)
+	}
+	rules.StrictNodes = true
+	if _, err := NewPathSelectionService(rules).SelectPath(relays, 2, nil, exitA, 0); !errors.Is(err, ErrExcludedRelay) {
+		t.Errorf("excluded chosen exit with StrictNodes: err = %v, want ErrExcludedRelay", err)
+	}
+}
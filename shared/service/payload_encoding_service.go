@@ -3,10 +3,15 @@ package service
 import (
 	"bytes"
 	"encoding/gob"
+
+	vo "ikedadada/go-ptor/shared/domain/value_object"
 )
 
 // PayloadEncodingService handles encoding and decoding of cell payloads
 type PayloadEncodingService interface {
+	// ForVersion returns the encoder for the given protocol version.
+	// Unknown versions fall back to ProtocolV1.
+	ForVersion(vo.ProtocolVersion) PayloadEncodingService
 	EncodeExtendPayload(*ExtendPayloadDTO) ([]byte, error)
 	DecodeExtendPayload([]byte) (*ExtendPayloadDTO, error)
 	EncodeCreatedPayload(*CreatedPayloadDTO) ([]byte, error)
@@ -20,14 +25,22 @@ type PayloadEncodingService interface {
 }
 
 // ExtendPayloadDTO carries the information needed to extend a circuit to the next hop.
+// MaxVersion advertises the highest payload version the client can encode
+// end-to-end payloads in; it is zero when sent by clients that predate it.
 type ExtendPayloadDTO struct {
-	NextHop   string
-	ClientPub [32]byte
+	NextHop    string
+	ClientPub  [32]byte
+	MaxVersion vo.ProtocolVersion
 }
 
-// CreatedPayloadDTO carries the relay's public key for a new circuit hop.
+// CreatedPayloadDTO carries the relay's public key for a new circuit hop
+// together with the auth tag proving it was issued by the relay's identity key.
+// MaxVersion advertises the highest payload version the relay can decode;
+// it is zero when sent by relays that predate versioned payloads.
 type CreatedPayloadDTO struct {
-	RelayPub [32]byte
+	RelayPub   [32]byte
+	Auth       []byte
+	MaxVersion vo.ProtocolVersion
 }
 
 // BeginPayloadDTO specifies the target address for a new stream.
@@ -49,11 +62,24 @@ type DataPayloadDTO struct {
 
 type payloadEncodingServiceImpl struct{}
 
-// NewPayloadEncodingService creates a new payload encoding service
+// NewPayloadEncodingService creates a new payload encoding service.
+// It encodes ProtocolV1 (gob) payloads; use ForVersion to pick another format.
 func NewPayloadEncodingService() PayloadEncodingService {
 	return &payloadEncodingServiceImpl{}
 }
 
+func (s *payloadEncodingServiceImpl) ForVersion(v vo.ProtocolVersion) PayloadEncodingService {
+	return payloadEncodingFor(v)
+}
+
+// payloadEncodingFor maps a protocol version to its payload encoder.
+func payloadEncodingFor(v vo.ProtocolVersion) PayloadEncodingService {
+	if v == vo.ProtocolV2 {
+		return &binaryPayloadEncodingServiceImpl{}
+	}
+	return &payloadEncodingServiceImpl{}
+}
+
 func (s *payloadEncodingServiceImpl) EncodeExtendPayload(p *ExtendPayloadDTO) ([]byte, error) {
 	return encodePayload(p)
 }
@@ -94,6 +120,35 @@ func (s *payloadEncodingServiceImpl) DecodeDataPayload(data []byte) (*DataPayloa
 	return decodePayload[DataPayloadDTO](data)
 }
 
+// TranscodePayload re-encodes the payload of a cmd cell from one protocol
+// version to another. Relays use it when forwarding a cell between links
+// that negotiated different versions. BEGIN, BEGIN_UDP, RESOLVE and CONNECT
+// cells carry onion ciphertext rather than a DTO and are returned unchanged.
+func TranscodePayload(cmd vo.CellCommand, data []byte, from, to vo.ProtocolVersion) ([]byte, error) {
+	if from == to || len(data) == 0 {
+		return data, nil
+	}
+	src, dst := payloadEncodingFor(from), payloadEncodingFor(to)
+	switch cmd {
+	case vo.CmdExtend:
+		return transcode(data, src.DecodeExtendPayload, dst.EncodeExtendPayload)
+	case vo.CmdCreated:
+		return transcode(data, src.DecodeCreatedPayload, dst.EncodeCreatedPayload)
+	case vo.CmdData, vo.CmdDatagram, vo.CmdResolved, vo.CmdEnd, vo.CmdSendme, vo.CmdBeginAck:
+		return transcode(data, src.DecodeDataPayload, dst.EncodeDataPayload)
+	default:
+		return data, nil
+	}
+}
+
+func transcode[T any](data []byte, decode func([]byte) (*T, error), encode func(*T) ([]byte, error)) ([]byte, error) {
+	p, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return encode(p)
+}
+
 // encodePayload serializes any type using gob encoding
 func encodePayload(payload any) ([]byte, error) {
 	var buf bytes.Buffer
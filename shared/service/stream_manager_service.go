@@ -10,6 +10,11 @@ type StreamManagerService interface {
 	Add(id uint16, conn net.Conn)
 	Get(id uint16) (net.Conn, bool)
 	Remove(id uint16)
+	// Detach forgets a stream but leaves its connection open, so it can be
+	// registered again under a stream on another circuit.
+	Detach(id uint16)
+	// Len returns the number of registered streams.
+	Len() int
 	CloseAll()
 }
 
@@ -45,6 +50,18 @@ func (s *streamManagerImpl) Remove(id uint16) {
 	s.mu.Unlock()
 }
 
+func (s *streamManagerImpl) Detach(id uint16) {
+	s.mu.Lock()
+	delete(s.m, id)
+	s.mu.Unlock()
+}
+
+func (s *streamManagerImpl) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.m)
+}
+
 func (s *streamManagerImpl) CloseAll() {
 	s.mu.Lock()
 	for _, conn := range s.m {
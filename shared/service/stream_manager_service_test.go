@@ -119,6 +119,32 @@ func TestStreamManagerService_Remove_NonExistent(t *testing.T) {
 	sm.Remove(999)
 }
 
+func TestStreamManagerService_Detach(t *testing.T) {
+	sm := NewStreamManagerService()
+	conn := newStreamManagerTestConn(1)
+	sm.Add(1, conn)
+
+	sm.Detach(1)
+
+	if conn.IsClosed() {
+		t.Error("Connection should stay open after detaching")
+	}
+	if _, ok := sm.Get(1); ok {
+		t.Error("Connection should not exist after detaching")
+	}
+}
+
+func TestStreamManagerService_Len(t *testing.T) {
+	sm := NewStreamManagerService()
+	sm.Add(1, newStreamManagerTestConn(1))
+	sm.Add(2, newStreamManagerTestConn(2))
+	sm.Remove(1)
+
+	if got := sm.Len(); got != 1 {
+		t.Errorf("Len = %d, want 1", got)
+	}
+}
+
 func TestStreamManagerService_CloseAll(t *testing.T) {
 	sm := NewStreamManagerService()
 
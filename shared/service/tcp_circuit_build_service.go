@@ -1,35 +1,48 @@
 package service
 
 import (
-	"encoding/binary"
 	"fmt"
-	"io"
 	"net"
 
 	"ikedadada/go-ptor/shared/domain/aggregate"
+	"ikedadada/go-ptor/shared/domain/entity"
 	vo "ikedadada/go-ptor/shared/domain/value_object"
 )
 
 // CircuitBuildService abstracts the network operations needed during circuit build.
 type CircuitBuildService interface {
-	// ConnectToRelay connects to the given relay address.
+	// ConnectToRelay connects to the given relay address and negotiates
+	// the protocol version used on the link.
 	ConnectToRelay(addr string) (net.Conn, error)
 	// SendExtendCell writes a cell to the relay.
 	SendExtendCell(conn net.Conn, cell *aggregate.RelayCell) error
-	// WaitForCreatedResponse waits for a CREATED payload from the relay.
+	// WaitForCreatedResponse reads the next cell from the relay and returns
+	// its payload if it is a CREATED cell.
 	WaitForCreatedResponse(conn net.Conn) ([]byte, error)
 	// TeardownCircuit notifies the relay about circuit teardown.
 	TeardownCircuit(conn net.Conn, cid vo.CircuitID) error
 }
 
 // TCPCircuitBuildService implements service.CircuitBuildService over raw TCP connections.
-type TCPCircuitBuildService struct{}
+type TCPCircuitBuildService struct {
+	vnSvc VersionNegotiationService
+	crSvc CellReaderService
+}
 
 // NewTCPCircuitBuildService returns a CircuitBuildService using TCP.
-func NewTCPCircuitBuildService() CircuitBuildService { return &TCPCircuitBuildService{} }
+func NewTCPCircuitBuildService() CircuitBuildService {
+	return NewTCPCircuitBuildServiceWith(NewVersionNegotiationService())
+}
+
+// NewTCPCircuitBuildServiceWith returns a CircuitBuildService using TCP that
+// opens links with the given negotiator.
+func NewTCPCircuitBuildServiceWith(vnSvc VersionNegotiationService) CircuitBuildService {
+	return &TCPCircuitBuildService{vnSvc: vnSvc, crSvc: NewCellReaderService()}
+}
 
-func (TCPCircuitBuildService) ConnectToRelay(addr string) (net.Conn, error) {
-	return net.Dial("tcp", addr)
+// ConnectToRelay dials the relay and negotiates the link protocol version.
+func (s TCPCircuitBuildService) ConnectToRelay(addr string) (net.Conn, error) {
+	return s.vnSvc.Dial(addr)
 }
 
 func (TCPCircuitBuildService) SendExtendCell(conn net.Conn, c *aggregate.RelayCell) error {
@@ -42,23 +55,25 @@ func (TCPCircuitBuildService) SendExtendCell(conn net.Conn, c *aggregate.RelayCe
 	return err
 }
 
-func (TCPCircuitBuildService) WaitForCreatedResponse(conn net.Conn) ([]byte, error) {
-	var hdr [20]byte
-	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+func (s TCPCircuitBuildService) WaitForCreatedResponse(conn net.Conn) ([]byte, error) {
+	_, cell, err := s.crSvc.ReadCell(conn)
+	if err != nil {
 		return nil, err
 	}
-	if vo.CellCommand(hdr[16]) != vo.CmdCreated || vo.ProtocolVersion(hdr[17]) != vo.ProtocolV1 {
-		return nil, fmt.Errorf("invalid created header")
+	switch cell.Cmd {
+	case vo.CmdCreated:
+	case vo.CmdDestroy:
+		return nil, fmt.Errorf("circuit destroyed while waiting for CREATED: %s %s", vo.EndReasonFrom(cell.Payload), vo.EndDetailFrom(cell.Payload))
+	default:
+		return nil, fmt.Errorf("unexpected %s while waiting for CREATED", cell.Cmd)
 	}
-	l := binary.BigEndian.Uint16(hdr[18:20])
-	if l == 0 {
-		return nil, fmt.Errorf("no payload")
+	if cell.Version != entity.LinkVersion(conn) {
+		return nil, fmt.Errorf("created version %s does not match link %s", cell.Version, entity.LinkVersion(conn))
 	}
-	payload := make([]byte, l)
-	if _, err := io.ReadFull(conn, payload); err != nil {
-		return nil, err
+	if len(cell.Payload) == 0 {
+		return nil, fmt.Errorf("no payload")
 	}
-	return payload, nil
+	return cell.Payload, nil
 }
 
 func (TCPCircuitBuildService) TeardownCircuit(conn net.Conn, cid vo.CircuitID) error {
@@ -2,13 +2,13 @@ package service
 
 import (
 	"bytes"
-	"encoding/binary"
 	"io"
 	"net"
 	"testing"
 	"time"
 
 	"ikedadada/go-ptor/shared/domain/aggregate"
+	"ikedadada/go-ptor/shared/domain/entity"
 	vo "ikedadada/go-ptor/shared/domain/value_object"
 )
 
@@ -51,15 +51,16 @@ func (c *circuitBuildTestConn) SetDeadline(t time.Time) error      { return nil
 func (c *circuitBuildTestConn) SetReadDeadline(t time.Time) error  { return nil }
 func (c *circuitBuildTestConn) SetWriteDeadline(t time.Time) error { return nil }
 
+// prepareCell queues a cell in the read buffer
+func (c *circuitBuildTestConn) prepareCell(cmd vo.CellCommand, version vo.ProtocolVersion, payload []byte) {
+	buf, _ := entity.Encode(entity.Cell{Cmd: cmd, Version: version, Payload: payload})
+	c.readBuffer.Write(vo.NewCircuitID().Bytes())
+	c.readBuffer.Write(buf)
+}
+
 // prepareCreatedResponse sets up a mock CREATED response in the read buffer
 func (c *circuitBuildTestConn) prepareCreatedResponse(payload []byte) {
-	var hdr [20]byte
-	hdr[16] = byte(vo.CmdCreated)
-	hdr[17] = byte(vo.ProtocolV1)
-	binary.BigEndian.PutUint16(hdr[18:20], uint16(len(payload)))
-
-	c.readBuffer.Write(hdr[:])
-	c.readBuffer.Write(payload)
+	c.prepareCell(vo.CmdCreated, vo.ProtocolV1, payload)
 }
 
 func TestTCPCircuitBuildService_SendExtendCell(t *testing.T) {
@@ -119,16 +120,8 @@ func TestTCPCircuitBuildService_WaitForCreatedResponse_InvalidHeader(t *testing.
 	svc := NewTCPCircuitBuildService()
 	conn := newCircuitBuildTestConn()
 
-	// Write invalid header (wrong command)
-	var hdr [20]byte
-	hdr[16] = byte(vo.CmdData) // Wrong command
-	hdr[17] = byte(vo.ProtocolV1)
-
-	const testPayloadLength = 4
-	binary.BigEndian.PutUint16(hdr[18:20], testPayloadLength)
-
-	conn.readBuffer.Write(hdr[:])
-	conn.readBuffer.Write([]byte("test"))
+	// Write a cell with the wrong command
+	conn.prepareCell(vo.CmdData, vo.ProtocolV1, []byte("test"))
 
 	_, err := svc.WaitForCreatedResponse(conn)
 	if err == nil {
@@ -140,13 +133,8 @@ func TestTCPCircuitBuildService_WaitForCreatedResponse_NoPayload(t *testing.T) {
 	svc := NewTCPCircuitBuildService()
 	conn := newCircuitBuildTestConn()
 
-	// Write header with zero payload length
-	var hdr [20]byte
-	hdr[16] = byte(vo.CmdCreated)
-	hdr[17] = byte(vo.ProtocolV1)
-	binary.BigEndian.PutUint16(hdr[18:20], 0) // Zero length
-
-	conn.readBuffer.Write(hdr[:])
+	// Write a CREATED cell with zero payload length
+	conn.prepareCell(vo.CmdCreated, vo.ProtocolV1, nil)
 
 	_, err := svc.WaitForCreatedResponse(conn)
 	if err == nil {
@@ -250,3 +238,34 @@ func TestTCPCircuitBuildService_ClosedConnection(t *testing.T) {
 		t.Error("Expected error when reading from closed connection")
 	}
 }
+
+func TestTCPCircuitBuildService_WaitForCreatedResponse_Destroy(t *testing.T) {
+	svc := NewTCPCircuitBuildService()
+	conn := newCircuitBuildTestConn()
+	conn.prepareCell(vo.CmdDestroy, vo.ProtocolV1, nil)
+
+	if _, err := svc.WaitForCreatedResponse(conn); err == nil {
+		t.Error("Expected error when the relay destroys the circuit")
+	}
+}
+
+func TestTCPCircuitBuildService_WaitForCreatedResponse_LinkVersion(t *testing.T) {
+	svc := NewTCPCircuitBuildService()
+	raw := newCircuitBuildTestConn()
+	link := entity.NewLink(raw, vo.ProtocolV2)
+
+	// a v1 cell on a v2 link is rejected
+	raw.prepareCell(vo.CmdCreated, vo.ProtocolV1, []byte("payload"))
+	if _, err := svc.WaitForCreatedResponse(link); err == nil {
+		t.Error("Expected error for version mismatch")
+	}
+
+	raw.prepareCell(vo.CmdCreated, vo.ProtocolV2, []byte("payload"))
+	payload, err := svc.WaitForCreatedResponse(link)
+	if err != nil {
+		t.Fatalf("WaitForCreatedResponse failed: %v", err)
+	}
+	if string(payload) != "payload" {
+		t.Errorf("Payload mismatch: got %q", payload)
+	}
+}
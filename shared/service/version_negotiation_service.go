@@ -0,0 +1,145 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+// ErrNoCommonVersion is returned when the peers share no protocol version.
+var ErrNoCommonVersion = errors.New("no common protocol version")
+
+// ErrLegacyFallbackRefused is returned by Dial when a peer closes the
+// connection on VERSIONS and falling back to v1 is not allowed for it.
+var ErrLegacyFallbackRefused = errors.New("refused v1 fallback")
+
+// versionsTimeout bounds how long the initiator waits for the peer's VERSIONS.
+const versionsTimeout = 10 * time.Second
+
+// VersionNegotiationService runs the VERSIONS exchange that opens every
+// client→relay and relay→relay link. The initiator sends the versions it
+// speaks, the responder answers with its own list, and both sides pick the
+// highest common one. VERSIONS cells always use circuit ID zero and a v1
+// header so that any peer can parse them.
+type VersionNegotiationService interface {
+	// Dial connects to addr and negotiates a version. A peer that closes the
+	// connection instead of answering may predate VERSIONS, but the close may
+	// as well come from an attacker forcing a downgrade. Dial therefore only
+	// redials such a peer as plain v1 when the legacy fallback is enabled and
+	// the peer has never answered VERSIONS before.
+	Dial(addr string) (net.Conn, error)
+	// Initiate sends our VERSIONS cell on conn and waits for the reply.
+	Initiate(conn net.Conn) (*entity.Link, error)
+	// Respond answers the peer's VERSIONS cell received on conn.
+	Respond(conn net.Conn, versions *entity.Cell) (*entity.Link, error)
+}
+
+type versionNegotiationServiceImpl struct {
+	versions       []vo.ProtocolVersion
+	legacyFallback bool
+	crSvc          CellReaderService
+
+	mu       sync.Mutex
+	answered map[string]bool // addresses that answered VERSIONS at least once
+}
+
+// NewVersionNegotiationService returns a negotiator offering every version
+// this node supports. It never falls back to v1 on its own.
+func NewVersionNegotiationService() VersionNegotiationService {
+	return NewVersionNegotiationServiceWith(vo.SupportedProtocolVersions(), false)
+}
+
+// NewVersionNegotiationServiceWith returns a negotiator offering only the
+// given versions, e.g. to pin a node to an older protocol. legacyFallback
+// lets Dial reach peers that predate VERSIONS.
+func NewVersionNegotiationServiceWith(versions []vo.ProtocolVersion, legacyFallback bool) VersionNegotiationService {
+	return &versionNegotiationServiceImpl{versions: versions, legacyFallback: legacyFallback, crSvc: NewCellReaderService(), answered: map[string]bool{}}
+}
+
+func (s *versionNegotiationServiceImpl) Dial(addr string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	link, err := s.Initiate(conn)
+	if err == nil {
+		s.mu.Lock()
+		s.answered[addr] = true
+		s.mu.Unlock()
+		return link, nil
+	}
+	conn.Close()
+	if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	if !s.legacyFallback {
+		log.Printf("peer %s closed during VERSIONS; legacy fallback is disabled", addr)
+		return nil, fmt.Errorf("%w: %s closed during VERSIONS", ErrLegacyFallbackRefused, addr)
+	}
+	s.mu.Lock()
+	answered := s.answered[addr]
+	s.mu.Unlock()
+	if answered {
+		log.Printf("peer %s closed during VERSIONS but answered it before; refusing %s", addr, vo.ProtocolV1)
+		return nil, fmt.Errorf("%w: %s has spoken VERSIONS before", ErrLegacyFallbackRefused, addr)
+	}
+	log.Printf("peer %s closed during VERSIONS, falling back to %s", addr, vo.ProtocolV1)
+	return net.Dial("tcp", addr)
+}
+
+func (s *versionNegotiationServiceImpl) Initiate(conn net.Conn) (*entity.Link, error) {
+	_ = conn.SetDeadline(time.Now().Add(versionsTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := s.send(conn); err != nil {
+		return nil, fmt.Errorf("send versions: %w", err)
+	}
+	_, cell, err := s.crSvc.ReadCell(conn)
+	if err != nil {
+		return nil, fmt.Errorf("read versions: %w", err)
+	}
+	if cell.Cmd != vo.CmdVersions {
+		return nil, fmt.Errorf("expected VERSIONS, got %s", cell.Cmd)
+	}
+	return s.agree(conn, cell)
+}
+
+func (s *versionNegotiationServiceImpl) Respond(conn net.Conn, versions *entity.Cell) (*entity.Link, error) {
+	if versions.Cmd != vo.CmdVersions {
+		return nil, fmt.Errorf("expected VERSIONS, got %s", versions.Cmd)
+	}
+	// Reply even if nothing matches so the initiator learns our versions.
+	if err := s.send(conn); err != nil {
+		return nil, fmt.Errorf("send versions: %w", err)
+	}
+	return s.agree(conn, versions)
+}
+
+func (s *versionNegotiationServiceImpl) send(conn net.Conn) error {
+	payload := make([]byte, len(s.versions))
+	for i, v := range s.versions {
+		payload[i] = byte(v)
+	}
+	cell := &entity.Cell{Cmd: vo.CmdVersions, Version: vo.ProtocolV1, Payload: payload}
+	return cell.SendToConnection(conn, vo.CircuitID{})
+}
+
+func (s *versionNegotiationServiceImpl) agree(conn net.Conn, cell *entity.Cell) (*entity.Link, error) {
+	theirs := make([]vo.ProtocolVersion, len(cell.Payload))
+	for i, b := range cell.Payload {
+		theirs[i] = vo.ProtocolVersion(b)
+	}
+	v, ok := vo.HighestCommonVersion(s.versions, theirs)
+	if !ok {
+		return nil, fmt.Errorf("%w: ours=%v theirs=%v", ErrNoCommonVersion, s.versions, theirs)
+	}
+	log.Printf("negotiated %s with %s", v, conn.RemoteAddr())
+	return entity.NewLink(conn, v), nil
+}
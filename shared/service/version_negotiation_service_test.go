@@ -0,0 +1,188 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"ikedadada/go-ptor/shared/domain/entity"
+	vo "ikedadada/go-ptor/shared/domain/value_object"
+)
+
+func TestVersionNegotiationService_InitiateRespond(t *testing.T) {
+	tests := []struct {
+		name      string
+		initiator []vo.ProtocolVersion
+		responder []vo.ProtocolVersion
+		want      vo.ProtocolVersion
+		wantErr   error
+	}{
+		{"both latest", vo.SupportedProtocolVersions(), vo.SupportedProtocolVersions(), vo.ProtocolV2, nil},
+		{"v1-only responder", vo.SupportedProtocolVersions(), []vo.ProtocolVersion{vo.ProtocolV1}, vo.ProtocolV1, nil},
+		{"v1-only initiator", []vo.ProtocolVersion{vo.ProtocolV1}, vo.SupportedProtocolVersions(), vo.ProtocolV1, nil},
+		{"nothing in common", []vo.ProtocolVersion{vo.ProtocolV2}, []vo.ProtocolVersion{vo.ProtocolV1}, 0, ErrNoCommonVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+
+			type result struct {
+				link *entity.Link
+				err  error
+			}
+			respCh := make(chan result, 1)
+			go func() {
+				_, cell, err := NewCellReaderService().ReadCell(b)
+				if err != nil {
+					respCh <- result{err: err}
+					return
+				}
+				link, err := NewVersionNegotiationServiceWith(tt.responder, false).Respond(b, cell)
+				respCh <- result{link, err}
+			}()
+
+			link, err := NewVersionNegotiationServiceWith(tt.initiator, false).Initiate(a)
+			resp := <-respCh
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) || !errors.Is(resp.err, tt.wantErr) {
+					t.Fatalf("errors = %v / %v, want %v", err, resp.err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || resp.err != nil {
+				t.Fatalf("negotiate: %v / %v", err, resp.err)
+			}
+			if link.Version() != tt.want || resp.link.Version() != tt.want {
+				t.Errorf("versions = %v / %v, want %v", link.Version(), resp.link.Version(), tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionNegotiationService_Initiate_UnexpectedReply(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		_, _, _ = NewCellReaderService().ReadCell(b)
+		c := &entity.Cell{Cmd: vo.CmdDestroy, Version: vo.ProtocolV1}
+		_ = c.SendToConnection(b, vo.NewCircuitID())
+	}()
+	if _, err := NewVersionNegotiationService().Initiate(a); err == nil {
+		t.Fatal("expected error for non-VERSIONS reply")
+	}
+}
+
+// serveLegacyPeer accepts connections on ln like a relay that predates
+// VERSIONS: it drops the first connection on the unknown command and hands
+// any plain v1 retry to accepted.
+func serveLegacyPeer(ln net.Listener, accepted chan<- net.Conn) {
+	c, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	_, _ = io.ReadFull(c, make([]byte, 16+entity.MaxCellSize))
+	c.Close()
+	c, err = ln.Accept()
+	if err != nil {
+		return
+	}
+	accepted <- c
+}
+
+func TestVersionNegotiationService_Dial_LegacyPeer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go serveLegacyPeer(ln, accepted)
+
+	conn, err := NewVersionNegotiationServiceWith(vo.SupportedProtocolVersions(), true).Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if v := entity.LinkVersion(conn); v != vo.ProtocolV1 {
+		t.Errorf("link version = %v, want v1", v)
+	}
+	(<-accepted).Close()
+}
+
+func TestVersionNegotiationService_Dial_LegacyFallbackDisabled(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveLegacyPeer(ln, make(chan net.Conn, 1))
+
+	if _, err := NewVersionNegotiationService().Dial(ln.Addr().String()); !errors.Is(err, ErrLegacyFallbackRefused) {
+		t.Fatalf("err = %v, want %v", err, ErrLegacyFallbackRefused)
+	}
+}
+
+func TestVersionNegotiationService_Dial_DowngradeRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// The peer answers VERSIONS once, then the connection is cut on VERSIONS
+	// as if someone in between wanted to force v1.
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if _, cell, err := NewCellReaderService().ReadCell(c); err == nil {
+			_, _ = NewVersionNegotiationService().Respond(c, cell)
+		}
+		c.Close()
+		serveLegacyPeer(ln, make(chan net.Conn, 1))
+	}()
+
+	vn := NewVersionNegotiationServiceWith(vo.SupportedProtocolVersions(), true)
+	conn, err := vn.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("first dial: %v", err)
+	}
+	conn.Close()
+	if _, err := vn.Dial(ln.Addr().String()); !errors.Is(err, ErrLegacyFallbackRefused) {
+		t.Fatalf("err = %v, want %v", err, ErrLegacyFallbackRefused)
+	}
+}
+
+func TestVersionNegotiationService_Dial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, cell, err := NewCellReaderService().ReadCell(c)
+		if err != nil {
+			return
+		}
+		_, _ = NewVersionNegotiationService().Respond(c, cell)
+	}()
+
+	conn, err := NewVersionNegotiationService().Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if v := entity.LinkVersion(conn); v != vo.ProtocolLatest {
+		t.Errorf("link version = %v, want %v", v, vo.ProtocolLatest)
+	}
+}